@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Attach command flag names
+const (
+	artifactTypeStr = "artifact-type"
+)
+
+var attach = &cli.Command{
+	Name:      "attach",
+	Usage:     "attach local files as an artifact referring to an existing manifest",
+	ArgsUsage: "<login-server> <file>[:<media-type>]...",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     subjectStr,
+			Usage:    "tag or digest of the manifest in the repository the artifact refers to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  artifactTypeStr,
+			Usage: "artifact type of the pushed artifact",
+			Value: registry.DefaultAttachArtifactType,
+		},
+		outFlag,
+	}, commonFlags...),
+	Action: runAttach,
+}
+
+func runAttach(ctx *cli.Context) (err error) {
+	files := parseFiles(ctx.Args().Tail())
+	if len(files) == 0 {
+		return errors.New("at least one file required")
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	if proxy.Repository == "" {
+		return errors.New("repository required to attach to a manifest")
+	}
+	defer reportMetrics(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	desc, err := proxy.Attach(ctx.Context, proxy.Repository, ctx.String(subjectStr), ctx.String(artifactTypeStr), files)
+	if err != nil {
+		return err
+	}
+	fmt.Println(desc.Digest)
+	return nil
+}
+
+// parseFiles parses file arguments, each a path optionally followed by a colon and the media type
+// of the file. A suffix without a slash is part of the path, not a media type.
+func parseFiles(args []string) []registry.FileContent {
+	files := make([]registry.FileContent, 0, len(args))
+	for _, arg := range args {
+		file := registry.FileContent{Path: arg}
+		if i := strings.LastIndex(arg, ":"); i > 0 && strings.Contains(arg[i+1:], "/") {
+			file.Path, file.MediaType = arg[:i], arg[i+1:]
+		}
+		files = append(files, file)
+	}
+	return files
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Benchmark command flag names
+const (
+	blobSizeStr  = "blob-size"
+	chunkSizeStr = "chunk-size"
+	countStr     = "count"
+)
+
+var benchmark = &cli.Command{
+	Name:      "benchmark",
+	Usage:     "compare the elapsed time and throughput of monolithic and chunked blob uploads",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.Int64Flag{
+			Name:  blobSizeStr,
+			Usage: "size in bytes of every uploaded blob",
+			Value: 10 << 20,
+		},
+		&cli.Int64SliceFlag{
+			Name:  chunkSizeStr,
+			Usage: "size in bytes of the chunks of chunked uploads, can be repeated to compare sizes",
+			Value: cli.NewInt64Slice(5 << 20),
+		},
+		&cli.IntFlag{
+			Name:  countStr,
+			Usage: "number of uploads with every method",
+			Value: 3,
+		},
+	}, commonFlags...),
+	Action: runBenchmark,
+}
+
+func runBenchmark(ctx *cli.Context) error {
+	if ctx.Int(countStr) <= 0 {
+		return fmt.Errorf("invalid upload count %d", ctx.Int(countStr))
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+
+	ctxu := ctx.Context
+	repo := repository(proxy)
+	if proxy.Repository == "" {
+		// the blobs are only needed for the measurement, the generated repository is deleted
+		defer deleteRepository(ctxu, proxy, repo)
+	}
+
+	result, err := proxy.GenerateUploadBenchmark(ctxu, repo, ctx.Int64(blobSizeStr), ctx.Int64Slice(chunkSizeStr), ctx.Int(countStr))
+	if err != nil {
+		return err
+	}
+	for _, stats := range result.Stats {
+		logger.Info().Msgf("%s: %d uploads of %d bytes, min: %v, mean: %v, max: %v, throughput: %.2f bytes/s",
+			stats.Method(), len(stats.Elapsed), result.Size, stats.Min(), stats.Mean(), stats.Max(), stats.Throughput(result.Size))
+	}
+	return nil
+}
+
+// deleteRepository deletes the repository, only warning if it fails.
+func deleteRepository(ctx context.Context, proxy *registry.Proxy, repo string) {
+	if err := proxy.DeleteRepository(ctx, repo); err != nil {
+		logger.Warn().Msgf("Failed to delete %s: %v", repo, err)
+		return
+	}
+	logger.Info().Msgf("Deleted %s", repo)
+}
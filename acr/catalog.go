@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Catalog command flag names
+const (
+	pageSizeStr = "page-size"
+	prefixStr   = "prefix"
+)
+
+var catalog = &cli.Command{
+	Name:      "catalog",
+	Usage:     "list the repositories of the registry",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  pageSizeStr,
+			Usage: "number of repositories requested per page",
+			Value: 100,
+		},
+		&cli.StringFlag{
+			Name:  prefixStr,
+			Usage: "only list repositories starting with the prefix",
+		},
+	}, commonFlags...),
+	Action: runCatalog,
+}
+
+func runCatalog(ctx *cli.Context) (err error) {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+
+	ctxu := ctx.Context
+	repos, err := proxy.ListRepositories(ctxu, ctx.Int(pageSizeStr))
+	if err != nil {
+		return err
+	}
+
+	prefix := ctx.String(prefixStr)
+	for _, repo := range repos {
+		if strings.HasPrefix(repo, prefix) {
+			fmt.Println(repo)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Cleanup command flag names
+const (
+	keepStr   = "keep"
+	dryRunStr = "dry-run"
+)
+
+var cleanup = &cli.Command{
+	Name:      "cleanup",
+	Usage:     "delete the generated repositories of the registry, keeping the newest ones",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:     keepStr,
+			Usage:    "`number` of the newest generated repositories to keep",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  dryRunStr,
+			Usage: "report the repositories that would be deleted without deleting them",
+		},
+		&cli.IntFlag{
+			Name:  pageSizeStr,
+			Usage: "number of repositories requested per page",
+			Value: 100,
+		},
+		yesFlag,
+	}, commonFlags...),
+	Action: runCleanup,
+}
+
+func runCleanup(ctx *cli.Context) (err error) {
+	keep := ctx.Int(keepStr)
+	if keep < 0 {
+		return fmt.Errorf("invalid number of repositories to keep %d", keep)
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+
+	ctxu := ctx.Context
+	repos, err := proxy.ListRepositories(ctxu, ctx.Int(pageSizeStr))
+	if err != nil {
+		return err
+	}
+
+	generated := registry.GeneratedRepositories(repos)
+	if keep > len(generated) {
+		keep = len(generated)
+	}
+	for _, repo := range generated[:keep] {
+		logger.Info().Msgf("Kept %s, created %v", repo.Name, repo.Created.UTC())
+	}
+
+	if !ctx.Bool(dryRunStr) {
+		names := make([]string, 0, len(generated)-keep)
+		for _, repo := range generated[keep:] {
+			names = append(names, repo.Name)
+		}
+		if err := confirm(ctx, fmt.Sprintf("delete %d repositories of %s", len(names), loginServerArg(ctx, 0)), names); err != nil {
+			return err
+		}
+	}
+
+	var deleted int
+	var errs []error
+	for _, repo := range generated[keep:] {
+		if ctx.Bool(dryRunStr) {
+			logger.Info().Msgf("Would delete %s, created %v", repo.Name, repo.Created.UTC())
+			continue
+		}
+		if err := proxy.DeleteRepository(ctxu, repo.Name); err != nil {
+			logger.Error().Msgf("Failed to delete %s: %v", repo.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info().Msgf("Deleted %s, created %v", repo.Name, repo.Created.UTC())
+		deleted++
+	}
+
+	logger.Info().Msgf("Kept %d and deleted %d of %d generated repositories", keep, deleted, len(generated))
+	return errors.Join(errs...)
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
 	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v2"
 )
@@ -20,13 +28,93 @@ const (
 	passwordStr     = "password"
 	dataEndpointStr = "dataendpoint"
 	traceStr        = "trace"
+	quietStr        = "quiet"
+	logLevelStr     = "log-level"
+	logFileStr      = "log-file"
+	otelEndpointStr = "otel-endpoint"
+	redactAuthStr   = "redact-auth"
+	traceFormatStr  = "trace-format"
+	seedStr         = "seed"
+	tagStr          = "tag"
+	repoStr         = "repo"
+	metricsStr      = "metrics"
+	headerStr       = "header"
+	configStr       = "config"
+
+	inlineConfigStr      = "inline-config"
+	inlineLayersStr      = "inline-small-layers"
+	inlineThresholdStr   = "inline-threshold"
+	maxManifestSizeStr   = "max-manifest-size"
+	referrersPageSizeStr = "referrers-page-size"
+	dumpManifestsStr     = "dump-manifests"
+	normalizeJSONStr     = "normalize-json"
+	skipInlinedUploadStr = "skip-inlined-upload"
+	manifestFirstStr     = "manifest-first"
+	headBeforeGetStr     = "head-before-get"
+	pullRangeStr         = "pull-range-size"
+
+	insecureLoginStr = "insecure-login-server"
+	insecureDataStr  = "insecure-data-endpoint"
+	referenceAnnStr  = "reference-annotations"
+	passwordStdinStr = "password-stdin"
+	passwordFileStr  = "password-file"
+
+	aadStr           = "aad"
+	tenantStr        = "tenant"
+	clientIDStr      = "client-id"
+	clientSecretStr  = "client-secret"
+	identityTokenStr = "identity-token"
+
+	msiStr                = "msi"
+	msiEndpointStr        = "msi-endpoint"
+	federatedTokenFileStr = "federated-token-file"
+
+	ifNotExistsStr  = "if-not-exists"
+	progressStr     = "progress"
+	foreignLayerStr = "foreign-layer"
+	acceptStr       = "accept"
+	compressStr     = "compress"
+	rpsStr          = "rps"
+	emptyConfigStr  = "empty-config-type"
+	validateStr     = "validate-schema"
+	http1Str        = "http1"
+	h2cStr          = "h2c"
+	maxIdleStr      = "max-idle-conns"
+	maxIdleHostStr  = "max-idle-conns-per-host"
+	idleTimeoutStr  = "idle-conn-timeout"
+	noKeepAliveStr  = "disable-keep-alives"
+	requestTimeStr  = "request-timeout"
+	uploadTimeStr   = "upload-timeout"
+	stallTimeStr    = "stall-timeout"
+	dnsTimeStr      = "dns-timeout"
+	recordStr       = "record"
+	allowCustomStr  = "allow-custom-media-types"
+	allowedTypeStr  = "allowed-media-type"
+	maxRetriesStr   = "max-retries"
+	retryDelayStr   = "retry-base-delay"
+	retryElapsedStr = "max-retry-elapsed"
+	layerStr        = "layer"
+	decodeStr       = "decode-content"
+	acceptEncStr    = "accept-encoding"
+	emptyHistoryStr = "empty-layer-history"
+	traceConnStr    = "trace-connections"
+	versionProbeStr = "registry-version"
 )
 
-// commonFlags is a collection of cli flags common to all commands.
-var commonFlags = []cli.Flag{
+// commonFlags is a collection of cli flags common to all commands, falling back to their
+// environment variables.
+var commonFlags = withEnvVars([]cli.Flag{
 	&cli.BoolFlag{
 		Name:  insecureStr,
-		Usage: "enable remote access over HTTP",
+		Usage: "enable remote access over HTTP to the login server and the data endpoint, overriding the per endpoint flags",
+	},
+	&cli.BoolFlag{
+		Name:  insecureLoginStr,
+		Usage: "access the login server over HTTP",
+	},
+	&cli.BoolFlag{
+		Name:  insecureDataStr,
+		Usage: "access the data endpoint over HTTP, redirects to it are made over HTTPS otherwise",
 	},
 	&cli.StringFlag{
 		Name:    userNameStr,
@@ -38,6 +126,14 @@ var commonFlags = []cli.Flag{
 		Aliases: []string{"p"},
 		Usage:   "login password",
 	},
+	&cli.BoolFlag{
+		Name:  passwordStdinStr,
+		Usage: "read the login password from stdin",
+	},
+	&cli.StringFlag{
+		Name:  passwordFileStr,
+		Usage: "read the login password from `file`",
+	},
 	&cli.StringFlag{
 		Name:    dataEndpointStr,
 		Aliases: []string{"d"},
@@ -47,7 +143,232 @@ var commonFlags = []cli.Flag{
 		Name:  basicAuthStr,
 		Usage: "use basic auth mode for data operations",
 	},
-}
+	&cli.Int64Flag{
+		Name:  seedStr,
+		Usage: "seed for deterministic layer content and digests",
+	},
+	&cli.BoolFlag{
+		Name:  metricsStr,
+		Usage: "print request and throughput metrics at the end of the command",
+	},
+	&cli.StringSliceFlag{
+		Name:  headerStr,
+		Usage: "extra `key=value` header sent with every request, can be repeated",
+	},
+	&cli.StringFlag{
+		Name:  configStr,
+		Usage: "YAML `file` describing the generation scenario",
+	},
+	&cli.StringFlag{
+		Name:  repoStr,
+		Usage: "repository to push to, defaults to a new time based repository, tags remain time based across runs unless --tag is given",
+	},
+	&cli.BoolFlag{
+		Name:  inlineConfigStr,
+		Usage: "embed small configs in the descriptor data field",
+	},
+	&cli.BoolFlag{
+		Name:  inlineLayersStr,
+		Usage: "embed small layers in the descriptor data field",
+	},
+	&cli.Int64Flag{
+		Name:  inlineThresholdStr,
+		Usage: "maximum size in bytes of inlined content",
+		Value: 1024,
+	},
+	&cli.Int64Flag{
+		Name:  maxManifestSizeStr,
+		Usage: "maximum size in bytes of the manifests, indexes and referrers responses read from the registry",
+		Value: 4 << 20,
+	},
+	&cli.IntFlag{
+		Name:  referrersPageSizeStr,
+		Usage: "number of referrers requested per page of the referrers API, following the Link header across pages, the registry default if not set",
+	},
+	&cli.BoolFlag{
+		Name:  skipInlinedUploadStr,
+		Usage: "do not upload inlined content as a separate blob",
+	},
+	&cli.BoolFlag{
+		Name:  manifestFirstStr,
+		Usage: "push manifests before the config and layers they reference, logging whether the registry rejects them or accepts them and serves them once the blobs are uploaded",
+	},
+	&cli.BoolFlag{
+		Name:  headBeforeGetStr,
+		Usage: "request the digest and size of every pulled blob with a HEAD request before the GET, failing if the content served by the GET does not match",
+	},
+	&cli.Int64Flag{
+		Name:  pullRangeStr,
+		Usage: "pull blobs in chunks of `bytes` with Range requests, failing unless every chunk is served as partial content covering exactly its range",
+	},
+	&cli.BoolFlag{
+		Name:  normalizeJSONStr,
+		Usage: "canonicalize pushed manifests and indexes, sorting their keys and removing insignificant whitespace, before computing their digest",
+	},
+	&cli.StringFlag{
+		Name:  dumpManifestsStr,
+		Usage: "write the exact content of every pushed manifest, index and config to a file of `dir` named after its digest",
+	},
+	&cli.BoolFlag{
+		Name:  aadStr,
+		Usage: "authenticate with an Azure AD service principal",
+	},
+	&cli.StringFlag{
+		Name:  tenantStr,
+		Usage: "Azure AD tenant of the service principal",
+	},
+	&cli.StringFlag{
+		Name:  clientIDStr,
+		Usage: "client id of the service principal",
+	},
+	&cli.StringFlag{
+		Name:  clientSecretStr,
+		Usage: "client secret of the service principal",
+	},
+	&cli.BoolFlag{
+		Name:  msiStr,
+		Usage: "authenticate with the managed identity of the Azure host, the user assigned identity of --" + clientIDStr + " if set, or with the --" + federatedTokenFileStr + " of a workload identity",
+	},
+	&cli.StringFlag{
+		Name:  msiEndpointStr,
+		Usage: "`url` of the token endpoint of the instance metadata service used for managed identity auth",
+		Value: registry.DefaultMSIEndpoint,
+	},
+	&cli.StringFlag{
+		Name:  federatedTokenFileStr,
+		Usage: "`file` holding an OIDC token federated with the --" + clientIDStr + " of the --" + tenantStr + ", used for managed identity auth instead of the instance metadata service, defaults to $AZURE_FEDERATED_TOKEN_FILE",
+	},
+	&cli.StringFlag{
+		Name:  identityTokenStr,
+		Usage: "registry identity token, such as the one stored by docker login, used as the bearer refresh token",
+	},
+	&cli.BoolFlag{
+		Name:  ifNotExistsStr,
+		Usage: "skip pushing to tags that already exist instead of overwriting them",
+	},
+	&cli.BoolFlag{
+		Name:  progressStr,
+		Usage: "report upload progress when stdout is a terminal",
+	},
+	&cli.StringSliceFlag{
+		Name:  foreignLayerStr,
+		Usage: "add a non-distributable layer hosted at `url` to generated images, can be repeated",
+	},
+	&cli.StringSliceFlag{
+		Name:  acceptStr,
+		Usage: "`media type` accepted when fetching manifests, can be repeated, defaults to all OCI and Docker manifest types",
+	},
+	&cli.StringSliceFlag{
+		Name:  layerStr,
+		Usage: "layer of generated images as `mediaType[:size]`, the media type being tar, gzip, zstd or any media type, can be repeated",
+	},
+	&cli.BoolFlag{
+		Name:  compressStr,
+		Usage: "generate gzip compressed layers",
+	},
+	&cli.IntFlag{
+		Name:  emptyHistoryStr,
+		Usage: "`number` of empty_layer history entries of generated image configs, following the one entry per layer",
+	},
+	&cli.BoolFlag{
+		Name:  traceConnStr,
+		Usage: "record the connection of every request in the trace log, including its TLS version, cipher suite and server certificate",
+	},
+	&cli.BoolFlag{
+		Name:  versionProbeStr,
+		Usage: "call the base endpoint of the registry before starting to report its API version and auth challenge, failing if it does not answer as a v2 registry or rejects the credentials",
+	},
+	&cli.BoolFlag{
+		Name:  decodeStr,
+		Usage: "request gzip and zstd encoded responses and decode them, pulled blobs must match their digest as received or once decoded",
+	},
+	&cli.StringFlag{
+		Name:  acceptEncStr,
+		Usage: "`encoding` sent as the Accept-Encoding of GET requests, such as gzip or identity, encoded responses are decoded and pulled blobs verified to match once decoded",
+	},
+	&cli.Float64Flag{
+		Name:  rpsStr,
+		Usage: "maximum number of requests per second, unlimited if not set",
+	},
+	&cli.IntFlag{
+		Name:  maxRetriesStr,
+		Usage: "maximum number of retries of throttled and failed requests",
+	},
+	&cli.DurationFlag{
+		Name:  retryDelayStr,
+		Usage: "upper bound of the first jittered retry delay, doubled for every retry",
+		Value: 500 * time.Millisecond,
+	},
+	&cli.DurationFlag{
+		Name:  retryElapsedStr,
+		Usage: "maximum time spent on a request including its retries, unbounded if not set",
+	},
+	&cli.StringSliceFlag{
+		Name:  referenceAnnStr,
+		Usage: "also name the subject of artifacts with annotations following the `convention`, oci or docker, can be repeated",
+	},
+	&cli.StringFlag{
+		Name:  emptyConfigStr,
+		Usage: "convention of empty artifact configs, one of scratch, empty, unknown or artifact-type",
+		Value: string(registry.EmptyConfigScratch),
+	},
+	&cli.BoolFlag{
+		Name:  validateStr,
+		Usage: "check generated manifests against the OCI JSON schema before pushing them",
+	},
+	&cli.BoolFlag{
+		Name:  http1Str,
+		Usage: "force HTTP/1.1, disabling HTTP/2",
+	},
+	&cli.BoolFlag{
+		Name:  h2cStr,
+		Usage: "force HTTP/2 over plaintext connections, requires --insecure",
+	},
+	&cli.IntFlag{
+		Name:  maxIdleStr,
+		Usage: "maximum number of idle connections across all hosts",
+	},
+	&cli.IntFlag{
+		Name:  maxIdleHostStr,
+		Usage: "maximum number of idle connections per host",
+	},
+	&cli.DurationFlag{
+		Name:  idleTimeoutStr,
+		Usage: "how long idle connections are kept open",
+	},
+	&cli.DurationFlag{
+		Name:  requestTimeStr,
+		Usage: "timeout of every request but blob uploads, including token requests, unbounded by default",
+	},
+	&cli.DurationFlag{
+		Name:  uploadTimeStr,
+		Usage: "timeout of every blob upload request, unbounded by default",
+	},
+	&cli.DurationFlag{
+		Name:  stallTimeStr,
+		Usage: "cancel a blob upload once none of its bytes are sent for this long, even though its connection is open, disabled by default",
+	},
+	&cli.DurationFlag{
+		Name:  dnsTimeStr,
+		Usage: "timeout of resolving the registry host names, unbounded by default",
+	},
+	&cli.BoolFlag{
+		Name:  noKeepAliveStr,
+		Usage: "open a new connection for every request",
+	},
+	&cli.StringFlag{
+		Name:  recordStr,
+		Usage: "save every request and response to `file` for offline replay",
+	},
+	&cli.BoolFlag{
+		Name:  allowCustomStr,
+		Usage: "do not warn about media types that are not OCI, Docker or explicitly allowed media types",
+	},
+	&cli.StringSliceFlag{
+		Name:  allowedTypeStr,
+		Usage: "`media type` accepted without warning in addition to the OCI and Docker media types, can be repeated",
+	},
+})
 
 var (
 	logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().Timestamp().Logger()
@@ -55,10 +376,44 @@ var (
 
 // proxy creates an new proxy instance from context specific arguments and flags.
 func proxy(ctx *cli.Context) (*registry.Proxy, error) {
-	if ctx.Bool(traceStr) {
-		logger = logger.With().Logger().Level(zerolog.TraceLevel)
-	} else {
-		logger = logger.With().Logger().Level(zerolog.InfoLevel)
+	opts, err := options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newProxy(ctx, opts)
+}
+
+// newProxy creates a new proxy instance from the options, which it validates, and probes the
+// registry version if requested.
+func newProxy(ctx *cli.Context, opts *registry.Options) (*registry.Proxy, error) {
+	proxy, err := registry.NewProxy(opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Bool(versionProbeStr) {
+		result, err := ping(ctx.Context, proxy)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info().Msgf("Registry %s", result)
+	}
+	return proxy, nil
+}
+
+// options creates the proxy options from context specific arguments and flags.
+// The login server is the first argument, or given by the environment.
+func options(ctx *cli.Context) (*registry.Options, error) {
+	return loginServerOptions(ctx, loginServerArg(ctx, 0))
+}
+
+// loginServerOptions creates the proxy options for the login server from context specific flags.
+func loginServerOptions(ctx *cli.Context, loginServer string) (*registry.Options, error) {
+	level, err := logLevel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if logger, err = newLogger(level, ctx.String(logFileStr)); err != nil {
+		return nil, err
 	}
 
 	username, password, basicAuthMode, err := getAuth(ctx)
@@ -66,28 +421,242 @@ func proxy(ctx *cli.Context) (*registry.Proxy, error) {
 		return nil, err
 	}
 
-	loginServer, dataEndpoint, err := resolveAll(ctx)
+	loginServer, dataEndpoint, err := resolveAll(ctx, loginServer)
 	if err != nil {
 		return nil, err
 	}
 
-	return registry.NewProxy(
-		&registry.Options{
-			LoginServer:   loginServer,
-			Username:      username,
-			Password:      password,
-			DataEndpoint:  dataEndpoint,
-			Insecure:      ctx.Bool(insecureStr),
-			BasicAuthMode: basicAuthMode,
+	headers, err := getHeaders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := parseLayers(ctx.StringSlice(layerStr))
+	if err != nil {
+		return nil, err
+	}
+	if n := ctx.Int(emptyHistoryStr); n < 0 {
+		return nil, fmt.Errorf("invalid number of empty layer history entries %d", n)
+	}
+
+	var seed *int64
+	if ctx.IsSet(seedStr) {
+		s := ctx.Int64(seedStr)
+		seed = &s
+	}
+
+	opts := &registry.Options{
+		LoginServer:   loginServer,
+		Username:      username,
+		Password:      password,
+		IdentityToken: ctx.String(identityTokenStr),
+		DataEndpoint:  dataEndpoint,
+		Insecure:      ctx.Bool(insecureStr),
+		BasicAuthMode: basicAuthMode,
+		Tag:           ctx.String(tagStr),
+		UserAgent:     fmt.Sprintf("image-gen-test/%s", Version),
+		Headers:       headers,
+		Seed:          seed,
+		Layers:        layers,
+
+		InlineConfig:      ctx.Bool(inlineConfigStr),
+		InlineSmallLayers: ctx.Bool(inlineLayersStr),
+		InlineThreshold:   ctx.Int64(inlineThresholdStr),
+		MaxManifestSize:   ctx.Int64(maxManifestSizeStr),
+		ReferrersPageSize: ctx.Int(referrersPageSizeStr),
+		DumpManifestsDir:  ctx.String(dumpManifestsStr),
+		NormalizeJSON:     ctx.Bool(normalizeJSONStr),
+		SkipInlinedUpload: ctx.Bool(skipInlinedUploadStr),
+		ManifestFirst:     ctx.Bool(manifestFirstStr),
+		HeadBeforeGet:     ctx.Bool(headBeforeGetStr),
+		PullRangeSize:     ctx.Int64(pullRangeStr),
+		IfNotExists:       ctx.Bool(ifNotExistsStr),
+		ForeignLayerURLs:  ctx.StringSlice(foreignLayerStr),
+		Accept:            ctx.StringSlice(acceptStr),
+		Compress:          ctx.Bool(compressStr),
+		RPS:               ctx.Float64(rpsStr),
+		Retry: rhttp.RetryPolicy{
+			MaxRetries: ctx.Int(maxRetriesStr),
+			BaseDelay:  ctx.Duration(retryDelayStr),
+			MaxElapsed: ctx.Duration(retryElapsedStr),
 		},
-		logger)
+		EmptyConfigType:     registry.EmptyConfigType(ctx.String(emptyConfigStr)),
+		ValidateSchema:      ctx.Bool(validateStr),
+		HTTP1:               ctx.Bool(http1Str),
+		H2C:                 ctx.Bool(h2cStr),
+		MaxIdleConns:        ctx.Int(maxIdleStr),
+		MaxIdleConnsPerHost: ctx.Int(maxIdleHostStr),
+		IdleConnTimeout:     ctx.Duration(idleTimeoutStr),
+		DisableKeepAlives:   ctx.Bool(noKeepAliveStr),
+		RequestTimeout:      ctx.Duration(requestTimeStr),
+		UploadTimeout:       ctx.Duration(uploadTimeStr),
+		StallTimeout:        ctx.Duration(stallTimeStr),
+		DNSTimeout:          ctx.Duration(dnsTimeStr),
+
+		AllowedMediaTypes:     ctx.StringSlice(allowedTypeStr),
+		AllowCustomMediaTypes: ctx.Bool(allowCustomStr),
+		InsecureLoginServer:   ctx.Bool(insecureLoginStr),
+		InsecureDataEndpoint:  ctx.Bool(insecureDataStr),
+		Tracer:                tracer(),
+		LogAuthorization:      !ctx.Bool(redactAuthStr),
+		DecodeContent:         ctx.Bool(decodeStr),
+		AcceptEncoding:        ctx.String(acceptEncStr),
+		EmptyLayerHistory:     ctx.Int(emptyHistoryStr),
+		TraceConnections:      ctx.Bool(traceConnStr),
+		TraceFormat:           rhttp.TraceFormat(ctx.String(traceFormatStr)),
+	}
+	for _, a := range ctx.StringSlice(referenceAnnStr) {
+		opts.ReferenceAnnotations = append(opts.ReferenceAnnotations, registry.ReferenceAnnotations(a))
+	}
+	if ctx.String(recordStr) != "" {
+		opts.Recorder = &rhttp.Recorder{}
+	}
+
+	if ctx.Bool(progressStr) {
+		if progress := newConsoleProgress(); progress != nil {
+			opts.Progress = progress
+		}
+	}
+
+	if ctx.Bool(aadStr) {
+		if username != "" {
+			return nil, errors.New("cannot use AAD auth with username and password")
+		}
+		if opts.IdentityToken != "" {
+			return nil, errors.New("cannot use AAD auth with an identity token")
+		}
+		opts.AAD = &registry.AADOptions{
+			TenantID:     ctx.String(tenantStr),
+			ClientID:     ctx.String(clientIDStr),
+			ClientSecret: ctx.String(clientSecretStr),
+		}
+	}
+
+	if ctx.Bool(msiStr) {
+		switch {
+		case opts.AAD != nil:
+			return nil, errors.New("cannot use managed identity auth with AAD service principal auth")
+		case username != "":
+			return nil, errors.New("cannot use managed identity auth with username and password")
+		case opts.IdentityToken != "":
+			return nil, errors.New("cannot use managed identity auth with an identity token")
+		}
+		opts.AAD = msiOptions(ctx)
+	} else if ctx.IsSet(federatedTokenFileStr) {
+		return nil, fmt.Errorf("--%s requires --%s", federatedTokenFileStr, msiStr)
+	}
+
+	if path := ctx.String(configStr); path != "" {
+		s, err := loadScenario(path)
+		if err != nil {
+			return nil, err
+		}
+		s.apply(opts)
+	}
+	if repo := ctx.String(repoStr); repo != "" {
+		opts.Repository = repo
+	}
+
+	return opts, nil
+}
+
+// msiOptions returns the managed identity credentials. Like the Azure SDKs, a workload identity
+// is configured by the AZURE_FEDERATED_TOKEN_FILE, AZURE_CLIENT_ID and AZURE_TENANT_ID variables
+// when the flags are not set.
+func msiOptions(ctx *cli.Context) *registry.AADOptions {
+	opts := &registry.AADOptions{
+		ManagedIdentity:    true,
+		MSIEndpoint:        ctx.String(msiEndpointStr),
+		TenantID:           ctx.String(tenantStr),
+		ClientID:           ctx.String(clientIDStr),
+		ClientSecret:       ctx.String(clientSecretStr),
+		FederatedTokenFile: ctx.String(federatedTokenFileStr),
+	}
+	if opts.FederatedTokenFile != "" {
+		return opts
+	}
+	if opts.FederatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); opts.FederatedTokenFile != "" {
+		if opts.ClientID == "" {
+			opts.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if opts.TenantID == "" {
+			opts.TenantID = os.Getenv("AZURE_TENANT_ID")
+		}
+	}
+	return opts
+}
+
+// reportCancelled logs the manifests pushed before the command was cancelled, if it was.
+func reportCancelled(ctx *cli.Context, proxy *registry.Proxy) {
+	if ctx.Context.Err() == nil {
+		return
+	}
+	pushed := proxy.Pushed().Descriptors
+	logger.Warn().Msgf("Cancelled after pushing %d manifests", len(pushed))
+	for _, desc := range pushed {
+		logger.Warn().Msgf("Pushed %s:%s (%s)", desc.Repository, desc.Reference, desc.Digest)
+	}
+}
+
+// logLevel returns the log level selected by the global flags. An explicit --log-level takes
+// precedence over --quiet, which takes precedence over --trace.
+func logLevel(ctx *cli.Context) (zerolog.Level, error) {
+	switch {
+	case ctx.IsSet(logLevelStr):
+		level, err := zerolog.ParseLevel(ctx.String(logLevelStr))
+		if err != nil {
+			return zerolog.NoLevel, fmt.Errorf("invalid log level %q: %w", ctx.String(logLevelStr), err)
+		}
+		return level, nil
+	case ctx.Bool(quietStr):
+		return zerolog.ErrorLevel, nil
+	case ctx.Bool(traceStr):
+		return zerolog.TraceLevel, nil
+	default:
+		return zerolog.InfoLevel, nil
+	}
+}
+
+// reportMetrics logs the request metrics collected by the proxy and saves the recorded
+// requests, if requested.
+func reportMetrics(ctx *cli.Context, proxy *registry.Proxy) {
+	if path := ctx.String(recordStr); path != "" {
+		if err := proxy.Recorder.Save(path); err != nil {
+			logger.Error().Msgf("Failed to save the recording: %v", err)
+		}
+	}
+	if !ctx.Bool(metricsStr) {
+		return
+	}
+	logger.Info().Msgf("Metrics: %v", proxy.Metrics())
+}
+
+// repository returns the configured repository or a new time based repository name.
+func repository(proxy *registry.Proxy) string {
+	if proxy.Repository != "" {
+		return proxy.Repository
+	}
+	return registry.NewRepositoryName()
 }
 
 // getAuth gets authentication information from context.
 func getAuth(ctx *cli.Context) (username, password string, basicAuthMode bool, err error) {
 	username = ctx.String(userNameStr)
-	password = ctx.String(passwordStr)
 	basicAuthMode = ctx.Bool(basicAuthStr)
+	if password, err = readPassword(ctx); err != nil {
+		return
+	}
+
+	if ctx.String(identityTokenStr) != "" {
+		if username != "" || password != "" {
+			err = errors.New("cannot use an identity token with username and password")
+			return
+		}
+		if basicAuthMode {
+			err = errors.New("identity token requires bearer auth, cannot use basic auth")
+			return
+		}
+	}
 
 	if username != "" && password == "" {
 		err = errors.New("password required with username")
@@ -107,21 +676,103 @@ func getAuth(ctx *cli.Context) (username, password string, basicAuthMode bool, e
 	return username, password, basicAuthMode, nil
 }
 
-// resolveAll attempts to resolve the endpoints specified in the context.
-func resolveAll(ctx *cli.Context) (loginServer, dataEndpoint string, err error) {
+// readPassword returns the password given with exactly one of --password, --password-stdin
+// or --password-file, if any. Trailing newlines of the stdin or file input are trimmed.
+func readPassword(ctx *cli.Context) (string, error) {
+	sources := 0
+	for _, set := range []bool{ctx.String(passwordStr) != "", ctx.Bool(passwordStdinStr), ctx.String(passwordFileStr) != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", fmt.Errorf("only one of --%s, --%s and --%s can be used", passwordStr, passwordStdinStr, passwordFileStr)
+	}
+
+	switch {
+	case ctx.Bool(passwordStdinStr):
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("read password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	case ctx.String(passwordFileStr) != "":
+		data, err := os.ReadFile(ctx.String(passwordFileStr))
+		if err != nil {
+			return "", fmt.Errorf("read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return ctx.String(passwordStr), nil
+}
+
+// getHeaders parses the extra request headers from context.
+func getHeaders(ctx *cli.Context) (http.Header, error) {
+	headers := http.Header{}
+	for _, h := range ctx.StringSlice(headerStr) {
+		key, value, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", h)
+		}
+		headers.Add(strings.TrimSpace(key), value)
+	}
+	return headers, nil
+}
+
+// layerMediaTypes maps the layer media type shorthands to media types.
+var layerMediaTypes = map[string]string{
+	"tar":  ociimagespec.MediaTypeImageLayer,
+	"gzip": ociimagespec.MediaTypeImageLayerGzip,
+	"zstd": ociimagespec.MediaTypeImageLayerZstd,
+}
+
+// parseLayers parses layer specs formatted as mediaType[:size].
+func parseLayers(values []string) ([]registry.LayerSpec, error) {
+	var layers []registry.LayerSpec
+	for _, value := range values {
+		spec := registry.LayerSpec{MediaType: value}
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			size, err := strconv.ParseInt(value[i+1:], 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid layer %q, expected mediaType[:size]", value)
+			}
+			spec = registry.LayerSpec{MediaType: value[:i], Size: size}
+		}
+		if mediaType, ok := layerMediaTypes[spec.MediaType]; ok {
+			spec.MediaType = mediaType
+		}
+		if spec.MediaType == "" {
+			return nil, fmt.Errorf("invalid layer %q, media type required", value)
+		}
+		layers = append(layers, spec)
+	}
+	return layers, nil
+}
+
+// resolveAll attempts to resolve the login server and the data endpoint specified in the context.
+func resolveAll(ctx *cli.Context, loginServer string) (_, dataEndpoint string, err error) {
 	hostnames := []string{}
 
-	if loginServer = ctx.Args().First(); loginServer == "" {
+	if loginServer == "" {
 		return loginServer, dataEndpoint, errors.New("login server name required")
 	}
+	if loginServer, err = normalizeHost(loginServer); err != nil {
+		return loginServer, dataEndpoint, fmt.Errorf("invalid login server: %w", err)
+	}
 
 	hostnames = append(hostnames, loginServer)
 
 	if dataEndpoint = ctx.String(dataEndpointStr); dataEndpoint != "" {
+		if dataEndpoint, err = normalizeHost(dataEndpoint); err != nil {
+			return loginServer, dataEndpoint, fmt.Errorf("invalid data endpoint: %w", err)
+		}
 		hostnames = append(hostnames, dataEndpoint)
 	}
 
 	for _, hostname := range hostnames {
+		if host, _, err := net.SplitHostPort(hostname); err == nil {
+			hostname = host
+		}
 		if err := resolve(hostname); err != nil {
 			return loginServer, dataEndpoint, err
 		}
@@ -130,6 +781,50 @@ func resolveAll(ctx *cli.Context) (loginServer, dataEndpoint string, err error)
 	return loginServer, dataEndpoint, nil
 }
 
+// hostLabelRegex matches a single DNS label of a hostname.
+var hostLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// normalizeHost validates a registry host argument, such as myregistry.azurecr.io or localhost:5000,
+// and returns it without an http(s) scheme or trailing slash.
+func normalizeHost(arg string) (string, error) {
+	host := strings.TrimSpace(arg)
+	if scheme, rest, ok := strings.Cut(host, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return "", fmt.Errorf("%q: unsupported scheme %s", arg, scheme)
+		}
+		host = rest
+	}
+	host = strings.TrimSuffix(host, "/")
+	if strings.Contains(host, "/") {
+		return "", fmt.Errorf("%q: must be a host name without a path", arg)
+	}
+
+	hostname := host
+	if strings.Contains(host, ":") {
+		h, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return "", fmt.Errorf("%q: %v", arg, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("%q: invalid port %s", arg, port)
+		}
+		hostname = h
+	}
+
+	if net.ParseIP(hostname) != nil {
+		return host, nil
+	}
+	if hostname == "" || len(hostname) > 253 {
+		return "", fmt.Errorf("%q: invalid host name length", arg)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostLabelRegex.MatchString(label) {
+			return "", fmt.Errorf("%q: invalid host name label %q", arg, label)
+		}
+	}
+	return host, nil
+}
+
 // resolve ..
 // dig +short hostname
 func resolve(hostname string) error {
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"gopkg.in/yaml.v3"
+)
+
+// scenario describes a generation scenario loaded from a YAML config file.
+// Unset values fall back to the built-in defaults.
+type scenario struct {
+	// Repository is the repository to push to
+	Repository string `yaml:"repository"`
+
+	// IndexManifestCount is the number of manifests in a generated index
+	IndexManifestCount int `yaml:"indexManifestCount"`
+
+	// IndexArtifactRatio is the fraction of the manifests of a generated index that are artifacts
+	IndexArtifactRatio float64 `yaml:"indexArtifactRatio"`
+
+	// SubjectLayerCount is the number of layers of a generated subject image
+	SubjectLayerCount int `yaml:"subjectLayerCount"`
+
+	// SubjectIsIndex indicates that generated subjects are indexes instead of images
+	SubjectIsIndex bool `yaml:"subjectIsIndex"`
+
+	// SubjectIsArtifact indicates that generated subjects are artifacts referring to an image
+	// or index
+	SubjectIsArtifact bool `yaml:"subjectIsArtifact"`
+
+	// ConfigMediaType is the media type of generated configs
+	ConfigMediaType string `yaml:"configMediaType"`
+
+	// ArtifactType is the artifact type of generated artifacts
+	ArtifactType string `yaml:"artifactType"`
+
+	// Artifacts are the artifact cases to generate
+	Artifacts []registry.ArtifactConstructOptions `yaml:"artifacts"`
+}
+
+// loadScenario reads a scenario from a YAML file.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// apply sets the scenario values on the proxy options.
+func (s *scenario) apply(opts *registry.Options) {
+	opts.Repository = s.Repository
+	opts.IndexManifestCount = s.IndexManifestCount
+	opts.IndexArtifactRatio = s.IndexArtifactRatio
+	opts.SubjectLayerCount = s.SubjectLayerCount
+	opts.SubjectIsIndex = s.SubjectIsIndex
+	opts.SubjectIsArtifact = s.SubjectIsArtifact
+	opts.ConfigMediaType = s.ConfigMediaType
+	opts.ArtifactType = s.ArtifactType
+	opts.ArtifactCases = s.Artifacts
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Confirmation flag names
+const (
+	yesStr = "yes"
+)
+
+// yesFlag skips the confirmation of destructive commands.
+var yesFlag = &cli.BoolFlag{
+	Name:    yesStr,
+	Aliases: []string{"y"},
+	Usage:   "do not ask for confirmation before deleting, required when stdin is not a terminal",
+}
+
+// confirm lists what is about to be deleted and asks the user to type yes, unless --yes is set.
+// It fails rather than proceeding when stdin is not a terminal.
+func confirm(ctx *cli.Context, action string, items []string) error {
+	if ctx.Bool(yesStr) || len(items) == 0 {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("stdin is not a terminal, pass --%s to %s without confirmation", yesStr, action)
+	}
+
+	fmt.Fprintf(os.Stderr, "About to %s:\n", action)
+	for _, item := range items {
+		fmt.Fprintf(os.Stderr, "  %s\n", item)
+	}
+	fmt.Fprint(os.Stderr, "Type yes to continue: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read confirmation: %w", err)
+	}
+	if strings.TrimSpace(line) != "yes" {
+		return errors.New("aborted")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Derived image command flag names
+const (
+	layersFromImageStr = "layers-from-image"
+	addLayerStr        = "add-layer"
+)
+
+var createDerivedImage = &cli.Command{
+	Name:      "create-derived-image",
+	Usage:     "push an image reusing the config and layers of an existing image without uploading them again",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     layersFromImageStr,
+			Usage:    "`reference` of the existing image, such as repo:tag or repo@sha256:..., its blobs are mounted if --repo is another repository",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  tagStr,
+			Usage: "tag of the pushed image, defaults to derived-<unix time>",
+		},
+		&cli.BoolFlag{
+			Name:  addLayerStr,
+			Usage: "add a generated layer on top of the reused layers",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateDerivedImage,
+}
+
+func runCreateDerivedImage(ctx *cli.Context) (err error) {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	source := ctx.String(layersFromImageStr)
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateDerivedImage(ctxu, proxy.Repository, proxy.Tag, source, ctx.Bool(addLayerStr))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: pushed %s reusing %d blobs of %s, %d mounted\n",
+			source, result.Descriptor.Digest, result.ReusedBlobs, result.Source.Digest, result.MountedBlobs)
+		return nil
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// errRunsDiffer is returned when the compared runs pushed different content.
+var errRunsDiffer = errors.New("runs differ")
+
+var diffRuns = &cli.Command{
+	Name:      "diff",
+	Usage:     "compare the descriptors of two runs written with --out, matching manifests by push order",
+	ArgsUsage: "<first-file> <second-file>",
+	Action:    runDiff,
+}
+
+func runDiff(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("diff requires two descriptor files")
+	}
+	first, err := readDescriptors(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	second, err := readDescriptors(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	diffs := diffDescriptors(first.Descriptors, second.Descriptors)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		fmt.Println("differs")
+		return fmt.Errorf("%d differences: %w", len(diffs), errRunsDiffer)
+	}
+	fmt.Println("identical")
+	return nil
+}
+
+// readDescriptors reads a descriptors file written with --out.
+func readDescriptors(path string) (registry.PushedDescriptors, error) {
+	var descs registry.PushedDescriptors
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return descs, err
+	}
+	if err := json.Unmarshal(data, &descs); err != nil {
+		return descs, fmt.Errorf("invalid descriptors file %s: %w", path, err)
+	}
+	return descs, nil
+}
+
+// diffDescriptors compares the manifests pushed by two runs in push order, along with their
+// config, layers and index manifests. Tags and repositories are time based unless set, so
+// references are reported but not compared.
+func diffDescriptors(first, second []registry.PushedDescriptor) []string {
+	var diffs []string
+	for i := 0; i < len(first) || i < len(second); i++ {
+		switch {
+		case i >= len(second):
+			diffs = append(diffs, fmt.Sprintf("manifest %d %s: only in the first run", i, first[i].Reference))
+			continue
+		case i >= len(first):
+			diffs = append(diffs, fmt.Sprintf("manifest %d %s: only in the second run", i, second[i].Reference))
+			continue
+		}
+
+		a, b := first[i], second[i]
+		ref := fmt.Sprintf("manifest %d %s", i, a.Reference)
+		if a.Reference != b.Reference {
+			ref = fmt.Sprintf("manifest %d %s/%s", i, a.Reference, b.Reference)
+		}
+		diffs = append(diffs, diffContent(ref, "manifest", &registry.ContentDescriptor{MediaType: a.MediaType, Digest: a.Digest, Size: a.Size},
+			&registry.ContentDescriptor{MediaType: b.MediaType, Digest: b.Digest, Size: b.Size})...)
+		diffs = append(diffs, diffContent(ref, "config", a.Config, b.Config)...)
+		diffs = append(diffs, diffContentList(ref, "layer", a.Layers, b.Layers)...)
+		diffs = append(diffs, diffContentList(ref, "index manifest", a.Manifests, b.Manifests)...)
+	}
+	return diffs
+}
+
+// diffContentList compares the content descriptors with the same role by position.
+func diffContentList(ref, role string, first, second []registry.ContentDescriptor) []string {
+	var diffs []string
+	for i := 0; i < len(first) || i < len(second); i++ {
+		var a, b *registry.ContentDescriptor
+		if i < len(first) {
+			a = &first[i]
+		}
+		if i < len(second) {
+			b = &second[i]
+		}
+		diffs = append(diffs, diffContent(ref, fmt.Sprintf("%s %d", role, i), a, b)...)
+	}
+	return diffs
+}
+
+// diffContent compares two content descriptors with the same role, either may be missing.
+func diffContent(ref, role string, a, b *registry.ContentDescriptor) []string {
+	switch {
+	case a == nil && b == nil:
+		return nil
+	case b == nil:
+		return []string{fmt.Sprintf("%s: %s only in the first run", ref, role)}
+	case a == nil:
+		return []string{fmt.Sprintf("%s: %s only in the second run", ref, role)}
+	}
+
+	var diffs []string
+	if a.MediaType != b.MediaType {
+		diffs = append(diffs, fmt.Sprintf("%s: %s media type %s != %s", ref, role, a.MediaType, b.MediaType))
+	}
+	if a.Digest != b.Digest {
+		diffs = append(diffs, fmt.Sprintf("%s: %s digest %s != %s", ref, role, a.Digest, b.Digest))
+	}
+	if a.Size != b.Size {
+		diffs = append(diffs, fmt.Sprintf("%s: %s size %d != %d", ref, role, a.Size, b.Size))
+	}
+	return diffs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	_ "crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+// Digest command flag names
+const (
+	algorithmStr = "algorithm"
+)
+
+var computeDigest = &cli.Command{
+	Name:      "digest",
+	Usage:     "print the digest of a manifest read from a file or stdin",
+	ArgsUsage: "[file]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  algorithmStr,
+			Usage: "digest algorithm, sha256 or sha512",
+			Value: string(digest.SHA256),
+		},
+	},
+	Action: runDigest,
+}
+
+func runDigest(ctx *cli.Context) error {
+	alg := digest.Algorithm(ctx.String(algorithmStr))
+	if alg != digest.SHA256 && alg != digest.SHA512 {
+		return fmt.Errorf("unsupported digest algorithm %s", alg)
+	}
+
+	var data []byte
+	var err error
+	if path := ctx.Args().First(); path != "" && path != "-" {
+		data, err = os.ReadFile(path)
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	// the digest covers the exact bytes, so whitespace and field order matter
+	if !json.Valid(data) {
+		return fmt.Errorf("manifest is not valid JSON")
+	}
+
+	fmt.Println(alg.FromBytes(data))
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// envPrefix prefixes the environment variables flags fall back to, such as IMAGEGEN_USERNAME
+// for --username or IMAGEGEN_LOG_LEVEL for --log-level.
+const envPrefix = "IMAGEGEN_"
+
+// loginServerEnv is the environment variable holding the login server when it is not given as
+// an argument.
+const loginServerEnv = envPrefix + "LOGIN_SERVER"
+
+// envDescription documents the environment variables in the command help.
+const envDescription = `Environment:
+   Flags fall back to the environment variable listed in their help, such as IMAGEGEN_USERNAME,
+   IMAGEGEN_PASSWORD, IMAGEGEN_DATA_ENDPOINT or IMAGEGEN_INSECURE, and the login server argument
+   to ` + loginServerEnv + `. Flags given on the command line take precedence over the environment.`
+
+// flagEnvNames are the environment variable names, without the prefix, of the flags whose
+// names run words together.
+var flagEnvNames = map[string]string{
+	dataEndpointStr: "DATA_ENDPOINT",
+	basicAuthStr:    "BASIC_AUTH",
+}
+
+// flagEnvVar returns the environment variable the named flag falls back to.
+func flagEnvVar(name string) string {
+	if env, ok := flagEnvNames[name]; ok {
+		return envPrefix + env
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// withEnvVars makes every flag fall back to its environment variable, so a flag given on the
+// command line takes precedence over the environment, which takes precedence over the default.
+// The help of every flag lists its variable.
+func withEnvVars(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		env := []string{flagEnvVar(f.Names()[0])}
+		switch f := f.(type) {
+		case *cli.BoolFlag:
+			f.EnvVars = env
+		case *cli.StringFlag:
+			f.EnvVars = env
+		case *cli.StringSliceFlag:
+			f.EnvVars = env
+		case *cli.IntFlag:
+			f.EnvVars = env
+		case *cli.Int64Flag:
+			f.EnvVars = env
+		case *cli.Float64Flag:
+			f.EnvVars = env
+		case *cli.DurationFlag:
+			f.EnvVars = env
+		}
+	}
+	return flags
+}
+
+// loginServerArg returns the login server given as the n-th argument, or by the environment.
+func loginServerArg(ctx *cli.Context, n int) string {
+	if loginServer := ctx.Args().Get(n); loginServer != "" {
+		return loginServer
+	}
+	return os.Getenv(loginServerEnv)
+}
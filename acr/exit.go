@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+)
+
+// Exit codes of the commands.
+const (
+	// exitFailure is returned for any error without a more specific code.
+	exitFailure = 1
+
+	// exitExpectationViolated is returned when the registry accepted content expected to be
+	// rejected, or rejected content expected to be accepted.
+	exitExpectationViolated = 2
+
+	// exitAuth is returned when the registry rejected the credentials or the auth flow failed.
+	exitAuth = 3
+
+	// exitNetwork is returned when the registry could not be reached, including DNS failures.
+	exitNetwork = 4
+
+	// exitRunsDiffer is returned when the runs compared by the diff command pushed different content.
+	exitRunsDiffer = 5
+
+	// exitCancelled is returned when the command was interrupted.
+	exitCancelled = 130
+)
+
+// exitCodesDescription documents the exit codes in the command help.
+const exitCodesDescription = `Exit codes:
+   0    success
+   1    any other failure
+   2    a negative test expectation was violated
+   3    authentication failure
+   4    network or DNS failure
+   5    the runs compared by diff differ
+   130  cancelled`
+
+// exitCode returns the exit code of a command that failed with the error.
+func exitCode(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, registry.ErrExpectationViolated):
+		return exitExpectationViolated
+	case errors.Is(err, registry.ErrUnauthorized), errors.Is(err, registry.ErrChallengeFailed):
+		return exitAuth
+	case errors.As(err, &netErr):
+		return exitNetwork
+	case errors.Is(err, errRunsDiffer):
+		return exitRunsDiffer
+	}
+	return exitFailure
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Helm command flag names
+const (
+	chartStr        = "chart"
+	chartNameStr    = "chart-name"
+	chartVersionStr = "chart-version"
+)
+
+var createHelmChart = &cli.Command{
+	Name:      "create-helm-chart",
+	Usage:     "push a Helm chart as an OCI artifact the way helm push does, to <repo>/<chart name>:<chart version>",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  chartStr,
+			Usage: "packaged chart `file` to push, such as one created by helm package, a synthetic chart is pushed if not set",
+		},
+		&cli.StringFlag{
+			Name:  chartNameStr,
+			Usage: "`name` of the synthetic chart",
+			Value: "imagegen-test",
+		},
+		&cli.StringFlag{
+			Name:  chartVersionStr,
+			Usage: "`version` of the synthetic chart, also its tag",
+			Value: "0.1.0",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateHelmChart,
+}
+
+func runCreateHelmChart(ctx *cli.Context) (err error) {
+	chart, err := helmChart(ctx)
+	if err != nil {
+		return err
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	// like helm push, the repository is the namespace the chart is pushed under
+	repo := path.Join(repository(proxy), chart.Name())
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		if _, err := proxy.GenerateHelmChart(ctxu, repo, chart); err != nil {
+			return err
+		}
+		fmt.Printf("oci://%s/%s --version %s\n", proxy.LoginServer, repo, chart.Version())
+		return nil
+	})
+}
+
+// helmChart returns the chart read from the chart file, or the synthetic chart.
+func helmChart(ctx *cli.Context) (registry.HelmChart, error) {
+	file := ctx.String(chartStr)
+	if file == "" {
+		return registry.NewHelmChart(ctx.String(chartNameStr), ctx.String(chartVersionStr))
+	}
+	if ctx.IsSet(chartNameStr) || ctx.IsSet(chartVersionStr) {
+		return registry.HelmChart{}, errors.New("the name and version of a chart file are read from its Chart.yaml, --" + chartNameStr + " and --" + chartVersionStr + " only apply to synthetic charts")
+	}
+	return registry.LoadHelmChart(file)
+}
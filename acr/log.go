@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// levelFilterWriter writes the log events at or above a minimum level.
+type levelFilterWriter struct {
+	io.Writer
+	level zerolog.Level
+}
+
+// WriteLevel writes the event if its level is at least the minimum level.
+func (w levelFilterWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < w.level {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+// newLogger creates a logger printing events at or above the given level to the console.
+// If a log file is given, every event down to the trace level is also written to it as JSON.
+func newLogger(level zerolog.Level, path string) (zerolog.Logger, error) {
+	console := zerolog.ConsoleWriter{Out: os.Stdout}
+	if path == "" {
+		return zerolog.New(console).With().Timestamp().Logger().Level(level), nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return zerolog.Logger{}, fmt.Errorf("open log file: %w", err)
+	}
+	w := zerolog.MultiLevelWriter(levelFilterWriter{Writer: console, level: level}, file)
+	return zerolog.New(w).With().Timestamp().Logger().Level(zerolog.TraceLevel), nil
+}
@@ -5,10 +5,13 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 
 	containerdLog "github.com/containerd/containerd/log"
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
 	"github.com/urfave/cli/v2"
 )
 
@@ -19,29 +22,92 @@ var (
 
 func main() {
 	app := &cli.App{
-		Name:    "generate image",
-		Usage:   "",
-		Version: Version,
+		Name:        "generate image",
+		Usage:       "",
+		Description: exitCodesDescription + "\n\n" + envDescription,
+		Version:     Version,
 		Authors: []*cli.Author{
 			{
 				Name: "Esteban Rey",
 			},
 		},
-		Flags: []cli.Flag{
+		Flags: withEnvVars([]cli.Flag{
 			&cli.BoolFlag{
 				Name:  traceStr,
-				Usage: "print trace logs with secrets",
+				Usage: "print trace logs, including secrets in response bodies",
 			},
-		},
+			&cli.BoolFlag{
+				Name:  redactAuthStr,
+				Usage: "redact the credentials of the Authorization header in trace logs, set to false to log them in full",
+				Value: true,
+			},
+			&cli.StringFlag{
+				Name:  traceFormatStr,
+				Usage: "`format` of the requests in trace logs, pretty for indented JSON or jsonl for a compact JSON line per request",
+				Value: string(rhttp.TraceFormatPretty),
+			},
+			&cli.BoolFlag{
+				Name:  quietStr,
+				Usage: "only print errors",
+			},
+			&cli.StringFlag{
+				Name:  logLevelStr,
+				Usage: "log `level`, one of trace, debug, info, warn, error, fatal or panic",
+			},
+			&cli.StringFlag{
+				Name:  logFileStr,
+				Usage: "also write every log event, including trace logs, as JSON to `file`",
+			},
+			&cli.StringFlag{
+				Name:  otelEndpointStr,
+				Usage: "OTLP/HTTP `URL` spans of every generation and request are exported to, such as http://localhost:4318",
+			},
+		}),
+		Before: startTracing,
+		After:  stopTracing,
 		Commands: []*cli.Command{
 			createOCIIndex,
 			createOCIArtifactsTest,
+			catalog,
+			cleanup,
+			createSignature,
+			createSBOM,
+			createHelmChart,
+			createTags,
+			createDerivedImage,
+			attach,
+			createReferrers,
+			createReferrerMatrix,
+			profileReferrers,
+			referrersTag,
+			computeDigest,
+			diffRuns,
+			createRepush,
+			regionCompare,
+			discoverDataEndpoint,
+			compareEndpoints,
+			benchmark,
+			serve,
+			pingRegistry,
 		},
 	}
 	disableLibraryLogrusLogging()
 
-	if err := app.Run(os.Args); err != nil {
-		logger.Fatal().Msg(err.Error())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// restore the default behavior so a second signal terminates immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if ctx.Err() != nil {
+			logger.Error().Msgf("Cancelled: %v", err)
+			os.Exit(exitCancelled)
+		}
+		logger.Error().Msg(err.Error())
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -2,29 +2,197 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/containerd/containerd/images"
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 )
 
+// Index command flag names
+const (
+	indexSubjectStr      = "index-subject"
+	indexArtifactTypeStr = "index-artifact-type"
+	mediaTypeStr         = "media-type"
+	descMediaTypeStr     = "descriptor-media-type"
+	mismatchStr          = "manifest-media-type-mismatch"
+	tagsStr              = "tags"
+	imageLayerCountStr   = "image-layer-count"
+	artifactRatioStr     = "artifact-ratio"
+	skipFailedStr        = "skip-failed-children"
+	extraChildStr        = "extra-child"
+	allowDanglingStr     = "allow-dangling"
+)
+
 var createOCIIndex = &cli.Command{
 	Name:      "create-oci-index",
 	Usage:     "create-oci-index",
 	ArgsUsage: "<login-server>",
-	Flags:     commonFlags,
-	Action:    runGenerateOCIIndex,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  tagStr,
+			Usage: "tag of the pushed index, defaults to the current unix time",
+		},
+		&cli.StringFlag{
+			Name:  tagsStr,
+			Usage: "comma separated extra `tags` the pushed index is put under without uploading its content again, such as v1,v2,latest",
+		},
+		&cli.StringFlag{
+			Name:    indexSubjectStr,
+			Aliases: []string{subjectStr},
+			Usage:   "`reference`, a tag or a digest, of the manifest in the repository the index refers to, checking that its referrers list the index once pushed",
+		},
+		&cli.StringFlag{
+			Name:  indexArtifactTypeStr,
+			Usage: "artifact type of the index",
+		},
+		&cli.StringFlag{
+			Name:  mediaTypeStr,
+			Usage: "media type of the index, oci, docker or any media type, the body omits it if not set",
+		},
+		&cli.StringFlag{
+			Name:  descMediaTypeStr,
+			Usage: "media type the index is pushed with, oci, docker or any media type, defaults to the body media type or oci",
+		},
+		&cli.IntFlag{
+			Name:  imageLayerCountStr,
+			Usage: "number of layers of the images of the index, 0 pushing images with only a config to probe whether the registry accepts them",
+			Value: 2,
+		},
+		&cli.Float64Flag{
+			Name:  artifactRatioStr,
+			Usage: "fraction of the manifests of the index that are artifacts instead of images, between 0 and 1",
+		},
+		&cli.BoolFlag{
+			Name:  skipFailedStr,
+			Usage: "push the index with the manifests pushed successfully when some fail, instead of aborting at the first failure",
+		},
+		&cli.StringSliceFlag{
+			Name:  extraChildStr,
+			Usage: "`mediaType:digest:size` of a manifest, such as one pushed by another tool, the index references after the generated ones, can be repeated",
+		},
+		&cli.BoolFlag{
+			Name:  allowDanglingStr,
+			Usage: "reference the --" + extraChildStr + " manifests without checking that they exist in the repository",
+		},
+		&cli.BoolFlag{
+			Name:  mismatchStr,
+			Usage: "instead of an index, push an image manifest with an index mediaType and an index with an image manifest mediaType, and report whether the registry accepts, rejects or normalizes them",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runGenerateOCIIndex,
 }
 
 func runGenerateOCIIndex(ctx *cli.Context) (err error) {
-	proxy, err := proxy(ctx)
+	opts, err := options(ctx)
 	if err != nil {
 		return err
 	}
-
-	ctxu := context.Background()
-	err = proxy.GenerateOCIIndex(ctxu, false)
+	if err := setIndexOptions(ctx, opts); err != nil {
+		return err
+	}
+	proxy, err := newProxy(ctx, opts)
 	if err != nil {
 		return err
 	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	if ctx.Bool(mismatchStr) {
+		return soak(ctx, proxy, func(ctxu context.Context) error {
+			results, err := proxy.GenerateMediaTypeMismatch(ctxu, repository(proxy))
+			for _, result := range results {
+				status := strconv.Itoa(result.Status)
+				if len(result.ErrorCodes) > 0 {
+					status += " " + strings.Join(result.ErrorCodes, ", ")
+				}
+				fmt.Printf("%s with a %s body: %s (%s)\n", result.DescriptorMediaType, result.BodyMediaType, result.Outcome, status)
+			}
+			return err
+		})
+	}
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		_, err := proxy.GenerateOCIIndex(ctxu, indexMediaType(ctx.String(mediaTypeStr)))
+		return err
+	})
+}
 
+// setIndexOptions sets the index specific options from context, before the proxy validates them.
+func setIndexOptions(ctx *cli.Context, opts *registry.Options) error {
+	opts.IndexSubject = ctx.String(indexSubjectStr)
+	opts.IndexArtifactType = ctx.String(indexArtifactTypeStr)
+	opts.IndexDescriptorMediaType = indexMediaType(ctx.String(descMediaTypeStr))
+	opts.ExtraTags = parseTags(ctx.String(tagsStr))
+	opts.IndexSkipFailedChildren = ctx.Bool(skipFailedStr)
+	for _, value := range ctx.StringSlice(extraChildStr) {
+		desc, err := parseExtraChild(value)
+		if err != nil {
+			return err
+		}
+		opts.IndexExtraChildren = append(opts.IndexExtraChildren, desc)
+	}
+	opts.IndexAllowDangling = ctx.Bool(allowDanglingStr)
+	if ctx.IsSet(artifactRatioStr) {
+		opts.IndexArtifactRatio = ctx.Float64(artifactRatioStr)
+	}
+	if ctx.IsSet(imageLayerCountStr) {
+		opts.ImageLayerCount = ctx.Int(imageLayerCountStr)
+		opts.ImageLayerCountSet = true
+	}
 	return nil
 }
+
+// parseExtraChild parses the mediaType:digest:size descriptor of an extra child of an index.
+func parseExtraChild(value string) (ociimagespec.Descriptor, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 {
+		return ociimagespec.Descriptor{}, fmt.Errorf("invalid extra child %q, expected mediaType:digest:size", value)
+	}
+	dgst, err := digest.Parse(parts[1] + ":" + parts[2])
+	if err != nil {
+		return ociimagespec.Descriptor{}, fmt.Errorf("invalid extra child %q: %w", value, err)
+	}
+	size, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || size < 0 {
+		return ociimagespec.Descriptor{}, fmt.Errorf("invalid extra child %q, invalid size %q", value, parts[3])
+	}
+	if parts[0] == "" {
+		return ociimagespec.Descriptor{}, fmt.Errorf("invalid extra child %q, missing media type", value)
+	}
+	return ociimagespec.Descriptor{MediaType: parts[0], Digest: dgst, Size: size}, nil
+}
+
+// parseTags parses a comma separated list of tags.
+func parseTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// indexMediaTypes maps the index media type shorthands to media types.
+var indexMediaTypes = map[string]string{
+	"oci":    ociimagespec.MediaTypeImageIndex,
+	"docker": images.MediaTypeDockerSchema2ManifestList,
+}
+
+// indexMediaType returns the media type selected by a shorthand or a full media type.
+func indexMediaType(value string) string {
+	if mediaType, ok := indexMediaTypes[value]; ok {
+		return mediaType
+	}
+	return value
+}
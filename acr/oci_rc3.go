@@ -2,29 +2,257 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/opencontainers/go-digest"
 	"github.com/urfave/cli/v2"
 )
 
+// Artifacts command flag names
+const (
+	casesStr              = "cases"
+	listCasesStr          = "list-cases"
+	subjectLayerCountStr  = "subject-layer-count"
+	subjectIndexStr       = "subject-index"
+	subjectArtifactStr    = "subject-artifact"
+	failFastStr           = "fail-fast"
+	continueStr           = "continue"
+	concurrencyStr        = "concurrency"
+	onlyReferrersStr      = "only-referrers"
+	outputStr             = "output"
+	artifactConfigStr     = "artifact-config"
+	artifactConfigTypeStr = "artifact-config-type"
+)
+
+// Artifacts summary formats
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
 var createOCIArtifactsTest = &cli.Command{
 	Name:      "create-oci-artifacts-test",
 	Usage:     "create-oci-artifacts-test",
 	ArgsUsage: "<login-server>",
-	Flags:     commonFlags,
-	Action:    runGenerateOCIArtifacts,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  casesStr,
+			Usage: "comma separated `indexes` of the artifact cases to run, such as 0,2,5",
+		},
+		&cli.BoolFlag{
+			Name:  listCasesStr,
+			Usage: "list the artifact cases without pushing anything",
+		},
+		&cli.StringFlag{
+			Name:  subjectStr,
+			Usage: "`digest` of an existing manifest in the repository used as the subject, defaults to pushing a new subject",
+		},
+		&cli.BoolFlag{
+			Name:  onlyReferrersStr,
+			Usage: "only push referrers to the existing --" + subjectStr + ", failing if it does not exist instead of pushing a new subject",
+		},
+		&cli.IntFlag{
+			Name:  subjectLayerCountStr,
+			Usage: "number of layers of the pushed subject image",
+		},
+		&cli.BoolFlag{
+			Name:  subjectIndexStr,
+			Usage: "push an index of images as the subject instead of an image",
+		},
+		&cli.BoolFlag{
+			Name:  subjectArtifactStr,
+			Usage: "push an artifact referring to the subject image or index as the subject, and check the referrers of both",
+		},
+		&cli.StringFlag{
+			Name:  artifactConfigStr,
+			Usage: "`file` holding the config of the artifacts of cases without a scratch config, such as a Helm chart config, instead of a generated image config",
+		},
+		&cli.StringFlag{
+			Name:  artifactConfigTypeStr,
+			Usage: "`media type` of the --" + artifactConfigStr + ", such as application/vnd.cncf.helm.config.v1+json",
+		},
+		&cli.BoolFlag{
+			Name:  failFastStr,
+			Usage: "stop at the first artifact case not behaving as expected",
+		},
+		&cli.BoolFlag{
+			Name:  continueStr,
+			Usage: "run all artifact cases even if some do not behave as expected, the default",
+		},
+		&cli.IntFlag{
+			Name:  concurrencyStr,
+			Usage: "number of artifact cases pushed concurrently, cases are still reported in order",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  outputStr,
+			Usage: "`format` of the summary of the cases printed once they ran, text for a table or json",
+			Value: outputText,
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runGenerateOCIArtifacts,
 }
 
 func runGenerateOCIArtifacts(ctx *cli.Context) (err error) {
-	proxy, err := proxy(ctx)
+	if ctx.Bool(listCasesStr) {
+		return listArtifactCases(ctx)
+	}
+
+	opts, err := options(ctx)
+	if err != nil {
+		return err
+	}
+	if path := ctx.String(artifactConfigStr); path != "" {
+		if opts.ArtifactConfig, err = artifactConfig(path, ctx.String(artifactConfigTypeStr)); err != nil {
+			return err
+		}
+	} else if ctx.IsSet(artifactConfigTypeStr) {
+		return fmt.Errorf("--%s requires --%s", artifactConfigTypeStr, artifactConfigStr)
+	}
+	proxy, err := newProxy(ctx, opts)
 	if err != nil {
 		return err
 	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	if proxy.SelectedCases, err = parseCases(ctx.String(casesStr)); err != nil {
+		return err
+	}
+	if ctx.Bool(failFastStr) && ctx.Bool(continueStr) {
+		return fmt.Errorf("only one of --%s and --%s can be used", failFastStr, continueStr)
+	}
+	proxy.FailFast = ctx.Bool(failFastStr)
+	if proxy.ArtifactConcurrency = ctx.Int(concurrencyStr); proxy.ArtifactConcurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d", proxy.ArtifactConcurrency)
+	}
+	if ctx.IsSet(subjectLayerCountStr) {
+		proxy.SubjectLayerCount = ctx.Int(subjectLayerCountStr)
+	}
+	if ctx.IsSet(subjectIndexStr) {
+		proxy.SubjectIsIndex = ctx.Bool(subjectIndexStr)
+	}
+	if ctx.IsSet(subjectArtifactStr) {
+		proxy.SubjectIsArtifact = ctx.Bool(subjectArtifactStr)
+	}
+	if subject := ctx.String(subjectStr); subject != "" {
+		if proxy.ArtifactSubject, err = digest.Parse(subject); err != nil {
+			return fmt.Errorf("invalid subject: %w", err)
+		}
+		if proxy.Repository == "" {
+			return errors.New("subject requires a repository")
+		}
+	}
+	if proxy.OnlyReferrers = ctx.Bool(onlyReferrersStr); proxy.OnlyReferrers && proxy.ArtifactSubject == "" {
+		return fmt.Errorf("--%s requires --%s", onlyReferrersStr, subjectStr)
+	}
 
-	ctxu := context.Background()
-	err = proxy.GenerateOCIArtifacts(ctxu)
+	output := ctx.String(outputStr)
+	if output != outputText && output != outputJSON {
+		return fmt.Errorf("invalid output format %q, expected %s or %s", output, outputText, outputJSON)
+	}
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		outcomes, err := proxy.GenerateOCIArtifacts(ctxu)
+		if perr := printArtifactOutcomes(os.Stdout, outcomes, output); err == nil {
+			err = perr
+		}
+		return err
+	})
+}
+
+// artifactConfig reads the artifact config of the given media type from the file, the proxy
+// validates it.
+func artifactConfig(path, mediaType string) (*registry.StaticContent, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
+		return nil, err
+	}
+	return &registry.StaticContent{MediaType: mediaType, Data: data}, nil
+}
+
+// printArtifactOutcomes prints the outcome of every artifact case as a table followed by the
+// totals, or as JSON.
+func printArtifactOutcomes(w io.Writer, outcomes []registry.ArtifactCaseOutcome, output string) error {
+	if output == outputJSON {
+		if outcomes == nil {
+			outcomes = []registry.ArtifactCaseOutcome{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(outcomes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CASE\tDESCRIPTION\tERROR EXPECTED\tOUTCOME\tRESULT")
+	passed := 0
+	for _, o := range outcomes {
+		outcome, result := "accepted", "FAIL"
+		if !o.Accepted {
+			outcome = "rejected"
+			if len(o.ErrorCodes) > 0 {
+				outcome += " (" + strings.Join(o.ErrorCodes, ", ") + ")"
+			}
+		}
+		if o.Passed {
+			result = "PASS"
+			passed++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%t\t%s\t%s\n", o.Index, o.Description, o.ErrorExpected, outcome, result)
+	}
+	if err := tw.Flush(); err != nil {
 		return err
 	}
+	_, err := fmt.Fprintf(w, "%d passed, %d failed\n", passed, len(outcomes)-passed)
+	return err
+}
 
+// listArtifactCases prints the title of every artifact case.
+func listArtifactCases(ctx *cli.Context) error {
+	cases := registry.DefaultArtifactCases
+	if path := ctx.String(configStr); path != "" {
+		s, err := loadScenario(path)
+		if err != nil {
+			return err
+		}
+		if len(s.Artifacts) > 0 {
+			cases = s.Artifacts
+		}
+	}
+
+	for i, c := range cases {
+		fmt.Println(c.Title(i))
+	}
 	return nil
 }
+
+// parseCases parses a comma separated list of artifact case indexes.
+func parseCases(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var cases []int
+	for _, s := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact case %q", s)
+		}
+		cases = append(cases, i)
+	}
+	return cases, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// outStr is the name of the flag selecting the pushed descriptors file.
+const outStr = "out"
+
+// outFlag writes the descriptors of the pushed manifests to a file.
+var outFlag = &cli.StringFlag{
+	Name:  outStr,
+	Usage: "write the descriptors of every pushed manifest as JSON to `file`",
+}
+
+// writeDescriptors writes the manifests pushed by the proxy to the file selected by --out, if any.
+func writeDescriptors(ctx *cli.Context, proxy *registry.Proxy) error {
+	path := ctx.String(outStr)
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(proxy.Pushed(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// apiVersion is the API version reported by registries speaking the v2 API.
+const apiVersion = "registry/2.0"
+
+var pingRegistry = &cli.Command{
+	Name:      "ping",
+	Aliases:   []string{"version"},
+	Usage:     "call the base endpoint of the registry and report its API version and auth challenge",
+	ArgsUsage: "<login-server>",
+	Flags:     commonFlags,
+	Action:    runPing,
+}
+
+func runPing(ctx *cli.Context) error {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+
+	result, err := ping(ctx.Context, proxy)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// pingResult describes the response of the registry to a ping for display.
+type pingResult registry.PingResult
+
+// ping calls the base endpoint of the registry. Registries are not required to report their API
+// version, so an unexpected one is only warned about.
+func ping(ctx context.Context, proxy *registry.Proxy) (pingResult, error) {
+	result, err := proxy.Ping(ctx)
+	if err != nil {
+		return pingResult(result), fmt.Errorf("ping: %w", err)
+	}
+	if result.APIVersion != apiVersion {
+		logger.Warn().Msgf("Registry reports API version %q, expected %s", result.APIVersion, apiVersion)
+	}
+	return pingResult(result), nil
+}
+
+// String formats the result for display.
+func (r pingResult) String() string {
+	s := fmt.Sprintf("API version: %s, status: %d", r.APIVersion, r.Status)
+	switch {
+	case r.AuthScheme == "":
+		s += ", auth: none"
+	case r.Realm != "":
+		s += fmt.Sprintf(", auth: %s, realm: %s, service: %s", r.AuthScheme, r.Realm, r.Service)
+	default:
+		s += fmt.Sprintf(", auth: %s", r.AuthScheme)
+	}
+	if r.AuthStatus != 0 {
+		s += fmt.Sprintf(", authenticated status: %d", r.AuthStatus)
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// consoleProgress is a registry.ProgressReporter drawing a percentage line per upload.
+type consoleProgress struct {
+	mu  sync.Mutex
+	out io.Writer
+	// last is the last percentage drawn per ref, to avoid redrawing unchanged lines.
+	last map[string]int64
+}
+
+// newConsoleProgress returns a progress reporter drawing to stdout, or nil if stdout is not a terminal.
+func newConsoleProgress() *consoleProgress {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &consoleProgress{out: os.Stdout, last: make(map[string]int64)}
+}
+
+// OnProgress redraws the progress line of the given ref.
+func (c *consoleProgress) OnProgress(ref string, pushed, total int64) {
+	percent := int64(100)
+	if total > 0 {
+		percent = pushed * 100 / total
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.last[ref]; ok && last == percent {
+		return
+	}
+	c.last[ref] = percent
+
+	fmt.Fprintf(c.out, "\r%s: %3d%% (%d/%d bytes)", ref, percent, pushed, total)
+	if pushed >= total {
+		fmt.Fprintln(c.out)
+		delete(c.last, ref)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Referrers command flag names
+const (
+	referrerCountStr = "referrer-count"
+	stepsStr         = "steps"
+)
+
+var createReferrers = &cli.Command{
+	Name:      "create-referrers",
+	Usage:     "push a subject with many referrers and list them through the referrers API",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  referrerCountStr,
+			Usage: "number of referrers to push",
+			Value: 10,
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateReferrers,
+}
+
+func runCreateReferrers(ctx *cli.Context) (err error) {
+	count := ctx.Int(referrerCountStr)
+	if count < 0 {
+		return fmt.Errorf("invalid referrer count %d", count)
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateReferrers(ctxu, repository(proxy), count)
+		if err != nil {
+			return err
+		}
+		if len(result.Referrers) != count {
+			logger.Warn().Msgf("Pushed %d referrers but listed %d", count, len(result.Referrers))
+		}
+		return nil
+	})
+}
+
+var createReferrerMatrix = &cli.Command{
+	Name:      "create-referrer-matrix",
+	Usage:     "push referrers of several artifact types to a subject and check the referrers API lists each type filtered by artifactType",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     artifactTypeStr,
+			Usage:    "artifact type and number of referrers as `type=count`, such as application/vnd.example.signature=3, can be repeated",
+			Required: true,
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateReferrerMatrix,
+}
+
+func runCreateReferrerMatrix(ctx *cli.Context) (err error) {
+	counts, err := parseArtifactTypeCounts(ctx.StringSlice(artifactTypeStr))
+	if err != nil {
+		return err
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateReferrerMatrix(ctxu, repository(proxy), counts)
+		for _, t := range result.Types {
+			fmt.Printf("%s: pushed %d, listed %d, filtered by registry: %t (mechanism: %s)\n", t.ArtifactType, t.Pushed, t.Listed, t.FiltersApplied, t.Mechanism)
+		}
+		return err
+	})
+}
+
+var profileReferrers = &cli.Command{
+	Name:      "profile-referrers",
+	Usage:     "push referrers to a subject in growing steps and time a full listing of its referrers after every step",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  stepsStr,
+			Usage: "comma separated increasing `counts` of referrers the subject is listed with",
+			Value: "10,100,1000",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runProfileReferrers,
+}
+
+func runProfileReferrers(ctx *cli.Context) (err error) {
+	counts, err := parseSteps(ctx.String(stepsStr))
+	if err != nil {
+		return err
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		profile, err := proxy.GenerateReferrersProfile(ctxu, repository(proxy), counts)
+		for _, l := range profile {
+			if l.Listed != l.Referrers {
+				logger.Warn().Msgf("Pushed %d referrers but listed %d", l.Referrers, l.Listed)
+			}
+		}
+		if perr := printReferrersProfile(os.Stdout, profile); err == nil {
+			err = perr
+		}
+		return err
+	})
+}
+
+// printReferrersProfile prints the listing latency of every step as a table.
+func printReferrersProfile(w io.Writer, profile []registry.ReferrersLatency) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REFERRERS\tLISTED\tPAGES\tLATENCY\tPER REFERRER\tMECHANISM")
+	for _, l := range profile {
+		var perReferrer time.Duration
+		if l.Referrers > 0 {
+			perReferrer = l.Latency / time.Duration(l.Referrers)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%v\t%v\t%s\n", l.Referrers, l.Listed, l.Pages, l.Latency.Round(time.Microsecond), perReferrer, l.Mechanism)
+	}
+	return tw.Flush()
+}
+
+// parseSteps parses a comma separated list of increasing referrer counts.
+func parseSteps(value string) ([]int, error) {
+	var counts []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid referrer count %q", s)
+		}
+		if len(counts) > 0 && n <= counts[len(counts)-1] {
+			return nil, fmt.Errorf("referrer counts must increase, %d follows %d", n, counts[len(counts)-1])
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+// parseArtifactTypeCounts parses type=count pairs. An artifact type cannot be given twice.
+func parseArtifactTypeCounts(values []string) ([]registry.ArtifactTypeCount, error) {
+	var counts []registry.ArtifactTypeCount
+	seen := make(map[string]bool)
+	for _, value := range values {
+		artifactType, count, found := strings.Cut(value, "=")
+		if !found || artifactType == "" {
+			return nil, fmt.Errorf("invalid artifact type count %q, expected type=count", value)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid referrer count in %q", value)
+		}
+		if seen[artifactType] {
+			return nil, fmt.Errorf("artifact type %s given twice", artifactType)
+		}
+		seen[artifactType] = true
+		counts = append(counts, registry.ArtifactTypeCount{ArtifactType: artifactType, Count: n})
+	}
+	return counts, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+var referrersTag = &cli.Command{
+	Name:      "referrers-tag",
+	Usage:     "print the referrers tag schema tag of a subject digest, and the index stored under it if a login server is given",
+	ArgsUsage: "<digest> [login-server]",
+	Flags:     commonFlags,
+	Action:    runReferrersTag,
+}
+
+func runReferrersTag(ctx *cli.Context) error {
+	dgst, err := digest.Parse(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+	tag := registry.ReferrersTag(dgst)
+	fmt.Println(tag)
+
+	loginServer := loginServerArg(ctx, 1)
+	if loginServer == "" {
+		return nil
+	}
+	repo := ctx.String(repoStr)
+	if repo == "" {
+		return errors.New("repository required to fetch the referrers tag")
+	}
+
+	opts, err := loginServerOptions(ctx, loginServer)
+	if err != nil {
+		return err
+	}
+	proxy, err := registry.NewProxy(opts, logger)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+
+	index, exists, err := proxy.ReferrersTagIndex(ctx.Context, repo, dgst)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		logger.Info().Msgf("Referrers tag %s:%s does not exist", repo, tag)
+		return nil
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Region command flag names
+const (
+	regionCompareStr = "region-compare"
+	samplesStr       = "samples"
+)
+
+var regionCompare = &cli.Command{
+	Name:      "region-compare",
+	Usage:     "push a blob through the login server and pull it back through the data endpoint, discovered from a blob redirect if not set",
+	ArgsUsage: "<login-server>",
+	Flags:     append(soakFlags, commonFlags...),
+	Action:    runRegionCompare,
+}
+
+func runRegionCompare(ctx *cli.Context) error {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+
+	if proxy.DataEndpoint == "" {
+		if err := useDiscoveredDataEndpoint(ctx.Context, proxy); err != nil {
+			return err
+		}
+	}
+	return regionCompareSoak(ctx, proxy)
+}
+
+// regionCompareSoak runs the region compare flow against the data endpoint of the proxy.
+func regionCompareSoak(ctx *cli.Context, proxy *registry.Proxy) error {
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateRegionCompare(ctxu, repository(proxy))
+		if err != nil {
+			return err
+		}
+		if !result.DigestMatches {
+			return fmt.Errorf("blob %s pulled from %s does not match its digest", result.Digest, result.PulledFrom)
+		}
+		return nil
+	})
+}
+
+var discoverDataEndpoint = &cli.Command{
+	Name:      "discover-data-endpoint",
+	Usage:     "learn the data endpoint of the registry from the redirect of a probe blob download",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  regionCompareStr,
+			Usage: "run the region compare flow against the discovered data endpoint",
+		},
+	}, append(soakFlags, commonFlags...)...),
+	Action: runDiscoverDataEndpoint,
+}
+
+func runDiscoverDataEndpoint(ctx *cli.Context) error {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+
+	if err := useDiscoveredDataEndpoint(ctx.Context, proxy); err != nil {
+		return err
+	}
+	fmt.Println(proxy.DataEndpoint)
+	if ctx.Bool(regionCompareStr) {
+		return regionCompareSoak(ctx, proxy)
+	}
+	return nil
+}
+
+// useDiscoveredDataEndpoint sets the data endpoint of the proxy to the one the registry redirects
+// blob downloads to. If the registry does not redirect, the data endpoint set with the flag
+// is kept, if any.
+func useDiscoveredDataEndpoint(ctx context.Context, proxy *registry.Proxy) error {
+	endpoint, err := proxy.DiscoverDataEndpoint(ctx, repository(proxy))
+	if err != nil {
+		return fmt.Errorf("discover data endpoint: %w", err)
+	}
+	switch {
+	case endpoint != "":
+		logger.Info().Msgf("Discovered data endpoint %s", endpoint)
+		proxy.DataEndpoint = endpoint
+	case proxy.DataEndpoint != "":
+		logger.Info().Msgf("Blob downloads are not redirected, using data endpoint %s", proxy.DataEndpoint)
+	default:
+		return errors.New("blob downloads are not redirected, set the data endpoint with --" + dataEndpointStr)
+	}
+	return nil
+}
+
+var compareEndpoints = &cli.Command{
+	Name:      "compare-endpoints",
+	Usage:     "request a blob many times from the login server and from the data endpoint it redirects to, and print the latency percentiles of both",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  countStr,
+			Usage: "number of requests to every endpoint",
+			Value: 100,
+		},
+		&cli.IntFlag{
+			Name:  concurrencyStr,
+			Usage: "number of blob requests made concurrently",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  samplesStr,
+			Usage: "`file` the elapsed time of every request is written to as CSV, for plotting",
+		},
+	}, commonFlags...),
+	Action: runCompareEndpoints,
+}
+
+func runCompareEndpoints(ctx *cli.Context) error {
+	if ctx.Int(countStr) <= 0 {
+		return fmt.Errorf("invalid request count %d", ctx.Int(countStr))
+	}
+	if ctx.Int(concurrencyStr) < 1 {
+		return fmt.Errorf("invalid concurrency %d", ctx.Int(concurrencyStr))
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+
+	result, err := proxy.GenerateEndpointComparison(ctx.Context, repository(proxy), ctx.Int(countStr), ctx.Int(concurrencyStr))
+	if err != nil {
+		return err
+	}
+	if path := ctx.String(samplesStr); path != "" {
+		if err := writeEndpointSamples(path, result); err != nil {
+			return fmt.Errorf("write samples: %w", err)
+		}
+	}
+	return printEndpointComparison(os.Stdout, result)
+}
+
+// namedLatency is the latency of an endpoint along with its name.
+type namedLatency struct {
+	name    string
+	latency registry.EndpointLatency
+}
+
+// endpointLatencies returns the latency of both endpoints of the comparison.
+func endpointLatencies(result registry.EndpointComparison) []namedLatency {
+	return []namedLatency{
+		{"login server", result.LoginServer},
+		{"data endpoint", result.DataEndpoint},
+	}
+}
+
+// printEndpointComparison prints the latency percentiles of both endpoints as a table.
+func printEndpointComparison(w io.Writer, result registry.EndpointComparison) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tHOST\tREQUESTS\tP50\tP90\tP99")
+	for _, e := range endpointLatencies(result) {
+		l := e.latency
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%v\t%v\n", e.name, l.Host, len(l.Elapsed), l.Percentile(50), l.Percentile(90), l.Percentile(99))
+	}
+	return tw.Flush()
+}
+
+// writeEndpointSamples writes the elapsed time of every request to the file as CSV, one row
+// per request with the endpoint, its host and the elapsed milliseconds.
+func writeEndpointSamples(path string, result registry.EndpointComparison) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"endpoint", "host", "elapsed_ms"})
+	for _, e := range endpointLatencies(result) {
+		for _, elapsed := range e.latency.Elapsed {
+			ms := strconv.FormatFloat(float64(elapsed)/1e6, 'f', 3, 64)
+			w.Write([]string{e.name, e.latency.Host, ms})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/urfave/cli/v2"
+)
+
+var createRepush = &cli.Command{
+	Name:      "create-repush",
+	Usage:     "push the same manifest twice and report whether the registry treated the second push as a no-op",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runRepush,
+}
+
+func runRepush(ctx *cli.Context) (err error) {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateRepush(ctxu, repository(proxy))
+		if err != nil {
+			return err
+		}
+		if !result.NoOp() {
+			logger.Warn().Msgf("Registry did not treat the repush of %s as a no-op", result.Digest)
+		}
+		return nil
+	})
+}
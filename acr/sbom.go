@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// SBOM command flag names
+const (
+	formatStr = "format"
+)
+
+// sbomFormats maps the SBOM format flag values to artifact types.
+var sbomFormats = map[string]string{
+	"spdx":      registry.SBOMArtifactTypeSPDX,
+	"cyclonedx": registry.SBOMArtifactTypeCycloneDX,
+}
+
+var createSBOM = &cli.Command{
+	Name:      "create-sbom",
+	Usage:     "attach an SBOM to an image",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  subjectStr,
+			Usage: "tag or `digest` of the image described by the SBOM, a new image is pushed if not set",
+		},
+		&cli.StringFlag{
+			Name:  formatStr,
+			Usage: "SBOM format, spdx or cyclonedx",
+			Value: "spdx",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateSBOM,
+}
+
+func runCreateSBOM(ctx *cli.Context) (err error) {
+	artifactType, ok := sbomFormats[ctx.String(formatStr)]
+	if !ok {
+		return fmt.Errorf("unsupported SBOM format %s", ctx.String(formatStr))
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		repo := repository(proxy)
+		subject, err := proxy.SubjectDescriptor(ctxu, repo, ctx.String(subjectStr))
+		if err != nil {
+			return err
+		}
+		_, err = proxy.GenerateSBOMArtifact(ctxu, repo, subject, artifactType)
+		return err
+	})
+}
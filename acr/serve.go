@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// Serve command flag names
+const (
+	listenStr = "listen"
+)
+
+var serve = &cli.Command{
+	Name:      "serve",
+	Usage:     "serve a local HTTP API generating content on the registry, for integration test harnesses",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  listenStr,
+			Usage: "`address` to listen on",
+			Value: "localhost:8080",
+		},
+	}, commonFlags...),
+	Action: runServe,
+}
+
+// indexRequest is the body of a POST /generate/index request.
+type indexRequest struct {
+	Repository          string                    `json:"repository"`
+	Tag                 string                    `json:"tag"`
+	ExtraTags           []string                  `json:"extraTags"`
+	ManifestCount       int                       `json:"manifestCount"`
+	LayerCount          *int                      `json:"layerCount"`
+	ArtifactRatio       float64                   `json:"artifactRatio"`
+	SkipFailedChildren  bool                      `json:"skipFailedChildren"`
+	MediaType           string                    `json:"mediaType"`
+	DescriptorMediaType string                    `json:"descriptorMediaType"`
+	ArtifactType        string                    `json:"artifactType"`
+	Subject             digest.Digest             `json:"subject"`
+	ExtraChildren       []ociimagespec.Descriptor `json:"extraChildren"`
+	AllowDangling       bool                      `json:"allowDangling"`
+}
+
+// artifactsRequest is the body of a POST /generate/artifacts request.
+type artifactsRequest struct {
+	Repository        string        `json:"repository"`
+	Cases             []int         `json:"cases"`
+	ArtifactType      string        `json:"artifactType"`
+	SubjectLayerCount int           `json:"subjectLayerCount"`
+	SubjectIsArtifact bool          `json:"subjectIsArtifact"`
+	Subject           digest.Digest `json:"subject"`
+	FailFast          bool          `json:"failFast"`
+	Concurrency       int           `json:"concurrency"`
+	OnlyReferrers     bool          `json:"onlyReferrers"`
+}
+
+// referrersRequest is the body of a POST /generate/referrers request.
+type referrersRequest struct {
+	Repository string `json:"repository"`
+	Count      int    `json:"count"`
+}
+
+// generateResponse is the body of a successful generate response.
+type generateResponse struct {
+	Descriptors []registry.PushedDescriptor `json:"descriptors"`
+	Result      any                         `json:"result,omitempty"`
+	Metrics     rhttp.MetricsSummary        `json:"metrics"`
+}
+
+// errorResponse is the body of a failed request.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// generateFunc runs a generation with a proxy dedicated to the request and returns its result, if any.
+type generateFunc func(ctx context.Context, proxy *registry.Proxy) (any, error)
+
+// server generates content for API requests. Every request gets its own proxy created from the
+// options given on the command line, so requests do not share pushed descriptors or metrics.
+type server struct {
+	opts *registry.Options
+}
+
+func runServe(ctx *cli.Context) error {
+	opts, err := options(ctx)
+	if err != nil {
+		return err
+	}
+	if path := ctx.String(recordStr); path != "" {
+		defer func() {
+			if err := opts.Recorder.Save(path); err != nil {
+				logger.Error().Msgf("Failed to save the recording: %v", err)
+			}
+		}()
+	}
+
+	s := server{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate/index", s.handle(s.generateIndex))
+	mux.HandleFunc("/generate/artifacts", s.handle(s.generateArtifacts))
+	mux.HandleFunc("/generate/referrers", s.handle(s.generateReferrers))
+
+	srv := &http.Server{
+		Addr:    ctx.String(listenStr),
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx.Context
+		},
+	}
+	go func() {
+		<-ctx.Context.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	logger.Info().Msgf("Serving on %s", srv.Addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// handle returns a handler decoding the JSON request body into options for a new proxy and
+// running the generation with it.
+func (s server) handle(generate func(r *http.Request, opts *registry.Options) (generateFunc, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+			return
+		}
+
+		opts := *s.opts
+		run, err := generate(r, &opts)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		proxy, err := registry.NewProxy(&opts, logger)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		result, err := run(r.Context(), proxy)
+		if err != nil {
+			logger.Error().Msgf("%s failed: %v", r.URL.Path, err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, generateResponse{
+			Descriptors: proxy.Pushed().Descriptors,
+			Result:      result,
+			Metrics:     proxy.Metrics(),
+		})
+	}
+}
+
+// generateIndex handles POST /generate/index.
+func (s server) generateIndex(r *http.Request, opts *registry.Options) (generateFunc, error) {
+	var req indexRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Subject != "" {
+		if err := req.Subject.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid index subject: %w", err)
+		}
+	}
+	setString(&opts.Repository, req.Repository)
+	setString(&opts.Tag, req.Tag)
+	if req.ExtraTags != nil {
+		opts.ExtraTags = req.ExtraTags
+	}
+	setString(&opts.IndexArtifactType, req.ArtifactType)
+	setString(&opts.IndexDescriptorMediaType, indexMediaType(req.DescriptorMediaType))
+	if req.ManifestCount > 0 {
+		opts.IndexManifestCount = req.ManifestCount
+	}
+	if req.ArtifactRatio < 0 || req.ArtifactRatio > 1 {
+		return nil, fmt.Errorf("invalid artifact ratio %v", req.ArtifactRatio)
+	}
+	if req.ArtifactRatio > 0 {
+		opts.IndexArtifactRatio = req.ArtifactRatio
+	}
+	if req.LayerCount != nil {
+		if *req.LayerCount < 0 {
+			return nil, fmt.Errorf("invalid layer count %d", *req.LayerCount)
+		}
+		opts.ImageLayerCount = *req.LayerCount
+		opts.ImageLayerCountSet = true
+	}
+	opts.IndexSubject = req.Subject.String()
+	for _, child := range req.ExtraChildren {
+		if err := child.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid extra child: %w", err)
+		}
+		if child.MediaType == "" {
+			return nil, fmt.Errorf("extra child %s has no media type", child.Digest)
+		}
+	}
+	opts.IndexExtraChildren = req.ExtraChildren
+	opts.IndexAllowDangling = req.AllowDangling
+	opts.IndexSkipFailedChildren = req.SkipFailedChildren
+
+	return func(ctx context.Context, proxy *registry.Proxy) (any, error) {
+		return proxy.GenerateOCIIndex(ctx, indexMediaType(req.MediaType))
+	}, nil
+}
+
+// generateArtifacts handles POST /generate/artifacts.
+func (s server) generateArtifacts(r *http.Request, opts *registry.Options) (generateFunc, error) {
+	var req artifactsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Subject != "" {
+		if err := req.Subject.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid subject: %w", err)
+		}
+	}
+	setString(&opts.Repository, req.Repository)
+	setString(&opts.ArtifactType, req.ArtifactType)
+	opts.ArtifactSubject = req.Subject
+	if opts.OnlyReferrers = req.OnlyReferrers; opts.OnlyReferrers && req.Subject == "" {
+		return nil, errors.New("only pushing referrers requires a subject")
+	}
+	opts.FailFast = req.FailFast
+	if req.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid concurrency %d", req.Concurrency)
+	}
+	opts.ArtifactConcurrency = req.Concurrency
+	if req.SubjectLayerCount > 0 {
+		opts.SubjectLayerCount = req.SubjectLayerCount
+	}
+	if req.SubjectIsArtifact {
+		opts.SubjectIsArtifact = true
+	}
+	if req.Cases != nil {
+		opts.SelectedCases = req.Cases
+	}
+
+	return func(ctx context.Context, proxy *registry.Proxy) (any, error) {
+		return proxy.GenerateOCIArtifacts(ctx)
+	}, nil
+}
+
+// generateReferrers handles POST /generate/referrers.
+func (s server) generateReferrers(r *http.Request, opts *registry.Options) (generateFunc, error) {
+	req := referrersRequest{Count: 10}
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Count < 0 {
+		return nil, fmt.Errorf("invalid referrer count %d", req.Count)
+	}
+	setString(&opts.Repository, req.Repository)
+
+	return func(ctx context.Context, proxy *registry.Proxy) (any, error) {
+		repo := proxy.Repository
+		if repo == "" {
+			repo = registry.NewRepositoryName()
+		}
+		return proxy.GenerateReferrers(ctx, repo, req.Count)
+	}, nil
+}
+
+// decodeJSON decodes the JSON request body into v. An empty body leaves v unchanged.
+func decodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error().Msgf("Failed to write the response: %v", err)
+	}
+}
+
+// setString sets the option to the value, if not empty.
+func setString(option *string, value string) {
+	if value != "" {
+		*option = value
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Referrer command flag names
+const (
+	subjectStr = "subject"
+)
+
+var createSignature = &cli.Command{
+	Name:      "create-signature",
+	Usage:     "attach a notation style signature to an image",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  subjectStr,
+			Usage: "tag or `digest` of the image to sign, a new image is pushed if not set",
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateSignature,
+}
+
+func runCreateSignature(ctx *cli.Context) (err error) {
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		repo := repository(proxy)
+		subject, err := proxy.SubjectDescriptor(ctxu, repo, ctx.String(subjectStr))
+		if err != nil {
+			return err
+		}
+		_, err = proxy.GenerateSignatureArtifact(ctxu, repo, subject)
+		return err
+	})
+}
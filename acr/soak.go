@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/estebanreyl/image-gen-test/pkg/registry"
+	"github.com/urfave/cli/v2"
+)
+
+// Soak flag names
+const (
+	repeatStr   = "repeat"
+	durationStr = "duration"
+	delayStr    = "delay"
+)
+
+// soakFlags select how many times a command runs, falling back to their environment variables.
+var soakFlags = withEnvVars([]cli.Flag{
+	&cli.IntFlag{
+		Name:  repeatStr,
+		Usage: "run the command `N` times, unlimited when --duration is set and this is not",
+		Value: 1,
+	},
+	&cli.DurationFlag{
+		Name:  durationStr,
+		Usage: "run the command repeatedly until the duration elapses",
+	},
+	&cli.DurationFlag{
+		Name:  delayStr,
+		Usage: "delay between repeated runs",
+		Value: time.Second,
+	},
+})
+
+// soak runs the iteration once, or repeatedly as selected by --repeat and --duration,
+// waiting --delay between iterations. Failed iterations are logged and the run goes on
+// until it is complete or cancelled, then a report aggregating all iterations is logged.
+func soak(ctx *cli.Context, proxy *registry.Proxy, iteration func(context.Context) error) error {
+	repeat := ctx.Int(repeatStr)
+	duration := ctx.Duration(durationStr)
+	if duration > 0 && !ctx.IsSet(repeatStr) {
+		repeat = 0
+	}
+	if repeat == 1 && duration <= 0 {
+		return iteration(ctx.Context)
+	}
+	if repeat < 0 {
+		return fmt.Errorf("invalid repeat count %d", repeat)
+	}
+
+	start := time.Now()
+	var runs, failures int
+	var lastErr error
+	for (repeat == 0 || runs < repeat) && (duration <= 0 || time.Since(start) < duration) {
+		if runs > 0 {
+			select {
+			case <-ctx.Context.Done():
+			case <-time.After(ctx.Duration(delayStr)):
+			}
+		}
+		if ctx.Context.Err() != nil {
+			break
+		}
+
+		runs++
+		if err := iteration(ctx.Context); err != nil {
+			if ctx.Context.Err() != nil {
+				return err
+			}
+			failures++
+			lastErr = err
+			logger.Error().Msgf("Iteration %d failed: %v", runs, err)
+		}
+	}
+
+	logger.Info().Msgf("Ran %d iterations in %v, %d failed. Metrics: %v",
+		runs, time.Since(start).Round(time.Millisecond), failures, proxy.Metrics())
+	if failures > 0 {
+		return fmt.Errorf("%d of %d iterations failed, last error: %w", failures, runs, lastErr)
+	}
+	return ctx.Context.Err()
+}
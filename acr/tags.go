@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Tags command flag names
+const (
+	tagCountStr = "tag-count"
+)
+
+var createTags = &cli.Command{
+	Name:      "create-tags",
+	Usage:     "push many tiny artifacts tagged tag-0 to tag-<count-1> to a single repository, for tag listing and scale tests",
+	ArgsUsage: "<login-server>",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  tagCountStr,
+			Usage: "number of tags pushed to the repository",
+			Value: 1000,
+		},
+		&cli.IntFlag{
+			Name:  concurrencyStr,
+			Usage: "number of artifacts pushed concurrently",
+			Value: 1,
+		},
+		outFlag,
+	}, append(soakFlags, commonFlags...)...),
+	Action: runCreateTags,
+}
+
+func runCreateTags(ctx *cli.Context) (err error) {
+	if ctx.Int(tagCountStr) <= 0 {
+		return fmt.Errorf("invalid tag count %d", ctx.Int(tagCountStr))
+	}
+	if ctx.Int(concurrencyStr) < 1 {
+		return fmt.Errorf("invalid concurrency %d", ctx.Int(concurrencyStr))
+	}
+
+	proxy, err := proxy(ctx)
+	if err != nil {
+		return err
+	}
+	defer reportMetrics(ctx, proxy)
+	defer reportCancelled(ctx, proxy)
+	defer func() {
+		if werr := writeDescriptors(ctx, proxy); err == nil {
+			err = werr
+		}
+	}()
+
+	repo := repository(proxy)
+	return soak(ctx, proxy, func(ctxu context.Context) error {
+		result, err := proxy.GenerateTags(ctxu, repo, ctx.Int(tagCountStr), ctx.Int(concurrencyStr))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: pushed %d tags in %v (%.1f tags/s), listed %d tags in %v\n",
+			repo, result.Pushed, result.Elapsed, result.Throughput(), result.Listed, result.ListElapsed)
+		return nil
+	})
+}
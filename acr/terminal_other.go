@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// isTerminal indicates if the file is a character device, which is the closest check available
+// without terminal ioctls.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
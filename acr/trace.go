@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation scope of the spans.
+const tracerName = "github.com/estebanreyl/image-gen-test"
+
+// tracerProvider exports the spans of the command, it is nil unless an OTLP endpoint is given.
+var tracerProvider *sdktrace.TracerProvider
+
+// startTracing sets up the export of spans to the OTLP endpoint given on the command line, if any.
+func startTracing(ctx *cli.Context) error {
+	endpoint := ctx.String(otelEndpointStr)
+	if endpoint == "" {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(ctx.Context, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "image-gen-test"),
+			attribute.String("service.version", Version),
+		)),
+	)
+	return nil
+}
+
+// stopTracing flushes the spans not exported yet.
+func stopTracing(ctx *cli.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	// the command context may be cancelled already, flushing must not depend on it
+	ctxu, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return tracerProvider.Shutdown(ctxu)
+}
+
+// tracer returns the tracer of the command, or nil if spans are not exported.
+func tracer() trace.Tracer {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Tracer(tracerName, trace.WithInstrumentationVersion(Version))
+}
@@ -0,0 +1,43 @@
+package http
+
+import (
+	"context"
+	"sync"
+)
+
+// commitDigestKey is the context key of the CommitDigest of a push.
+type commitDigestKey struct{}
+
+// CommitDigest holds the Docker-Content-Digest header of the last successful PUT made with a
+// context, the digest the registry returned on the commit of a push. It is safe for concurrent use.
+type CommitDigest struct {
+	mu     sync.Mutex
+	digest string
+}
+
+// WithCommitDigest returns a context recording the digest returned by the PUT requests
+// MetricsTransport makes with it, and the CommitDigest they are recorded to.
+func WithCommitDigest(ctx context.Context) (context.Context, *CommitDigest) {
+	c := &CommitDigest{}
+	return context.WithValue(ctx, commitDigestKey{}, c), c
+}
+
+// Digest returns the digest returned on commit, empty if there was no commit or the registry
+// returned no digest.
+func (c *CommitDigest) Digest() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.digest
+}
+
+// recordCommitDigest records the digest returned by a successful PUT made with the context, if
+// the context records it.
+func recordCommitDigest(ctx context.Context, digest string) {
+	c, ok := ctx.Value(commitDigestKey{}).(*CommitDigest)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.digest = digest
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+)
+
+// ConnectionInfo describes the connection a round trip was made over.
+type ConnectionInfo struct {
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Reused     bool   `json:"reused"`
+	Protocol   string `json:"protocol,omitempty"`
+
+	// TLS details, empty over plaintext connections.
+	TLSVersion  string `json:"tlsVersion,omitempty"`
+	CipherSuite string `json:"cipherSuite,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+
+	// CertSubject and CertIssuer describe the certificate presented by the server.
+	CertSubject string `json:"certSubject,omitempty"`
+	CertIssuer  string `json:"certIssuer,omitempty"`
+}
+
+// traceConnection returns a request recording the connection it is sent over to the info.
+// The info is completed with the TLS state of the response by completeConnection.
+func traceConnection(req *http.Request, info *ConnectionInfo) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(conn httptrace.GotConnInfo) {
+			if conn.Conn != nil {
+				info.RemoteAddr = conn.Conn.RemoteAddr().String()
+			}
+			info.Reused = conn.Reused
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// completeConnection records the protocol and TLS state of the response to the info.
+func completeConnection(info *ConnectionInfo, resp *http.Response) {
+	info.Protocol = resp.Proto
+	state := resp.TLS
+	if state == nil {
+		return
+	}
+	info.TLSVersion = tls.VersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	info.ServerName = state.ServerName
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		info.CertSubject = cert.Subject.String()
+		info.CertIssuer = cert.Issuer.String()
+	}
+}
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"net/http"
+)
+
+// HeaderUserAgent is the User-Agent header name.
+const HeaderUserAgent = "User-Agent"
+
+// HeaderTransport is an http.RoundTripper that sets a fixed set of headers on every request.
+// Headers already present on the request are overwritten.
+type HeaderTransport struct {
+	Base   http.RoundTripper
+	Header http.Header
+}
+
+// RoundTrip sets the configured headers and does an HTTP/HTTPs roundtrip.
+func (t HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.Header) > 0 {
+		req = req.Clone(req.Context())
+		for key, values := range t.Header {
+			req.Header.Del(key)
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,20 @@
+package http
+
+import (
+	"context"
+)
+
+// maxBodySizeKey is the context key of the maximum response body size.
+type maxBodySizeKey struct{}
+
+// WithMaxBodySize returns a context bounding the size of the response bodies RoundTripperWithContext
+// reads for requests made with it. Reading a larger body fails with io.ErrTooLarge.
+func WithMaxBodySize(ctx context.Context, max int64) context.Context {
+	return context.WithValue(ctx, maxBodySizeKey{}, max)
+}
+
+// maxBodySize returns the maximum response body size set on the context, zero if unbounded.
+func maxBodySize(ctx context.Context) int64 {
+	max, _ := ctx.Value(maxBodySizeKey{}).(int64)
+	return max
+}
@@ -0,0 +1,233 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/estebanreyl/image-gen-test/pkg/io"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metrics aggregates timing and size statistics over a sequence of round trips.
+// It is safe for concurrent use.
+type Metrics struct {
+	mu            sync.Mutex
+	requests      int
+	bytesSent     int64
+	bytesReceived int64
+	elapsed       time.Duration
+	statusCodes   map[int]int
+	firstStart    time.Time
+	lastEnd       time.Time
+	newConns      int
+	reusedConns   int
+
+	verifiedDigests   int
+	mismatchedDigests int
+}
+
+// MetricsSummary is a point in time snapshot of Metrics.
+type MetricsSummary struct {
+	Requests       int           `json:"requests"`
+	BytesSent      int64         `json:"bytesSent"`
+	BytesReceived  int64         `json:"bytesReceived"`
+	StatusCodes    map[int]int   `json:"statusCodes"`
+	TotalElapsed   time.Duration `json:"totalElapsed"`
+	AverageElapsed time.Duration `json:"averageElapsed"`
+	WallTime       time.Duration `json:"wallTime"`
+	NewConns       int           `json:"newConnections"`
+	ReusedConns    int           `json:"reusedConnections"`
+
+	// VerifiedDigests and MismatchedDigests count the pushes whose commit returned a digest
+	// matching, or not, the pushed digest.
+	VerifiedDigests   int `json:"verifiedDigests"`
+	MismatchedDigests int `json:"mismatchedDigests"`
+}
+
+// NewMetrics creates a new, empty Metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{statusCodes: make(map[int]int)}
+}
+
+// Record adds a single round trip to the metrics.
+func (m *Metrics) Record(sent, received int64, code int, startedAt time.Time, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sent < 0 {
+		sent = 0
+	}
+	if received < 0 {
+		received = 0
+	}
+
+	m.requests++
+	m.bytesSent += sent
+	m.bytesReceived += received
+	m.elapsed += elapsed
+	m.statusCodes[code]++
+	if m.firstStart.IsZero() || startedAt.Before(m.firstStart) {
+		m.firstStart = startedAt
+	}
+	if end := startedAt.Add(elapsed); end.After(m.lastEnd) {
+		m.lastEnd = end
+	}
+}
+
+// RecordConnection records whether a round trip opened a new connection or reused an idle one.
+func (m *Metrics) RecordConnection(reused bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if reused {
+		m.reusedConns++
+	} else {
+		m.newConns++
+	}
+}
+
+// RecordCommitDigest records whether the digest returned on the commit of a push matched the
+// pushed digest.
+func (m *Metrics) RecordCommitDigest(matched bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if matched {
+		m.verifiedDigests++
+	} else {
+		m.mismatchedDigests++
+	}
+}
+
+// Summary returns a snapshot of the metrics recorded so far.
+func (m *Metrics) Summary() MetricsSummary {
+	if m == nil {
+		return MetricsSummary{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := MetricsSummary{
+		Requests:      m.requests,
+		BytesSent:     m.bytesSent,
+		BytesReceived: m.bytesReceived,
+		StatusCodes:   make(map[int]int, len(m.statusCodes)),
+		TotalElapsed:  m.elapsed,
+		WallTime:      m.lastEnd.Sub(m.firstStart),
+		NewConns:      m.newConns,
+		ReusedConns:   m.reusedConns,
+
+		VerifiedDigests:   m.verifiedDigests,
+		MismatchedDigests: m.mismatchedDigests,
+	}
+	for code, count := range m.statusCodes {
+		s.StatusCodes[code] = count
+	}
+	if m.requests > 0 {
+		s.AverageElapsed = m.elapsed / time.Duration(m.requests)
+	}
+	return s
+}
+
+// UploadThroughput returns the effective upload bandwidth in bytes per second over the wall time.
+func (s MetricsSummary) UploadThroughput() float64 {
+	if s.WallTime <= 0 {
+		return 0
+	}
+	return float64(s.BytesSent) / s.WallTime.Seconds()
+}
+
+// String formats the summary for display.
+func (s MetricsSummary) String() string {
+	return fmt.Sprintf("requests: %d, sent: %d bytes, received: %d bytes, status codes: %v, total elapsed: %v, average elapsed: %v, wall time: %v, upload throughput: %.2f bytes/s, connections: %d new, %d reused, commit digests: %d verified, %d mismatched",
+		s.Requests, s.BytesSent, s.BytesReceived, s.StatusCodes, s.TotalElapsed, s.AverageElapsed, s.WallTime, s.UploadThroughput(), s.NewConns, s.ReusedConns, s.VerifiedDigests, s.MismatchedDigests)
+}
+
+// MetricsTransport is an http.RoundTripper that records every request to a Metrics collector.
+// It is meant to instrument HTTP clients that are not driven through RoundTripper, such as
+// the containerd resolver.
+type MetricsTransport struct {
+	Base    http.RoundTripper
+	Metrics *Metrics
+
+	// Recorder, when set, keeps every round trip for later inspection.
+	// Response bodies are not read, so only the status and headers are recorded.
+	Recorder *Recorder
+
+	// Tracer, when set, receives a span for every round trip.
+	Tracer trace.Tracer
+}
+
+// RoundTrip does an HTTP/HTTPs roundtrip and records its statistics.
+func (t MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body io.Reader
+	if req.Body != nil {
+		body = io.NewReader(req.Body)
+		req = req.Clone(req.Context())
+		req.Body = readCloser{Reader: body, Closer: req.Body}
+	}
+
+	req, span := startSpan(t.Tracer, req)
+	startedAt := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		endSpan(span, 0, 0, time.Since(startedAt), err)
+		return resp, err
+	}
+
+	var sent int64
+	if body != nil {
+		sent = body.N()
+	}
+	elapsed := time.Since(startedAt)
+	endSpan(span, resp.StatusCode, resp.ContentLength, elapsed, nil)
+	t.Metrics.Record(sent, resp.ContentLength, resp.StatusCode, startedAt, elapsed)
+	if req.Method == http.MethodPut && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		recordCommitDigest(req.Context(), resp.Header.Get(HeaderContentDigest))
+	}
+	t.Recorder.Record(RoundTripInfo{
+		Request: Request{
+			Method:              req.Method,
+			URL:                 req.URL,
+			HeaderAuthorization: req.Header.Get(HeaderAuthorization),
+			StartedAt:           startedAt,
+		},
+		Response: Response{
+			Code:                     resp.StatusCode,
+			HeaderChallenge:          resp.Header.Get(HeaderChallenge),
+			HeaderLink:               resp.Header.Get(HeaderLink),
+			HeaderContentType:        resp.Header.Get(HeaderContentType),
+			HeaderRetryAfter:         resp.Header.Get(HeaderRetryAfter),
+			HeaderRateLimitRemaining: rateLimitHeader(resp.Header, HeaderRateLimitRemaining),
+			HeaderRateLimitReset:     rateLimitHeader(resp.Header, HeaderRateLimitReset),
+			HeaderContentDigest:      resp.Header.Get(HeaderContentDigest),
+			HeaderAPIVersion:         resp.Header.Get(HeaderAPIVersion),
+			HeaderContentLength:      resp.ContentLength,
+			Size:                     resp.ContentLength,
+		},
+		Elapsed: elapsed.String(),
+	})
+	return resp, nil
+}
+
+// readCloser combines a Reader with the Closer of the body it wraps.
+type readCloser struct {
+	io.Reader
+	Closer interface{ Close() error }
+}
+
+// Close closes the wrapped body.
+func (r readCloser) Close() error {
+	return r.Closer.Close()
+}
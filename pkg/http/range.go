@@ -0,0 +1,83 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ByteRange is an inclusive range of bytes as used by the Range and Content-Range headers.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// String formats the range as a Range header value.
+func (r ByteRange) String() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+// UploadString formats the range as the Content-Range header value of a chunk of a blob upload,
+// which omits the unit, such as 0-99.
+func (r ByteRange) UploadString() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Len returns the number of bytes in the range.
+func (r ByteRange) Len() int64 {
+	return r.End - r.Start + 1
+}
+
+// ParseRange parses a single range Range header value, such as bytes=0-99.
+func ParseRange(header string) (ByteRange, error) {
+	var r ByteRange
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return r, fmt.Errorf("unsupported range %q", header)
+	}
+	if _, err := fmt.Sscanf(spec, "%d-%d", &r.Start, &r.End); err != nil {
+		return r, fmt.Errorf("invalid range %q: %v", header, err)
+	}
+	return r, nil
+}
+
+// ParseContentRange parses a Content-Range header value, such as bytes 0-99/1000.
+// The total size is -1 if unknown.
+func ParseContentRange(header string) (r ByteRange, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return r, 0, fmt.Errorf("unsupported content range %q", header)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return r, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	if _, err := fmt.Sscanf(rng, "%d-%d", &r.Start, &r.End); err != nil {
+		return r, 0, fmt.Errorf("invalid content range %q: %v", header, err)
+	}
+	total = -1
+	if size != "*" {
+		if _, err := fmt.Sscanf(size, "%d", &total); err != nil {
+			return r, 0, fmt.Errorf("invalid content range %q: %v", header, err)
+		}
+	}
+	return r, total, nil
+}
+
+// ParseUploadRange parses the Range header of a blob upload response, such as 0-99, which
+// omits the unit. It returns the number of bytes received by the registry, the end of the
+// range plus one. The distribution registry reports an empty session as 0-0, so 0-0 is read
+// as no bytes received, a single byte received being indistinguishable from it.
+func ParseUploadRange(header string) (int64, error) {
+	var r ByteRange
+	spec := strings.TrimPrefix(header, "bytes=")
+	if _, err := fmt.Sscanf(spec, "%d-%d", &r.Start, &r.End); err != nil {
+		return 0, fmt.Errorf("invalid upload range %q: %v", header, err)
+	}
+	if r.Start != 0 || r.End < -1 {
+		return 0, fmt.Errorf("invalid upload range %q", header)
+	}
+	if r.End == 0 {
+		return 0, nil
+	}
+	return r.End + 1, nil
+}
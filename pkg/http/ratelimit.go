@@ -0,0 +1,25 @@
+package http
+
+import (
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitTransport is an http.RoundTripper that waits for the limiter before every request.
+// Sharing the limiter between transports caps their combined request rate.
+type RateLimitTransport struct {
+	Base    http.RoundTripper
+	Limiter *rate.Limiter
+}
+
+// RoundTrip waits for the limiter and does an HTTP/HTTPs roundtrip.
+// Waiting is abandoned when the request context is done.
+func (t RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Limiter != nil {
+		if err := t.Limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,40 @@
+package http
+
+import "sync"
+
+// Recorder keeps every round trip made through the transports it is installed in, in the order
+// they completed. It is safe for concurrent use, and a nil Recorder records nothing.
+type Recorder struct {
+	mu    sync.Mutex
+	trips []RoundTripInfo
+}
+
+// Record appends a round trip to the recorder.
+func (r *Recorder) Record(info RoundTripInfo) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trips = append(r.trips, info)
+}
+
+// Trips returns a copy of the round trips recorded so far.
+func (r *Recorder) Trips() []RoundTripInfo {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RoundTripInfo(nil), r.trips...)
+}
+
+// Reset discards the round trips recorded so far.
+func (r *Recorder) Reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trips = nil
+}
@@ -0,0 +1,120 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// recordedResponse is a Response as stored in a recording. The body is stored as bytes,
+// since responses such as blobs are not JSON.
+type recordedResponse struct {
+	Response
+	Body []byte `json:"body,omitempty"`
+}
+
+// recordedTrip is a RoundTripInfo as stored in a recording.
+type recordedTrip struct {
+	Request  Request          `json:"request"`
+	Response recordedResponse `json:"response"`
+	Elapsed  string           `json:"elapsed"`
+}
+
+// Save writes the round trips recorded so far to a file, in a format LoadRecording reads back.
+// Credentials in Authorization headers are redacted, only their scheme is kept.
+func (r *Recorder) Save(path string) error {
+	trips := r.Trips()
+	recording := make([]recordedTrip, len(trips))
+	for i, trip := range trips {
+		request := trip.Request
+		request.HeaderAuthorization = redactAuthorization(request.HeaderAuthorization)
+		recording[i] = recordedTrip{
+			Request:  request,
+			Response: recordedResponse{Response: trip.Response, Body: trip.Response.Body},
+			Elapsed:  trip.Elapsed,
+		}
+	}
+
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// redactAuthorization returns the Authorization header value with the credentials replaced,
+// keeping only the scheme, such as Bearer <redacted>. A value without a scheme is redacted as a
+// whole, an empty one is kept.
+func redactAuthorization(value string) string {
+	if value == "" {
+		return ""
+	}
+	if scheme, _, found := strings.Cut(value, " "); found {
+		return scheme + " <redacted>"
+	}
+	return "<redacted>"
+}
+
+// LoadRecording reads round trips saved by Recorder.Save.
+func LoadRecording(path string) ([]RoundTripInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recording []recordedTrip
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %w", path, err)
+	}
+
+	trips := make([]RoundTripInfo, len(recording))
+	for i, trip := range recording {
+		response := trip.Response.Response
+		response.Body = trip.Response.Body
+		trips[i] = RoundTripInfo{
+			Request:  trip.Request,
+			Response: response,
+			Elapsed:  trip.Elapsed,
+		}
+	}
+	return trips, nil
+}
+
+// ReplayRoundTripper is a RoundTripper serving recorded round trips back in order, without
+// any network access. Every request must match the method and URL of the next recorded trip.
+// It is safe for concurrent use.
+type ReplayRoundTripper struct {
+	mu    sync.Mutex
+	trips []RoundTripInfo
+	next  int
+}
+
+// NewReplayRoundTripper creates a ReplayRoundTripper serving the given round trips.
+func NewReplayRoundTripper(trips []RoundTripInfo) *ReplayRoundTripper {
+	return &ReplayRoundTripper{trips: trips}
+}
+
+// RoundTrip returns the next recorded round trip if it matches the request.
+func (r *ReplayRoundTripper) RoundTrip(req *http.Request) (RoundTripInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.trips) {
+		return RoundTripInfo{}, fmt.Errorf("replay exhausted after %d trips, unexpected %s %s", len(r.trips), req.Method, req.URL)
+	}
+	trip := r.trips[r.next]
+	if trip.Method != req.Method || trip.URL == nil || trip.URL.String() != req.URL.String() {
+		return RoundTripInfo{}, fmt.Errorf("replay trip %d: expected %s %s, got %s %s", r.next, trip.Method, trip.URL, req.Method, req.URL)
+	}
+	r.next++
+	return trip, nil
+}
+
+// Remaining returns the number of recorded round trips not replayed yet.
+func (r *ReplayRoundTripper) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.trips) - r.next
+}
@@ -0,0 +1,23 @@
+package http
+
+import "testing"
+
+func TestRedactAuthorization(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "bearer", value: "Bearer eyJhbGciOi.payload.signature", want: "Bearer <redacted>"},
+		{name: "basic", value: "Basic dXNlcjpwYXNzd29yZA==", want: "Basic <redacted>"},
+		{name: "without scheme", value: "eyJhbGciOi.payload.signature", want: "<redacted>"},
+		{name: "empty", value: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactAuthorization(tt.value); got != tt.want {
+				t.Errorf("redactAuthorization(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
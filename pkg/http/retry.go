@@ -0,0 +1,137 @@
+package http
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// RetryPolicy decides whether and when a failed request is retried.
+// Delays grow exponentially from BaseDelay with full jitter, so concurrent clients throttled
+// at the same time do not retry in lockstep. The zero value never retries.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of retries of a request.
+	MaxRetries int
+
+	// BaseDelay is the upper bound of the first delay, doubled for every retry.
+	BaseDelay time.Duration
+
+	// MaxElapsed bounds the cumulative time spent on a request including its retries,
+	// no retry is scheduled past it even if attempts remain. Unbounded if zero.
+	MaxElapsed time.Duration
+}
+
+// Retryable indicates if a request that failed with the status code may succeed when retried.
+// Only throttling and server errors are retried, client errors never are.
+func (p RetryPolicy) Retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Delay returns the delay before the given retry, counted from zero, drawn uniformly between
+// zero and the exponential backoff.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	backoff := p.BaseDelay
+	for i := 0; i < retry && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Next returns the delay before the given retry of a request started at startedAt, or false
+// if the request must not be retried. A delay requested with Retry-After takes precedence
+// when it is longer than the backoff.
+func (p RetryPolicy) Next(retry int, startedAt time.Time, retryAfter time.Duration) (time.Duration, bool) {
+	if retry >= p.MaxRetries {
+		return 0, false
+	}
+	delay := p.Delay(retry)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if p.MaxElapsed > 0 && time.Since(startedAt)+delay > p.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// RetryTransport is an http.RoundTripper that retries throttled and failed requests
+// following a RetryPolicy. Requests with a body are only retried if the body can be
+// replayed with GetBody.
+type RetryTransport struct {
+	Base   http.RoundTripper
+	Policy RetryPolicy
+	Logger zerolog.Logger
+}
+
+// RoundTrip does an HTTP/HTTPs roundtrip, retrying it as allowed by the policy.
+// Once the policy stops retrying, the last response or error is returned as is.
+// Waiting is abandoned when the request context is done.
+func (t RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	startedAt := time.Now()
+	for retry := 0; ; retry++ {
+		resp, err := t.Base.RoundTrip(req)
+
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+		case !t.Policy.Retryable(resp.StatusCode):
+			return resp, nil
+		default:
+			retryAfter, _ = Response{HeaderRetryAfter: resp.Header.Get(HeaderRetryAfter)}.RetryAfter()
+		}
+
+		delay, ok := t.Policy.Next(retry, startedAt, retryAfter)
+		if ok && req.Body != nil && req.GetBody == nil {
+			ok = false
+		}
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			t.Logger.Warn().Msgf("%s %s failed with %d, retrying in %v", req.Method, req.URL, resp.StatusCode, delay)
+		} else {
+			t.Logger.Warn().Msgf("%s %s failed: %v, retrying in %v", req.Method, req.URL, err, delay)
+		}
+
+		if err := Sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// Sleep waits for the delay, or returns the context error if it is done first.
+func Sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
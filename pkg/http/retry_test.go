@@ -0,0 +1,162 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// countingServer returns a server responding to every request with the status returned by
+// respond, given the number of the request counted from one, and the count of requests served.
+func countingServer(t *testing.T, respond func(n int32, w http.ResponseWriter) int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(respond(count.Add(1), w))
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+// roundTrip sends a GET request to the URL through a RetryTransport following the policy.
+func roundTrip(t *testing.T, ctx context.Context, policy RetryPolicy, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := RetryTransport{Base: http.DefaultTransport, Policy: policy, Logger: zerolog.Nop()}
+	resp, err := transport.RoundTrip(req)
+	if resp != nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxElapsed: time.Minute}
+	tests := []struct {
+		name       string
+		retry      int
+		startedAt  time.Time
+		retryAfter time.Duration
+		wantOK     bool
+		wantMin    time.Duration
+	}{
+		{name: "first retry", retry: 0, startedAt: time.Now(), wantOK: true},
+		{name: "attempts exhausted", retry: 3, startedAt: time.Now()},
+		{name: "elapsed budget exhausted", retry: 0, startedAt: time.Now().Add(-2 * time.Minute)},
+		{name: "retry after beyond budget", retry: 0, startedAt: time.Now(), retryAfter: 2 * time.Minute},
+		{name: "retry after longer than backoff", retry: 0, startedAt: time.Now(), retryAfter: time.Second, wantOK: true, wantMin: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := policy.Next(tt.retry, tt.startedAt, tt.retryAfter)
+			if ok != tt.wantOK {
+				t.Fatalf("Next() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && delay < tt.wantMin {
+				t.Errorf("Next() delay = %v, want at least %v", delay, tt.wantMin)
+			}
+		})
+	}
+}
+
+func TestRetryTransportMaxElapsed(t *testing.T) {
+	server, count := countingServer(t, func(int32, http.ResponseWriter) int {
+		time.Sleep(40 * time.Millisecond)
+		return http.StatusServiceUnavailable
+	})
+	policy := RetryPolicy{MaxRetries: 100, MaxElapsed: 100 * time.Millisecond}
+
+	resp, err := roundTrip(t, context.Background(), policy, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n := count.Load(); n < 2 || n > 4 {
+		t.Errorf("attempts = %d, want the elapsed budget to stop retrying after 2 to 4 attempts", n)
+	}
+}
+
+func TestRetryTransportStatuses(t *testing.T) {
+	tests := []struct {
+		status       int
+		wantAttempts int32
+	}{
+		{status: http.StatusBadRequest, wantAttempts: 1},
+		{status: http.StatusUnauthorized, wantAttempts: 1},
+		{status: http.StatusForbidden, wantAttempts: 1},
+		{status: http.StatusNotFound, wantAttempts: 1},
+		{status: http.StatusTooManyRequests, wantAttempts: 3},
+		{status: http.StatusInternalServerError, wantAttempts: 3},
+		{status: http.StatusServiceUnavailable, wantAttempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server, count := countingServer(t, func(int32, http.ResponseWriter) int { return tt.status })
+
+			resp, err := roundTrip(t, context.Background(), RetryPolicy{MaxRetries: 2}, server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if n := count.Load(); n != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", n, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportCancelled(t *testing.T) {
+	server, count := countingServer(t, func(int32, http.ResponseWriter) int { return http.StatusServiceUnavailable })
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	startedAt := time.Now()
+	_, err := roundTrip(t, ctx, RetryPolicy{MaxRetries: 3, BaseDelay: time.Hour}, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Errorf("returned after %v, want the wait abandoned on cancellation", elapsed)
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("attempts = %d, want 1", n)
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	server, count := countingServer(t, func(n int32, w http.ResponseWriter) int {
+		if n == 1 {
+			w.Header().Set(HeaderRetryAfter, "1")
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+
+	startedAt := time.Now()
+	resp, err := roundTrip(t, context.Background(), RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if elapsed := time.Since(startedAt); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least the 1s of Retry-After", elapsed)
+	}
+	if n := count.Load(); n != 2 {
+		t.Errorf("attempts = %d, want 2", n)
+	}
+}
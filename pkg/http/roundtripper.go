@@ -2,27 +2,44 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	stdio "io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/estebanreyl/image-gen-test/pkg/io"
 	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // HTTP related constants
 const (
-	HeaderChallenge     = "Www-Authenticate"
-	HeaderAuthorization = "Authorization"
-	HeaderContentType   = "Content-Type"
-	HeaderAccept        = "Accept"
-	HeaderLink          = "Link"
+	HeaderChallenge          = "Www-Authenticate"
+	HeaderAuthorization      = "Authorization"
+	HeaderContentType        = "Content-Type"
+	HeaderAccept             = "Accept"
+	HeaderLink               = "Link"
+	HeaderRange              = "Range"
+	HeaderContentRange       = "Content-Range"
+	HeaderOCIFilters         = "OCI-Filters-Applied"
+	HeaderRetryAfter         = "Retry-After"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderContentDigest      = "Docker-Content-Digest"
+	HeaderContentEncoding    = "Content-Encoding"
+	HeaderAcceptEncoding     = "Accept-Encoding"
+	HeaderAPIVersion         = "Docker-Distribution-Api-Version"
 )
 
+// maxLoggedBodySize is the number of bytes of a response body kept in the trace log,
+// larger bodies are truncated.
+const maxLoggedBodySize = 4096
+
 // Request represents a request made to the registry.
 type Request struct {
 	Method              string    `json:"method"`
@@ -33,13 +50,32 @@ type Request struct {
 
 // Response respresents a response received from the registry.
 type Response struct {
-	Code            int             `json:"code,omitempty"`
-	HeaderChallenge string          `json:"Www-Authenticate,omitempty"`
-	HeaderLocation  *url.URL        `json:"redirectLocation,omitempty"`
-	HeaderLink      string          `json:"link,omitempty"`
-	Size            int64           `json:"size,omitempty"`
-	SHA256Sum       digest.Digest   `json:"sha256,omitempty"`
-	Body            json.RawMessage `json:"body,omitempty"`
+	Code                     int             `json:"code,omitempty"`
+	HeaderChallenge          string          `json:"Www-Authenticate,omitempty"`
+	HeaderLocation           *url.URL        `json:"redirectLocation,omitempty"`
+	HeaderLink               string          `json:"link,omitempty"`
+	HeaderContentType        string          `json:"contentType,omitempty"`
+	HeaderContentRange       string          `json:"contentRange,omitempty"`
+	HeaderRange              string          `json:"range,omitempty"`
+	HeaderOCIFilters         string          `json:"ociFiltersApplied,omitempty"`
+	HeaderRetryAfter         string          `json:"retryAfter,omitempty"`
+	HeaderRateLimitRemaining string          `json:"rateLimitRemaining,omitempty"`
+	HeaderRateLimitReset     string          `json:"rateLimitReset,omitempty"`
+	HeaderContentDigest      string          `json:"contentDigest,omitempty"`
+	HeaderContentEncoding    string          `json:"contentEncoding,omitempty"`
+	HeaderAPIVersion         string          `json:"apiVersion,omitempty"`
+	HeaderContentLength      int64           `json:"contentLength,omitempty"`
+	Size                     int64           `json:"size,omitempty"`
+	SHA256Sum                digest.Digest   `json:"sha256,omitempty"`
+	Body                     json.RawMessage `json:"body,omitempty"`
+
+	// EncodedSize and EncodedSHA256Sum describe the encoded body received when it was decoded,
+	// in which case Size, SHA256Sum and Body describe the decoded body.
+	EncodedSize      int64         `json:"encodedSize,omitempty"`
+	EncodedSHA256Sum digest.Digest `json:"encodedSha256,omitempty"`
+
+	// Connection describes the connection of the round trip, if connection tracing is enabled.
+	Connection *ConnectionInfo `json:"connection,omitempty"`
 }
 
 // RoundTripInfo represents information about a network round-trip.
@@ -49,6 +85,27 @@ type RoundTripInfo struct {
 	Elapsed  string `json:"elapsed"`
 }
 
+// TraceFormat is the format of the round trips in trace logs.
+type TraceFormat string
+
+// Trace formats.
+const (
+	// TraceFormatPretty logs every round trip as indented JSON, for interactive use.
+	TraceFormatPretty TraceFormat = "pretty"
+
+	// TraceFormatJSONL logs every round trip as a single line of compact JSON, for log pipelines.
+	TraceFormatJSONL TraceFormat = "jsonl"
+)
+
+// Validate checks that the trace format is known, the empty format being pretty.
+func (f TraceFormat) Validate() error {
+	switch f {
+	case "", TraceFormatPretty, TraceFormatJSONL:
+		return nil
+	}
+	return fmt.Errorf("invalid trace format %q, expected %s or %s", f, TraceFormatPretty, TraceFormatJSONL)
+}
+
 // RoundTripper provides a means to do an HTTP/HTTPs round trip.
 type RoundTripper interface {
 	// RoundTrip makes an HTTP request and returns the response with some stats.
@@ -57,13 +114,46 @@ type RoundTripper interface {
 
 // RoundTripperWithContext provides an implementation for RoundTripper.
 type RoundTripperWithContext struct {
-	Base   http.RoundTripper
-	Logger zerolog.Logger
+	Base    http.RoundTripper
+	Logger  zerolog.Logger
+	Metrics *Metrics
+
+	// Recorder, when set, keeps every round trip for later inspection.
+	Recorder *Recorder
+
+	// Tracer, when set, receives a span for every round trip.
+	Tracer trace.Tracer
+
+	// LogAuthorization logs the Authorization header in full in trace logs, only its scheme
+	// is logged otherwise. The header is always sent in full.
+	LogAuthorization bool
+
+	// DecodeContent requests gzip and zstd encoded responses and decodes them, keeping the
+	// size and digest of the encoded body.
+	DecodeContent bool
+
+	// AcceptEncoding, when set, is sent as the Accept-Encoding header of GET requests instead
+	// of the encodings requested by DecodeContent, such as gzip or identity. Encoded responses
+	// are then decoded as with DecodeContent.
+	AcceptEncoding string
+
+	// TraceConnections records the connection of every round trip, including its TLS version,
+	// cipher suite and server certificate, to the response.
+	TraceConnections bool
+
+	// TraceFormat is the format of the round trips in trace logs, pretty if empty.
+	TraceFormat TraceFormat
 }
 
 // RoundTrip does an HTTP/HTTPs roundtrip and returns the response with some contextual info.
-func (r RoundTripperWithContext) RoundTrip(req *http.Request) (RoundTripInfo, error) {
-	info := RoundTripInfo{
+func (r RoundTripperWithContext) RoundTrip(req *http.Request) (info RoundTripInfo, err error) {
+	req, span := startSpan(r.Tracer, req)
+	if accept := r.acceptEncoding(req); accept != "" && req.Header.Get(HeaderAcceptEncoding) == "" {
+		// an explicit Accept-Encoding keeps the transport from decoding gzip transparently
+		req = req.Clone(req.Context())
+		req.Header.Set(HeaderAcceptEncoding, accept)
+	}
+	info = RoundTripInfo{
 		Request: Request{
 			Method:              req.Method,
 			URL:                 req.URL,
@@ -71,46 +161,113 @@ func (r RoundTripperWithContext) RoundTrip(req *http.Request) (RoundTripInfo, er
 			HeaderAuthorization: req.Header.Get(HeaderAuthorization),
 		},
 	}
+	// loggedBody is the response body as embedded in the trace log, the body itself when it is
+	// JSON and an escaped, possibly truncated, string otherwise.
+	var loggedBody json.RawMessage
 	defer func() {
-		info.Elapsed = time.Since(info.StartedAt).String()
+		elapsed := time.Since(info.StartedAt)
+		info.Elapsed = elapsed.String()
+		endSpan(span, info.Response.Code, info.Response.WireSize(), elapsed, err)
+		r.Metrics.Record(req.ContentLength, info.Response.WireSize(), info.Response.Code, info.StartedAt, elapsed)
+		r.Recorder.Record(info)
+		if info.Response.Code == http.StatusTooManyRequests {
+			r.Logger.Warn().Msgf("%s %s throttled, retry after: %q, rate limit remaining: %q, reset: %q",
+				info.Method, info.URL, info.Response.HeaderRetryAfter, info.Response.HeaderRateLimitRemaining, info.Response.HeaderRateLimitReset)
+		}
 		var msg string
-		bytes, err := json.MarshalIndent(info, "", "   ")
-
-		if err != nil && strings.HasPrefix(err.Error(), "json: error calling MarshalJSON for type") {
-			// Hack: This could be due to a non-JSON response. Attempt to modify the response body to JSON.
-			original := info.Response.Body
-			info.Response.Body = json.RawMessage(fmt.Sprintf("{\"pretty\": \"%s\"}", url.PathEscape(string(original))))
-			bytes, err = json.MarshalIndent(info, "", "   ")
-			info.Response.Body = original
+		logged := info
+		logged.Response.Body = loggedBody
+		if !r.LogAuthorization {
+			logged.Request.HeaderAuthorization = redactAuthorization(logged.Request.HeaderAuthorization)
 		}
-
-		if err != nil {
-			msg = fmt.Sprintf("marshal_error: %v", err)
+		// the named error is not reused, so a marshal error does not replace the round trip error
+		var bytes []byte
+		var marshalErr error
+		if r.TraceFormat == TraceFormatJSONL {
+			bytes, marshalErr = json.Marshal(logged)
+		} else {
+			bytes, marshalErr = json.MarshalIndent(logged, "", "   ")
+		}
+		if marshalErr != nil {
+			// keep what is needed to diagnose the response even if it cannot be marshaled
+			msg = fmt.Sprintf("marshal_error: %v, %s %s, status: %d, body: %q",
+				marshalErr, info.Method, info.URL, info.Response.Code, bodySnippet(info.Response.Body))
 		} else {
 			msg = string(bytes)
 		}
 		r.Logger.Trace().Msg(msg)
 	}()
 
+	var conn *ConnectionInfo
+	if r.TraceConnections {
+		conn = &ConnectionInfo{}
+		req = traceConnection(req, conn)
+	}
+
 	resp, err := r.Base.RoundTrip(req)
 	if err != nil {
 		return info, err
 	}
 	defer resp.Body.Close()
+	if conn != nil {
+		completeConnection(conn, resp)
+	}
 
 	bodyReader := io.NewReader(resp.Body)
-	bodyBytes, err := ioutil.ReadAll(bodyReader)
+	var decoder io.DecodingReader
+	if encoding := resp.Header.Get(HeaderContentEncoding); (r.DecodeContent || r.AcceptEncoding != "") && encoding != "" {
+		if decoder, err = io.NewDecodingReader(resp.Body, encoding); err != nil {
+			return info, err
+		}
+		defer decoder.Close()
+		bodyReader = decoder
+	}
+	var body stdio.Reader = bodyReader
+	if max := maxBodySize(req.Context()); max > 0 {
+		if resp.ContentLength > max {
+			return info, fmt.Errorf("%s %s: response body of %d bytes exceeds %d bytes: %w", req.Method, req.URL, resp.ContentLength, max, io.ErrTooLarge)
+		}
+		body = io.NewLimitedReader(bodyReader, max)
+	}
+	bodyBytes, err := ioutil.ReadAll(body)
+	if errors.Is(err, io.ErrTooLarge) {
+		return info, fmt.Errorf("%s %s: response body exceeds %d bytes: %w", req.Method, req.URL, maxBodySize(req.Context()), err)
+	}
 	if err != nil {
 		return info, err
 	}
 
 	info.Response = Response{
-		Code:            resp.StatusCode,
-		HeaderChallenge: resp.Header.Get(HeaderChallenge),
-		HeaderLink:      resp.Header.Get(HeaderLink),
-		Size:            bodyReader.N(),
-		SHA256Sum:       digest.NewDigest(digest.SHA256, bodyReader.SHA256Hash()),
-		Body:            bodyBytes,
+		Code:                     resp.StatusCode,
+		HeaderChallenge:          resp.Header.Get(HeaderChallenge),
+		HeaderLink:               resp.Header.Get(HeaderLink),
+		HeaderContentType:        resp.Header.Get(HeaderContentType),
+		HeaderContentRange:       resp.Header.Get(HeaderContentRange),
+		HeaderRange:              resp.Header.Get(HeaderRange),
+		HeaderOCIFilters:         resp.Header.Get(HeaderOCIFilters),
+		HeaderRetryAfter:         resp.Header.Get(HeaderRetryAfter),
+		HeaderRateLimitRemaining: rateLimitHeader(resp.Header, HeaderRateLimitRemaining),
+		HeaderRateLimitReset:     rateLimitHeader(resp.Header, HeaderRateLimitReset),
+		HeaderContentDigest:      resp.Header.Get(HeaderContentDigest),
+		HeaderAPIVersion:         resp.Header.Get(HeaderAPIVersion),
+		HeaderContentLength:      resp.ContentLength,
+		Size:                     bodyReader.N(),
+		SHA256Sum:                digest.NewDigest(digest.SHA256, bodyReader.SHA256Hash()),
+		Body:                     bodyBytes,
+	}
+	info.Response.Connection = conn
+	info.Response.HeaderContentEncoding = resp.Header.Get(HeaderContentEncoding)
+	if decoder != nil {
+		info.Response.EncodedSize = decoder.WireN()
+		info.Response.EncodedSHA256Sum = digest.NewDigest(digest.SHA256, decoder.WireSHA256Hash())
+	}
+	switch kind := bodyReader.ContentKind(); {
+	// a body only shaped like JSON would fail the marshaling of the whole trace record
+	case kind == io.ContentJSON && len(bodyBytes) <= maxLoggedBodySize && json.Valid(bodyBytes):
+		loggedBody = bodyBytes
+	case kind != io.ContentEmpty:
+		// marshaling a string cannot fail
+		loggedBody, _ = json.Marshal(bodySnippet(bodyBytes))
 	}
 
 	locURL, err := resp.Location()
@@ -122,5 +279,92 @@ func (r RoundTripperWithContext) RoundTrip(req *http.Request) (RoundTripInfo, er
 		info.Response.HeaderLocation = locURL
 	}
 
+	if rng := req.Header.Get(HeaderRange); rng != "" && info.Response.Code == http.StatusPartialContent {
+		if err := validatePartialContent(rng, info.Response); err != nil {
+			return info, err
+		}
+	}
+
 	return info, nil
 }
+
+// WireSize returns the size of the body as received, before it was decoded.
+func (r Response) WireSize() int64 {
+	if r.EncodedSHA256Sum != "" {
+		return r.EncodedSize
+	}
+	return r.Size
+}
+
+// acceptEncoding returns the Accept-Encoding header to send with the request, if any.
+func (r RoundTripperWithContext) acceptEncoding(req *http.Request) string {
+	switch {
+	case r.AcceptEncoding != "" && req.Method == http.MethodGet:
+		return r.AcceptEncoding
+	case r.DecodeContent:
+		return io.EncodingGzip + ", " + io.EncodingZstd
+	}
+	return ""
+}
+
+// WireSHA256Sum returns the digest of the body as received, before it was decoded.
+func (r Response) WireSHA256Sum() digest.Digest {
+	if r.EncodedSHA256Sum != "" {
+		return r.EncodedSHA256Sum
+	}
+	return r.SHA256Sum
+}
+
+// RetryAfter returns the delay requested by the Retry-After header, which holds either
+// a number of seconds or an HTTP date. It returns false if the header is absent or invalid.
+func (r Response) RetryAfter() (time.Duration, bool) {
+	if r.HeaderRetryAfter == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(r.HeaderRetryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(r.HeaderRetryAfter); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// bodySnippet returns the body as a string, truncated to maxLoggedBodySize bytes with
+// an indicator of the number of bytes left out.
+func bodySnippet(body []byte) string {
+	if len(body) <= maxLoggedBodySize {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d more bytes truncated)", body[:maxLoggedBodySize], len(body)-maxLoggedBodySize)
+}
+
+// rateLimitHeader returns the value of a rate limit header, falling back to its X- prefixed variant.
+func rateLimitHeader(header http.Header, name string) string {
+	if value := header.Get(name); value != "" {
+		return value
+	}
+	return header.Get("X-" + name)
+}
+
+// validatePartialContent checks that a partial response covers exactly the requested range.
+func validatePartialContent(requested string, resp Response) error {
+	want, err := ParseRange(requested)
+	if err != nil {
+		return err
+	}
+	got, _, err := ParseContentRange(resp.HeaderContentRange)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("requested range %d-%d, got %d-%d", want.Start, want.End, got.Start, got.End)
+	}
+	if resp.Size != want.Len() {
+		return fmt.Errorf("requested %d bytes, got %d", want.Len(), resp.Size)
+	}
+	return nil
+}
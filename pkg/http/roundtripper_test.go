@@ -0,0 +1,103 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// loggedRoundTrip sends a GET request to a server responding with the body, and returns the
+// response body as embedded in the trace log of the round trip.
+func loggedRoundTrip(t *testing.T, contentType string, body []byte) json.RawMessage {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderContentType, contentType)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	var logs bytes.Buffer
+	rt := RoundTripperWithContext{
+		Base:        http.DefaultTransport,
+		Logger:      zerolog.New(&logs).Level(zerolog.TraceLevel),
+		TraceFormat: TraceFormatJSONL,
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info.Response.Body, body) {
+		t.Errorf("response body of %d bytes, want the %d bytes received", len(info.Response.Body), len(body))
+	}
+
+	var line struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("trace log %q: %v", logs.String(), err)
+	}
+	var logged RoundTripInfo
+	if err := json.Unmarshal([]byte(line.Message), &logged); err != nil {
+		t.Fatalf("logged round trip %q: %v", line.Message, err)
+	}
+	return logged.Response.Body
+}
+
+func TestRoundTripLoggedBody(t *testing.T) {
+	jsonBody := []byte(`{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`)
+	largeJSON := []byte(fmt.Sprintf(`{"tags":[%q]}`, strings.Repeat("a", maxLoggedBodySize)))
+	text := []byte("404 page not found\n\t\"quoted\"")
+	// control characters make the body binary while keeping it valid UTF-8, so it survives
+	// being escaped as is
+	binary := bytes.Repeat([]byte{0x00, 0x01, 0x1b, 'a'}, maxLoggedBodySize/2)
+	truncated := func(body []byte) string {
+		return fmt.Sprintf("%s... (%d more bytes truncated)", body[:maxLoggedBodySize], len(body)-maxLoggedBodySize)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantRaw     []byte
+		wantString  string
+	}{
+		{name: "json embedded raw", contentType: "application/json", body: jsonBody, wantRaw: jsonBody},
+		{name: "invalid json escaped", contentType: "application/json", body: []byte("{not json}"), wantString: "{not json}"},
+		{name: "large json truncated", contentType: "application/json", body: largeJSON, wantString: truncated(largeJSON)},
+		{name: "text escaped", contentType: "text/plain", body: text, wantString: string(text)},
+		{name: "small binary escaped", contentType: "application/octet-stream", body: binary[:16], wantString: string(binary[:16])},
+		{name: "large binary truncated", contentType: "application/octet-stream", body: binary, wantString: truncated(binary)},
+		{name: "empty not logged", contentType: "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged := loggedRoundTrip(t, tt.contentType, tt.body)
+			switch {
+			case tt.wantRaw != nil:
+				if !bytes.Equal(logged, tt.wantRaw) {
+					t.Errorf("logged body = %s, want %s", logged, tt.wantRaw)
+				}
+			case tt.wantString != "":
+				var got string
+				if err := json.Unmarshal(logged, &got); err != nil {
+					t.Fatalf("logged body %s is not a string: %v", logged, err)
+				}
+				if got != tt.wantString {
+					t.Errorf("logged body = %q, want %q", got, tt.wantString)
+				}
+			case len(logged) > 0:
+				t.Errorf("logged body = %s, want none", logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TimeoutError indicates that an operation did not complete within its own timeout, as opposed
+// to the context of the whole command being done. It wraps context.DeadlineExceeded.
+type TimeoutError struct {
+	// Op describes the operation, such as "upload" or "DNS lookup of example.azurecr.io".
+	Op string
+
+	// Timeout is the timeout of the operation.
+	Timeout time.Duration
+}
+
+// Error describes the operation and its timeout.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Op, e.Timeout)
+}
+
+// Unwrap returns context.DeadlineExceeded.
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// WithTimeout returns a context derived from the parent that is done once the timeout elapses,
+// with a TimeoutError describing the operation as its cause. The parent is returned as is if
+// the timeout is not positive.
+func WithTimeout(parent context.Context, timeout time.Duration, op string) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeoutCause(parent, timeout, &TimeoutError{Op: op, Timeout: timeout})
+}
+
+// TimeoutCause annotates the error with the TimeoutError that caused the context to be done,
+// if any, so errors tell which operation timed out.
+func TimeoutCause(ctx context.Context, err error) error {
+	var timeout *TimeoutError
+	if err == nil || ctx.Err() == nil || errors.As(err, &timeout) || !errors.As(context.Cause(ctx), &timeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", timeout, err)
+}
+
+// TimeoutTransport is an http.RoundTripper bounding every request, until its response body is
+// closed, by a timeout derived from the request context. Uploads, blob upload requests with a
+// body, are bounded by UploadTimeout and every other request, including token requests, by
+// RequestTimeout. A timeout is disabled if not positive.
+type TimeoutTransport struct {
+	Base           http.RoundTripper
+	RequestTimeout time.Duration
+	UploadTimeout  time.Duration
+}
+
+// RoundTrip does an HTTP/HTTPs roundtrip bounded by the timeout of the request.
+func (t TimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout, op := t.RequestTimeout, "request"
+	if isUpload(req) {
+		timeout, op = t.UploadTimeout, "upload"
+	}
+	if timeout <= 0 {
+		return t.Base.RoundTrip(req)
+	}
+
+	ctx, cancel := WithTimeout(req.Context(), timeout, fmt.Sprintf("%s %s %s", op, req.Method, req.URL.Redacted()))
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, TimeoutCause(ctx, err)
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel}
+	return resp, nil
+}
+
+// isUpload indicates if the request sends blob content, a monolithic or chunk upload.
+func isUpload(req *http.Request) bool {
+	return (req.Method == http.MethodPut || req.Method == http.MethodPatch) &&
+		req.Body != nil && req.Body != http.NoBody && strings.Contains(req.URL.Path, "/blobs/uploads/")
+}
+
+// cancelBody is a response body releasing the timeout of its request once closed.
+type cancelBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Read reads the body, telling which operation timed out if the timeout elapsed.
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = TimeoutCause(b.ctx, err)
+	}
+	return n, err
+}
+
+// Close closes the body and releases the timeout.
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// DNSTimeoutDialer returns a dial function resolving host names within the timeout before
+// dialing their addresses with the dialer, in order, until one connects.
+func DNSTimeoutDialer(dialer *net.Dialer, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		lookupCtx, cancel := WithTimeout(ctx, timeout, "DNS lookup of "+host)
+		defer cancel()
+		ips, err := dialer.Resolver.LookupHost(lookupCtx, host)
+		if err != nil {
+			return nil, TimeoutCause(lookupCtx, err)
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
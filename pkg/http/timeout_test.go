@@ -0,0 +1,136 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	const slow = 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Query().Has("slowbody") {
+			// the response starts in time, its body does not
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(slow):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("done"))
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		transport TimeoutTransport
+		wantOp    string // the operation timing out, none if the request completes
+	}{
+		{name: "request timed out", method: http.MethodGet, path: "/v2/test/manifests/latest", transport: TimeoutTransport{RequestTimeout: 20 * time.Millisecond}, wantOp: "request GET"},
+		{name: "request within timeout", method: http.MethodGet, path: "/v2/test/manifests/latest", transport: TimeoutTransport{RequestTimeout: 5 * time.Second}},
+		{name: "upload bounded by upload timeout", method: http.MethodPut, path: "/v2/test/blobs/uploads/1", body: "blob", transport: TimeoutTransport{RequestTimeout: 20 * time.Millisecond, UploadTimeout: 5 * time.Second}},
+		{name: "upload timed out", method: http.MethodPatch, path: "/v2/test/blobs/uploads/1", body: "chunk", transport: TimeoutTransport{RequestTimeout: 5 * time.Second, UploadTimeout: 20 * time.Millisecond}, wantOp: "upload PATCH"},
+		{name: "manifest push bounded by request timeout", method: http.MethodPut, path: "/v2/test/manifests/latest", body: "{}", transport: TimeoutTransport{RequestTimeout: 20 * time.Millisecond, UploadTimeout: 5 * time.Second}, wantOp: "request PUT"},
+		{name: "upload session start bounded by request timeout", method: http.MethodPost, path: "/v2/test/blobs/uploads/", transport: TimeoutTransport{RequestTimeout: 20 * time.Millisecond, UploadTimeout: 5 * time.Second}, wantOp: "request POST"},
+		{name: "timeouts disabled", method: http.MethodGet, path: "/v2/test/manifests/latest"},
+		{name: "body timed out", method: http.MethodGet, path: "/v2/test/blobs/sha256:abc?slowbody=1", transport: TimeoutTransport{RequestTimeout: 20 * time.Millisecond}, wantOp: "request GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := tt.transport
+			transport.Base = http.DefaultTransport
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+
+			if tt.wantOp == "" {
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				return
+			}
+			var timeout *TimeoutError
+			if !errors.As(err, &timeout) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("RoundTrip() error = %v, want a TimeoutError", err)
+			}
+			if !strings.HasPrefix(timeout.Op, tt.wantOp+" ") {
+				t.Errorf("timed out operation = %q, want %q", timeout.Op, tt.wantOp)
+			}
+		})
+	}
+}
+
+func TestTimeoutCause(t *testing.T) {
+	errRequest := errors.New("request failed")
+	timedOut := func() context.Context {
+		ctx, cancel := WithTimeout(context.Background(), time.Nanosecond, "upload")
+		t.Cleanup(cancel)
+		<-ctx.Done()
+		return ctx
+	}
+	cancelled := func() context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		err         error
+		wantTimeout bool
+	}{
+		{name: "no error", ctx: timedOut()},
+		{name: "context not done", ctx: context.Background(), err: errRequest},
+		{name: "context cancelled", ctx: cancelled(), err: errRequest},
+		{name: "context timed out", ctx: timedOut(), err: errRequest, wantTimeout: true},
+		{name: "already annotated", ctx: timedOut(), err: &TimeoutError{Op: "request", Timeout: time.Second}, wantTimeout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := TimeoutCause(tt.ctx, tt.err)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("TimeoutCause() = %v, want nil", err)
+				}
+				return
+			}
+			var timeout *TimeoutError
+			if got := errors.As(err, &timeout); got != tt.wantTimeout {
+				t.Fatalf("TimeoutCause() = %v, annotated %v, want %v", err, got, tt.wantTimeout)
+			}
+			if !tt.wantTimeout {
+				if err != tt.err {
+					t.Errorf("TimeoutCause() = %v, want the error as is", err)
+				}
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), tt.err.Error()) {
+				t.Errorf("TimeoutCause() = %v, want it to wrap the deadline and tell the original error", err)
+			}
+			if strings.Count(err.Error(), "timed out") != 1 {
+				t.Errorf("TimeoutCause() = %v, want the timeout told once", err)
+			}
+		})
+	}
+}
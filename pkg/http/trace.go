@@ -0,0 +1,112 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Span attribute keys.
+const (
+	AttributeMethod  = attribute.Key("http.request.method")
+	AttributeURL     = attribute.Key("url.full")
+	AttributeStatus  = attribute.Key("http.response.status_code")
+	AttributeSize    = attribute.Key("http.response.body.size")
+	AttributeElapsed = attribute.Key("elapsed")
+)
+
+// Operation returns the name of the registry operation made by a request, such as push.manifest
+// or auth.token. Requests outside the registry API, such as redirected blob downloads, are named
+// after their method.
+func Operation(method string, u *url.URL) string {
+	path := u.Path
+	switch {
+	case strings.HasPrefix(path, "/oauth2/token"):
+		return "auth.token"
+	case strings.HasPrefix(path, "/oauth2/exchange"):
+		return "auth.exchange"
+	case path == "/v2/" || path == "/v2":
+		return "auth.challenge"
+	case path == "/v2/_catalog":
+		return "list.repositories"
+	case strings.HasPrefix(path, "/acr/v1/"):
+		return "acr." + strings.ToLower(method)
+	case !strings.HasPrefix(path, "/v2/"):
+		return "http." + strings.ToLower(method)
+	case strings.Contains(path, "/blobs/uploads"):
+		return "push.blob"
+	case strings.HasSuffix(path, "/tags/list"):
+		return "list.tags"
+	case strings.Contains(path, "/referrers/"):
+		return "list.referrers"
+	}
+
+	var kind string
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		kind = "manifest"
+	case strings.Contains(path, "/blobs/"):
+		kind = "blob"
+	default:
+		return "http." + strings.ToLower(method)
+	}
+	switch method {
+	case http.MethodPut:
+		return "push." + kind
+	case http.MethodDelete:
+		return "delete." + kind
+	case http.MethodHead:
+		return "check." + kind
+	}
+	return "pull." + kind
+}
+
+// startSpan starts a span for the request, named after its operation, and propagates the span
+// to the registry with the W3C trace context headers. The request is returned unchanged if the
+// tracer is nil.
+func startSpan(tracer trace.Tracer, req *http.Request) (*http.Request, trace.Span) {
+	if tracer == nil {
+		return req, noop.Span{}
+	}
+	ctx, span := tracer.Start(req.Context(), Operation(req.Method, req.URL), trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(AttributeMethod.String(req.Method), AttributeURL.String(spanURL(req.URL)))
+
+	req = req.Clone(ctx)
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endSpan records the outcome of a round trip on its span and ends it.
+func endSpan(span trace.Span, code int, size int64, elapsed time.Duration, err error) {
+	defer span.End()
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(AttributeElapsed.String(elapsed.String()))
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case code != 0:
+		span.SetAttributes(AttributeStatus.Int(code), AttributeSize.Int64(size))
+		if code >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+	}
+}
+
+// spanURL returns the URL without its query, which carries credentials in redirects to
+// the data endpoint.
+func spanURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = ""
+	redacted.User = nil
+	return redacted.String()
+}
@@ -0,0 +1,47 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestOperation(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{method: http.MethodGet, url: "https://example.azurecr.io/oauth2/token?scope=repository:test:pull", want: "auth.token"},
+		{method: http.MethodPost, url: "https://example.azurecr.io/oauth2/exchange", want: "auth.exchange"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/", want: "auth.challenge"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2", want: "auth.challenge"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/_catalog?n=100", want: "list.repositories"},
+		{method: http.MethodDelete, url: "https://example.azurecr.io/acr/v1/test", want: "acr.delete"},
+		{method: http.MethodGet, url: "https://example.blob.core.windows.net/data/sha256:abc?sig=secret", want: "http.get"},
+		{method: http.MethodPost, url: "https://example.azurecr.io/v2/test/blobs/uploads/", want: "push.blob"},
+		{method: http.MethodPatch, url: "https://example.azurecr.io/v2/test/blobs/uploads/0f1e", want: "push.blob"},
+		{method: http.MethodPut, url: "https://example.azurecr.io/v2/test/blobs/uploads/0f1e?digest=sha256:abc", want: "push.blob"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/nested/test/tags/list", want: "list.tags"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/test/referrers/sha256:abc", want: "list.referrers"},
+		{method: http.MethodPut, url: "https://example.azurecr.io/v2/test/manifests/latest", want: "push.manifest"},
+		{method: http.MethodDelete, url: "https://example.azurecr.io/v2/test/manifests/sha256:abc", want: "delete.manifest"},
+		{method: http.MethodHead, url: "https://example.azurecr.io/v2/test/manifests/latest", want: "check.manifest"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/test/manifests/latest", want: "pull.manifest"},
+		{method: http.MethodHead, url: "https://example.azurecr.io/v2/test/blobs/sha256:abc", want: "check.blob"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/test/blobs/sha256:abc", want: "pull.blob"},
+		{method: http.MethodDelete, url: "https://example.azurecr.io/v2/test/blobs/sha256:abc", want: "delete.blob"},
+		{method: http.MethodGet, url: "https://example.azurecr.io/v2/test/unknown", want: "http.get"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Operation(tt.method, u); got != tt.want {
+				t.Errorf("Operation(%s, %s) = %q, want %q", tt.method, tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package io
+
+import "unicode/utf8"
+
+// ContentKind describes the kind of content read.
+type ContentKind int
+
+// Content kinds.
+const (
+	// ContentEmpty is the kind of content when nothing was read.
+	ContentEmpty ContentKind = iota
+
+	// ContentJSON is UTF-8 text delimited as a JSON object or array.
+	ContentJSON
+
+	// ContentText is UTF-8 text without control characters other than whitespace.
+	ContentText
+
+	// ContentBinary is any other content.
+	ContentBinary
+)
+
+// String returns the name of the content kind.
+func (k ContentKind) String() string {
+	switch k {
+	case ContentEmpty:
+		return "empty"
+	case ContentJSON:
+		return "json"
+	case ContentText:
+		return "text"
+	}
+	return "binary"
+}
+
+// contentSniffer classifies content as it is read, without buffering it.
+// JSON is recognized by its delimiters only, the content is not validated.
+type contentSniffer struct {
+	n      int64
+	binary bool
+
+	// first and last are the first and last non whitespace bytes read.
+	first, last byte
+
+	// pending holds the start of a multi-byte rune split across reads.
+	pending []byte
+}
+
+// write classifies the next bytes read.
+func (s *contentSniffer) write(p []byte) {
+	s.n += int64(len(p))
+	if s.binary || len(p) == 0 {
+		return
+	}
+	for _, c := range p {
+		if !isSpace(c) {
+			if s.first == 0 {
+				s.first = c
+			}
+			break
+		}
+	}
+	for i := len(p) - 1; i >= 0; i-- {
+		if !isSpace(p[i]) {
+			s.last = p[i]
+			break
+		}
+	}
+
+	if len(s.pending) > 0 {
+		for len(p) > 0 && !utf8.FullRune(s.pending) {
+			s.pending = append(s.pending, p[0])
+			p = p[1:]
+		}
+		if !utf8.FullRune(s.pending) {
+			return
+		}
+		if r, size := utf8.DecodeRune(s.pending); r == utf8.RuneError && size == 1 {
+			s.binary = true
+			return
+		}
+		s.pending = s.pending[:0]
+	}
+
+	for i := 0; i < len(p); {
+		c := p[i]
+		if c < utf8.RuneSelf {
+			if (c < 0x20 && !isSpace(c)) || c == 0x7f {
+				s.binary = true
+				return
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(p[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !utf8.FullRune(p[i:]) {
+				s.pending = append(s.pending, p[i:]...)
+				return
+			}
+			s.binary = true
+			return
+		}
+		i += size
+	}
+}
+
+// kind returns the kind of the content read so far.
+func (s *contentSniffer) kind() ContentKind {
+	switch {
+	case s.n == 0:
+		return ContentEmpty
+	case s.binary || len(s.pending) > 0:
+		return ContentBinary
+	case s.first == '{' && s.last == '}', s.first == '[' && s.last == ']':
+		return ContentJSON
+	}
+	return ContentText
+}
+
+// isSpace indicates if the byte is JSON whitespace.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
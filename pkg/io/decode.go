@@ -0,0 +1,93 @@
+package io
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings supported by NewDecodingReader.
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+// DecodingReader is a Reader decompressing what it reads. N, SHA256Hash and ContentKind describe
+// the decompressed content, while the encoded content read from the wire is recorded separately.
+type DecodingReader interface {
+	Reader
+
+	// WireN is a record of the total number of encoded bytes read so far.
+	WireN() int64
+
+	// WireSHA256Hash returns the SHA256 hash of the encoded bytes read.
+	WireSHA256Hash() hash.Hash
+
+	// Close releases the decompressor.
+	Close() error
+}
+
+// NewDecodingReader creates a new DecodingReader decompressing content with the given
+// Content-Encoding, gzip or zstd. Identity or empty encodings are read as is.
+func NewDecodingReader(r io.Reader, encoding string) (DecodingReader, error) {
+	wire := NewReader(r)
+	d := &decodingReader{wire: wire}
+
+	var decoded io.Reader
+	switch encoding {
+	case "", EncodingIdentity:
+		decoded = wire
+	case EncodingGzip, "x-gzip":
+		gr, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, err
+		}
+		decoded, d.close = gr, gr.Close
+	case EncodingZstd:
+		zr, err := zstd.NewReader(wire)
+		if err != nil {
+			return nil, err
+		}
+		decoded = zr
+		d.close = func() error {
+			zr.Close()
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	hash := sha256.New()
+	d.ReaderWithContext = ReaderWithContext{base: io.TeeReader(decoded, hash), sha256Hash: hash}
+	return d, nil
+}
+
+// decodingReader provides an implementation of DecodingReader.
+type decodingReader struct {
+	ReaderWithContext
+	wire  Reader
+	close func() error
+}
+
+// WireN returns the total number of encoded bytes read.
+func (r *decodingReader) WireN() int64 {
+	return r.wire.N()
+}
+
+// WireSHA256Hash returns the SHA256 hash of the encoded bytes read.
+func (r *decodingReader) WireSHA256Hash() hash.Hash {
+	return r.wire.SHA256Hash()
+}
+
+// Close releases the decompressor, if any.
+func (r *decodingReader) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
@@ -0,0 +1,39 @@
+package io
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrTooLarge indicates that content exceeds the maximum size it is read with.
+var ErrTooLarge = errors.New("content too large")
+
+// limitedReader reads at most a maximum number of bytes.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// NewLimitedReader creates a reader reading at most max bytes from r. Unlike io.LimitReader,
+// reading past max fails with ErrTooLarge instead of ending the content early.
+func NewLimitedReader(r io.Reader, max int64) io.Reader {
+	return &limitedReader{r: r, n: max}
+}
+
+// Read reads the given bytes, or fails with ErrTooLarge once more than the maximum is read.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	// read one byte past the limit to tell content of exactly the maximum size from larger content
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.n = -1
+		return 0, ErrTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
@@ -6,8 +6,8 @@ import (
 	"io"
 )
 
-// Reader describes a reader with a record of the number of bytes
-// and a sha256 hash of what's read.
+// Reader describes a reader with a record of the number of bytes,
+// a sha256 hash and the kind of what's read.
 type Reader interface {
 	// Read reads the given bytes and returns the number of bytes read.
 	Read([]byte) (int, error)
@@ -17,6 +17,9 @@ type Reader interface {
 
 	// N is a record of the total number of bytes read so far.
 	N() int64
+
+	// ContentKind returns the kind of the content read so far.
+	ContentKind() ContentKind
 }
 
 // NewReader creates a new Reader
@@ -31,12 +34,14 @@ type ReaderWithContext struct {
 	base       io.Reader
 	sha256Hash hash.Hash
 	n          int64
+	sniffer    contentSniffer
 }
 
 // Read reads the given bytes
 func (r *ReaderWithContext) Read(p []byte) (int, error) {
 	n, err := r.base.Read(p)
 	r.n += int64(n)
+	r.sniffer.write(p[:n])
 	return n, err
 }
 
@@ -49,3 +54,8 @@ func (r *ReaderWithContext) N() int64 {
 func (r *ReaderWithContext) SHA256Hash() hash.Hash {
 	return r.sha256Hash
 }
+
+// ContentKind returns the kind of the bytes read, sniffed as they are read.
+func (r *ReaderWithContext) ContentKind() ContentKind {
+	return r.sniffer.kind()
+}
@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+)
+
+// Azure AD token exchange constants.
+const (
+	aadAuthorityHost = "https://login.microsoftonline.com"
+	aadTokenRoute    = "/%s/oauth2/v2.0/token" // add tenant
+	acrResource      = "https://containerregistry.azure.net"
+	acrResourceScope = acrResource + "/.default"
+
+	// DefaultMSIEndpoint is the token endpoint of the Azure instance metadata service.
+	DefaultMSIEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	msiAPIVersion      = "2018-02-01"
+	// msiTimeout bounds managed identity token requests, so hosts without the instance
+	// metadata service fail fast.
+	msiTimeout = 10 * time.Second
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	routeOAuthExchange = "/oauth2/exchange"
+)
+
+// AADOptions are the Azure AD credentials used to authenticate to ACR, those of a service
+// principal or of a managed identity.
+type AADOptions struct {
+	// TenantID is the Azure AD tenant of the service principal
+	TenantID string
+
+	// ClientID is the application (client) ID of the service principal, or of the user
+	// assigned managed identity
+	ClientID string
+
+	// ClientSecret is the client secret of the service principal
+	ClientSecret string
+
+	// ManagedIdentity gets the AAD access token of the managed identity of the Azure host from
+	// the instance metadata service, the system assigned identity unless ClientID is set
+	ManagedIdentity bool
+
+	// MSIEndpoint is the token endpoint of the instance metadata service, defaults to
+	// DefaultMSIEndpoint
+	MSIEndpoint string
+
+	// FederatedTokenFile is a file holding an OIDC token federated with the client, such as
+	// the one of a Kubernetes workload identity, used as the client assertion instead of the
+	// client secret or the instance metadata service
+	FederatedTokenFile string
+}
+
+// aadTokenSource obtains an ACR refresh token for a service principal.
+// The AAD access token is exchanged for an ACR refresh token once and then cached.
+type aadTokenSource struct {
+	opts        AADOptions
+	loginServer string
+	baseURL     string
+	tripper     rhttp.RoundTripper
+
+	mu           sync.Mutex
+	refreshToken string
+}
+
+// RefreshToken returns an ACR refresh token, acquiring it if needed.
+func (s *aadTokenSource) RefreshToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refreshToken != "" {
+		return s.refreshToken, nil
+	}
+
+	aadToken, err := s.aadToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	refreshToken, err := s.exchange(ctx, aadToken)
+	if err != nil {
+		return "", err
+	}
+	s.refreshToken = refreshToken
+	return refreshToken, nil
+}
+
+// aadToken obtains an AAD access token for the container registry resource.
+func (s *aadTokenSource) aadToken(ctx context.Context) (string, error) {
+	if s.opts.ManagedIdentity && s.opts.FederatedTokenFile == "" {
+		return s.msiToken(ctx)
+	}
+
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {s.opts.ClientID},
+		"scope":      {acrResourceScope},
+	}
+	if s.opts.FederatedTokenFile != "" {
+		assertion, err := os.ReadFile(s.opts.FederatedTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read federated token: %w", err)
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	} else {
+		form.Set("client_secret", s.opts.ClientSecret)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := s.postForm(ctx, aadAuthorityHost+fmt.Sprintf(aadTokenRoute, url.PathEscape(s.opts.TenantID)), form, &result); err != nil {
+		return "", fmt.Errorf("get AAD access token failed: %w", err)
+	}
+	return result.AccessToken, nil
+}
+
+// msiToken obtains an AAD access token for the container registry resource from the instance
+// metadata service.
+func (s *aadTokenSource) msiToken(ctx context.Context) (string, error) {
+	endpoint := s.opts.MSIEndpoint
+	if endpoint == "" {
+		endpoint = DefaultMSIEndpoint
+	}
+	query := url.Values{
+		"api-version": {msiAPIVersion},
+		"resource":    {acrResource},
+	}
+	if s.opts.ClientID != "" {
+		query.Set("client_id", s.opts.ClientID)
+	}
+
+	ctx, cancel := rhttp.WithTimeout(ctx, msiTimeout, "managed identity token request")
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	tripInfo, err := s.tripper.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("instance metadata service %s unreachable, managed identity auth requires an Azure host with a managed identity: %w", endpoint, rhttp.TimeoutCause(ctx, err))
+	}
+	if err := checkStatus("managed identity token request", tripInfo, http.StatusOK); err != nil {
+		return "", fmt.Errorf("get AAD access token failed: %w", err)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(tripInfo.Response.Body, &result); err != nil {
+		return "", fmt.Errorf("get AAD access token failed: %w", err)
+	}
+	return result.AccessToken, nil
+}
+
+// exchange exchanges an AAD access token for an ACR refresh token.
+func (s *aadTokenSource) exchange(ctx context.Context, aadToken string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {s.loginServer},
+		"access_token": {aadToken},
+	}
+	// the tenant of a managed identity is not known, the registry then uses the one of the token
+	if s.opts.TenantID != "" {
+		form.Set("tenant", s.opts.TenantID)
+	}
+	var result struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := s.postForm(ctx, s.baseURL+routeOAuthExchange, form, &result); err != nil {
+		return "", fmt.Errorf("exchange AAD access token failed: %w", err)
+	}
+	return result.RefreshToken, nil
+}
+
+// postForm posts a form and decodes the JSON response into result.
+func (s *aadTokenSource) postForm(ctx context.Context, endpoint string, form url.Values, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(rhttp.HeaderContentType, "application/x-www-form-urlencoded")
+
+	tripInfo, err := s.tripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	if err := checkStatus("token request", tripInfo, http.StatusOK); err != nil {
+		return err
+	}
+	return json.Unmarshal(tripInfo.Response.Body, result)
+}
+
+// validate checks that all credentials of the service principal or managed identity are set.
+func (o AADOptions) validate() error {
+	switch {
+	case o.ManagedIdentity && o.ClientSecret != "":
+		return errors.New("cannot use a client secret with managed identity auth")
+	case o.FederatedTokenFile != "" && o.ClientSecret != "":
+		return errors.New("cannot use a client secret with a federated token")
+	case o.FederatedTokenFile != "" && (o.TenantID == "" || o.ClientID == ""):
+		return errors.New("tenant and client id required with a federated token")
+	case o.ManagedIdentity:
+		return nil
+	case o.TenantID == "" || o.ClientID == "" || o.ClientSecret == "":
+		return errors.New("tenant, client id and client secret required for AAD auth")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pushArtifact pushes an artifact manifest with an empty config and the given layers.
+// The manifest is pushed by digest, unless a tag is given.
+func (p Proxy) pushArtifact(ctx context.Context, repo, tag, artifactType string, subject *ociimagespec.Descriptor, layers []ContentGenerator, annotations map[string]string) (ociimagespec.Descriptor, error) {
+	return p.pushManifest(ctx, repo, tag, manifestContent{
+		config:       p.emptyConfig(artifactType),
+		layers:       layers,
+		artifactType: artifactType,
+		subject:      subject,
+		annotations:  annotations,
+	})
+}
+
+// NewRepositoryName returns a new time based repository name.
+func NewRepositoryName() string {
+	return fmt.Sprintf("%v%v", repoprefix, newTimeID())
+}
+
+// lastTimeID is the last ID returned by newTimeID.
+var lastTimeID atomic.Int64
+
+// newTimeID returns the current unix time, or the next unused second if it was already returned,
+// so names generated in quick succession do not collide.
+func newTimeID() int64 {
+	for {
+		last := lastTimeID.Load()
+		id := time.Now().Unix()
+		if id <= last {
+			id = last + 1
+		}
+		if lastTimeID.CompareAndSwap(last, id) {
+			return id
+		}
+	}
+}
+
+// SubjectDescriptor returns the descriptor of the manifest with the given reference in the repository.
+// If reference is empty, a new subject image, or index if SubjectIsIndex is set, is pushed instead.
+// If SubjectIsArtifact is set, the new subject is an artifact referring to that image or index.
+func (p Proxy) SubjectDescriptor(ctx context.Context, repo, reference string) (ociimagespec.Descriptor, error) {
+	if reference == "" {
+		desc, _, err := p.pushSubject(ctx, repo)
+		return desc, err
+	}
+	return p.ResolveDescriptor(ctx, repo, reference)
+}
+
+// pushSubject pushes a new subject as described by SubjectDescriptor. The manifest an artifact
+// subject refers to is returned as well, nil for other subjects.
+func (p Proxy) pushSubject(ctx context.Context, repo string) (ociimagespec.Descriptor, *ociimagespec.Descriptor, error) {
+	tag := "oci-subject"
+	if p.SubjectIsArtifact {
+		tag = "oci-subject-base"
+	}
+	var base ociimagespec.Descriptor
+	var err error
+	if p.SubjectIsIndex {
+		base, _, err = p.pushIndex(ctx, repo, tag, ociimagespec.MediaTypeImageIndex, "", nil, nil)
+	} else {
+		base, err = p.pushOCIImage(ctx, repo, tag, p.configGenerator(), p.imageLayerGenerators(tag, p.subjectLayerCount()))
+	}
+	if err != nil || !p.SubjectIsArtifact {
+		return base, nil, err
+	}
+
+	subject, err := p.pushOCIArtifact(ctx, &base, repo, "oci-subject", ArtifactConstructOptions{
+		IncludesArtifactType: true,
+		ConfigIsScratch:      true,
+		LayerCount:           1,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+	})
+	if err != nil {
+		return ociimagespec.Descriptor{}, nil, fmt.Errorf("push artifact subject referring to %s: %w", base.Digest, err)
+	}
+	p.Logger.Info().Msgf("Pushed artifact subject %s referring to %s", subject.Digest, base.Digest)
+	return subject, &base, nil
+}
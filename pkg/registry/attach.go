@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Attached file defaults.
+const (
+	// DefaultAttachArtifactType is the artifact type of attached files if none is given.
+	DefaultAttachArtifactType = "application/vnd.unknown.artifact.v1"
+
+	// DefaultAttachMediaType is the media type of an attached file if none is given.
+	DefaultAttachMediaType = ociimagespec.MediaTypeImageLayer
+)
+
+// FileContent generates the content of a local file, annotated with the file name.
+type FileContent struct {
+	Path      string
+	MediaType string
+}
+
+// Generate returns the content of the file, which must not change size while it is read.
+func (g FileContent) Generate() (string, []byte, error) {
+	f, err := os.Open(g.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := readVerified(f, ociimagespec.Descriptor{Size: info.Size()})
+	if err != nil {
+		return "", nil, fmt.Errorf("read %s: %w", g.Path, err)
+	}
+	mediaType := g.MediaType
+	if mediaType == "" {
+		mediaType = DefaultAttachMediaType
+	}
+	return mediaType, data, nil
+}
+
+// Annotations returns the title annotation naming the file.
+func (g FileContent) Annotations() map[string]string {
+	return map[string]string{
+		ociimagespec.AnnotationTitle: filepath.Base(g.Path),
+	}
+}
+
+// Attach pushes an artifact with the files as layers, referring to the manifest at the reference
+// in the repository, which is resolved to set the artifact subject.
+func (p Proxy) Attach(ctx context.Context, repo, reference, artifactType string, files []FileContent) (_ ociimagespec.Descriptor, err error) {
+	ctx, span := p.startSpan(ctx, "attach", repo)
+	defer func() { endSpan(span, err) }()
+
+	if len(files) == 0 {
+		return ociimagespec.Descriptor{}, errors.New("at least one file required")
+	}
+	if artifactType == "" {
+		artifactType = DefaultAttachArtifactType
+	}
+	subject, err := p.ResolveDescriptor(ctx, repo, reference)
+	if err != nil {
+		return ociimagespec.Descriptor{}, fmt.Errorf("resolve subject: %w", err)
+	}
+
+	layers := make([]ContentGenerator, len(files))
+	for i, file := range files {
+		layers[i] = file
+	}
+	return p.pushArtifact(ctx, repo, "", artifactType, &subject, layers, nil)
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+)
+
+// resolverAuthorizer authorizes the requests of the containerd resolver with the credentials of
+// the transport. Bearer tokens are shared with the transport, so a token expiring during a push is
+// refreshed once from the challenge of the rejected request, as for the requests of the transport.
+type resolverAuthorizer struct {
+	t transport
+}
+
+var _ docker.Authorizer = resolverAuthorizer{}
+
+// Authorize sets the cached bearer token, or the basic auth credentials, on the request.
+func (a resolverAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	switch a.t.authType {
+	case basicAuth:
+		req.SetBasicAuth(a.t.username, a.t.password)
+	default:
+		// without credentials, the token is an anonymous one answering an earlier challenge
+		if token := a.t.token.get(requestRepository(req.URL)); token != "" {
+			req.Header.Set(rhttp.HeaderAuthorization, "Bearer "+token)
+		}
+	}
+	return nil
+}
+
+// AddResponses refreshes the bearer token from the challenge of the last response, a 401, so the
+// resolver retries the request with it. A request is retried once, it fails if it is rejected
+// again with the refreshed token.
+func (a resolverAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	last := responses[len(responses)-1]
+	if a.t.authType == basicAuth {
+		return fmt.Errorf("basic auth rejected: %w", errdefs.ErrNotImplemented)
+	}
+	if unauthorized := countUnauthorized(responses); unauthorized > 1 {
+		return fmt.Errorf("%s %s rejected %d times, the refreshed token too: %w", last.Request.Method, last.Request.URL, unauthorized, ErrUnauthorized)
+	}
+
+	repo := requestRepository(last.Request.URL)
+	rejected := strings.TrimPrefix(last.Request.Header.Get(rhttp.HeaderAuthorization), "Bearer ")
+	if rejected != "" {
+		a.t.logger.Trace().Msgf("%s %s rejected the bearer token, requesting a new token", last.Request.Method, last.Request.URL)
+		a.t.token.invalidate(repo, rejected)
+	}
+	_, err := a.t.tokenFromChallenge(ctx, repo, last.Header.Get(rhttp.HeaderChallenge))
+	return err
+}
+
+// countUnauthorized returns the number of 401 responses.
+func countUnauthorized(responses []*http.Response) int {
+	n := 0
+	for _, resp := range responses {
+		if resp.StatusCode == http.StatusUnauthorized {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// UploadStats describes repeated uploads of blobs of the same size with one upload method.
+type UploadStats struct {
+	// ChunkSize is the size of the uploaded chunks, zero for monolithic uploads.
+	ChunkSize int64
+
+	// Elapsed are the durations of the uploads.
+	Elapsed []time.Duration
+}
+
+// Method returns the name of the upload method.
+func (s UploadStats) Method() string {
+	if s.ChunkSize == 0 {
+		return "monolithic"
+	}
+	return fmt.Sprintf("chunked %d bytes", s.ChunkSize)
+}
+
+// Min returns the shortest upload duration.
+func (s UploadStats) Min() time.Duration {
+	var min time.Duration
+	for i, elapsed := range s.Elapsed {
+		if i == 0 || elapsed < min {
+			min = elapsed
+		}
+	}
+	return min
+}
+
+// Max returns the longest upload duration.
+func (s UploadStats) Max() time.Duration {
+	var max time.Duration
+	for _, elapsed := range s.Elapsed {
+		if elapsed > max {
+			max = elapsed
+		}
+	}
+	return max
+}
+
+// Mean returns the average upload duration.
+func (s UploadStats) Mean() time.Duration {
+	if len(s.Elapsed) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, elapsed := range s.Elapsed {
+		total += elapsed
+	}
+	return total / time.Duration(len(s.Elapsed))
+}
+
+// Throughput returns the average upload bandwidth in bytes per second for blobs of the given size.
+func (s UploadStats) Throughput(size int64) float64 {
+	mean := s.Mean()
+	if mean <= 0 {
+		return 0
+	}
+	return float64(size) / mean.Seconds()
+}
+
+// UploadBenchmarkResult describes the uploads of a benchmark.
+type UploadBenchmarkResult struct {
+	// Size is the size of every uploaded blob.
+	Size int64
+
+	// Stats are the statistics of every upload method, monolithic first.
+	Stats []UploadStats
+}
+
+// GenerateUploadBenchmark uploads blobs of the given size count times with the monolithic upload
+// of the containerd pusher, then count times in chunks of every given size.
+// Every upload sends a distinct blob, so the registry cannot skip uploads of content it already has.
+func (p Proxy) GenerateUploadBenchmark(ctx context.Context, repo string, size int64, chunkSizes []int64, count int) (_ UploadBenchmarkResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.upload_benchmark", repo)
+	defer func() { endSpan(span, err) }()
+
+	if size <= 0 {
+		return UploadBenchmarkResult{}, fmt.Errorf("invalid blob size %d", size)
+	}
+	for _, chunkSize := range chunkSizes {
+		if chunkSize <= 0 {
+			return UploadBenchmarkResult{}, fmt.Errorf("invalid chunk size %d", chunkSize)
+		}
+	}
+
+	pusher, err := p.pusher(ctx, repo, "")
+	if err != nil {
+		return UploadBenchmarkResult{}, err
+	}
+	result := UploadBenchmarkResult{Size: size}
+	blob := 0
+	for _, chunkSize := range append([]int64{0}, chunkSizes...) {
+		stats := UploadStats{ChunkSize: chunkSize}
+		for i := 0; i < count; i++ {
+			g := CustomLayer{
+				Content: TimestampLayer{Tag: fmt.Sprintf("%s-benchmark", tagPrefix), Index: blob},
+				Spec:    LayerSpec{MediaType: ociimagespec.MediaTypeImageLayer, Size: size},
+				Index:   blob,
+			}
+			blob++
+			_, data, err := g.Generate()
+			if err != nil {
+				return result, err
+			}
+			desc := ociimagespec.Descriptor{
+				MediaType: ociimagespec.MediaTypeImageLayer,
+				Digest:    digest.FromBytes(data),
+				Size:      size,
+			}
+
+			startedAt := time.Now()
+			if chunkSize == 0 {
+				err = p.uploadBytes(ctx, pusher, repo, "", desc, data)
+			} else {
+				err = p.uploadChunked(ctx, repo, desc, data, chunkSize)
+			}
+			if err != nil {
+				return result, fmt.Errorf("%s upload: %w", stats.Method(), err)
+			}
+			stats.Elapsed = append(stats.Elapsed, time.Since(startedAt))
+		}
+		result.Stats = append(result.Stats, stats)
+	}
+	return result, nil
+}
@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/estebanreyl/image-gen-test/pkg/io"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PullBlob downloads a blob from the registry and verifies its digest.
+// Redirects to the data endpoint are followed. If HeadBeforeGet is set, the blob is first
+// described by a HEAD request, and the downloaded content must match the description.
+// If PullRangeSize is set, the blob is downloaded in chunks of that size, its size being
+// requested with a HEAD request first.
+func (p Proxy) PullBlob(ctx context.Context, repo string, dgst digest.Digest) (rhttp.RoundTripInfo, error) {
+	var head ociimagespec.Descriptor
+	if p.HeadBeforeGet || p.PullRangeSize > 0 {
+		var err error
+		if head, err = p.HeadBlob(ctx, repo, dgst); err != nil {
+			return rhttp.RoundTripInfo{}, err
+		}
+	}
+	// an empty blob has no range to request
+	if p.PullRangeSize > 0 && head.Size > 0 {
+		return p.pullBlobRange(ctx, repo, ociimagespec.Descriptor{Digest: dgst, Size: head.Size}, p.PullRangeSize)
+	}
+
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodGet,
+		url:      p.url(routeBlobs, repo, dgst),
+		op:       fmt.Sprintf("pull blob %s", dgst),
+		expected: []int{http.StatusOK},
+	})
+	if err != nil {
+		return tripInfo, err
+	}
+	if p.HeadBeforeGet {
+		if err := verifyHead(dgst, head, tripInfo.Response); err != nil {
+			return tripInfo, err
+		}
+	}
+	return tripInfo, p.verifyPulledBlob(dgst, tripInfo.Response)
+}
+
+// HeadBlob returns the descriptor of the blob as reported by the registry in the headers of a
+// HEAD request, following redirects. The size is the Content-Length, which must be set, and the
+// digest the Docker-Content-Digest header, if set, which must then match the blob digest.
+func (p Proxy) HeadBlob(ctx context.Context, repo string, dgst digest.Digest) (ociimagespec.Descriptor, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodHead,
+		url:      p.url(routeBlobs, repo, dgst),
+		op:       fmt.Sprintf("head blob %s", dgst),
+		expected: []int{http.StatusOK},
+	})
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+
+	resp := tripInfo.Response
+	if resp.HeaderContentLength < 0 {
+		return ociimagespec.Descriptor{}, fmt.Errorf("head blob %s: registry did not return the Content-Length header", dgst)
+	}
+	desc := ociimagespec.Descriptor{Size: resp.HeaderContentLength}
+	if resp.HeaderContentDigest != "" {
+		if desc.Digest, err = digest.Parse(resp.HeaderContentDigest); err != nil {
+			return desc, fmt.Errorf("head blob %s: invalid %s header: %w", dgst, rhttp.HeaderContentDigest, err)
+		}
+		if desc.Digest != dgst {
+			return desc, fmt.Errorf("head blob %s failed, registry reported digest %s: %w", dgst, desc.Digest, ErrDigestMismatch)
+		}
+	}
+	return desc, nil
+}
+
+// verifyHead checks that a blob downloaded by a GET request matches the digest and size a HEAD
+// request reported for it. A blob compressed for transport by the GET may match either as
+// received or once decoded.
+func verifyHead(dgst digest.Digest, head ociimagespec.Descriptor, resp rhttp.Response) error {
+	if head.Size != resp.Size && head.Size != resp.WireSize() {
+		return fmt.Errorf("pull blob %s failed, HEAD reported size %d, GET served %d bytes: %w", dgst, head.Size, resp.WireSize(), ErrHeadMismatch)
+	}
+	if length := resp.HeaderContentLength; length >= 0 && length != head.Size && resp.Size != head.Size {
+		return fmt.Errorf("pull blob %s failed, HEAD reported Content-Length %d, GET reported %d: %w", dgst, head.Size, length, ErrHeadMismatch)
+	}
+	if head.Digest != "" && head.Digest.Algorithm() == digest.SHA256 && head.Digest != resp.SHA256Sum && head.Digest != resp.WireSHA256Sum() {
+		return fmt.Errorf("pull blob %s failed, HEAD reported digest %s, GET served %s: %w", dgst, head.Digest, resp.SHA256Sum, ErrHeadMismatch)
+	}
+	return nil
+}
+
+// verifyPulledBlob checks the digest of a pulled blob. A blob served with a Content-Encoding
+// was compressed for transport and must match its digest once decoded. A blob only matching
+// as received means the registry labeled the blob bytes themselves with a Content-Encoding,
+// wrongly applying transport compression to content addressable content, which clients
+// decoding the response transparently would fail to verify.
+func (p Proxy) verifyPulledBlob(dgst digest.Digest, resp rhttp.Response) error {
+	if dgst.Algorithm() != digest.SHA256 {
+		return nil
+	}
+	encoding := resp.HeaderContentEncoding
+	if encoding == "" || encoding == io.EncodingIdentity {
+		if resp.SHA256Sum != dgst {
+			return fmt.Errorf("pull blob %s failed, got digest %s: %w", dgst, resp.SHA256Sum, ErrDigestMismatch)
+		}
+		return nil
+	}
+
+	switch {
+	case resp.EncodedSHA256Sum != "" && resp.SHA256Sum == dgst:
+		p.Logger.Info().Msgf("Blob %s was compressed with %s for transport, the decoded content matches its digest", dgst, encoding)
+	case resp.WireSHA256Sum() == dgst:
+		p.Logger.Warn().Msgf("Blob %s was served with Content-Encoding %s but only its encoded bytes match its digest, the registry wrongly applies transport compression to blobs", dgst, encoding)
+	default:
+		return fmt.Errorf("pull blob %s failed, got digest %s decoded from %s content: %w", dgst, resp.SHA256Sum, encoding, ErrDigestMismatch)
+	}
+	return nil
+}
+
+// pullBlobRange downloads a blob of the given size in chunks using Range requests.
+// Every chunk must be served as partial content covering exactly the requested range,
+// and the digest of the assembled chunks must match the blob digest. The round trip of the
+// last chunk is returned, with the body, size and digest of the assembled blob.
+func (p Proxy) pullBlobRange(ctx context.Context, repo string, desc ociimagespec.Descriptor, chunkSize int64) (rhttp.RoundTripInfo, error) {
+	var tripInfo rhttp.RoundTripInfo
+	data := make([]byte, 0, desc.Size)
+	for start := int64(0); start < desc.Size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= desc.Size {
+			end = desc.Size - 1
+		}
+		var err error
+		tripInfo, err = p.transport.roundTrip(ctx, registryRequest{
+			method:    http.MethodGet,
+			url:       p.url(routeBlobs, repo, desc.Digest),
+			byteRange: &rhttp.ByteRange{Start: start, End: end},
+			op:        fmt.Sprintf("pull blob %s range %d-%d", desc.Digest, start, end),
+			expected:  []int{http.StatusPartialContent},
+		})
+		if err != nil {
+			return tripInfo, err
+		}
+		data = append(data, tripInfo.Response.Body...)
+	}
+
+	tripInfo.Response.Body = data
+	tripInfo.Response.Size = int64(len(data))
+	tripInfo.Response.SHA256Sum = digest.FromBytes(data)
+	if got := desc.Digest.Algorithm().FromBytes(data); got != desc.Digest {
+		return tripInfo, fmt.Errorf("pull blob %s by range failed, assembled digest %s: %w", desc.Digest, got, ErrDigestMismatch)
+	}
+	return tripInfo, nil
+}
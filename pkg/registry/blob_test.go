@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPullBlobRange(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	dgst := digest.FromBytes(data)
+	tests := []struct {
+		name      string
+		rangeSize int64
+		ignore    bool
+		wantGets  int
+		wantErr   error
+	}{
+		{name: "without ranges", wantGets: 1},
+		{name: "uneven chunks", rangeSize: 300, wantGets: 4},
+		{name: "even chunks", rangeSize: 250, wantGets: 4},
+		{name: "single chunk", rangeSize: 2000, wantGets: 1},
+		{name: "range ignored", rangeSize: 300, ignore: true, wantGets: 1, wantErr: ErrUnexpectedStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			m.mu.Lock()
+			m.storeBlob("ranged", dgst, data)
+			m.mu.Unlock()
+			if tt.ignore {
+				m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+					if r.Method != http.MethodGet {
+						return false
+					}
+					w.WriteHeader(http.StatusOK)
+					w.Write(data)
+					return true
+				}
+			}
+			p := newTestProxy(t, server, Options{PullRangeSize: tt.rangeSize})
+
+			tripInfo, err := p.PullBlob(context.Background(), "ranged", dgst)
+			if gets := m.count(http.MethodGet, "/blobs/"); gets != tt.wantGets {
+				t.Errorf("GET requests = %d, want %d", gets, tt.wantGets)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(tripInfo.Response.Body, data) {
+				t.Errorf("pulled %d bytes, want the %d bytes of the blob", len(tripInfo.Response.Body), len(data))
+			}
+			if tripInfo.Response.SHA256Sum != dgst {
+				t.Errorf("pulled digest = %s, want %s", tripInfo.Response.SHA256Sum, dgst)
+			}
+		})
+	}
+}
+
+func TestPushBytesCommitDigest(t *testing.T) {
+	data := []byte("committed blob")
+	desc := ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	otherDigest := digest.FromString("altered blob")
+	tests := []struct {
+		name         string
+		returned     digest.Digest
+		wantErr      error
+		wantVerified int
+		wantMismatch int
+	}{
+		{name: "matching digest", returned: desc.Digest, wantVerified: 1},
+		{name: "altered content", returned: otherDigest, wantErr: ErrDigestMismatch, wantMismatch: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/blobs/uploads/") {
+					return false
+				}
+				w.Header().Set("Location", "/v2/committed/blobs/"+tt.returned.String())
+				w.Header().Set("Docker-Content-Digest", tt.returned.String())
+				w.WriteHeader(http.StatusCreated)
+				return true
+			}
+			p := newTestProxy(t, server, Options{})
+			ctx := context.Background()
+			pusher, err := p.pusher(ctx, "committed", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = p.pushBytes(ctx, pusher, desc, data)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("pushBytes() error = %v, want %v", err, tt.wantErr)
+			}
+			summary := p.Metrics()
+			if summary.VerifiedDigests != tt.wantVerified || summary.MismatchedDigests != tt.wantMismatch {
+				t.Errorf("commit digests %d verified, %d mismatched, want %d and %d",
+					summary.VerifiedDigests, summary.MismatchedDigests, tt.wantVerified, tt.wantMismatch)
+			}
+		})
+	}
+}
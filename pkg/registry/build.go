@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Blob is a generated blob referenced by a built manifest.
+type Blob struct {
+	Descriptor ociimagespec.Descriptor
+	Data       []byte
+}
+
+// BuildOptions control how manifests are built by BuildOCIImage and BuildOCIArtifact.
+type BuildOptions struct {
+	// InlineConfig embeds small configs in the config descriptor data field.
+	InlineConfig bool
+
+	// InlineLayers embeds small layers in the layer descriptor data field.
+	InlineLayers bool
+
+	// InlineThreshold is the maximum size in bytes of inlined content, defaults to 1024.
+	InlineThreshold int64
+
+	// ForeignLayerURLs are referenced as non-distributable layers after the generated layers.
+	ForeignLayerURLs []string
+
+	// Subject is the manifest the built manifest refers to, if any.
+	Subject *ociimagespec.Descriptor
+
+	// Annotations are the annotations of the built manifest.
+	Annotations map[string]string
+
+	// NormalizeJSON canonicalizes the manifest, sorting its keys and removing insignificant
+	// whitespace, before its digest is computed.
+	NormalizeJSON bool
+}
+
+// BuildOCIImage generates the config and layers of an OCI image and returns the content and
+// descriptor of its manifest along with the blobs it references, without any network I/O.
+// The config is given the diff IDs of the layers if it is an ImageConfig, an image requires one.
+func BuildOCIImage(config ContentGenerator, layers []ContentGenerator, opts BuildOptions) ([]byte, ociimagespec.Descriptor, []Blob, error) {
+	if config == nil {
+		return nil, ociimagespec.Descriptor{}, nil, errors.New("build image: missing config")
+	}
+	m := manifestContent{
+		config:      config,
+		layers:      layers,
+		subject:     opts.Subject,
+		annotations: opts.Annotations,
+	}
+	for _, u := range opts.ForeignLayerURLs {
+		m.foreignLayers = append(m.foreignLayers, foreignLayer(u))
+	}
+	return m.build(opts)
+}
+
+// BuildOCIArtifact is like BuildOCIImage for an artifact of the given type. A nil config is
+// replaced with the scratch config.
+func BuildOCIArtifact(artifactType string, config ContentGenerator, layers []ContentGenerator, opts BuildOptions) ([]byte, ociimagespec.Descriptor, []Blob, error) {
+	if config == nil {
+		config = scratchContent
+	}
+	m := manifestContent{
+		config:       config,
+		layers:       layers,
+		artifactType: artifactType,
+		subject:      opts.Subject,
+		annotations:  opts.Annotations,
+	}
+	for _, u := range opts.ForeignLayerURLs {
+		m.foreignLayers = append(m.foreignLayers, foreignLayer(u))
+	}
+	return m.build(opts)
+}
+
+// build generates the config and layers and returns the content and descriptor of the
+// manifest referencing them, along with the generated blobs, layers first.
+func (m manifestContent) build(opts BuildOptions) ([]byte, ociimagespec.Descriptor, []Blob, error) {
+	var blobs []Blob
+	var layerDescs []ociimagespec.Descriptor
+	var diffIDs []digest.Digest
+	for _, layer := range m.layers {
+		blob, err := generateBlob(layer, opts.InlineLayers, opts.InlineThreshold)
+		if err != nil {
+			return nil, ociimagespec.Descriptor{}, nil, err
+		}
+		blobs = append(blobs, blob)
+		layerDescs = append(layerDescs, blob.Descriptor)
+		diffID := blob.Descriptor.Digest
+		if d, ok := layer.(diffIDer); ok {
+			diffID = d.DiffID()
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+	// foreign and missing layers are not generated, their digests stand for their diff IDs
+	for _, layers := range [][]ociimagespec.Descriptor{m.foreignLayers, m.missingLayers} {
+		for _, layer := range layers {
+			layerDescs = append(layerDescs, layer)
+			diffIDs = append(diffIDs, layer.Digest)
+		}
+	}
+
+	config := m.config
+	if c, ok := config.(ImageConfig); ok {
+		c.DiffIDs = diffIDs
+		config = c
+	}
+	configBlob, err := generateBlob(config, opts.InlineConfig, opts.InlineThreshold)
+	if err != nil {
+		return nil, ociimagespec.Descriptor{}, nil, err
+	}
+	blobs = append(blobs, configBlob)
+
+	manifestBytes, err := json.Marshal(ociimagespec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ociimagespec.MediaTypeImageManifest,
+		ArtifactType: m.artifactType,
+		Config:       configBlob.Descriptor,
+		Layers:       layerDescs,
+		Subject:      m.subject,
+		Annotations:  m.annotations,
+	})
+	if err != nil {
+		return nil, ociimagespec.Descriptor{}, nil, err
+	}
+	if opts.NormalizeJSON {
+		if manifestBytes, err = canonicalJSON(manifestBytes); err != nil {
+			return nil, ociimagespec.Descriptor{}, nil, err
+		}
+	}
+	manifestDesc := ociimagespec.Descriptor{
+		MediaType:    ociimagespec.MediaTypeImageManifest,
+		ArtifactType: m.artifactType,
+		Digest:       digest.FromBytes(manifestBytes),
+		Size:         int64(len(manifestBytes)),
+	}
+	return manifestBytes, manifestDesc, blobs, nil
+}
+
+// generateBlob generates a blob and describes it. Its content is embedded in the descriptor if
+// inline is set and it does not exceed the threshold, the scratch and empty blobs always
+// have their content embedded.
+func generateBlob(g ContentGenerator, inline bool, threshold int64) (Blob, error) {
+	mediaType, data, err := g.Generate()
+	if err != nil {
+		return Blob{}, err
+	}
+	desc := ociimagespec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if a, ok := g.(annotator); ok {
+		desc.Annotations = a.Annotations()
+	}
+
+	if threshold <= 0 {
+		threshold = defaultInlineThreshold
+	}
+	if isScratchBlob(desc) || (inline && int64(len(data)) <= threshold) {
+		desc.Data = data
+	}
+	return Blob{Descriptor: desc, Data: data}, nil
+}
+
+// isScratchBlob indicates if the descriptor describes the scratch or empty blob.
+func isScratchBlob(desc ociimagespec.Descriptor) bool {
+	return isEmptyMediaType(desc.MediaType) && desc.Digest == ociimagespec.ScratchDescriptor.Digest
+}
+
+// isEmptyMediaType indicates if the media type is the one of the scratch or empty blob.
+func isEmptyMediaType(mediaType string) bool {
+	return mediaType == ociimagespec.MediaTypeScratch || mediaType == mediaTypeEmpty
+}
+
+// foreignLayer returns the descriptor of a non-distributable layer hosted at the given URL.
+// The digest and size describe synthetic content, since the registry does not validate them.
+func foreignLayer(url string) ociimagespec.Descriptor {
+	data := []byte(fmt.Sprintf("ForeignLayer %s", url))
+	return ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+		URLs:      []string{url},
+	}
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildOCIImage(t *testing.T) {
+	small := StaticContent{MediaType: ociimagespec.MediaTypeImageLayer, Data: []byte("small layer")}
+	large := StaticContent{MediaType: ociimagespec.MediaTypeImageLayer, Data: bytes.Repeat([]byte("l"), 64)}
+	config := ImageConfig{MediaType: ociimagespec.MediaTypeImageConfig, Image: ociConfig}
+	subject := &ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject"),
+		Size:      7,
+	}
+	const foreignURL = "https://example.com/layer.tar.gz"
+
+	tests := []struct {
+		name           string
+		config         ContentGenerator
+		opts           BuildOptions
+		wantErr        bool
+		wantLayers     int
+		wantInlined    []bool // per generated layer
+		wantConfigData bool
+	}{
+		{name: "nil config", wantErr: true},
+		{name: "plain", config: config, wantLayers: 2, wantInlined: []bool{false, false}},
+		{name: "inline layers", config: config, opts: BuildOptions{InlineLayers: true}, wantLayers: 2, wantInlined: []bool{true, true}},
+		{name: "inline below threshold", config: config, opts: BuildOptions{InlineLayers: true, InlineThreshold: 32}, wantLayers: 2, wantInlined: []bool{true, false}},
+		{name: "inline config", config: config, opts: BuildOptions{InlineConfig: true}, wantLayers: 2, wantInlined: []bool{false, false}, wantConfigData: true},
+		{name: "foreign layer", config: config, opts: BuildOptions{ForeignLayerURLs: []string{foreignURL}}, wantLayers: 3, wantInlined: []bool{false, false}},
+		{name: "subject", config: config, opts: BuildOptions{Subject: subject}, wantLayers: 2, wantInlined: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, desc, blobs, err := BuildOCIImage(tt.config, []ContentGenerator{small, large}, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildOCIImage() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			manifest := checkBuiltManifest(t, data, desc, blobs)
+
+			if len(manifest.Layers) != tt.wantLayers {
+				t.Fatalf("manifest has %d layers, want %d", len(manifest.Layers), tt.wantLayers)
+			}
+			for i, want := range tt.wantInlined {
+				if got := manifest.Layers[i].Data != nil; got != want {
+					t.Errorf("layer %d inlined = %v, want %v", i, got, want)
+				}
+			}
+			if got := manifest.Config.Data != nil; got != tt.wantConfigData {
+				t.Errorf("config inlined = %v, want %v", got, tt.wantConfigData)
+			}
+			if len(tt.opts.ForeignLayerURLs) > 0 {
+				foreign := manifest.Layers[len(manifest.Layers)-1]
+				if foreign.MediaType != ociimagespec.MediaTypeImageLayerNonDistributableGzip || len(foreign.URLs) != 1 || foreign.URLs[0] != foreignURL {
+					t.Errorf("foreign layer %+v, want a non-distributable layer hosted at %s", foreign, foreignURL)
+				}
+			}
+			if (manifest.Subject == nil) != (tt.opts.Subject == nil) || (manifest.Subject != nil && manifest.Subject.Digest != subject.Digest) {
+				t.Errorf("manifest subject = %+v, want %+v", manifest.Subject, tt.opts.Subject)
+			}
+
+			// the config lists the diff IDs of every layer, foreign ones included
+			var image ociimagespec.Image
+			if err := json.Unmarshal(blobs[len(blobs)-1].Data, &image); err != nil {
+				t.Fatal(err)
+			}
+			if len(image.RootFS.DiffIDs) != tt.wantLayers {
+				t.Errorf("config lists %d diff IDs, want %d", len(image.RootFS.DiffIDs), tt.wantLayers)
+			}
+		})
+	}
+}
+
+func TestBuildOCIArtifact(t *testing.T) {
+	layer := StaticContent{MediaType: "application/vnd.imagegen.test", Data: []byte("artifact layer")}
+	subject := &ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject"),
+		Size:      7,
+	}
+	tests := []struct {
+		name       string
+		config     ContentGenerator
+		opts       BuildOptions
+		wantConfig digest.Digest
+	}{
+		{name: "scratch config", wantConfig: ociimagespec.ScratchDescriptor.Digest},
+		{name: "given config", config: JSONContent{MediaType: "application/vnd.imagegen.config+json", Value: map[string]string{"a": "b"}}, wantConfig: digest.FromString(`{"a":"b"}`)},
+		{name: "inline layers", opts: BuildOptions{InlineLayers: true}, wantConfig: ociimagespec.ScratchDescriptor.Digest},
+		{name: "foreign layer", opts: BuildOptions{ForeignLayerURLs: []string{"https://example.com/layer.tar.gz"}}, wantConfig: ociimagespec.ScratchDescriptor.Digest},
+		{name: "subject", opts: BuildOptions{Subject: subject}, wantConfig: ociimagespec.ScratchDescriptor.Digest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, desc, blobs, err := BuildOCIArtifact(imagegenArtifactType, tt.config, []ContentGenerator{layer}, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest := checkBuiltManifest(t, data, desc, blobs)
+
+			if manifest.ArtifactType != imagegenArtifactType || desc.ArtifactType != imagegenArtifactType {
+				t.Errorf("artifact type %q, descriptor %q, want %q", manifest.ArtifactType, desc.ArtifactType, imagegenArtifactType)
+			}
+			if manifest.Config.Digest != tt.wantConfig {
+				t.Errorf("config digest = %s, want %s", manifest.Config.Digest, tt.wantConfig)
+			}
+			// the scratch config is always inlined
+			if got, want := manifest.Config.Data != nil, tt.config == nil; got != want {
+				t.Errorf("config inlined = %v, want %v", got, want)
+			}
+			if got := manifest.Layers[0].Data != nil; got != tt.opts.InlineLayers {
+				t.Errorf("layer inlined = %v, want %v", got, tt.opts.InlineLayers)
+			}
+			if wantLayers := 1 + len(tt.opts.ForeignLayerURLs); len(manifest.Layers) != wantLayers {
+				t.Errorf("manifest has %d layers, want %d", len(manifest.Layers), wantLayers)
+			} else if wantLayers > 1 && manifest.Layers[1].MediaType != ociimagespec.MediaTypeImageLayerNonDistributableGzip {
+				t.Errorf("foreign layer media type = %q, want %q", manifest.Layers[1].MediaType, ociimagespec.MediaTypeImageLayerNonDistributableGzip)
+			}
+			if (manifest.Subject == nil) != (tt.opts.Subject == nil) {
+				t.Errorf("manifest subject = %+v, want %+v", manifest.Subject, tt.opts.Subject)
+			}
+		})
+	}
+}
+
+// checkBuiltManifest checks the descriptor describes the manifest, that the blobs are the
+// generated layers followed by the config, and returns the manifest.
+func checkBuiltManifest(t *testing.T, data []byte, desc ociimagespec.Descriptor, blobs []Blob) ociimagespec.Manifest {
+	t.Helper()
+	if desc.Digest != digest.FromBytes(data) || desc.Size != int64(len(data)) || desc.MediaType != ociimagespec.MediaTypeImageManifest {
+		t.Errorf("descriptor %+v does not describe the %d bytes manifest", desc, len(data))
+	}
+	var manifest ociimagespec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) == 0 || blobs[len(blobs)-1].Descriptor.Digest != manifest.Config.Digest {
+		t.Fatalf("blobs %d do not end with the config %s", len(blobs), manifest.Config.Digest)
+	}
+	for i, blob := range blobs[:len(blobs)-1] {
+		if blob.Descriptor.Digest != manifest.Layers[i].Digest || blob.Descriptor.Digest != digest.FromBytes(blob.Data) {
+			t.Errorf("blob %d %s does not match layer %s", i, blob.Descriptor.Digest, manifest.Layers[i].Digest)
+		}
+		if manifest.Layers[i].Data != nil && !bytes.Equal(manifest.Layers[i].Data, blob.Data) {
+			t.Errorf("layer %d inlines other data than its blob", i)
+		}
+	}
+	return manifest
+}
@@ -0,0 +1,28 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// canonicalJSON returns the canonical form of a JSON document: object keys sorted, no
+// insignificant whitespace and no HTML escaping, so the same document always has the same bytes
+// and digest whatever produced it. Numbers are kept as written.
+func canonicalJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("canonicalize JSON: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, fmt.Errorf("canonicalize JSON: %w", err)
+	}
+	// the encoder terminates the document with a newline
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
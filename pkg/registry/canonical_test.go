@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "keys sorted", in: `{"b":1,"a":{"d":2,"c":3}}`, want: `{"a":{"c":3,"d":2},"b":1}`},
+		{name: "whitespace removed", in: "{\n  \"a\": [1, 2],\n  \"b\": \"x y\"\n}\n", want: `{"a":[1,2],"b":"x y"}`},
+		{name: "html not escaped", in: `{"a":"<b> & c"}`, want: `{"a":"<b> & c"}`},
+		{name: "html escapes decoded", in: `{"a":"\u003cb\u003e \u0026 c"}`, want: `{"a":"<b> & c"}`},
+		{name: "numbers kept as written", in: `{"a":1.50,"b":1e3,"c":12345678901234567890}`, want: `{"a":1.50,"b":1e3,"c":12345678901234567890}`},
+		{name: "invalid", in: `{"a":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalJSON([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("canonicalJSON() error = %v, want error %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("canonicalJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeJSONDigest(t *testing.T) {
+	annotations := map[string]string{
+		ociimagespec.AnnotationTitle:       "layers <a> & <b>",
+		ociimagespec.AnnotationDescription: "annotated manifest",
+	}
+	build := func(normalize bool) ([]byte, ociimagespec.Descriptor) {
+		t.Helper()
+		data, desc, _, err := BuildOCIArtifact(imagegenArtifactType, nil, nil, BuildOptions{
+			Annotations:   annotations,
+			NormalizeJSON: normalize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data, desc
+	}
+	plain, plainDesc := build(false)
+	normalized, normalizedDesc := build(true)
+
+	if plainDesc.Digest == normalizedDesc.Digest {
+		t.Errorf("digest %s with and without normalization, want the key order and escaping to change it", plainDesc.Digest)
+	}
+	if normalizedDesc.Digest != digest.FromBytes(normalized) || normalizedDesc.Size != int64(len(normalized)) {
+		t.Errorf("normalized descriptor %s of %d bytes does not describe the normalized manifest", normalizedDesc.Digest, normalizedDesc.Size)
+	}
+	canonical, err := canonicalJSON(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(normalized, canonical) {
+		t.Errorf("normalized manifest = %s, want the canonical form of the plain one %s", normalized, canonical)
+	}
+	if !bytes.HasPrefix(normalized, []byte(`{"annotations":{"org.opencontainers.image.description"`)) {
+		t.Errorf("normalized manifest %s does not start with the sorted annotations", normalized)
+	}
+	if !bytes.Contains(normalized, []byte("<a> & <b>")) || !bytes.Contains(plain, []byte(`\u003ca\u003e \u0026`)) {
+		t.Errorf("only the plain manifest should escape HTML characters, plain %s, normalized %s", plain, normalized)
+	}
+	if again, _ := build(true); !bytes.Equal(again, normalized) {
+		t.Errorf("normalized manifest differs between builds, %s then %s", normalized, again)
+	}
+
+	// normalization changes the bytes, never the manifest
+	var plainManifest, normalizedManifest ociimagespec.Manifest
+	if err := json.Unmarshal(plain, &plainManifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(normalized, &normalizedManifest); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plainManifest, normalizedManifest) {
+		t.Errorf("normalized manifest %+v differs from the plain one %+v", normalizedManifest, plainManifest)
+	}
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// Catalog routes
+const (
+	routeCatalog = "/v2/_catalog"
+)
+
+// linkNextRegex matches the URL of the next page in a Link header.
+var linkNextRegex = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// catalogResponse describes the catalog API response.
+type catalogResponse struct {
+	// Repositories is a page of repository names.
+	Repositories []string `json:"repositories"`
+}
+
+// ListRepositories lists all repositories in the registry, following the Link header across pages.
+// pageSize sets the number of repositories requested per page, the registry default is used if not positive.
+func (p Proxy) ListRepositories(ctx context.Context, pageSize int) ([]string, error) {
+	next := p.url(routeCatalog)
+	if pageSize > 0 {
+		next += "?" + url.Values{"n": {fmt.Sprint(pageSize)}}.Encode()
+	}
+
+	var repos []string
+	for next != "" {
+		tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+			method:   http.MethodGet,
+			url:      next,
+			op:       "list repositories",
+			expected: []int{http.StatusOK},
+		})
+		if err != nil {
+			return repos, err
+		}
+
+		var page catalogResponse
+		if err := json.Unmarshal(tripInfo.Response.Body, &page); err != nil {
+			return repos, err
+		}
+		repos = append(repos, page.Repositories...)
+
+		next, err = nextPage(next, tripInfo.Response.HeaderLink)
+		if err != nil {
+			return repos, err
+		}
+	}
+	return repos, nil
+}
+
+// nextPage returns the absolute URL of the next page referenced by a Link header,
+// or an empty string if there is no next page.
+func nextPage(current, link string) (string, error) {
+	match := linkNextRegex.FindStringSubmatch(link)
+	if match == nil {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(match[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid link header %q: %w", link, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
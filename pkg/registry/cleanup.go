@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cleanup routes
+const (
+	acrrouteRepository = "/acr/v1/%s" // add repo name
+)
+
+// GeneratedRepository is a repository named by NewRepositoryName.
+type GeneratedRepository struct {
+	// Name is the repository name.
+	Name string
+
+	// Created is the time embedded in the name.
+	Created time.Time
+}
+
+// GeneratedRepositories returns the repositories named by NewRepositoryName, newest first.
+// Other repositories, including ones sharing the prefix without a valid timestamp, are ignored.
+func GeneratedRepositories(repos []string) []GeneratedRepository {
+	var generated []GeneratedRepository
+	for _, repo := range repos {
+		id, err := strconv.ParseInt(strings.TrimPrefix(repo, repoprefix), 10, 64)
+		if !strings.HasPrefix(repo, repoprefix) || err != nil {
+			continue
+		}
+		generated = append(generated, GeneratedRepository{Name: repo, Created: time.Unix(id, 0)})
+	}
+	sort.SliceStable(generated, func(i, j int) bool {
+		return generated[i].Created.After(generated[j].Created)
+	})
+	return generated
+}
+
+// DeleteRepository deletes the repository with all its manifests and tags.
+// It uses the ACR repository API, as the distribution spec has no repository deletion.
+func (p Proxy) DeleteRepository(ctx context.Context, repo string) error {
+	_, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodDelete,
+		url:      p.url(acrrouteRepository, repo),
+		op:       fmt.Sprintf("delete repository %s", repo),
+		expected: []int{http.StatusAccepted, http.StatusOK},
+	})
+	return err
+}
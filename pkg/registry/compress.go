@@ -0,0 +1,48 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// annotationUncompressedSize records the uncompressed size of a compressed layer.
+const annotationUncompressedSize = "io.imagegentest.layer.uncompressed.size"
+
+// tarGzip packs the content as a single file tar archive and compresses it with gzip.
+// Timestamps are left unset so the result only depends on the name and content.
+// The uncompressed archive is returned as well, its digest being the diff ID of the layer.
+func tarGzip(name string, content []byte) (compressed, archive []byte, err error) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+	}); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return nil, nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(tarBuf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), tarBuf.Bytes(), nil
+}
+
+// layerFileName returns the name of the file holding the content of the i-th layer.
+func layerFileName(i int) string {
+	return fmt.Sprintf("layer-%d.txt", i)
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
+)
+
+// newHTTPTransport returns the transport shared by every request of the proxy, including
+// token and challenge requests. Connections it opens and reuses are recorded to the metrics.
+func newHTTPTransport(opts *Options, logger zerolog.Logger, metrics *rhttp.Metrics) (http.RoundTripper, error) {
+	if opts.HTTP1 && opts.H2C {
+		return nil, errors.New("HTTP/1.1 only and h2c are mutually exclusive")
+	}
+	dial := (&net.Dialer{}).DialContext
+	if opts.DNSTimeout > 0 {
+		dial = rhttp.DNSTimeoutDialer(&net.Dialer{}, opts.DNSTimeout)
+	}
+	if opts.H2C {
+		if !opts.loginServerInsecure() {
+			return nil, errors.New("h2c requires insecure access over HTTP")
+		}
+		// h2c speaks HTTP/2 over plaintext connections, without any upgrade negotiation
+		return connectionTracer{
+			Base: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, network, addr)
+				},
+			},
+			Logger:  logger,
+			Metrics: metrics,
+		}, nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.HTTP1 {
+		// a non nil, empty TLSNextProto map disables HTTP/2
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	}
+	if opts.MaxIdleConns > 0 {
+		t.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	t.DisableKeepAlives = opts.DisableKeepAlives
+	if opts.DNSTimeout > 0 {
+		// the dialer settings of the default transport
+		t.DialContext = rhttp.DNSTimeoutDialer(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, opts.DNSTimeout)
+	}
+	return connectionTracer{Base: t, Logger: logger, Metrics: metrics}, nil
+}
+
+// connectionTracer is an http.RoundTripper recording whether every request opened a new connection
+// or reused one, and logging the protocol negotiated on new connections.
+type connectionTracer struct {
+	Base    http.RoundTripper
+	Logger  zerolog.Logger
+	Metrics *rhttp.Metrics
+}
+
+// RoundTrip does an HTTP/HTTPs roundtrip, tracing the connection it used.
+func (t connectionTracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn httptrace.GotConnInfo
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if conn.Conn == nil {
+		return resp, nil
+	}
+	t.Metrics.RecordConnection(conn.Reused)
+	if !conn.Reused {
+		t.Logger.Trace().Msgf("New connection %s -> %s negotiated %s", conn.Conn.LocalAddr(), conn.Conn.RemoteAddr(), resp.Proto)
+	}
+	return resp, nil
+}
@@ -0,0 +1,296 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DerivedImageResult describes an image pushed with the layers of an existing image.
+type DerivedImageResult struct {
+	// Descriptor describes the pushed image.
+	Descriptor ociimagespec.Descriptor `json:"descriptor"`
+
+	// Source describes the image the layers were taken from.
+	Source ociimagespec.Descriptor `json:"source"`
+
+	// ReusedBlobs is the number of blobs of the source referenced without being uploaded.
+	ReusedBlobs int `json:"reusedBlobs"`
+
+	// MountedBlobs is the number of reused blobs mounted from the repository of the source.
+	MountedBlobs int `json:"mountedBlobs"`
+}
+
+// GenerateDerivedImage pushes to the tag an image referencing the config and layers of the source
+// image, given as repo:tag or repo@digest, without uploading them again. The image is pushed to the
+// repository of the source if repo is empty, and the reused blobs are mounted from the repository
+// of the source if it differs. Every reused blob must exist in the repository. If addLayer is set,
+// a synthetic layer is added on top of the reused ones, and the config of the source is pushed
+// again with the diff ID of the new layer.
+func (p Proxy) GenerateDerivedImage(ctx context.Context, repo, tag, source string, addLayer bool) (result DerivedImageResult, err error) {
+	sourceRepo, reference, err := splitReference(source)
+	if err != nil {
+		return result, err
+	}
+	if repo == "" {
+		repo = sourceRepo
+	}
+	if tag == "" {
+		tag = fmt.Sprintf("derived-%v", newTimeID())
+	}
+	ctx, span := p.startSpan(ctx, "generate.derived_image", repo)
+	defer func() { endSpan(span, err) }()
+
+	skip, overwrite, err := p.checkTag(ctx, repo, tag)
+	if err != nil || skip {
+		return result, err
+	}
+
+	manifest, sourceDesc, err := p.fetchImageManifest(ctx, sourceRepo, reference)
+	if err != nil {
+		return result, fmt.Errorf("fetch source image %s: %w", source, err)
+	}
+	result.Source = sourceDesc
+
+	reused := manifest.Layers
+	if !addLayer {
+		reused = append([]ociimagespec.Descriptor{manifest.Config}, reused...)
+	}
+	for _, desc := range reused {
+		// foreign layers are fetched from their URLs and never in the registry
+		if len(desc.URLs) > 0 {
+			continue
+		}
+		if sourceRepo != repo {
+			mounted, err := p.mountBlob(ctx, repo, sourceRepo, desc)
+			if err != nil {
+				return result, err
+			}
+			if mounted {
+				result.MountedBlobs++
+			}
+		}
+		head, err := p.HeadBlob(ctx, repo, desc.Digest)
+		if err != nil {
+			return result, fmt.Errorf("reused blob %s of %s: %w", desc.Digest, source, err)
+		}
+		if head.Size != desc.Size {
+			return result, fmt.Errorf("reused blob %s of %s has size %d instead of %d: %w", desc.Digest, source, head.Size, desc.Size, ErrSizeMismatch)
+		}
+		p.uploaded.add(repo, desc.Digest)
+		result.ReusedBlobs++
+	}
+
+	pusher, err := p.pusher(ctx, repo, tag)
+	if err != nil {
+		return result, err
+	}
+	if addLayer {
+		blobs, err := p.deriveLayer(ctx, sourceRepo, tag, &manifest, sourceDesc.MediaType)
+		if err != nil {
+			return result, err
+		}
+		if err := p.uploadBlobs(ctx, pusher, repo, blobs); err != nil {
+			return result, err
+		}
+	}
+
+	annotations := map[string]string{
+		ociimagespec.AnnotationBaseImageName:   source,
+		ociimagespec.AnnotationBaseImageDigest: sourceDesc.Digest.String(),
+	}
+	for k, v := range manifest.Annotations {
+		if _, ok := annotations[k]; !ok {
+			annotations[k] = v
+		}
+	}
+	manifest.Annotations = annotations
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return result, err
+	}
+	desc := ociimagespec.Descriptor{
+		MediaType: sourceDesc.MediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := p.uploadManifest(ctx, pusher, repo, tag, desc, data); err != nil {
+		return result, err
+	}
+	p.pushed.add(repo, tag, desc, data)
+	p.logPushed(repo, tag, overwrite)
+	result.Descriptor = desc
+
+	p.Logger.Info().Msgf("Pushed %s:%s reusing %d blobs of %s, %d mounted", repo, tag, result.ReusedBlobs, source, result.MountedBlobs)
+	return result, nil
+}
+
+// fetchImageManifest fetches and decodes the image manifest at the reference, which must be an
+// OCI image manifest or a Docker image manifest, and returns it along with its descriptor.
+func (p Proxy) fetchImageManifest(ctx context.Context, repo, reference string) (ociimagespec.Manifest, ociimagespec.Descriptor, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(routeManifests, repo, reference),
+		accept:      p.manifestAccept(),
+		op:          fmt.Sprintf("get manifest %s", reference),
+		expected:    []int{http.StatusOK},
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil {
+		return ociimagespec.Manifest{}, ociimagespec.Descriptor{}, err
+	}
+	desc := ociimagespec.Descriptor{
+		Digest: tripInfo.Response.SHA256Sum,
+		Size:   tripInfo.Response.Size,
+	}
+	if dgst, err := digest.Parse(reference); err == nil && dgst != desc.Digest {
+		return ociimagespec.Manifest{}, desc, fmt.Errorf("get manifest %s failed, got digest %s: %w", reference, desc.Digest, ErrDigestMismatch)
+	}
+
+	var manifest ociimagespec.Manifest
+	if err := json.Unmarshal(tripInfo.Response.Body, &manifest); err != nil {
+		return manifest, desc, err
+	}
+	desc.MediaType = manifest.MediaType
+	if desc.MediaType == "" {
+		desc.MediaType = strings.TrimSpace(strings.Split(tripInfo.Response.HeaderContentType, ";")[0])
+	}
+	if desc.MediaType != ociimagespec.MediaTypeImageManifest && desc.MediaType != images.MediaTypeDockerSchema2Manifest {
+		return manifest, desc, fmt.Errorf("%s is a %s, not an image manifest", reference, desc.MediaType)
+	}
+	return manifest, desc, nil
+}
+
+// deriveLayer generates a synthetic layer, following the first configured layer spec if any, and
+// adds it on top of the layers of the manifest, along with the config of the source with the diff
+// ID of the layer appended, and returns both blobs.
+func (p Proxy) deriveLayer(ctx context.Context, sourceRepo, tag string, manifest *ociimagespec.Manifest, mediaType string) ([]Blob, error) {
+	g := p.imageLayerGenerators(tag, 1)[0]
+	layer, err := generateBlob(g, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	diffID := layer.Descriptor.Digest
+	if g, ok := g.(diffIDer); ok {
+		diffID = g.DiffID()
+	}
+	if mediaType == images.MediaTypeDockerSchema2Manifest {
+		layer.Descriptor.MediaType = dockerLayerMediaType(layer.Descriptor.MediaType)
+	}
+
+	tripInfo, err := p.PullBlob(ctx, sourceRepo, manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("pull config of the source image: %w", err)
+	}
+	configData, err := appendDiffID(tripInfo.Response.Body, diffID)
+	if err != nil {
+		return nil, fmt.Errorf("config %s of the source image: %w", manifest.Config.Digest, err)
+	}
+	config := Blob{
+		Descriptor: ociimagespec.Descriptor{
+			MediaType: manifest.Config.MediaType,
+			Digest:    digest.FromBytes(configData),
+			Size:      int64(len(configData)),
+		},
+		Data: configData,
+	}
+
+	manifest.Config = config.Descriptor
+	manifest.Layers = append(manifest.Layers, layer.Descriptor)
+	return []Blob{layer, config}, nil
+}
+
+// appendDiffID appends the diff ID to the rootfs of the image config, along with a history entry
+// if the config has a history, keeping every other field as is.
+func appendDiffID(data []byte, diffID digest.Digest) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var config map[string]any
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	rootfs, ok := config["rootfs"].(map[string]any)
+	if !ok {
+		return nil, errors.New("no rootfs, not an image config")
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]any)
+	rootfs["diff_ids"] = append(diffIDs, diffID.String())
+	if history, ok := config["history"].([]any); ok {
+		config["history"] = append(history, map[string]any{
+			"created":    time.Now().UTC().Format(time.RFC3339),
+			"created_by": "image-gen-test derived layer",
+		})
+	}
+	return json.Marshal(config)
+}
+
+// dockerLayerMediaType returns the Docker media type of a generated OCI layer media type.
+func dockerLayerMediaType(mediaType string) string {
+	switch mediaType {
+	case ociimagespec.MediaTypeImageLayer:
+		return images.MediaTypeDockerSchema2Layer
+	case ociimagespec.MediaTypeImageLayerGzip:
+		return images.MediaTypeDockerSchema2LayerGzip
+	}
+	return mediaType
+}
+
+// mountBlob mounts the blob of the source repository into the repository without uploading it, and
+// reports whether the registry mounted it. A registry starting an upload instead did not, the
+// upload is then cancelled.
+func (p Proxy) mountBlob(ctx context.Context, repo, from string, desc ociimagespec.Descriptor) (bool, error) {
+	query := url.Values{
+		"mount": {desc.Digest.String()},
+		"from":  {from},
+	}
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodPost,
+		url:      p.url(routeBlobUploads, repo) + "?" + query.Encode(),
+		op:       fmt.Sprintf("mount blob %s from %s", desc.Digest, from),
+		expected: []int{http.StatusCreated, http.StatusAccepted},
+	})
+	if err != nil {
+		return false, err
+	}
+	if tripInfo.Response.Code == http.StatusCreated {
+		return true, nil
+	}
+
+	p.Logger.Warn().Msgf("Registry did not mount blob %s from %s into %s", desc.Digest, from, repo)
+	if location, err := uploadLocation(tripInfo); err == nil {
+		if _, err := p.transport.roundTrip(ctx, registryRequest{
+			method:   http.MethodDelete,
+			url:      location.String(),
+			op:       fmt.Sprintf("cancel upload of %s", desc.Digest),
+			expected: []int{http.StatusNoContent, http.StatusOK, http.StatusAccepted},
+		}); err != nil {
+			p.Logger.Warn().Msgf("Failed to cancel the upload started instead of the mount of %s: %v", desc.Digest, err)
+		}
+	}
+	return false, nil
+}
+
+// splitReference splits a reference into its repository and its tag or digest, such as repo:tag
+// or repo@sha256:... A reference without either is an error.
+func splitReference(ref string) (repo, reference string, err error) {
+	if i := strings.LastIndex(ref, "@"); i > 0 {
+		if _, err := digest.Parse(ref[i+1:]); err != nil {
+			return "", "", fmt.Errorf("invalid reference %q: %w", ref, err)
+		}
+		return ref[:i], ref[i+1:], nil
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") && i > 0 && i < len(ref)-1 {
+		return ref[:i], ref[i+1:], nil
+	}
+	return "", "", fmt.Errorf("invalid reference %q, expected repo:tag or repo@digest", ref)
+}
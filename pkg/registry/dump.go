@@ -0,0 +1,24 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dumpContent writes the content of a manifest, index or config about to be pushed to a file of
+// the dump directory named after its digest, such as sha256-<hex>, if dumping is enabled.
+// The content is written before it is uploaded, so the content of rejected pushes is kept.
+func (p Proxy) dumpContent(desc ociimagespec.Descriptor, data []byte) error {
+	if p.DumpManifestsDir == "" {
+		return nil
+	}
+	path := filepath.Join(p.DumpManifestsDir, fmt.Sprintf("%s-%s", desc.Digest.Algorithm(), desc.Digest.Encoded()))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("dump %s: %w", desc.Digest, err)
+	}
+	p.Logger.Debug().Msgf("Dumped %s %s to %s", desc.MediaType, desc.Digest, path)
+	return nil
+}
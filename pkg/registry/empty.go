@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"fmt"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EmptyConfigType is the convention used for the config of artifacts without one.
+//
+// Since image-spec v1.1 an artifact without a config uses the empty descriptor, and must then
+// set artifactType. Before that, tools picked their own media type for an empty "{}" config,
+// and the artifact type was conveyed by the config media type itself. Registries validate
+// these conventions differently, which is why all of them can be generated.
+type EmptyConfigType string
+
+// Empty config conventions.
+const (
+	// EmptyConfigScratch is the scratch descriptor of the image-spec v1.1 release candidates,
+	// renamed to the empty descriptor before the final release.
+	EmptyConfigScratch EmptyConfigType = "scratch"
+
+	// EmptyConfigEmpty is the empty descriptor of image-spec v1.1, the only convention
+	// the spec defines for artifacts without a config.
+	EmptyConfigEmpty EmptyConfigType = "empty"
+
+	// EmptyConfigUnknown is the media type ORAS used for empty configs before image-spec v1.1.
+	// The spec treats it as any other custom config media type.
+	EmptyConfigUnknown EmptyConfigType = "unknown"
+
+	// EmptyConfigArtifactType uses the artifact type as the media type of an empty config,
+	// the pre v1.1 way of typing artifacts. It is valid as a custom config media type.
+	EmptyConfigArtifactType EmptyConfigType = "artifact-type"
+)
+
+// Media types of the empty config conventions.
+const (
+	mediaTypeEmpty         = "application/vnd.oci.empty.v1+json"
+	mediaTypeUnknownConfig = "application/vnd.unknown.config.v1+json"
+)
+
+// EmptyConfigTypes are the supported empty config conventions.
+var EmptyConfigTypes = []EmptyConfigType{
+	EmptyConfigScratch,
+	EmptyConfigEmpty,
+	EmptyConfigUnknown,
+	EmptyConfigArtifactType,
+}
+
+// validate checks that the convention is supported. The zero value selects the scratch descriptor.
+func (t EmptyConfigType) validate() error {
+	if t == "" {
+		return nil
+	}
+	for _, supported := range EmptyConfigTypes {
+		if t == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported empty config type %q, expected one of %v", t, EmptyConfigTypes)
+}
+
+// emptyConfig returns the generator of empty configs following the configured convention,
+// for an artifact of the given type.
+func (p Proxy) emptyConfig(artifactType string) ContentGenerator {
+	mediaType := ociimagespec.MediaTypeScratch
+	switch p.EmptyConfigType {
+	case EmptyConfigEmpty:
+		mediaType = mediaTypeEmpty
+	case EmptyConfigUnknown:
+		mediaType = mediaTypeUnknownConfig
+	case EmptyConfigArtifactType:
+		mediaType = artifactType
+	}
+	return StaticContent{MediaType: mediaType, Data: ociimagespec.ScratchDescriptor.Data}
+}
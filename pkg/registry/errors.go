@@ -0,0 +1,255 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+)
+
+// Errors returned by registry operations, wrapped with context.
+var (
+	// ErrUnauthorized indicates that the registry rejected the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrNotFound indicates that the requested content does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrChallengeFailed indicates that the registry did not issue a usable auth challenge.
+	ErrChallengeFailed = errors.New("auth challenge failed")
+
+	// ErrDigestMismatch indicates that content does not match its expected digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+
+	// ErrSizeMismatch indicates that content does not match its expected size.
+	ErrSizeMismatch = errors.New("size mismatch")
+
+	// ErrHeadMismatch indicates that the content served by a GET request does not match the
+	// digest or size reported by a HEAD request for the same content.
+	ErrHeadMismatch = errors.New("HEAD and GET mismatch")
+
+	// ErrUnexpectedStatus indicates that the registry responded with an unexpected status code.
+	ErrUnexpectedStatus = errors.New("unexpected status")
+
+	// ErrSchemaInvalid indicates that a generated manifest does not match the OCI JSON schema.
+	ErrSchemaInvalid = errors.New("manifest does not match the OCI schema")
+
+	// ErrStalled indicates that an upload made no progress for the stall timeout while its
+	// connection was still open.
+	ErrStalled = errors.New("upload stalled")
+
+	// ErrExpectationViolated indicates that the registry accepted content expected to be rejected,
+	// or rejected content expected to be accepted.
+	ErrExpectationViolated = errors.New("expectation violated")
+)
+
+// StatusError indicates that the registry responded to an operation with a status code the
+// operation does not succeed with. It wraps the sentinel matching the status code.
+type StatusError struct {
+	// Op describes the failed operation.
+	Op string
+
+	// Expected are the status codes the operation succeeds with.
+	Expected []int
+
+	// Got is the status code the registry responded with.
+	Got int
+
+	// Errors are the errors of the registry error response, if any.
+	Errors []RegistryError
+}
+
+// Error describes the operation with the expected and actual status codes, and the errors of
+// the registry error response.
+func (e *StatusError) Error() string {
+	expected := make([]string, len(e.Expected))
+	for i, code := range e.Expected {
+		expected[i] = strconv.Itoa(code)
+	}
+	got := strconv.Itoa(e.Got)
+	if len(e.Errors) > 0 {
+		got = fmt.Sprintf("%s (%s)", got, formatRegistryErrors(e.Errors))
+	}
+	return fmt.Sprintf("%s failed, expected: %s, got: %s: %v", e.Op, strings.Join(expected, " or "), got, e.Unwrap())
+}
+
+// Unwrap returns the sentinel matching the status code.
+func (e *StatusError) Unwrap() error {
+	switch e.Got {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return ErrUnexpectedStatus
+}
+
+// checkStatus returns a StatusError with the error codes of the response if its status code is not
+// one of the codes the operation succeeds with.
+func checkStatus(op string, tripInfo rhttp.RoundTripInfo, expected ...int) error {
+	for _, code := range expected {
+		if tripInfo.Response.Code == code {
+			return nil
+		}
+	}
+	return &StatusError{
+		Op:       op,
+		Expected: expected,
+		Got:      tripInfo.Response.Code,
+		Errors:   ParseErrorResponse(tripInfo.Response.Body),
+	}
+}
+
+// pushError wraps an error returned by the containerd pusher with the sentinel
+// matching the status code the registry responded with, if any, describing the errors
+// of the registry error response the pusher leaves out.
+func pushError(err error) error {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+	sentinel := ErrUnexpectedStatus
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		sentinel = ErrUnauthorized
+	case http.StatusNotFound:
+		sentinel = ErrNotFound
+	}
+	if errs := ParseErrorResponse(statusErr.Body); len(errs) > 0 {
+		return fmt.Errorf("%w (%s): %w", err, formatRegistryErrors(errs), sentinel)
+	}
+	return fmt.Errorf("%w: %w", err, sentinel)
+}
+
+// StallError indicates that no byte of a blob was uploaded for the stall timeout, so the upload
+// was cancelled. It wraps ErrStalled.
+type StallError struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest
+
+	// Transferred is the number of bytes of the blob uploaded before the upload stalled.
+	Transferred int64
+
+	// Total is the size of the blob.
+	Total int64
+
+	// Timeout is the stall timeout.
+	Timeout time.Duration
+}
+
+// Error describes the blob and how much of it was uploaded.
+func (e *StallError) Error() string {
+	return fmt.Sprintf("upload of %s stalled for %v after %d of %d bytes", e.Digest, e.Timeout, e.Transferred, e.Total)
+}
+
+// Unwrap returns ErrStalled.
+func (e *StallError) Unwrap() error {
+	return ErrStalled
+}
+
+// stallCause annotates the error with the StallError that caused the context to be done, if any,
+// like rhttp.TimeoutCause does for timeouts.
+func stallCause(ctx context.Context, err error) error {
+	var stall *StallError
+	if err == nil || ctx.Err() == nil || errors.As(err, &stall) || !errors.As(context.Cause(ctx), &stall) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", stall, err)
+}
+
+// pushOutcomeUnknown indicates if a push failed without the registry answering it, such as when
+// the connection broke after the request was sent, so the content may or may not have landed.
+func pushOutcomeUnknown(ctx context.Context, err error) bool {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	return ctx.Err() == nil && !errors.As(err, &statusErr) && !errors.Is(err, ErrDigestMismatch)
+}
+
+// pushRetryable indicates if a failed push may succeed when pushed again, either because the
+// registry did not answer it or answered with a status the retry policy retries.
+func pushRetryable(ctx context.Context, err error, policy rhttp.RetryPolicy) bool {
+	var statusErr remoteserrors.ErrUnexpectedStatus
+	if errors.As(err, &statusErr) {
+		return ctx.Err() == nil && policy.Retryable(statusErr.StatusCode)
+	}
+	return pushOutcomeUnknown(ctx, err)
+}
+
+// RegistryError is an error of a registry error response, as defined by the distribution spec.
+type RegistryError struct {
+	// Code is the error code, such as MANIFEST_BLOB_UNKNOWN or DENIED.
+	Code string `json:"code"`
+
+	// Message is the human readable description of the error.
+	Message string `json:"message,omitempty"`
+
+	// Detail is the unstructured detail of the error, if any.
+	Detail json.RawMessage `json:"detail,omitempty"`
+}
+
+// String returns the code of the error followed by its message.
+func (e RegistryError) String() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// errorResponse is the body of a registry error response, as defined by the distribution spec.
+type errorResponse struct {
+	Errors []RegistryError `json:"errors"`
+}
+
+// ParseErrorResponse decodes the errors of a registry error response body. It returns nil if the
+// body is not an error response, such as the HTML page of a proxy, or holds no error with a code.
+func ParseErrorResponse(body []byte) []RegistryError {
+	var resp errorResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	var errs []RegistryError
+	for _, e := range resp.Errors {
+		if e.Code != "" {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// RegistryErrors returns the errors of the registry error response that caused an error, if any.
+func RegistryErrors(err error) []RegistryError {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Errors
+	}
+	var pushErr remoteserrors.ErrUnexpectedStatus
+	if !errors.As(err, &pushErr) {
+		return nil
+	}
+	return ParseErrorResponse(pushErr.Body)
+}
+
+// errorCodes returns the error codes of the registry response that caused an error, if any.
+func errorCodes(err error) []string {
+	var codes []string
+	for _, e := range RegistryErrors(err) {
+		codes = append(codes, e.Code)
+	}
+	return codes
+}
+
+// formatRegistryErrors describes the errors of a registry error response.
+func formatRegistryErrors(errs []RegistryError) string {
+	descriptions := make([]string, len(errs))
+	for i, e := range errs {
+		descriptions[i] = e.String()
+	}
+	return strings.Join(descriptions, ", ")
+}
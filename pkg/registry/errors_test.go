@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	remoteserrors "github.com/containerd/containerd/remotes/errors"
+)
+
+func TestParseErrorResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []RegistryError
+	}{
+		{
+			name: "distribution with detail",
+			body: `{"errors":[{"code":"MANIFEST_BLOB_UNKNOWN","message":"blob unknown to registry","detail":"sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}]}`,
+			want: []RegistryError{{
+				Code:    "MANIFEST_BLOB_UNKNOWN",
+				Message: "blob unknown to registry",
+				Detail:  []byte(`"sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"`),
+			}},
+		},
+		{
+			name: "distribution with several errors",
+			body: `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"},{"code":"UNAUTHORIZED","message":"authentication required","detail":null}]}`,
+			want: []RegistryError{
+				{Code: "DENIED", Message: "requested access to the resource is denied"},
+				{Code: "UNAUTHORIZED", Message: "authentication required", Detail: []byte("null")},
+			},
+		},
+		{
+			name: "ACR",
+			body: `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required, visit https://aka.ms/acr/authorization for more information.","detail":[{"Type":"repository","Name":"hello-world","Action":"push"}]}]}` + "\n",
+			want: []RegistryError{{
+				Code:    "UNAUTHORIZED",
+				Message: "authentication required, visit https://aka.ms/acr/authorization for more information.",
+				Detail:  []byte(`[{"Type":"repository","Name":"hello-world","Action":"push"}]`),
+			}},
+		},
+		{
+			name: "ACR manifest unknown",
+			body: `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest tagged by \"latest\" is not found","detail":{"Tag":"latest"}}]}`,
+			want: []RegistryError{{
+				Code:    "MANIFEST_UNKNOWN",
+				Message: `manifest tagged by "latest" is not found`,
+				Detail:  []byte(`{"Tag":"latest"}`),
+			}},
+		},
+		{
+			name: "errors without code",
+			body: `{"errors":[{"message":"no code"},{"code":"TOOMANYREQUESTS"}]}`,
+			want: []RegistryError{{Code: "TOOMANYREQUESTS"}},
+		},
+		{
+			name: "not JSON",
+			body: "<html><body><h1>502 Bad Gateway</h1></body></html>",
+		},
+		{
+			name: "JSON without errors",
+			body: `{"message":"not found"}`,
+		},
+		{
+			name: "empty",
+			body: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseErrorResponse([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseErrorResponse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryErrorsOfPushError(t *testing.T) {
+	err := pushError(remoteserrors.ErrUnexpectedStatus{
+		Status:        "404 Not Found",
+		StatusCode:    http.StatusNotFound,
+		Body:          []byte(`{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`),
+		RequestURL:    "https://example.azurecr.io/v2/hello-world/blobs/uploads/",
+		RequestMethod: http.MethodPost,
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("pushError() = %v, want it to wrap %v", err, ErrNotFound)
+	}
+	if !strings.Contains(err.Error(), "(NAME_UNKNOWN: repository name not known to registry)") {
+		t.Errorf("pushError() = %q, want the registry error described", err)
+	}
+	want := []RegistryError{{Code: "NAME_UNKNOWN", Message: "repository name not known to registry"}}
+	if got := RegistryErrors(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("RegistryErrors() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStatusErrorDescribesRegistryErrors(t *testing.T) {
+	err := &StatusError{
+		Op:       "put manifest latest",
+		Expected: []int{http.StatusCreated},
+		Got:      http.StatusBadRequest,
+		Errors:   []RegistryError{{Code: "MANIFEST_INVALID", Message: "manifest invalid"}},
+	}
+	want := "put manifest latest failed, expected: 201, got: 400 (MANIFEST_INVALID: manifest invalid): unexpected status"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if codes := errorCodes(err); !reflect.DeepEqual(codes, []string{"MANIFEST_INVALID"}) {
+		t.Errorf("errorCodes() = %v, want [MANIFEST_INVALID]", codes)
+	}
+}
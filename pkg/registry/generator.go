@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ContentGenerator generates the content of a config or layer blob.
+type ContentGenerator interface {
+	// Generate returns the media type and content of the blob.
+	Generate() (mediaType string, data []byte, err error)
+}
+
+// annotator is implemented by generators that describe the content they generated with annotations.
+type annotator interface {
+	// Annotations returns the annotations of the last generated content.
+	Annotations() map[string]string
+}
+
+// diffIDer is implemented by generators of compressed layers, whose diff ID is not the digest
+// of the blob.
+type diffIDer interface {
+	// DiffID returns the digest of the uncompressed last generated content.
+	DiffID() digest.Digest
+}
+
+// StaticContent generates the same content every time.
+type StaticContent struct {
+	MediaType string
+	Data      []byte
+}
+
+// Generate returns the static content.
+func (g StaticContent) Generate() (string, []byte, error) {
+	return g.MediaType, g.Data, nil
+}
+
+// JSONContent generates the JSON encoding of a value.
+type JSONContent struct {
+	MediaType string
+	Value     any
+}
+
+// Generate returns the JSON encoding of the value.
+func (g JSONContent) Generate() (string, []byte, error) {
+	data, err := json.Marshal(g.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	return g.MediaType, data, nil
+}
+
+// TimestampLayer generates a layer embedding the tag, the layer index and the current time,
+// so every generation yields a new digest.
+type TimestampLayer struct {
+	Tag   string
+	Index int
+}
+
+// Generate returns the timestamped layer content.
+func (g TimestampLayer) Generate() (string, []byte, error) {
+	data := []byte(fmt.Sprintf("TestLayer %s %d-at-time %s", g.Tag, g.Index, time.Now()))
+	return ociimagespec.MediaTypeImageLayer, data, nil
+}
+
+// seededLayer generates a layer drawn from a seeded PRNG, so the content only depends on
+// the seed and generation order.
+type seededLayer struct {
+	rand  *rand.Rand
+	index int
+}
+
+// Generate returns the next pseudo random layer content.
+func (g seededLayer) Generate() (string, []byte, error) {
+	buf := make([]byte, 32)
+	g.rand.Read(buf)
+	return ociimagespec.MediaTypeImageLayer, []byte(fmt.Sprintf("TestLayer %d-seeded %x", g.index, buf)), nil
+}
+
+// GzipLayer packs the content of another generator in a gzip compressed tar archive.
+// The uncompressed size is recorded as an annotation.
+type GzipLayer struct {
+	Content ContentGenerator
+	// Name is the name of the single file in the archive.
+	Name string
+
+	annotations map[string]string
+	diffID      digest.Digest
+}
+
+// Generate returns the compressed archive.
+func (g *GzipLayer) Generate() (string, []byte, error) {
+	_, data, err := g.Content.Generate()
+	if err != nil {
+		return "", nil, err
+	}
+	compressed, archive, err := tarGzip(g.Name, data)
+	if err != nil {
+		return "", nil, err
+	}
+	g.diffID = digest.FromBytes(archive)
+	g.annotations = map[string]string{
+		annotationUncompressedSize: fmt.Sprint(len(data)),
+	}
+	return ociimagespec.MediaTypeImageLayerGzip, compressed, nil
+}
+
+// Annotations returns the uncompressed size of the last generated archive.
+func (g *GzipLayer) Annotations() map[string]string {
+	return g.annotations
+}
+
+// DiffID returns the digest of the last generated archive before compression.
+func (g *GzipLayer) DiffID() digest.Digest {
+	return g.diffID
+}
+
+// ImageConfig generates an image config whose rootfs and history describe the layers of the image.
+type ImageConfig struct {
+	MediaType string
+
+	// Image is the base config, its creation time, rootfs and history are overwritten.
+	Image ociimagespec.Image
+
+	// Created is the creation time of the image and its history, the generation time if nil.
+	Created *time.Time
+
+	// DiffIDs are the digests of the uncompressed layers of the image, in order.
+	DiffIDs []digest.Digest
+
+	// EmptyLayers is the number of empty_layer history entries following the layer entries.
+	EmptyLayers int
+}
+
+// emptyLayerInstructions are the instructions of the empty_layer history entries, in order.
+var emptyLayerInstructions = []string{
+	`ENV PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin`,
+	`LABEL org.opencontainers.image.vendor=imagegentest`,
+	`WORKDIR /`,
+	`CMD ["/bin/sh"]`,
+}
+
+// Generate returns the JSON encoding of the config with one history entry per layer followed by
+// the empty_layer entries.
+func (g ImageConfig) Generate() (string, []byte, error) {
+	created := time.Now().UTC().Truncate(time.Second)
+	if g.Created != nil {
+		created = *g.Created
+	}
+
+	config := g.Image
+	config.Created = &created
+	config.RootFS = ociimagespec.RootFS{Type: "layers", DiffIDs: g.DiffIDs}
+	config.History = nil
+	for i, diffID := range g.DiffIDs {
+		config.History = append(config.History, ociimagespec.History{
+			Created:   &created,
+			CreatedBy: fmt.Sprintf("COPY %s / # %s", layerFileName(i), diffID.Encoded()[:12]),
+			Author:    config.Author,
+		})
+	}
+	for i := 0; i < g.EmptyLayers; i++ {
+		config.History = append(config.History, ociimagespec.History{
+			Created:    &created,
+			CreatedBy:  emptyLayerInstructions[i%len(emptyLayerInstructions)],
+			Author:     config.Author,
+			EmptyLayer: true,
+		})
+	}
+	return JSONContent{MediaType: g.MediaType, Value: config}.Generate()
+}
+
+// LayerSpec describes a layer of a generated image.
+type LayerSpec struct {
+	// MediaType is the media type of the layer.
+	MediaType string
+
+	// Size is the size of the layer in bytes, the size of the generated content if zero.
+	Size int64
+}
+
+// CustomLayer generates the content of another generator with the media type and size of a spec.
+// The content is padded with zeros to the size, it is not encoded as the media type. Content
+// longer than the size is replaced by its index followed by its digest, repeated up to the size,
+// since truncating it would keep the prefix every generated layer starts with.
+type CustomLayer struct {
+	Content ContentGenerator
+	Spec    LayerSpec
+
+	// Index is the position of the layer in its image, which keeps the layers of an image distinct
+	// even when they are too small to hold the digest of their content.
+	Index int
+}
+
+// Generate returns the resized content with the spec media type.
+func (g CustomLayer) Generate() (string, []byte, error) {
+	_, data, err := g.Content.Generate()
+	if err != nil {
+		return "", nil, err
+	}
+	switch size := g.Spec.Size; {
+	case size > 0 && int64(len(data)) > size:
+		sum := sha256.Sum256(data)
+		fill := append(binary.AppendUvarint(nil, uint64(g.Index)), sum[:]...)
+		resized := make([]byte, size)
+		for n := 0; n < len(resized); {
+			n += copy(resized[n:], fill)
+		}
+		data = resized
+	case size > 0:
+		resized := make([]byte, size)
+		copy(resized, data)
+		data = resized
+	}
+	return g.Spec.MediaType, data, nil
+}
+
+// scratchContent generates the OCI scratch blob.
+var scratchContent = StaticContent{
+	MediaType: ociimagespec.ScratchDescriptor.MediaType,
+	Data:      ociimagespec.ScratchDescriptor.Data,
+}
+
+// configGenerator returns the generator of image configs.
+// Its rootfs and history are filled in once the layers of the image are pushed.
+func (p Proxy) configGenerator() ContentGenerator {
+	g := ImageConfig{
+		MediaType:   p.configMediaType(),
+		Image:       ociConfig,
+		EmptyLayers: p.EmptyLayerHistory,
+	}
+	if p.rand != nil {
+		// keep seeded configs identical across runs
+		created := time.Unix(0, 0).UTC()
+		g.Created = &created
+	}
+	return g
+}
+
+// imageLayerGenerators returns the generators of the layers of an image with the given tag,
+// following the configured layer specs if any, or the given number of default layers.
+func (p Proxy) imageLayerGenerators(tag string, count int) []ContentGenerator {
+	if len(p.Layers) == 0 {
+		return p.layerGenerators(tag, count)
+	}
+	layers := make([]ContentGenerator, len(p.Layers))
+	for i, spec := range p.Layers {
+		var g ContentGenerator = TimestampLayer{Tag: tag, Index: i}
+		if p.rand != nil {
+			g = seededLayer{rand: p.rand, index: i}
+		}
+		layers[i] = CustomLayer{Content: g, Spec: spec, Index: i}
+	}
+	return layers
+}
+
+// layerGenerators returns the generators of the layers of an image with the given tag.
+// Layers are timestamped by default, drawn from the proxy's PRNG when seeded and
+// compressed when compression is enabled.
+func (p Proxy) layerGenerators(tag string, count int) []ContentGenerator {
+	layers := make([]ContentGenerator, count)
+	for i := range layers {
+		var g ContentGenerator = TimestampLayer{Tag: tag, Index: i}
+		if p.rand != nil {
+			g = seededLayer{rand: p.rand, index: i}
+		}
+		if p.Compress {
+			g = &GzipLayer{Content: g, Name: layerFileName(i)}
+		}
+		layers[i] = g
+	}
+	return layers
+}
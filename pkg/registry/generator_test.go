@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCustomLayersDistinct(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int64
+		seed  bool
+	}{
+		{name: "single byte layers", sizes: []int64{1, 1, 1}},
+		{name: "truncated layers", sizes: []int64{4, 4, 9, 9}},
+		{name: "truncated seeded layers", sizes: []int64{4, 4, 9, 9}, seed: true},
+		{name: "padded layers", sizes: []int64{1000, 1000}},
+		{name: "generated size", sizes: []int64{0, 0}},
+		{name: "mixed sizes", sizes: []int64{1, 32, 33, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &Options{}
+			for _, size := range tt.sizes {
+				opts.Layers = append(opts.Layers, LayerSpec{MediaType: ociimagespec.MediaTypeImageLayer, Size: size})
+			}
+			p := Proxy{Options: opts}
+			if tt.seed {
+				p.rand = rand.New(rand.NewSource(1))
+			}
+
+			seen := map[digest.Digest]int{}
+			for i, g := range p.imageLayerGenerators("tag", 0) {
+				blob, err := generateBlob(g, false, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size := tt.sizes[i]; size > 0 && blob.Descriptor.Size != size {
+					t.Errorf("layer %d size = %d, want %d", i, blob.Descriptor.Size, size)
+				}
+				if j, ok := seen[blob.Descriptor.Digest]; ok {
+					t.Errorf("layers %d and %d have the same digest %s", j, i, blob.Descriptor.Digest)
+				}
+				seen[blob.Descriptor.Digest] = i
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Helm chart media types.
+const (
+	HelmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	HelmChartMediaType  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// HelmChart is a packaged Helm chart pushed as an OCI artifact.
+type HelmChart struct {
+	// Metadata is the content of the Chart.yaml of the chart, which becomes the config of the
+	// artifact. It holds at least the name and version of the chart.
+	Metadata map[string]any
+
+	// Content is the packaged chart, a gzipped tar archive.
+	Content []byte
+}
+
+// Name returns the name of the chart.
+func (c HelmChart) Name() string {
+	name, _ := c.Metadata["name"].(string)
+	return name
+}
+
+// Version returns the version of the chart.
+func (c HelmChart) Version() string {
+	version, _ := c.Metadata["version"].(string)
+	return version
+}
+
+// Tag returns the tag Helm pushes the chart to, its version with the + of build metadata,
+// not allowed in tags, replaced with _.
+func (c HelmChart) Tag() string {
+	return strings.ReplaceAll(c.Version(), "+", "_")
+}
+
+// NewHelmChart returns a synthetic chart with the given name and version, packaging a
+// Chart.yaml, a values.yaml and a config map template.
+func NewHelmChart(name, version string) (HelmChart, error) {
+	if name == "" || version == "" {
+		return HelmChart{}, errors.New("chart name and version required")
+	}
+	metadata := map[string]any{
+		"apiVersion":  "v2",
+		"name":        name,
+		"version":     version,
+		"description": "Chart generated by image-gen-test",
+		"type":        "application",
+	}
+	chartYAML, err := yaml.Marshal(metadata)
+	if err != nil {
+		return HelmChart{}, err
+	}
+	// Chart.yaml comes first, as helm package writes it
+	content, err := packHelmChart(name, []chartFile{
+		{"Chart.yaml", chartYAML},
+		{"values.yaml", []byte("message: generated by image-gen-test\n")},
+		{"templates/configmap.yaml", []byte(helmConfigMapTemplate)},
+	})
+	if err != nil {
+		return HelmChart{}, err
+	}
+	return HelmChart{Metadata: metadata, Content: content}, nil
+}
+
+// helmConfigMapTemplate is the template of the synthetic charts.
+const helmConfigMapTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  message: {{ .Values.message | quote }}
+`
+
+// LoadHelmChart reads a packaged chart, such as one created by helm package, taking its
+// metadata from the Chart.yaml at the root of the chart.
+func LoadHelmChart(file string) (HelmChart, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return HelmChart{}, err
+	}
+	chartYAML, err := readChartYAML(content)
+	if err != nil {
+		return HelmChart{}, fmt.Errorf("read chart %s: %w", file, err)
+	}
+	var metadata map[string]any
+	if err := yaml.Unmarshal(chartYAML, &metadata); err != nil {
+		return HelmChart{}, fmt.Errorf("read Chart.yaml of %s: %w", file, err)
+	}
+	chart := HelmChart{Metadata: metadata, Content: content}
+	if chart.Name() == "" || chart.Version() == "" {
+		return HelmChart{}, fmt.Errorf("Chart.yaml of %s has no name or version", file)
+	}
+	return chart, nil
+}
+
+// readChartYAML returns the Chart.yaml at the root of the chart in a gzipped tar archive.
+func readChartYAML(content []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("no Chart.yaml found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		// charts are packaged in a directory named after them
+		dir, file := path.Split(strings.TrimPrefix(header.Name, "./"))
+		if file == "Chart.yaml" && strings.Count(dir, "/") == 1 {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// chartFile is a file of a packaged chart, its name relative to the chart directory.
+type chartFile struct {
+	name    string
+	content []byte
+}
+
+// packHelmChart packs the files in a directory named after the chart and compresses the
+// archive with gzip. Timestamps are left unset so the result only depends on the files.
+func packHelmChart(name string, files []chartFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(name, file.name),
+			Mode:     0644,
+			Size:     int64(len(file.content)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GenerateHelmChart pushes the chart to the repository the way helm push does: the config is
+// the JSON encoding of the chart metadata, the single layer is the packaged chart and the
+// manifest is tagged with the chart version.
+func (p Proxy) GenerateHelmChart(ctx context.Context, repo string, chart HelmChart) (_ ociimagespec.Descriptor, err error) {
+	ctx, span := p.startSpan(ctx, "generate.helm_chart", repo)
+	defer func() { endSpan(span, err) }()
+	config, err := json.Marshal(chart.Metadata)
+	if err != nil {
+		return ociimagespec.Descriptor{}, fmt.Errorf("encode chart metadata: %w", err)
+	}
+
+	tag := chart.Tag()
+	skip, overwrite, err := p.checkTag(ctx, repo, tag)
+	if err != nil || skip {
+		return ociimagespec.Descriptor{}, err
+	}
+	desc, err := p.pushManifest(ctx, repo, tag, manifestContent{
+		config: StaticContent{MediaType: HelmConfigMediaType, Data: config},
+		layers: []ContentGenerator{StaticContent{MediaType: HelmChartMediaType, Data: chart.Content}},
+		annotations: map[string]string{
+			ociimagespec.AnnotationTitle:   chart.Name(),
+			ociimagespec.AnnotationVersion: chart.Version(),
+		},
+	})
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	p.logPushed(repo, tag, overwrite)
+	p.Logger.Info().Msgf("Pushed Helm chart %s %s as %s:%s@%s", chart.Name(), chart.Version(), repo, tag, desc.Digest)
+	return desc, nil
+}
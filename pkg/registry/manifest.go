@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestMediaTypes are the manifest media types accepted when fetching manifests.
+var manifestMediaTypes = []string{
+	ociimagespec.MediaTypeImageManifest,
+	ociimagespec.MediaTypeImageIndex,
+	images.MediaTypeDockerSchema2Manifest,
+	images.MediaTypeDockerSchema2ManifestList,
+}
+
+// manifestAccept returns the Accept header of manifest fetches, the configured media types
+// or all the OCI and Docker manifest and index media types by default.
+func (p Proxy) manifestAccept() string {
+	if len(p.Accept) > 0 {
+		return strings.Join(p.Accept, ", ")
+	}
+	return strings.Join(manifestMediaTypes, ", ")
+}
+
+// artifactIndex is an OCI image index with the artifactType and subject fields
+// introduced in OCI image-spec v1.1, which the vendored image-spec does not define.
+type artifactIndex struct {
+	ociimagespec.Index
+
+	// ArtifactType is the type of an artifact when the index is used for an artifact.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject is the manifest the index refers to.
+	Subject *ociimagespec.Descriptor `json:"subject,omitempty"`
+}
+
+// ResolveDescriptor fetches the manifest at the reference, a tag or a digest, and returns its descriptor.
+// The digest and size are computed from the fetched bytes, which must match the digest of a digest
+// reference and the digest reported by the registry with the same algorithm, if any.
+func (p Proxy) ResolveDescriptor(ctx context.Context, repo, reference string) (ociimagespec.Descriptor, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(routeManifests, repo, reference),
+		accept:      p.manifestAccept(),
+		op:          fmt.Sprintf("get manifest %s", reference),
+		expected:    []int{http.StatusOK},
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(tripInfo.Response.Body, &manifest); err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = tripInfo.Response.HeaderContentType
+	}
+
+	desc := ociimagespec.Descriptor{
+		MediaType: mediaType,
+		Digest:    tripInfo.Response.SHA256Sum,
+		Size:      tripInfo.Response.Size,
+	}
+	if dgst, err := digest.Parse(reference); err == nil && dgst != desc.Digest {
+		return desc, fmt.Errorf("get manifest %s failed, got digest %s: %w", reference, desc.Digest, ErrDigestMismatch)
+	}
+	if reported, err := digest.Parse(tripInfo.Response.HeaderContentDigest); err == nil && reported.Algorithm() == desc.Digest.Algorithm() && reported != desc.Digest {
+		return desc, fmt.Errorf("get manifest %s failed, registry reported digest %s, got %s: %w", reference, reported, desc.Digest, ErrDigestMismatch)
+	}
+	return desc, nil
+}
+
+// uploadManifest pushes a manifest to the tag of the pusher, or by digest if it has none.
+// Manifest pushes are idempotent, pushing the same content by digest is a no-op and to the same
+// tag a harmless re-tag. A push failing without an answer from the registry is settled by
+// checking whether the reference resolves to the manifest before every retry.
+func (p Proxy) uploadManifest(ctx context.Context, pusher remotes.Pusher, repo, tag string, desc ociimagespec.Descriptor, data []byte) error {
+	if err := p.dumpContent(desc, data); err != nil {
+		return err
+	}
+	reference := tag
+	if reference == "" {
+		reference = desc.Digest.String()
+	}
+	return p.retryPush(ctx, pusher, repo, tag, desc, data, func(ctx context.Context) bool {
+		got, err := p.HeadManifest(ctx, repo, reference)
+		return err == nil && got.Digest == desc.Digest
+	})
+}
+
+// HeadManifest returns the descriptor of the manifest at the reference, a tag or a digest, as
+// reported by the registry in the headers of a HEAD request, without downloading the manifest.
+// The digest is the Docker-Content-Digest header, which must be a valid digest matching a digest
+// reference. The media type is the Content-Type and the size the Content-Length, if known.
+func (p Proxy) HeadManifest(ctx context.Context, repo, reference string) (ociimagespec.Descriptor, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodHead,
+		url:      p.url(routeManifests, repo, reference),
+		accept:   p.manifestAccept(),
+		op:       fmt.Sprintf("head manifest %s", reference),
+		expected: []int{http.StatusOK},
+	})
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+
+	resp := tripInfo.Response
+	if resp.HeaderContentDigest == "" {
+		return ociimagespec.Descriptor{}, fmt.Errorf("head manifest %s: registry did not return the %s header", reference, rhttp.HeaderContentDigest)
+	}
+	dgst, err := digest.Parse(resp.HeaderContentDigest)
+	if err != nil {
+		return ociimagespec.Descriptor{}, fmt.Errorf("head manifest %s: invalid %s header: %w", reference, rhttp.HeaderContentDigest, err)
+	}
+	desc := ociimagespec.Descriptor{
+		MediaType: strings.TrimSpace(strings.Split(resp.HeaderContentType, ";")[0]),
+		Digest:    dgst,
+	}
+	if resp.HeaderContentLength > 0 {
+		desc.Size = resp.HeaderContentLength
+	}
+	if ref, err := digest.Parse(reference); err == nil && ref != dgst {
+		return desc, fmt.Errorf("head manifest %s failed, registry reported digest %s: %w", reference, dgst, ErrDigestMismatch)
+	}
+	return desc, nil
+}
+
+// manifestExists checks whether a manifest exists for the given tag or digest. Any 200 answers
+// that it exists, since the Docker-Content-Digest header HeadManifest requires is optional.
+func (p Proxy) manifestExists(ctx context.Context, repo, reference string) (bool, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodHead,
+		url:      p.url(routeManifests, repo, reference),
+		accept:   p.manifestAccept(),
+		op:       fmt.Sprintf("head manifest %s", reference),
+		expected: []int{http.StatusOK, http.StatusNotFound},
+	})
+	if err != nil {
+		return false, err
+	}
+	return tripInfo.Response.Code == http.StatusOK, nil
+}
+
+// checkTag checks whether a tag exists before pushing a top-level manifest to it.
+// It returns whether the push should be skipped because the tag exists and IfNotExists is set,
+// and whether the push overwrites an existing tag.
+func (p Proxy) checkTag(ctx context.Context, repo, tag string) (skip, overwrite bool, err error) {
+	exists, err := p.manifestExists(ctx, repo, tag)
+	if err != nil {
+		return false, false, err
+	}
+	if exists && p.IfNotExists {
+		p.Logger.Info().Msgf("Tag %s:%s exists, skipping push", repo, tag)
+		return true, false, nil
+	}
+	return false, exists, nil
+}
+
+// logPushed reports whether a top-level push created or overwrote a tag.
+func (p Proxy) logPushed(repo, tag string, overwrite bool) {
+	if overwrite {
+		p.Logger.Info().Msgf("Overwrote %s:%s", repo, tag)
+	} else {
+		p.Logger.Info().Msgf("Created %s:%s", repo, tag)
+	}
+}
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+)
+
+func TestUploadManifestConnectionDropped(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   bool
+		wantPuts int
+	}{
+		// the registry stored the manifest before the connection dropped, the retry finds it
+		{name: "stored before the drop", stored: true, wantPuts: 1},
+		// the registry lost the manifest with the connection, the retry pushes it again
+		{name: "lost with the drop", stored: false, wantPuts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const repo, tag = "dropped", "v1"
+			m, server := newMemRegistry(t)
+			var dropped atomic.Bool
+			m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") || dropped.Swap(true) {
+					return false
+				}
+				data, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if tt.stored {
+					m.putManifest(repo, tag, memManifest{MediaType: r.Header.Get("Content-Type"), Data: data})
+				}
+				// drop the connection once the request is read, before any response is sent
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					t.Error(err)
+					return true
+				}
+				conn.Close()
+				return true
+			}
+			p := newTestProxy(t, server, Options{Retry: rhttp.RetryPolicy{MaxRetries: 2}})
+
+			ctx := context.Background()
+			data, desc, _, err := BuildOCIArtifact(imagegenArtifactType, nil, nil, BuildOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pusher, err := p.pusher(ctx, repo, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.uploadManifest(ctx, pusher, repo, tag, desc, data); err != nil {
+				t.Fatalf("uploadManifest() error = %v", err)
+			}
+			if got := m.count(http.MethodPut, "/manifests/"); got != tt.wantPuts {
+				t.Errorf("manifest PUTs = %d, want %d", got, tt.wantPuts)
+			}
+			manifest, ok := m.manifest(repo, tag)
+			if !ok || string(manifest.Data) != string(data) {
+				t.Errorf("%s:%s does not resolve to the pushed manifest", repo, tag)
+			}
+		})
+	}
+}
+
+func TestManifestExistsWithoutDigestHeader(t *testing.T) {
+	const repo, tag = "nodigest", "v1"
+	m, server := newMemRegistry(t)
+	// the registry answers manifest HEADs without the optional Docker-Content-Digest header
+	m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodHead || !strings.Contains(r.URL.Path, "/manifests/") {
+			return false
+		}
+		manifest, ok := m.manifest(repo, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		if !ok {
+			memError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return true
+		}
+		w.Header().Set("Content-Type", manifest.MediaType)
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	data, desc, _, err := BuildOCIArtifact(imagegenArtifactType, nil, nil, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.putManifest(repo, tag, memManifest{MediaType: desc.MediaType, Data: data})
+	p := newTestProxy(t, server, Options{})
+	ctx := context.Background()
+
+	exists, err := p.manifestExists(ctx, repo, tag)
+	if err != nil || !exists {
+		t.Errorf("manifestExists(%s) = %v, %v, want true", tag, exists, err)
+	}
+	exists, err = p.manifestExists(ctx, repo, "missing")
+	if err != nil || exists {
+		t.Errorf("manifestExists(missing) = %v, %v, want false", exists, err)
+	}
+	if _, err := p.HeadManifest(ctx, repo, tag); err == nil {
+		t.Errorf("HeadManifest() succeeded without the %s header, want an error", rhttp.HeaderContentDigest)
+	}
+}
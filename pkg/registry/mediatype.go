@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// KnownMediaTypes are the OCI and Docker media types, and the media types of the generated
+// content, that registries are expected to accept.
+var KnownMediaTypes = []string{
+	ociimagespec.MediaTypeImageManifest,
+	ociimagespec.MediaTypeImageIndex,
+	ociimagespec.MediaTypeImageConfig,
+	ociimagespec.MediaTypeImageLayer,
+	ociimagespec.MediaTypeImageLayerGzip,
+	ociimagespec.MediaTypeImageLayerZstd,
+	ociimagespec.MediaTypeImageLayerNonDistributable,
+	ociimagespec.MediaTypeImageLayerNonDistributableGzip,
+	ociimagespec.MediaTypeImageLayerNonDistributableZstd,
+	ociimagespec.MediaTypeScratch,
+	mediaTypeEmpty,
+	mediaTypeUnknownConfig,
+
+	images.MediaTypeDockerSchema2Manifest,
+	images.MediaTypeDockerSchema2ManifestList,
+	images.MediaTypeDockerSchema2Config,
+	images.MediaTypeDockerSchema2Layer,
+	images.MediaTypeDockerSchema2LayerGzip,
+	images.MediaTypeDockerSchema2LayerForeign,
+	images.MediaTypeDockerSchema2LayerForeignGzip,
+
+	imagegenConfigMediaType,
+	imagegenArtifactType,
+	notarySignatureArtifactType,
+	notaryJWSMediaType,
+	notaryPayloadMediaType,
+	SBOMArtifactTypeSPDX,
+	SBOMArtifactTypeCycloneDX,
+	HelmConfigMediaType,
+	HelmChartMediaType,
+}
+
+// mediaTypeWarnings records the unknown media types already warned about. It is safe for concurrent use.
+type mediaTypeWarnings struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// first indicates if the media type is seen for the first time.
+func (w *mediaTypeWarnings) first(mediaType string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seen == nil {
+		w.seen = make(map[string]bool)
+	}
+	if w.seen[mediaType] {
+		return false
+	}
+	w.seen[mediaType] = true
+	return true
+}
+
+// knownMediaType indicates if the media type is a known or explicitly allowed media type.
+func (p Proxy) knownMediaType(mediaType string) bool {
+	for _, known := range KnownMediaTypes {
+		if mediaType == known {
+			return true
+		}
+	}
+	for _, allowed := range p.AllowedMediaTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMediaType warns once about each media type that is neither known nor allowed,
+// unless custom media types are allowed. Empty media types are not checked.
+func (p Proxy) checkMediaType(kind, mediaType string) {
+	if p.AllowCustomMediaTypes || mediaType == "" || p.knownMediaType(mediaType) {
+		return
+	}
+	if p.mediaTypeWarnings.first(mediaType) {
+		p.Logger.Warn().Msgf("Unknown %s media type %q, the registry may reject it", kind, mediaType)
+	}
+}
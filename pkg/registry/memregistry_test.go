@@ -0,0 +1,378 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+var (
+	memRouteBase      = regexp.MustCompile(`^/v2/$`)
+	memRouteUploads   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+	memRouteBlobs     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	memRouteManifests = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	memRouteTags      = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+// memRequest is a request served by a memRegistry.
+type memRequest struct {
+	Method string
+	URI    string
+}
+
+// memManifest is a manifest stored by a memRegistry.
+type memManifest struct {
+	MediaType string
+	Data      []byte
+}
+
+// memRegistry is an in-memory registry implementing the parts of the distribution API the proxy
+// pushes and pulls with, without the referrers API. Blobs are stored per repository, so a blob
+// must be uploaded or mounted to every repository referencing it.
+type memRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string]map[digest.Digest][]byte
+	manifests map[string]map[string]memManifest
+	uploads   map[string][]byte
+	requests  []memRequest
+
+	// hook is called before every request is served, and serves it instead if it returns true.
+	hook func(w http.ResponseWriter, r *http.Request) bool
+}
+
+// newMemRegistry starts an in-memory registry, closed once the test ends.
+func newMemRegistry(t *testing.T) (*memRegistry, *httptest.Server) {
+	t.Helper()
+	m := &memRegistry{
+		blobs:     map[string]map[digest.Digest][]byte{},
+		manifests: map[string]map[string]memManifest{},
+		uploads:   map[string][]byte{},
+	}
+	server := httptest.NewServer(m)
+	t.Cleanup(server.Close)
+	return m, server
+}
+
+// newTestProxy returns a proxy pushing to the server over HTTP without authentication.
+func newTestProxy(t *testing.T, server *httptest.Server, opts Options) *Proxy {
+	t.Helper()
+	opts.LoginServer = strings.TrimPrefix(server.URL, "http://")
+	opts.Insecure = true
+	p, err := NewProxy(&opts, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// count returns the number of served requests with the method whose URI contains the substring.
+func (m *memRegistry) count(method, substr string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, r := range m.requests {
+		if r.Method == method && strings.Contains(r.URI, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// blobPuts returns the number of upload PUTs of the blob to the repository, failed or not.
+func (m *memRegistry) blobPuts(repo string, dgst digest.Digest) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, r := range m.requests {
+		u, err := url.Parse(r.URI)
+		if err != nil || r.Method != http.MethodPut {
+			continue
+		}
+		if match := memRouteUploads.FindStringSubmatch(u.Path); match != nil && match[1] == repo && u.Query().Get("digest") == dgst.String() {
+			n++
+		}
+	}
+	return n
+}
+
+// blob returns the content of the blob in the repository, if any.
+func (m *memRegistry) blob(repo string, dgst digest.Digest) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[repo][dgst]
+	return data, ok
+}
+
+// manifest returns the manifest at the reference in the repository, if any.
+func (m *memRegistry) manifest(repo, reference string) (memManifest, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	manifest, ok := m.manifests[repo][reference]
+	return manifest, ok
+}
+
+// putManifest stores the manifest at the tag, if any, and at its digest.
+func (m *memRegistry) putManifest(repo, tag string, manifest memManifest) digest.Digest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dgst := digest.FromBytes(manifest.Data)
+	if m.manifests[repo] == nil {
+		m.manifests[repo] = map[string]memManifest{}
+	}
+	m.manifests[repo][dgst.String()] = manifest
+	if tag != "" {
+		m.manifests[repo][tag] = manifest
+	}
+	return dgst
+}
+
+// ServeHTTP serves the distribution API routes.
+func (m *memRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests = append(m.requests, memRequest{Method: r.Method, URI: r.URL.RequestURI()})
+	hook := m.hook
+	m.mu.Unlock()
+	if hook != nil && hook(w, r) {
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case memRouteBase.MatchString(path):
+		w.WriteHeader(http.StatusOK)
+	case memRouteUploads.MatchString(path):
+		match := memRouteUploads.FindStringSubmatch(path)
+		m.serveUpload(w, r, match[1], match[2])
+	case memRouteBlobs.MatchString(path):
+		match := memRouteBlobs.FindStringSubmatch(path)
+		m.serveBlob(w, r, match[1], digest.Digest(match[2]))
+	case memRouteManifests.MatchString(path):
+		match := memRouteManifests.FindStringSubmatch(path)
+		m.serveManifest(w, r, match[1], match[2])
+	case memRouteTags.MatchString(path) && r.Method == http.MethodGet:
+		m.serveTags(w, memRouteTags.FindStringSubmatch(path)[1])
+	default:
+		memError(w, http.StatusNotFound, "NOT_FOUND", "route not found")
+	}
+}
+
+func (m *memRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Method == http.MethodPost {
+		if mount, from := digest.Digest(r.URL.Query().Get("mount")), r.URL.Query().Get("from"); mount != "" {
+			if data, ok := m.blobs[from][mount]; ok {
+				m.storeBlob(repo, mount, data)
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, mount))
+				w.Header().Set("Docker-Content-Digest", mount.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id = uuid.NewString()
+		m.uploads[id] = nil
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	upload, ok := m.uploads[id]
+	if !ok {
+		memError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+		return
+	}
+	upload = append(upload, body...)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", max(len(upload)-1, 0)))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		m.uploads[id] = upload
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", max(len(upload)-1, 0)))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		delete(m.uploads, id)
+		dgst, err := digest.Parse(r.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(upload) != dgst {
+			memError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+			return
+		}
+		m.storeBlob(repo, dgst, upload)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(m.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// storeBlob stores the blob in the repository, the lock must be held.
+func (m *memRegistry) storeBlob(repo string, dgst digest.Digest, data []byte) {
+	if m.blobs[repo] == nil {
+		m.blobs[repo] = map[digest.Digest][]byte{}
+	}
+	m.blobs[repo][dgst] = data
+}
+
+func (m *memRegistry) serveBlob(w http.ResponseWriter, r *http.Request, repo string, dgst digest.Digest) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, ok := m.blob(repo, dgst)
+	if !ok {
+		memError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	// serves Range requests as partial content
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (m *memRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, reference string) {
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		tag := reference
+		if dgst, err := digest.Parse(reference); err == nil {
+			if dgst != digest.FromBytes(data) {
+				memError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+				return
+			}
+			tag = ""
+		}
+		dgst := m.putManifest(repo, tag, memManifest{MediaType: r.Header.Get("Content-Type"), Data: data})
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repo, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		manifest, ok := m.manifest(repo, reference)
+		if !ok {
+			memError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+			return
+		}
+		w.Header().Set("Content-Type", manifest.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest.Data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.Data).String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(manifest.Data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *memRegistry) serveTags(w http.ResponseWriter, repo string) {
+	m.mu.Lock()
+	tags := []string{}
+	for reference := range m.manifests[repo] {
+		if _, err := digest.Parse(reference); err != nil {
+			tags = append(tags, reference)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(tags)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+}
+
+// memError responds with a distribution error response.
+func memError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func TestPushIndexDescriptorMediaType(t *testing.T) {
+	tests := []struct {
+		name               string
+		mediaType          string
+		descriptorOverride string
+		wantContentType    string
+	}{
+		{name: "body without media type", wantContentType: ociimagespec.MediaTypeImageIndex},
+		{name: "oci index", mediaType: ociimagespec.MediaTypeImageIndex, wantContentType: ociimagespec.MediaTypeImageIndex},
+		{name: "docker manifest list", mediaType: images.MediaTypeDockerSchema2ManifestList, wantContentType: images.MediaTypeDockerSchema2ManifestList},
+		{name: "overridden without media type", descriptorOverride: images.MediaTypeDockerSchema2ManifestList, wantContentType: images.MediaTypeDockerSchema2ManifestList},
+		{name: "overridden mismatching body", mediaType: ociimagespec.MediaTypeImageIndex, descriptorOverride: images.MediaTypeDockerSchema2ManifestList, wantContentType: images.MediaTypeDockerSchema2ManifestList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const repo, tag = "indexes", "v1"
+			m, server := newMemRegistry(t)
+			p := newTestProxy(t, server, Options{
+				Repository:               repo,
+				Tag:                      tag,
+				IndexManifestCount:       2,
+				IndexDescriptorMediaType: tt.descriptorOverride,
+			})
+
+			result, err := p.GenerateOCIIndex(context.Background(), tt.mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, ok := m.manifest(repo, tag)
+			if !ok {
+				t.Fatalf("index not pushed to %s:%s", repo, tag)
+			}
+			if stored.MediaType != tt.wantContentType {
+				t.Errorf("pushed with Content-Type %q, want %q", stored.MediaType, tt.wantContentType)
+			}
+			if digest.FromBytes(stored.Data) != result.Digest {
+				t.Errorf("stored digest %s, want the pushed digest %s", digest.FromBytes(stored.Data), result.Digest)
+			}
+			var body struct {
+				MediaType *string                   `json:"mediaType"`
+				Manifests []ociimagespec.Descriptor `json:"manifests"`
+			}
+			if err := json.Unmarshal(stored.Data, &body); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.mediaType == "" && body.MediaType != nil:
+				t.Errorf("body media type = %q, want the field omitted", *body.MediaType)
+			case tt.mediaType != "" && (body.MediaType == nil || *body.MediaType != tt.mediaType):
+				t.Errorf("body media type = %v, want %q", body.MediaType, tt.mediaType)
+			}
+			if len(body.Manifests) != 2 {
+				t.Errorf("index lists %d manifests, want 2", len(body.Manifests))
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MismatchOutcome is how a registry handled a manifest pushed with a media type that does not match
+// the mediaType field of its body.
+type MismatchOutcome string
+
+// Mismatch outcomes.
+const (
+	// MismatchAccepted indicates the manifest was stored and is served back as pushed.
+	MismatchAccepted MismatchOutcome = "accepted"
+
+	// MismatchRejected indicates the push failed.
+	MismatchRejected MismatchOutcome = "rejected"
+
+	// MismatchNormalized indicates the push succeeded, but the manifest is served back with
+	// another media type or digest.
+	MismatchNormalized MismatchOutcome = "normalized"
+)
+
+// MediaTypeMismatchResult describes the push of a manifest whose descriptor media type,
+// sent as the Content-Type, disagrees with the mediaType field of its body.
+type MediaTypeMismatchResult struct {
+	// DescriptorMediaType is the media type the manifest was pushed with.
+	DescriptorMediaType string
+
+	// BodyMediaType is the mediaType field of the manifest body.
+	BodyMediaType string
+
+	// Digest is the digest of the pushed manifest.
+	Digest digest.Digest
+
+	// Status is the status code of the push.
+	Status int
+
+	// ErrorCodes are the error codes of a rejected push.
+	ErrorCodes []string
+
+	// ServedMediaType and ServedDigest describe the manifest served back by digest,
+	// if the push succeeded.
+	ServedMediaType string
+	ServedDigest    digest.Digest
+
+	// Outcome is how the registry handled the manifest.
+	Outcome MismatchOutcome
+}
+
+// GenerateMediaTypeMismatch pushes an image manifest with an index mediaType field as an image
+// manifest, then an index with an image manifest mediaType field as an index, and records whether
+// the registry accepts, rejects or normalizes them. Rejections are results, not errors.
+func (p Proxy) GenerateMediaTypeMismatch(ctx context.Context, repo string) (_ []MediaTypeMismatchResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.media_type_mismatch", repo)
+	defer func() { endSpan(span, err) }()
+
+	tag := fmt.Sprintf("%s-mismatch-manifest", tagPrefix)
+	pusher, err := p.pusher(ctx, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := p.buildManifest(ctx, pusher, repo, manifestContent{
+		config: p.configGenerator(),
+		layers: p.imageLayerGenerators(tag, 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociimagespec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	manifest.MediaType = ociimagespec.MediaTypeImageIndex
+	manifestResult, err := p.pushMismatched(ctx, repo, tag, ociimagespec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	tag = fmt.Sprintf("%s-mismatch-index", tagPrefix)
+	image, err := p.pushOCIImage(ctx, repo, fmt.Sprintf("%s-image", tag), p.configGenerator(), p.imageLayerGenerators(tag, 1))
+	if err != nil {
+		return nil, err
+	}
+	index := ociimagespec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ociimagespec.MediaTypeImageManifest,
+		Manifests: []ociimagespec.Descriptor{image},
+	}
+	indexResult, err := p.pushMismatched(ctx, repo, tag, ociimagespec.MediaTypeImageIndex, index)
+	if err != nil {
+		return nil, err
+	}
+	return []MediaTypeMismatchResult{manifestResult, indexResult}, nil
+}
+
+// pushMismatched pushes the body with the descriptor media type and fetches it back by digest.
+func (p Proxy) pushMismatched(ctx context.Context, repo, tag, mediaType string, body any) (MediaTypeMismatchResult, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return MediaTypeMismatchResult{}, err
+	}
+	var fields struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return MediaTypeMismatchResult{}, err
+	}
+	desc := ociimagespec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	result := MediaTypeMismatchResult{
+		DescriptorMediaType: mediaType,
+		BodyMediaType:       fields.MediaType,
+		Digest:              desc.Digest,
+		Outcome:             MismatchRejected,
+	}
+
+	tripInfo, err := p.putManifest(ctx, repo, tag, desc, data)
+	result.Status = tripInfo.Response.Code
+	if err != nil {
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			return result, err
+		}
+		result.ErrorCodes = errorCodes(statusErr)
+		p.Logger.Info().Msgf("Push of %s with a %s body was rejected with %d %v", mediaType, fields.MediaType, result.Status, result.ErrorCodes)
+		return result, nil
+	}
+	p.pushed.add(repo, tag, desc, data)
+
+	tripInfo, err = p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(routeManifests, repo, desc.Digest),
+		accept:      p.manifestAccept(),
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Outcome = MismatchNormalized
+	if tripInfo.Response.Code == http.StatusOK {
+		result.ServedMediaType = tripInfo.Response.HeaderContentType
+		result.ServedDigest = tripInfo.Response.SHA256Sum
+		if result.ServedMediaType == mediaType && result.ServedDigest == desc.Digest {
+			result.Outcome = MismatchAccepted
+		}
+	}
+	p.Logger.Info().Msgf("Push of %s with a %s body was %s, served as %s %s", mediaType, fields.MediaType, result.Outcome, result.ServedMediaType, result.ServedDigest)
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+)
+
+// Base routes
+const (
+	routeBase = "/v2/"
+)
+
+// PingResult describes the response of the registry to the base endpoint of the API.
+type PingResult struct {
+	// Status is the status code of the anonymous request, 200 if the registry does not require
+	// auth and 401 if it does.
+	Status int
+
+	// APIVersion is the Docker-Distribution-Api-Version header, registry/2.0 for registries
+	// speaking the v2 API.
+	APIVersion string
+
+	// AuthScheme is the scheme of the auth challenge, such as bearer or basic, if any.
+	AuthScheme string
+
+	// Realm is the token server of a bearer challenge.
+	Realm string
+
+	// Service is the service tokens are obtained for in a bearer challenge.
+	Service string
+
+	// AuthStatus is the status code of the request made with the configured credentials,
+	// zero if none are configured.
+	AuthStatus int
+}
+
+// Ping calls the base endpoint of the API anonymously to learn the API version and the auth
+// challenge of the registry, then again with the configured credentials, if any, to validate them.
+func (p Proxy) Ping(ctx context.Context) (PingResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url(routeBase), nil)
+	if err != nil {
+		return PingResult{}, err
+	}
+	tripInfo, err := p.transport.tripper.RoundTrip(req)
+	if err != nil {
+		return PingResult{}, err
+	}
+	if err := checkStatus("ping", tripInfo, http.StatusOK, http.StatusUnauthorized); err != nil {
+		return PingResult{}, err
+	}
+	result := PingResult{
+		Status:     tripInfo.Response.Code,
+		APIVersion: tripInfo.Response.HeaderAPIVersion,
+	}
+	if challenge := tripInfo.Response.HeaderChallenge; challenge != "" {
+		var params map[string]string
+		result.AuthScheme, params = parseAuthHeader(challenge)
+		result.Realm = params[claimRealm]
+		result.Service = params[claimService]
+	}
+
+	if p.transport.authType == noAuth {
+		return result, nil
+	}
+	tripInfo, err = p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodGet,
+		url:      p.url(routeBase),
+		op:       "authenticated ping",
+		expected: []int{http.StatusOK},
+	})
+	result.AuthStatus = tripInfo.Response.Code
+	return result, err
+}
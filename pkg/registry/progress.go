@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	stdio "io"
+	"sync/atomic"
+	"time"
+
+	"github.com/estebanreyl/image-gen-test/pkg/io"
+	"github.com/opencontainers/go-digest"
+)
+
+// ProgressReporter receives progress updates while content is uploaded.
+type ProgressReporter interface {
+	// OnProgress is called as the content identified by ref is streamed,
+	// with the number of bytes pushed so far out of total.
+	OnProgress(ref string, pushed, total int64)
+}
+
+// noProgress is a ProgressReporter that discards all updates.
+type noProgress struct{}
+
+// OnProgress does nothing.
+func (noProgress) OnProgress(string, int64, int64) {}
+
+// progressReader is a reader reporting the number of bytes read to a ProgressReporter.
+type progressReader struct {
+	io.Reader
+	// data is the content read, replayed when the reader is rewound
+	data     []byte
+	ref      string
+	total    int64
+	reporter ProgressReporter
+	// read is the number of bytes read, loaded concurrently by the stall watchdog
+	read atomic.Int64
+}
+
+// Read reads the given bytes and reports the progress.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.read.Store(r.Reader.N())
+		r.reporter.OnProgress(r.ref, r.Reader.N(), r.total)
+	}
+	return n, err
+}
+
+// Seek rewinds the reader to the start of the content, so an upload reset when its request
+// is retried, such as a manifest PUT failing after it was sent, replays the content.
+// Seeking anywhere else is not supported.
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != stdio.SeekStart {
+		return 0, errors.New("progress reader only seeks to the start")
+	}
+	r.Reader = io.NewReader(bytes.NewReader(r.data))
+	r.read.Store(0)
+	return 0, nil
+}
+
+// watchStalls returns a context cancelled with a StallError once the reader reads no byte for the
+// timeout, along with a function to stop watching. Watching stops once all the content is read,
+// waiting for the registry to commit the upload is not a stall. The context is returned as is if
+// the timeout is not positive.
+func watchStalls(ctx context.Context, r *progressReader, dgst digest.Digest, timeout time.Duration) (context.Context, func()) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(max(timeout/4, time.Millisecond))
+		defer ticker.Stop()
+		last, lastAt := r.read.Load(), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				n := r.read.Load()
+				switch {
+				case n >= r.total:
+					return
+				case n != last:
+					last, lastAt = n, now
+				case now.Sub(lastAt) >= timeout:
+					cancel(&StallError{Digest: dgst, Transferred: n, Total: r.total, Timeout: timeout})
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
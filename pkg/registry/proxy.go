@@ -6,12 +6,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/estebanreyl/image-gen-test/pkg/io"
 	"github.com/google/uuid"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -19,12 +28,20 @@ import (
 	orasartifact "github.com/oras-project/artifacts-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // Registry REST routes
 const (
 	// Referrer routes
 	ocirouteReferrers = "/v2/%s/referrers/%s" // add repo name and digest
+
+	// Blob routes
+	routeBlobs = "/v2/%s/blobs/%s" // add repo name and digest
+
+	// Manifest routes
+	routeManifests = "/v2/%s/manifests/%s" // add repo name and reference
 )
 
 // Constants for generated data.
@@ -34,6 +51,12 @@ const (
 	imagegenArtifactType    = "application/acr.imagegent.artifact.test"
 	repoprefix              = "imagegentest"
 	tagPrefix               = "genimage"
+
+	defaultIndexManifestCount = 11
+	defaultSubjectLayerCount  = 2
+	defaultImageLayerCount    = 2
+	defaultInlineThreshold    = 1024
+	defaultMaxManifestSize    = 4 << 20
 )
 
 // Other data.
@@ -64,20 +87,288 @@ type Options struct {
 	// Password is the registry login password
 	Password string
 
-	// Insecure indicates if registry should be accessed over HTTP
+	// AAD are the Azure AD service principal or managed identity credentials, used instead of username and password
+	AAD *AADOptions
+
+	// IdentityToken is a registry refresh token, such as the identity token stored by docker login,
+	// used instead of username and password. It requires bearer auth.
+	IdentityToken string
+
+	// Insecure indicates if registry should be accessed over HTTP. It applies to both the
+	// login server and the data endpoint, and takes precedence over InsecureLoginServer
+	// and InsecureDataEndpoint.
 	Insecure bool
 
+	// InsecureLoginServer indicates if the login server should be accessed over HTTP
+	InsecureLoginServer bool
+
+	// InsecureDataEndpoint indicates if the data endpoint should be accessed over HTTP,
+	// redirects to it are made over HTTPS otherwise. It requires DataEndpoint.
+	InsecureDataEndpoint bool
+
 	// BasicAuthMode indicates that only basic auth should be used
 	BasicAuthMode bool
 
+	// Repository is the repository pushed to, defaults to a new time based repository per run.
+	// Tags remain time based when it is set, so re-runs push next to the content of previous runs
+	// unless Tag is set too.
 	Repository string
+
+	// Tag is the tag used for the top-level manifest, defaults to the current unix time
+	Tag string
+
+	// UserAgent is the User-Agent header sent with every request
+	UserAgent string
+
+	// Headers are extra headers sent with every request
+	Headers http.Header
+
+	// ExtraTags are the tags a generated index is put under once pushed to Tag, its content being
+	// uploaded only once
+	ExtraTags []string
+
+	// IndexManifestCount is the number of manifests in a generated index
+	IndexManifestCount int
+
+	// IndexArtifactRatio is the fraction of the manifests of a generated index that are artifacts
+	// without subject, spread among the images making up the rest of the index
+	IndexArtifactRatio float64
+
+	// ImageLayerCount is the number of layers of the images of a generated index if
+	// ImageLayerCountSet, two otherwise. Zero pushes images referencing only a config, which
+	// registries disagree on accepting.
+	ImageLayerCount    int
+	ImageLayerCountSet bool
+
+	// SubjectLayerCount is the number of layers of a generated subject image
+	SubjectLayerCount int
+
+	// SubjectIsIndex indicates that generated subjects are indexes of simple images instead of images
+	SubjectIsIndex bool
+
+	// SubjectIsArtifact indicates that generated subjects are artifacts referring to an image, or
+	// an index if SubjectIsIndex is set, so referrers attach to an intermediate artifact
+	SubjectIsArtifact bool
+
+	// Layers describe the layers of generated images, overriding the number of layers of
+	// subject and index images
+	Layers []LayerSpec
+
+	// EmptyLayerHistory is the number of empty_layer history entries of generated image configs,
+	// which otherwise have one history entry per layer
+	EmptyLayerHistory int
+
+	// ConfigMediaType is the media type of generated configs
+	ConfigMediaType string
+
+	// ArtifactType is the artifact type of generated artifacts
+	ArtifactType string
+
+	// ArtifactConfig, if set, is the config of generated artifacts not using a scratch config
+	// instead of a generated image config, such as the config of a Helm chart
+	ArtifactConfig *StaticContent
+
+	// AllowedMediaTypes are media types accepted in addition to KnownMediaTypes
+	AllowedMediaTypes []string
+
+	// AllowCustomMediaTypes disables the warnings about media types that are neither known nor allowed
+	AllowCustomMediaTypes bool
+
+	// ArtifactCases are the artifacts to generate, defaults to DefaultArtifactCases
+	ArtifactCases []ArtifactConstructOptions
+
+	// SelectedCases are the indexes of the artifact cases to run, all cases are run if empty
+	SelectedCases []int
+
+	// FailFast stops the artifact cases at the first one not behaving as expected, instead of
+	// running all of them
+	FailFast bool
+
+	// ArtifactConcurrency is the number of artifact cases pushed concurrently, one if not positive.
+	// Cases are still reported in order.
+	ArtifactConcurrency int
+
+	// ReferenceAnnotations are the conventions of annotations naming the subject set on
+	// artifacts with a subject, in addition to the subject field
+	ReferenceAnnotations []ReferenceAnnotations
+
+	// ArtifactSubject is the digest of an existing manifest used as the subject of generated artifacts,
+	// a new subject image is pushed if empty or if it does not exist in the repository
+	ArtifactSubject digest.Digest
+
+	// OnlyReferrers only pushes referrers to ArtifactSubject, which must exist in the repository,
+	// instead of pushing a new subject image when it does not. Cases with a subject in another
+	// repository still push their subject there.
+	OnlyReferrers bool
+
+	// InlineConfig indicates that small configs are embedded in the config descriptor data field
+	InlineConfig bool
+
+	// InlineSmallLayers indicates that small layers are embedded in the layer descriptor data field
+	InlineSmallLayers bool
+
+	// InlineThreshold is the maximum size in bytes of inlined content, defaults to 1024
+	InlineThreshold int64
+
+	// MaxManifestSize is the maximum size in bytes of the manifests and indexes read from the
+	// registry, defaults to 4 MiB
+	MaxManifestSize int64
+
+	// ReferrersPageSize is the number of referrers requested per page of the referrers API with
+	// the n query parameter, the registry default if not positive
+	ReferrersPageSize int
+
+	// SkipInlinedUpload indicates that inlined content is not uploaded as a separate blob
+	SkipInlinedUpload bool
+
+	// ManifestFirst pushes manifests before the config and layers they reference, to probe
+	// whether the registry requires referenced blobs to exist when a manifest is pushed
+	ManifestFirst bool
+
+	// HeadBeforeGet requests the digest and size of blobs with a HEAD request before pulling
+	// them, and checks that the pulled content matches, to catch registries, or the CDNs in front
+	// of them, whose HEAD and GET responses disagree
+	HeadBeforeGet bool
+
+	// PullRangeSize, if positive, pulls blobs in chunks of this many bytes with Range requests,
+	// each of which must be served as partial content covering exactly the requested range
+	PullRangeSize int64
+
+	// NormalizeJSON canonicalizes generated manifests and indexes, sorting their keys and
+	// removing insignificant whitespace, before their digest is computed and they are pushed
+	NormalizeJSON bool
+
+	// DumpManifestsDir is the directory the exact content of every pushed manifest, index and
+	// config is written to, in a file named after its digest. Nothing is written if empty.
+	DumpManifestsDir string
+
+	// Accept are the media types accepted when fetching manifests, all the OCI and Docker
+	// manifest and index media types if empty
+	Accept []string
+
+	// IndexSkipFailedChildren pushes a generated index referencing the children pushed
+	// successfully when some fail, instead of aborting at the first failed child
+	IndexSkipFailedChildren bool
+
+	// IndexArtifactType is the artifact type of a generated index
+	IndexArtifactType string
+
+	// IndexDescriptorMediaType overrides the media type an index is pushed with, which defaults to
+	// the media type of its body, or the OCI index if the body omits it
+	IndexDescriptorMediaType string
+
+	// IndexSubject is the reference, a tag or a digest, of the subject of a generated index, which
+	// must exist in the repository. The index must then be listed by the referrers of the subject.
+	IndexSubject string
+
+	// IndexExtraChildren are descriptors of manifests, such as ones pushed by other tools, a generated
+	// index references after its generated children, without pushing anything for them
+	IndexExtraChildren []ociimagespec.Descriptor
+
+	// IndexAllowDangling references IndexExtraChildren without checking that they exist in the repository
+	IndexAllowDangling bool
+
+	// EmptyConfigType is the convention used for empty artifact configs, defaults to the scratch descriptor
+	EmptyConfigType EmptyConfigType
+
+	// ValidateSchema indicates that generated manifests and indexes are checked against the
+	// OCI JSON schema before they are pushed
+	ValidateSchema bool
+
+	// IfNotExists indicates that pushes to existing tags are skipped instead of overwriting them
+	IfNotExists bool
+
+	// Compress indicates that generated layers are gzip compressed tar archives
+	Compress bool
+
+	// ForeignLayerURLs are the URLs of non-distributable layers added to generated images
+	ForeignLayerURLs []string
+
+	// Progress receives upload progress updates, no progress is reported if nil
+	Progress ProgressReporter
+
+	// HTTP1 forces HTTP/1.1, disabling the HTTP/2 negotiation
+	HTTP1 bool
+
+	// H2C forces HTTP/2 over plaintext connections, it requires Insecure
+	H2C bool
+
+	// MaxIdleConns caps the idle connections kept open across all hosts, Go's default if not positive
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost caps the idle connections kept open per host, Go's default if not positive
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long idle connections are kept open, Go's default if not positive
+	IdleConnTimeout time.Duration
+
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+
+	// RequestTimeout bounds every request but blob uploads, including token requests, unbounded if not positive
+	RequestTimeout time.Duration
+
+	// UploadTimeout bounds every blob upload request, unbounded if not positive
+	UploadTimeout time.Duration
+
+	// StallTimeout cancels a blob upload with a StallError once none of its bytes are sent for
+	// that long, unlike UploadTimeout which bounds every request of the upload. Disabled if not positive.
+	StallTimeout time.Duration
+
+	// DNSTimeout bounds the resolution of host names when dialing, unbounded if not positive
+	DNSTimeout time.Duration
+
+	// RPS caps the rate of outgoing requests per second, unlimited if not positive
+	RPS float64
+
+	// Retry is the policy retrying throttled and failed requests, requests are not retried by default
+	Retry rhttp.RetryPolicy
+
+	// Recorder, when set, keeps every round trip made by the proxy for later inspection.
+	Recorder *rhttp.Recorder
+
+	// Tracer, when set, receives a span for every generation and every request made by the proxy.
+	Tracer trace.Tracer
+
+	// LogAuthorization logs the credentials of the Authorization header of requests in trace logs,
+	// which are redacted by default
+	LogAuthorization bool
+
+	// DecodeContent requests gzip and zstd encoded responses and decodes them, pulled blobs
+	// must match their digest either as received or once decoded
+	DecodeContent bool
+
+	// AcceptEncoding is sent as the Accept-Encoding header of GET requests, such as gzip or
+	// identity, to check how the registry compresses responses. Encoded responses are decoded.
+	AcceptEncoding string
+
+	// TraceConnections records the connection of every request in the trace log and recording,
+	// including its TLS version, cipher suite and server certificate
+	TraceConnections bool
+
+	// TraceFormat is the format of the requests in the trace log, indented JSON if empty
+	TraceFormat rhttp.TraceFormat
+
+	// Seed, when set, makes generated layer content deterministic.
+	// Layer bytes, layer digests and the digests of the manifests and indexes
+	// referencing them are then identical across runs using the same seed.
+	// Repository and tag names are unaffected and remain time based unless
+	// Repository or Tag are set.
+	Seed *int64
 }
 
 // Proxy acts as a proxy to a remote registry.
 type Proxy struct {
 	*Options
 	zerolog.Logger
-	resolver remotes.Resolver
+	resolverOptions docker.ResolverOptions
+	transport       transport
+	rand            *rand.Rand
+	metrics         *rhttp.Metrics
+	pushed          *pushLog
+	uploaded        *blobSet
+
+	mediaTypeWarnings *mediaTypeWarnings
 }
 
 // NewProxy creates a new registry proxy.
@@ -90,411 +381,1458 @@ func NewProxy(opts *Options, logger zerolog.Logger) (*Proxy, error) {
 		return nil, errors.New("login server name required")
 	}
 
-	resolver := docker.NewResolver(docker.ResolverOptions{
-		Credentials: func(s string) (string, string, error) {
-			return opts.Username, opts.Password, nil
-		},
-		PlainHTTP: false,
-	})
+	if err := opts.EmptyConfigType.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.TraceFormat.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.DumpManifestsDir != "" {
+		if err := os.MkdirAll(opts.DumpManifestsDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if opts.IndexArtifactRatio < 0 || opts.IndexArtifactRatio > 1 {
+		return nil, fmt.Errorf("invalid index artifact ratio %v, expected a fraction between 0 and 1", opts.IndexArtifactRatio)
+	}
+	if opts.PullRangeSize < 0 {
+		return nil, fmt.Errorf("invalid pull range size %d", opts.PullRangeSize)
+	}
+	if opts.ImageLayerCountSet {
+		if opts.ImageLayerCount < 0 {
+			return nil, fmt.Errorf("invalid number of image layers %d", opts.ImageLayerCount)
+		}
+		if len(opts.Layers) > 0 {
+			return nil, errors.New("only one of an image layer count and layer specs can be set")
+		}
+	}
+	if subject := opts.IndexSubject; subject != "" {
+		// tags cannot hold a colon, so a reference holding one must be a digest
+		if strings.Contains(subject, ":") {
+			if _, err := digest.Parse(subject); err != nil {
+				return nil, fmt.Errorf("invalid index subject: %w", err)
+			}
+		}
+		if opts.Repository == "" {
+			return nil, errors.New("index subject requires a repository")
+		}
+	}
+	for _, a := range opts.ReferenceAnnotations {
+		if err := a.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c := opts.ArtifactConfig; c != nil {
+		if c.MediaType == "" {
+			return nil, errors.New("artifact config requires a media type")
+		}
+		if strings.HasSuffix(c.MediaType, "+json") && !json.Valid(c.Data) {
+			return nil, fmt.Errorf("artifact config of media type %s is not valid JSON", c.MediaType)
+		}
+	}
+
+	if opts.InsecureDataEndpoint && opts.DataEndpoint == "" {
+		return nil, errors.New("insecure data endpoint requires a data endpoint")
+	}
+
+	header := opts.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if opts.UserAgent != "" {
+		header.Set(rhttp.HeaderUserAgent, opts.UserAgent)
+	}
+	metrics := rhttp.NewMetrics()
+	limited, err := newHTTPTransport(opts, logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if opts.RequestTimeout > 0 || opts.UploadTimeout > 0 {
+		// every attempt of a retried request gets its own timeout, waiting for the limiter does not count
+		limited = rhttp.TimeoutTransport{
+			Base:           limited,
+			RequestTimeout: opts.RequestTimeout,
+			UploadTimeout:  opts.UploadTimeout,
+		}
+	}
+	if opts.RPS > 0 {
+		// a single limiter caps token, challenge and content requests alike
+		limited = rhttp.RateLimitTransport{
+			Base:    limited,
+			Limiter: rate.NewLimiter(rate.Limit(opts.RPS), 1),
+		}
+	}
+	// the pusher streams content its requests cannot replay as a whole, uploadBytes retries its
+	// pushes from the start instead, with the same policy
+	pushBase := rhttp.HeaderTransport{
+		Base:   limited,
+		Header: header,
+	}
+	if opts.Retry.MaxRetries > 0 {
+		// retries go through the limiter, so they count against the request rate
+		limited = rhttp.RetryTransport{
+			Base:   limited,
+			Policy: opts.Retry,
+			Logger: logger,
+		}
+	}
+	base := rhttp.HeaderTransport{
+		Base:   limited,
+		Header: header,
+	}
 
-	return &Proxy{
-		resolver: resolver,
-		Options:  opts,
+	tripper := rhttp.RoundTripperWithContext{
+		Base:     base,
 		Logger:   logger,
-	}, nil
+		Metrics:  metrics,
+		Recorder: opts.Recorder,
+		Tracer:   opts.Tracer,
+
+		LogAuthorization: opts.LogAuthorization,
+		DecodeContent:    opts.DecodeContent,
+		AcceptEncoding:   opts.AcceptEncoding,
+		TraceConnections: opts.TraceConnections,
+		TraceFormat:      opts.TraceFormat,
+	}
+
+	if opts.IdentityToken != "" {
+		switch {
+		case opts.BasicAuthMode:
+			return nil, errors.New("identity token requires bearer auth, cannot use basic auth mode")
+		case opts.AAD != nil:
+			return nil, errors.New("cannot use an identity token with AAD auth")
+		case opts.Username != "":
+			return nil, errors.New("cannot use an identity token with username and password")
+		}
+	}
+
+	var aad *aadTokenSource
+	if opts.AAD != nil {
+		if err := opts.AAD.validate(); err != nil {
+			return nil, err
+		}
+		aad = &aadTokenSource{
+			opts:        *opts.AAD,
+			loginServer: opts.LoginServer,
+			baseURL:     endpointURL(opts.LoginServer, opts.loginServerInsecure()),
+			tripper:     tripper,
+		}
+	}
+
+	var t transport
+	switch {
+	case aad != nil:
+		t, err = newRefreshTokenTransport(tripper, aad.RefreshToken, logger)
+	case opts.IdentityToken != "":
+		t, err = newRefreshTokenTransport(tripper, func(context.Context) (string, error) {
+			return opts.IdentityToken, nil
+		}, logger)
+	case opts.BasicAuthMode:
+		t, err = newBasicAuthTransport(tripper, opts.Username, opts.Password, logger)
+	case opts.Username != "":
+		t, err = newBearerAuthTransport(tripper, opts.Username, opts.Password, logger)
+	default:
+		t, err = newNoAuthTransport(tripper, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.dataEndpoint = opts.DataEndpoint
+	t.dataEndpointURL = opts.dataEndpointURL
+
+	resolverOptions := docker.ResolverOptions{
+		// pushes share the bearer tokens of the transport, and refresh them as its requests do
+		Authorizer: resolverAuthorizer{t: t},
+		PlainHTTP:  opts.loginServerInsecure(),
+		Client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				req.URL = opts.dataEndpointURL(req.URL)
+				return nil
+			},
+			Transport: rhttp.MetricsTransport{
+				Base:     pushBase,
+				Metrics:  metrics,
+				Recorder: opts.Recorder,
+				Tracer:   opts.Tracer,
+			},
+		},
+	}
+
+	var seeded *rand.Rand
+	if opts.Seed != nil {
+		seeded = rand.New(rand.NewSource(*opts.Seed))
+	}
+
+	p := &Proxy{
+		resolverOptions:   resolverOptions,
+		transport:         t,
+		Options:           opts,
+		Logger:            logger,
+		rand:              seeded,
+		metrics:           metrics,
+		pushed:            &pushLog{},
+		uploaded:          &blobSet{},
+		mediaTypeWarnings: &mediaTypeWarnings{},
+	}
+	// check the configured media types before touching the network
+	p.checkMediaType("config", p.configMediaType())
+	p.checkMediaType("artifact", p.artifactType())
+	p.checkMediaType("artifact", p.IndexArtifactType)
+	p.checkMediaType("index", p.IndexDescriptorMediaType)
+	return p, nil
+}
+
+// url returns the URL of the given route on the login server.
+func (p Proxy) url(route string, args ...any) string {
+	return endpointURL(p.LoginServer, p.loginServerInsecure()) + fmt.Sprintf(route, args...)
+}
+
+// loginServerInsecure indicates if the login server is accessed over HTTP.
+func (o Options) loginServerInsecure() bool {
+	return o.Insecure || o.InsecureLoginServer
+}
+
+// dataEndpointInsecure indicates if the data endpoint is accessed over HTTP.
+func (o Options) dataEndpointInsecure() bool {
+	return o.Insecure || o.InsecureDataEndpoint
 }
 
-// PushOCIIndex pushes an OCI Index to the registry
-func (p Proxy) GenerateOCIIndex(ctx context.Context, hasMediaType bool) error {
+// dataEndpointURL returns the URL with the scheme of the data endpoint if it points to it,
+// or the URL unchanged otherwise.
+func (o Options) dataEndpointURL(u *url.URL) *url.URL {
+	if o.DataEndpoint == "" || (u.Host != o.DataEndpoint && u.Hostname() != o.DataEndpoint) {
+		return u
+	}
+	scheme := "https"
+	if o.dataEndpointInsecure() {
+		scheme = "http"
+	}
+	if u.Scheme == scheme {
+		return u
+	}
+	rewritten := *u
+	rewritten.Scheme = scheme
+	return &rewritten
+}
+
+// endpointURL returns the base URL of a registry endpoint.
+func endpointURL(host string, insecure bool) string {
+	if insecure {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// Metrics returns a summary of all requests made by the proxy so far.
+func (p Proxy) Metrics() rhttp.MetricsSummary {
+	return p.metrics.Summary()
+}
+
+// GenerateOCIIndex pushes an OCI Index to the registry
+// The index body and descriptor use the given media type, such as the OCI index or the Docker
+// manifest list. If it is empty, the body omits the mediaType field and is pushed as an OCI index,
+// leaving the registry to infer the type from the descriptor.
+// IndexDescriptorMediaType overrides the descriptor media type, which is sent as the Content-Type
+// of the push, to test how registries handle a descriptor that does not match the body.
+// The index is then put again under every extra tag, without uploading its content again.
+// A failed child push aborts the index, unless IndexSkipFailedChildren is set or the child is an
+// image without layers the registry rejected, and the result describes the children pushed either way.
+// IndexExtraChildren are referenced after the generated children, and must exist in the
+// repository unless IndexAllowDangling is set. An index with an IndexSubject must be listed by
+// the referrers of the subject once pushed.
+func (p Proxy) GenerateOCIIndex(ctx context.Context, mediaType string) (result IndexResult, err error) {
 	var (
-		repo = fmt.Sprintf("%v%v", repoprefix, time.Now().Unix())
-		tag  = fmt.Sprintf("%v", time.Now().Unix())
+		repo = NewRepositoryName()
+		tag  = fmt.Sprintf("%v", newTimeID())
 	)
 	if p.Repository != "" {
 		repo = p.Repository
 	}
+	if p.Tag != "" {
+		tag = p.Tag
+	}
+	ctx, span := p.startSpan(ctx, "generate.index", repo)
+	defer func() { endSpan(span, err) }()
+
+	skip, overwrite, err := p.checkTag(ctx, repo, tag)
+	if err != nil {
+		return result, err
+	}
+	if skip {
+		return result, nil
+	}
+
+	var subject *ociimagespec.Descriptor
+	if p.IndexSubject != "" {
+		desc, err := p.ResolveDescriptor(ctx, repo, p.IndexSubject)
+		if err != nil {
+			return result, fmt.Errorf("resolve index subject: %w", err)
+		}
+		subject = &desc
+	}
+
+	if !p.IndexAllowDangling {
+		if err := p.checkExtraChildren(ctx, repo); err != nil {
+			return result, err
+		}
+	}
+
+	desc, result, err := p.pushIndex(ctx, repo, tag, mediaType, p.IndexArtifactType, subject, p.IndexExtraChildren)
+	if err != nil {
+		return result, err
+	}
+	p.logPushed(repo, tag, overwrite)
+
+	if subject != nil {
+		if err := p.verifyIndexReferrer(ctx, repo, desc, *subject); err != nil {
+			return result, err
+		}
+	}
+	if len(p.ExtraTags) > 0 {
+		return result, p.tagManifest(ctx, repo, desc, p.ExtraTags)
+	}
+	return result, nil
+}
+
+// verifyIndexReferrer checks that the referrers of the subject list the index with its artifact type.
+func (p Proxy) verifyIndexReferrer(ctx context.Context, repo string, index, subject ociimagespec.Descriptor) error {
+	result, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+	if err != nil {
+		return err
+	}
+	for _, r := range result.Referrers {
+		if r.Digest != index.Digest {
+			continue
+		}
+		if r.ArtifactType != p.IndexArtifactType {
+			return fmt.Errorf("referrers of %s list index %s with artifact type %q instead of %q: %w", subject.Digest, index.Digest, r.ArtifactType, p.IndexArtifactType, ErrExpectationViolated)
+		}
+		p.Logger.Info().Msgf("Referrers of %s list index %s (mechanism: %s)", subject.Digest, index.Digest, result.Mechanism)
+		return nil
+	}
+	return fmt.Errorf("referrers of %s do not list index %s (mechanism: %s): %w", subject.Digest, index.Digest, result.Mechanism, ErrNotFound)
+}
 
+// checkExtraChildren checks that the extra children of a generated index exist in the repository.
+// A child the registry describes with another media type or size is still referenced as given.
+func (p Proxy) checkExtraChildren(ctx context.Context, repo string) error {
+	for _, child := range p.IndexExtraChildren {
+		desc, err := p.HeadManifest(ctx, repo, child.Digest.String())
+		if err != nil {
+			return fmt.Errorf("check extra child %s of the index: %w", child.Digest, err)
+		}
+		if desc.MediaType != child.MediaType || (desc.Size != 0 && desc.Size != child.Size) {
+			p.Logger.Warn().Msgf("Extra child %s of the index is described as %s of %d bytes, the registry serves it as %s of %d bytes",
+				child.Digest, child.MediaType, child.Size, desc.MediaType, desc.Size)
+		}
+	}
+	return nil
+}
+
+// pushIndex pushes an index of simple images to the tag, followed by the extra children. The
+// index body has the given media type, which is omitted if empty, and is pushed with the
+// configured index descriptor media type.
+func (p Proxy) pushIndex(ctx context.Context, repo, tag, mediaType, artifactType string, subject *ociimagespec.Descriptor, extra []ociimagespec.Descriptor) (ociimagespec.Descriptor, IndexResult, error) {
+	var result IndexResult
 	var Manifests []ociimagespec.Descriptor
-	for i := 0; i < 11; i++ {
-		// Push simple image
-		desc, err := p.pushOCIImage(ctx, repo, fmt.Sprintf("%s-oci-%d", tag, i), ociConfig, 2)
+	count := p.indexManifestCount()
+	artifacts := int(math.Round(p.IndexArtifactRatio * float64(count)))
+	for i := 0; i < count; i++ {
+		// artifacts are spread evenly among the images
+		isArtifact := (i+1)*artifacts/count > i*artifacts/count
+		childTag, desc, err := p.pushIndexChild(ctx, repo, tag, i, isArtifact)
+		child := IndexChild{Tag: childTag, Digest: desc.Digest}
 		if err != nil {
-			return err
+			child.Error = err.Error()
 		}
-		Manifests = append(Manifests, desc)
+		result.Children = append(result.Children, child)
+		if err == nil {
+			Manifests = append(Manifests, desc)
+			continue
+		}
+
+		// an image without layers probes the registry, its rejection is recorded like a skip
+		layerless := errors.Is(err, errLayerlessImageRejected)
+		if (!p.IndexSkipFailedChildren && !layerless) || ctx.Err() != nil {
+			if len(Manifests) > 0 {
+				p.Logger.Warn().Msgf("Children pushed to %s without an index referencing them: %s", repo, strings.Join(result.pushedTags(), ", "))
+			}
+			return ociimagespec.Descriptor{}, result, fmt.Errorf("push child %d of %d of index %s, %d pushed before: %w", i+1, count, tag, len(Manifests), err)
+		}
+		p.Logger.Warn().Msgf("Skipping child %s of index %s: %v", childTag, tag, err)
+		result.Skipped++
 	}
-	index := ociimagespec.Index{
-		Versioned: specs.Versioned{
-			SchemaVersion: 2,
-		},
-		Manifests: Manifests,
+	if len(Manifests) == 0 {
+		return ociimagespec.Descriptor{}, result, fmt.Errorf("push index %s: all %d children failed", tag, count)
 	}
-	if hasMediaType {
-		index.MediaType = ociimagespec.MediaTypeImageIndex
+	if result.Skipped > 0 {
+		p.Logger.Warn().Msgf("Pushing index %s with %d of %d children, %d skipped", tag, len(Manifests), count, result.Skipped)
+	}
+	index := artifactIndex{
+		Index: ociimagespec.Index{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Manifests: append(Manifests, extra...),
+		},
+		ArtifactType: artifactType,
+		Subject:      subject,
 	}
+	index.MediaType = mediaType
 
 	indexBytes, err := json.Marshal(index)
 	if err != nil {
-		return err
+		return ociimagespec.Descriptor{}, result, err
+	}
+	if p.NormalizeJSON {
+		if indexBytes, err = canonicalJSON(indexBytes); err != nil {
+			return ociimagespec.Descriptor{}, result, err
+		}
+	}
+	descMediaType := mediaType
+	if descMediaType == "" {
+		descMediaType = ociimagespec.MediaTypeImageIndex
+	}
+	if p.IndexDescriptorMediaType != "" {
+		descMediaType = p.IndexDescriptorMediaType
+	}
+	if descMediaType != mediaType {
+		p.Logger.Info().Msgf("Pushing index with body media type %q as %q", mediaType, descMediaType)
+	}
+	p.checkMediaType("index", mediaType)
+	p.checkMediaType("index", descMediaType)
+	if err := p.validateSchema(descMediaType, indexBytes); err != nil {
+		return ociimagespec.Descriptor{}, result, err
 	}
 
-	ref := fmt.Sprintf("%s/%s:%s", p.Options.LoginServer, repo, tag)
-	pusher, err := p.resolver.Pusher(ctx, ref)
+	pusher, err := p.pusher(ctx, repo, tag)
 	if err != nil {
-		return err
+		return ociimagespec.Descriptor{}, result, err
 	}
 	indexDesc := ociimagespec.Descriptor{
-		MediaType: ociimagespec.MediaTypeImageIndex,
+		MediaType: descMediaType,
 		Digest:    digest.FromBytes(indexBytes),
 		Size:      int64(len(indexBytes)),
 	}
-	err = uploadBytes(ctx, pusher, indexDesc, indexBytes)
+	err = p.uploadManifest(ctx, pusher, repo, tag, indexDesc, indexBytes)
 	if err != nil {
-		return err
+		return ociimagespec.Descriptor{}, result, err
+	}
+	p.pushed.add(repo, tag, indexDesc, indexBytes)
+	if subject != nil {
+		if err := p.updateReferrersTag(ctx, repo, subject.Digest, indexDesc, indexBytes); err != nil {
+			return ociimagespec.Descriptor{}, result, fmt.Errorf("update referrers tag of %s: %w", subject.Digest, err)
+		}
+	}
+	result.Digest = indexDesc.Digest
+	if artifacts > 0 {
+		p.Logger.Info().Msgf("Pushed index %s of %d images and %d artifacts of type %s", indexDesc.Digest, count-artifacts, artifacts, p.artifactType())
+	}
+	return indexDesc, result, nil
+}
+
+// pushIndexChild pushes the i-th child of the index with the given tag, an artifact or an
+// image, and returns its tag and descriptor.
+func (p Proxy) pushIndexChild(ctx context.Context, repo, tag string, i int, isArtifact bool) (string, ociimagespec.Descriptor, error) {
+	if isArtifact {
+		artifactTag := fmt.Sprintf("%s-artifact-%d", tag, i)
+		desc, err := p.pushOCIArtifact(ctx, nil, repo, artifactTag, ArtifactConstructOptions{
+			IncludesArtifactType: true,
+			ConfigIsScratch:      true,
+			LayerCount:           1,
+		})
+		return artifactTag, desc, err
+	}
+
+	// Push simple image
+	imageTag := fmt.Sprintf("%s-oci-%d", tag, i)
+	layers := p.imageLayerGenerators(imageTag, p.imageLayerCount())
+	desc, err := p.pushOCIImage(ctx, repo, imageTag, p.configGenerator(), layers)
+	if len(layers) == 0 {
+		// unlike the artifact case without layers, whether the registry accepts an image
+		// without layers is not expected either way, so its response is reported
+		if err != nil {
+			return imageTag, ociimagespec.Descriptor{}, fmt.Errorf("%w: %s: %w", errLayerlessImageRejected, imageTag, err)
+		}
+		p.Logger.Info().Msgf("Registry accepted image %s without layers as %s", imageTag, desc.Digest)
+	}
+	return imageTag, desc, err
+}
+
+// errLayerlessImageRejected indicates that the registry rejected an image of a generated index
+// pushed without layers.
+var errLayerlessImageRejected = errors.New("registry rejected image without layers")
+
+// IndexChild describes the push of a child manifest of a generated index.
+type IndexChild struct {
+	// Tag is the tag the child was pushed to.
+	Tag string `json:"tag"`
+
+	// Digest is the digest of the pushed child, empty if its push failed.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Error is the error of a failed push.
+	Error string `json:"error,omitempty"`
+}
+
+// IndexResult describes a generated index and the push of its children.
+type IndexResult struct {
+	// Digest is the digest of the pushed index, empty if it was not pushed.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Children are the children whose push was attempted, in order.
+	Children []IndexChild `json:"children"`
+
+	// Skipped is the number of failed children left out of the index.
+	Skipped int `json:"skipped"`
+}
+
+// pushedTags returns the tags of the children pushed successfully.
+func (r IndexResult) pushedTags() []string {
+	var tags []string
+	for _, c := range r.Children {
+		if c.Error == "" {
+			tags = append(tags, c.Tag)
+		}
+	}
+	return tags
+}
+
+// ArtifactConstructOptions describes how a test artifact is constructed.
+type ArtifactConstructOptions struct {
+	// IncludesArtifactType indicates if the manifest sets an artifact type
+	IncludesArtifactType bool `yaml:"includesArtifactType"`
+
+	// ArtifactType overrides the configured artifact type of the manifest and its empty config
+	ArtifactType string `yaml:"artifactType"`
+
+	// ConfigIsScratch indicates if the config is empty, following the configured empty config convention
+	ConfigIsScratch bool `yaml:"configIsScratch"`
+
+	// LayersAreScratch indicates if the layers are the scratch descriptor
+	LayersAreScratch bool `yaml:"layersAreScratch"`
+
+	// LayerCount is the number of layers
+	LayerCount int `yaml:"layerCount"`
+
+	// HasSubject indicates if the manifest has a subject
+	HasSubject bool `yaml:"hasSubject"`
+
+	// SubjectInRegistry indicates if the subject exists in the registry
+	SubjectInRegistry bool `yaml:"subjectInRegistry"`
+
+	// SubjectInOtherRepository indicates if the subject exists only in another repository of the
+	// registry, in which case the referrers of both repositories are listed once pushed
+	SubjectInOtherRepository bool `yaml:"subjectInOtherRepository"`
+
+	// MissingBlob indicates if the manifest references a layer that was never uploaded
+	MissingBlob bool `yaml:"missingBlob"`
+
+	// ErrorExpected indicates if the registry is expected to reject the artifact
+	ErrorExpected bool `yaml:"errorExpected"`
+}
+
+// Title describes the i-th artifact case.
+func (o ArtifactConstructOptions) Title(i int) string {
+	return fmt.Sprintf("OCI Artifact %d: %s", i, o.Description())
+}
+
+// Description describes the subject, artifact type, config and layers of the artifact case.
+func (o ArtifactConstructOptions) Description() string {
+	subjectAdded := "Subject Added"
+	if !o.HasSubject {
+		subjectAdded = "Subject Missing"
+	}
+
+	subjectExists := "Subject in Registry"
+	switch {
+	case o.SubjectInOtherRepository:
+		subjectExists = "Subject in Other Repository"
+	case !o.SubjectInRegistry:
+		subjectExists = "Subject Not in Registry"
 	}
 
+	artifactTypeAdded := "Artifact Type Added"
+	if !o.IncludesArtifactType {
+		artifactTypeAdded = "Artifact Type Missing"
+	}
+
+	configType := "Scratch Config"
+	if !o.ConfigIsScratch {
+		configType = "Regular Config"
+	}
+
+	layerType := "Scratch Layers"
+	if !o.LayersAreScratch {
+		layerType = "Regular Layers"
+	}
+	layerType = fmt.Sprintf("%s (%d)", layerType, o.LayerCount)
+	if o.MissingBlob {
+		layerType = fmt.Sprintf("%s - Missing Blob", layerType)
+	}
+	return fmt.Sprintf("%s - %s - %s - %s - %s", subjectAdded, subjectExists, artifactTypeAdded, configType, layerType)
+}
+
+// logCrossRepositoryReferrers reports whether the referrers of the subject in the repository of
+// the artifact and in the repository of the subject list the artifact.
+func (p Proxy) logCrossRepositoryReferrers(ctx context.Context, artifact, subject ociimagespec.Descriptor, repos ...string) error {
+	for _, repo := range repos {
+		result, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+		if err != nil {
+			return err
+		}
+		listed := false
+		for _, r := range result.Referrers {
+			if r.Digest == artifact.Digest {
+				listed = true
+			}
+		}
+		p.Logger.Info().Msgf("Referrers of %s in %s list the artifact: %t (mechanism: %s)", subject.Digest, repo, listed, result.Mechanism)
+	}
 	return nil
 }
 
-type artifactConstructOptions struct {
-	includesArtifactType bool
-	configIsScratch      bool
-	layersAreScratch     bool
-	layercount           int
-	hasSubject           bool
-	subjectInRegistry    bool
-	errorExpected        bool
+// DefaultArtifactCases are the artifact cases generated when none are configured.
+var DefaultArtifactCases = []ArtifactConstructOptions{
+	// Subject Exists
+	{
+		// Basic Referrer Artifact type (Success)
+		IncludesArtifactType: true,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     true,
+		LayerCount:           1,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		ErrorExpected:        false,
+	},
+	{
+		// Basic Refferer Artifact type (Success - teleportLike)
+		IncludesArtifactType: true,
+		ConfigIsScratch:      false,
+		LayersAreScratch:     false,
+		LayerCount:           3,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		ErrorExpected:        false,
+	},
+	{
+		// Artifact Type no artifact type but using scratch (Error)
+		IncludesArtifactType: false,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     true,
+		LayerCount:           1,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		ErrorExpected:        true,
+	},
+	{
+		// Basic Artifact type with Layers and scratch config (Expected)
+		IncludesArtifactType: true,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     false,
+		LayerCount:           1,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		ErrorExpected:        false,
+	},
+	{
+		// Basic Artifact type with config, scratch layers and no artifact type (Error)
+		// This should fallback to use the mediatype as artifact type I think
+		IncludesArtifactType: false,
+		ConfigIsScratch:      false,
+		LayersAreScratch:     true,
+		LayerCount:           1,
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		ErrorExpected:        false,
+	},
+	{
+		// Basic Artifact type Scratch everything, no subject (Expected)
+		IncludesArtifactType: true,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     true,
+		LayerCount:           1,
+		HasSubject:           false,
+		SubjectInRegistry:    false,
+		ErrorExpected:        false,
+	},
+	{
+		// Regular OCI (Expected)
+		IncludesArtifactType: false,
+		ConfigIsScratch:      false,
+		LayersAreScratch:     false,
+		LayerCount:           1,
+		HasSubject:           false,
+		SubjectInRegistry:    false,
+		ErrorExpected:        false,
+	},
+	{
+		// Basic Artifact type Scratch everything, no artifact type (Error)
+		// If the scratch config is true, then the artifact type must be set
+		IncludesArtifactType: false,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     true,
+		LayerCount:           1,
+		HasSubject:           false,
+		SubjectInRegistry:    false,
+		ErrorExpected:        true,
+	},
+	{
+		// Basic Artifact type No layers (Error)
+		IncludesArtifactType: true,
+		ConfigIsScratch:      true,
+		LayersAreScratch:     false,
+		LayerCount:           0,
+		HasSubject:           false,
+		SubjectInRegistry:    false,
+		ErrorExpected:        true,
+	},
+	{
+		// Regular OCI referencing a layer that was never uploaded (Error)
+		// The registry should reject the manifest, usually with MANIFEST_BLOB_UNKNOWN
+		IncludesArtifactType: false,
+		ConfigIsScratch:      false,
+		LayersAreScratch:     false,
+		LayerCount:           1,
+		HasSubject:           false,
+		SubjectInRegistry:    false,
+		MissingBlob:          true,
+		ErrorExpected:        true,
+	},
+	{
+		// Basic Referrer Artifact type with a subject in another repository (Expected)
+		// The subject is missing from the repository of the artifact, which registries should
+		// accept, whether the referrers of either repository list it is reported
+		IncludesArtifactType:     true,
+		ConfigIsScratch:          true,
+		LayersAreScratch:         true,
+		LayerCount:               1,
+		HasSubject:               true,
+		SubjectInRegistry:        false,
+		SubjectInOtherRepository: true,
+		ErrorExpected:            false,
+	},
 }
 
-func (p Proxy) GenerateOCIArtifacts(ctx context.Context) error {
+// GenerateOCIArtifacts pushes the selected artifact cases and returns the outcome of every case
+// run, in order. It fails with ErrExpectationViolated if any case did not behave as expected.
+func (p Proxy) GenerateOCIArtifacts(ctx context.Context) (outcomes []ArtifactCaseOutcome, err error) {
 	var (
-		repo = fmt.Sprintf("%v%v", repoprefix, time.Now().Unix())
+		repo = NewRepositoryName()
 	)
 	if p.Repository != "" {
 		repo = p.Repository
 	}
-	// Subject Exists
-	opts := []artifactConstructOptions{
-		{
-			// Basic Referrer Artifact type (Success)
-			includesArtifactType: true,
-			configIsScratch:      true,
-			layersAreScratch:     true,
-			layercount:           1,
-			hasSubject:           true,
-			subjectInRegistry:    true,
-			errorExpected:        false,
-		},
-		{
-			// Basic Refferer Artifact type (Success - teleportLike)
-			includesArtifactType: true,
-			configIsScratch:      false,
-			layersAreScratch:     false,
-			layercount:           3,
-			hasSubject:           true,
-			subjectInRegistry:    true,
-			errorExpected:        false,
-		},
-		{
-			// Artifact Type no artifact type but using scratch (Error)
-			includesArtifactType: false,
-			configIsScratch:      true,
-			layersAreScratch:     true,
-			layercount:           1,
-			hasSubject:           true,
-			subjectInRegistry:    true,
-			errorExpected:        true,
-		},
-		{
-			// Basic Artifact type with Layers and scratch config (Expected)
-			includesArtifactType: true,
-			configIsScratch:      true,
-			layersAreScratch:     false,
-			layercount:           1,
-			hasSubject:           true,
-			subjectInRegistry:    true,
-			errorExpected:        false,
-		},
-		{
-			// Basic Artifact type with config, scratch layers and no artifact type (Error)
-			// This should fallback to use the mediatype as artifact type I think
-			includesArtifactType: false,
-			configIsScratch:      false,
-			layersAreScratch:     true,
-			layercount:           1,
-			hasSubject:           true,
-			subjectInRegistry:    true,
-			errorExpected:        false,
-		},
-		{
-			// Basic Artifact type Scratch everything, no subject (Expected)
-			includesArtifactType: true,
-			configIsScratch:      true,
-			layersAreScratch:     true,
-			layercount:           1,
-			hasSubject:           false,
-			subjectInRegistry:    false,
-			errorExpected:        false,
-		},
-		{
-			// Regular OCI (Expected)
-			includesArtifactType: false,
-			configIsScratch:      false,
-			layersAreScratch:     false,
-			layercount:           1,
-			hasSubject:           false,
-			subjectInRegistry:    false,
-			errorExpected:        false,
-		},
-		{
-			// Basic Artifact type Scratch everything, no artifact type (Error)
-			// If the scratch config is true, then the artifact type must be set
-			includesArtifactType: false,
-			configIsScratch:      true,
-			layersAreScratch:     true,
-			layercount:           1,
-			hasSubject:           false,
-			subjectInRegistry:    false,
-			errorExpected:        true,
-		},
-		{
-			// Basic Artifact type No layers (Error)
-			includesArtifactType: true,
-			configIsScratch:      true,
-			layersAreScratch:     false,
-			layercount:           0,
-			hasSubject:           false,
-			subjectInRegistry:    false,
-			errorExpected:        true,
-		},
-	}
-	// Push a Subject
-	subjectDesc, err := p.pushOCIImage(ctx, repo, "oci-subject", ociConfig, 2)
-	if err != nil {
-		return err
+	ctx, span := p.startSpan(ctx, "generate.artifacts", repo)
+	defer func() { endSpan(span, err) }()
+	opts := p.artifactCases()
+	for _, i := range p.SelectedCases {
+		if i < 0 || i >= len(opts) {
+			return nil, fmt.Errorf("artifact case %d out of range, %d cases defined", i, len(opts))
+		}
 	}
 
+	// subjects are pushed once before the cases, which may run concurrently
+	subjects := artifactSubjects{otherRepo: fmt.Sprintf("%s-other", repo)}
+	if subjects.subject, subjects.base, err = p.artifactSubject(ctx, repo); err != nil {
+		return nil, err
+	}
 	for i, opt := range opts {
-		var subject *ociimagespec.Descriptor
-		if opt.hasSubject {
-			if opt.subjectInRegistry {
-				subject = &subjectDesc
-			} else {
-				uuidStr := uuid.New().String() // Generate a random UUID to make sure subject doesn't exist
-				subject = &ociimagespec.Descriptor{
-					MediaType: ociimagespec.MediaTypeImageIndex,
-					Digest:    digest.FromBytes([]byte(uuidStr)),
-					Size:      int64(len([]byte(uuidStr))),
-				}
+		if p.caseSelected(i) && opt.HasSubject && opt.SubjectInOtherRepository {
+			if subjects.other, err = p.SubjectDescriptor(ctx, subjects.otherRepo, ""); err != nil {
+				return nil, err
 			}
+			break
 		}
+	}
 
-		_, err := p.pushOCIArtifact(ctx, subject, repo, fmt.Sprintf("%s-oci-%d", tagPrefix, i), opt)
-
-		subjectAdded := "Subject Added"
-		if !opt.hasSubject {
-			subjectAdded = "Subject Missing"
+	// up to ArtifactConcurrency cases are pushed at a time, a case frees its slot once reported
+	// so cases are reported in order and a single slot runs them strictly one after the other
+	workers := make(chan struct{}, p.artifactConcurrency())
+	results := make([]artifactCaseResult, len(opts))
+	done := make([]chan struct{}, len(opts))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer stop()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, opt := range opts {
+			if !p.caseSelected(i) {
+				continue
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-runCtx.Done():
+				results[i] = artifactCaseResult{fatal: runCtx.Err()}
+				close(done[i])
+				continue
+			}
+			wg.Add(1)
+			go func(i int, opt ArtifactConstructOptions) {
+				defer wg.Done()
+				results[i] = p.pushArtifactCase(runCtx, repo, i, opt, subjects)
+				close(done[i])
+			}(i, opt)
 		}
+	}()
 
-		subjectExists := "Subject in Registry"
-		if !opt.subjectInRegistry {
-			subjectExists = "Subject Not in Registry"
+	var violations []string
+	// referrers are the artifacts accepted with the subject in the repository as their subject
+	var referrers []ociimagespec.Descriptor
+	for i, opt := range opts {
+		if !p.caseSelected(i) {
+			continue
 		}
-
-		artifactTypeAdded := "Artifact Type Added"
-		if !opt.includesArtifactType {
-			artifactTypeAdded = "Artifact Type Missing"
+		<-done[i]
+		// failed cases are reported and skipped, but cancellation stops the run
+		if err := ctx.Err(); err != nil {
+			return outcomes, err
 		}
-
-		configType := "Scratch Config"
-		if !opt.configIsScratch {
-			configType = "Regular Config"
+		result := results[i]
+		if result.fatal != nil {
+			return outcomes, result.fatal
+		}
+		<-workers
+		if result.skipped {
+			continue
 		}
 
-		layerType := "Scratch Layers"
-		if !opt.layersAreScratch {
-			layerType = "Regular Layers"
+		p.Logger.Info().Msgf(opt.Title(i))
+		outcome := ArtifactCaseOutcome{
+			Index:         i,
+			Description:   opt.Description(),
+			ErrorExpected: opt.ErrorExpected,
+			Accepted:      result.err == nil,
 		}
-		layerType = fmt.Sprintf("%s (%d)", layerType, opt.layercount)
-		testTitle := fmt.Sprintf("OCI Artifact %d: %s - %s - %s - %s - %s", i, subjectAdded, subjectExists, artifactTypeAdded, configType, layerType)
-		p.Logger.Info().Msgf(testTitle)
-		if err != nil {
-			if opt.errorExpected {
+		var violation string
+		if err := result.err; err != nil {
+			outcome.Error = err.Error()
+			if outcome.ErrorCodes = errorCodes(err); len(outcome.ErrorCodes) > 0 {
+				p.Logger.Info().Msgf("Registry Error Codes: %s", strings.Join(outcome.ErrorCodes, ", "))
+			}
+			if opt.ErrorExpected {
 				p.Logger.Info().Msgf("Received Expected Error: %v", err)
 				p.Logger.Info().Msgf("Success")
 			} else {
 				p.Logger.Error().Msgf("Received Unexpected Error: %v", err)
+				violation = fmt.Sprintf("case %d expected success but failed: %v", i, err)
 			}
+		} else if opt.ErrorExpected {
+			p.Logger.Error().Msgf("Expected Error Not Received")
+			violation = fmt.Sprintf("case %d expected an error but succeeded", i)
 		} else {
 			p.Logger.Info().Msgf("Success")
 		}
+		if result.err == nil && opt.HasSubject && opt.SubjectInRegistry && !opt.SubjectInOtherRepository {
+			referrers = append(referrers, result.desc)
+		}
+		outcome.Passed = violation == ""
+		outcomes = append(outcomes, outcome)
+		if violation == "" {
+			continue
+		}
+		if p.FailFast {
+			return outcomes, fmt.Errorf("%s: %w", violation, ErrExpectationViolated)
+		}
+		violations = append(violations, violation)
 	}
-	return nil
+	var failures []string
+	if len(violations) > 0 {
+		failures = append(failures, fmt.Sprintf("%d of %d artifact cases did not behave as expected, %s", len(violations), len(outcomes), strings.Join(violations, "; ")))
+	}
+	if subjects.base != nil {
+		graphViolations, err := p.checkArtifactSubjectGraph(ctx, repo, subjects, referrers)
+		if err != nil {
+			return outcomes, err
+		}
+		if len(graphViolations) > 0 {
+			failures = append(failures, fmt.Sprintf("the referrers of the artifact subject and its base are incomplete, %s", strings.Join(graphViolations, "; ")))
+		}
+	}
+	if len(failures) > 0 {
+		return outcomes, fmt.Errorf("%s: %w", strings.Join(failures, "; "), ErrExpectationViolated)
+	}
+	return outcomes, nil
 }
 
-// Pushes a simple OCI image with @param layercount layers to the registry
-func (p Proxy) pushOCIImage(ctx context.Context, repo, tag string, config any, layercount int) (ociimagespec.Descriptor, error) {
-	configBytes, err := json.Marshal(config)
-	if err != nil {
-		return ociimagespec.Descriptor{}, err
+// ArtifactCaseOutcome describes how the registry handled an artifact case.
+type ArtifactCaseOutcome struct {
+	// Index is the index of the case.
+	Index int `json:"index"`
+
+	// Description describes the artifact of the case.
+	Description string `json:"description"`
+
+	// ErrorExpected indicates if the registry was expected to reject the artifact.
+	ErrorExpected bool `json:"errorExpected"`
+
+	// Accepted indicates if the registry accepted the artifact.
+	Accepted bool `json:"accepted"`
+
+	// Error is the error of a rejected artifact.
+	Error string `json:"error,omitempty"`
+
+	// ErrorCodes are the registry error codes of a rejected artifact.
+	ErrorCodes []string `json:"errorCodes,omitempty"`
+
+	// Passed indicates if the registry behaved as expected.
+	Passed bool `json:"passed"`
+}
+
+// artifactSubjects are the subjects of the artifact cases, pushed before the cases.
+type artifactSubjects struct {
+	subject ociimagespec.Descriptor
+
+	// base is the manifest a generated artifact subject refers to, nil unless the subject is
+	// a generated artifact.
+	base *ociimagespec.Descriptor
+
+	// other is the subject in otherRepo of the cases with a subject in another repository.
+	other     ociimagespec.Descriptor
+	otherRepo string
+}
+
+// artifactCaseResult is the outcome of pushing an artifact case.
+type artifactCaseResult struct {
+	// err is the error of the push, reported as the outcome of the case.
+	err error
+
+	// desc is the descriptor of the pushed artifact.
+	desc ociimagespec.Descriptor
+
+	// fatal is an error stopping the run, such as a failure to check the tag.
+	fatal error
+
+	// skipped indicates that the tag exists and IfNotExists is set.
+	skipped bool
+}
+
+// pushArtifactCase pushes the i-th artifact case to the repository.
+func (p Proxy) pushArtifactCase(ctx context.Context, repo string, i int, opt ArtifactConstructOptions, subjects artifactSubjects) artifactCaseResult {
+	if err := ctx.Err(); err != nil {
+		return artifactCaseResult{fatal: err}
+	}
+	var subject *ociimagespec.Descriptor
+	if opt.HasSubject {
+		if opt.SubjectInOtherRepository {
+			subject = &subjects.other
+		} else if opt.SubjectInRegistry {
+			subject = &subjects.subject
+		} else {
+			uuidStr := p.newUUID().String() // Generate a random UUID to make sure subject doesn't exist
+			subject = &ociimagespec.Descriptor{
+				MediaType: ociimagespec.MediaTypeImageIndex,
+				Digest:    digest.FromBytes([]byte(uuidStr)),
+				Size:      int64(len([]byte(uuidStr))),
+			}
+		}
 	}
 
-	ref := fmt.Sprintf("%s/%s:%s", p.Options.LoginServer, repo, tag)
-	pusher, err := p.resolver.Pusher(ctx, ref)
-	// Upload config blob
+	tag := fmt.Sprintf("%s-oci-%d", tagPrefix, i)
+	skip, overwrite, err := p.checkTag(ctx, repo, tag)
 	if err != nil {
-		return ociimagespec.Descriptor{}, err
+		return artifactCaseResult{fatal: err}
 	}
-	configDesc := ociimagespec.Descriptor{
-		MediaType: imagegenConfigMediaType,
-		Digest:    digest.FromBytes(configBytes),
-		Size:      int64(len(configBytes)),
+	if skip {
+		return artifactCaseResult{skipped: true}
 	}
-	err = uploadBytes(ctx, pusher, configDesc, configBytes)
+	desc, err := p.pushOCIArtifact(ctx, subject, repo, tag, opt)
 	if err != nil {
-		return ociimagespec.Descriptor{}, err
+		return artifactCaseResult{err: err}
+	}
+	p.logPushed(repo, tag, overwrite)
+	if opt.HasSubject && opt.SubjectInOtherRepository {
+		if err := p.logCrossRepositoryReferrers(ctx, desc, *subject, repo, subjects.otherRepo); err != nil {
+			return artifactCaseResult{fatal: err}
+		}
+	}
+	return artifactCaseResult{desc: desc}
+}
+
+// artifactConcurrency returns the number of artifact cases pushed concurrently. Cases of seeded
+// runs are pushed one at a time, so they draw their content from the PRNG in order.
+func (p Proxy) artifactConcurrency() int {
+	if p.ArtifactConcurrency <= 1 {
+		return 1
 	}
+	if p.rand != nil {
+		p.Logger.Warn().Msgf("Pushing artifact cases one at a time, seeded content requires an ordered run")
+		return 1
+	}
+	return p.ArtifactConcurrency
+}
 
-	// upload layers
-	var layerDescs []ociimagespec.Descriptor
-	for i := 0; i < layercount; i++ {
-		layerBytes := []byte(fmt.Sprintf("TestLayer %s %d-at-time %s", tag, i, time.Now()))
-		layerDesc := ociimagespec.Descriptor{
-			MediaType: ociimagespec.MediaTypeImageLayer,
-			Digest:    digest.FromBytes(layerBytes),
-			Size:      int64(len(layerBytes)),
+// artifactSubject returns the configured artifact subject if it exists in the repository,
+// or pushes a new subject unless only referrers are pushed, along with the manifest a pushed
+// artifact subject refers to.
+func (p Proxy) artifactSubject(ctx context.Context, repo string) (ociimagespec.Descriptor, *ociimagespec.Descriptor, error) {
+	if p.OnlyReferrers && p.ArtifactSubject == "" {
+		return ociimagespec.Descriptor{}, nil, errors.New("only pushing referrers requires a subject")
+	}
+	if p.ArtifactSubject != "" {
+		exists, err := p.manifestExists(ctx, repo, p.ArtifactSubject.String())
+		if err != nil {
+			return ociimagespec.Descriptor{}, nil, err
+		}
+		if exists {
+			desc, err := p.ResolveDescriptor(ctx, repo, p.ArtifactSubject.String())
+			return desc, nil, err
 		}
-		err := uploadBytes(ctx, pusher, layerDesc, layerBytes)
+		if p.OnlyReferrers {
+			return ociimagespec.Descriptor{}, nil, fmt.Errorf("subject %s in %s: %w", p.ArtifactSubject, repo, ErrNotFound)
+		}
+		p.Logger.Warn().Msgf("Subject %s does not exist in %s, pushing a new subject", p.ArtifactSubject, repo)
+	}
+	return p.pushSubject(ctx, repo)
+}
+
+// checkArtifactSubjectGraph checks that the referrers of the manifest an artifact subject refers
+// to list the subject, and that the referrers of the subject list the given artifacts. It returns
+// a violation for every artifact missing from a listing.
+func (p Proxy) checkArtifactSubjectGraph(ctx context.Context, repo string, subjects artifactSubjects, referrers []ociimagespec.Descriptor) ([]string, error) {
+	var violations []string
+	for _, edge := range []struct {
+		subject   ociimagespec.Descriptor
+		referrers []ociimagespec.Descriptor
+	}{
+		{*subjects.base, []ociimagespec.Descriptor{subjects.subject}},
+		{subjects.subject, referrers},
+	} {
+		result, err := p.GetReferrersOCI(ctx, repo, edge.subject.Digest, "")
 		if err != nil {
-			return ociimagespec.Descriptor{}, err
+			return nil, err
+		}
+		listed := make(map[digest.Digest]bool)
+		for _, r := range result.Referrers {
+			listed[r.Digest] = true
+		}
+		missing := 0
+		for _, r := range edge.referrers {
+			if !listed[r.Digest] {
+				missing++
+				violations = append(violations, fmt.Sprintf("referrers of %s do not list %s", edge.subject.Digest, r.Digest))
+			}
 		}
-		layerDescs = append(layerDescs, layerDesc)
+		p.Logger.Info().Msgf("Referrers of %s list %d of %d artifacts (mechanism: %s)", edge.subject.Digest, len(edge.referrers)-missing, len(edge.referrers), result.Mechanism)
 	}
+	return violations, nil
+}
 
-	ociManifest := ociimagespec.Manifest{
-		Versioned: specs.Versioned{SchemaVersion: 2},
-		MediaType: ociimagespec.MediaTypeImageManifest,
-		Config:    configDesc,
-		Layers:    layerDescs,
+// Pushes a simple OCI image with the generated config and layers to the registry
+func (p Proxy) pushOCIImage(ctx context.Context, repo, tag string, config ContentGenerator, layers []ContentGenerator) (ociimagespec.Descriptor, error) {
+	m := manifestContent{
+		config: config,
+		layers: layers,
+	}
+	// foreign layers are fetched from their URLs and never uploaded to the registry
+	for _, u := range p.ForeignLayerURLs {
+		m.foreignLayers = append(m.foreignLayers, foreignLayer(u))
+	}
+	return p.pushManifest(ctx, repo, tag, m)
+}
+
+// Pushes a simple OCI Image Artifact
+func (p Proxy) pushOCIArtifact(ctx context.Context, subject *ociimagespec.Descriptor, repo, tag string, opts ArtifactConstructOptions) (ociimagespec.Descriptor, error) {
+	m := manifestContent{
+		config:  p.configGenerator(),
+		layers:  p.layerGenerators(tag, opts.LayerCount),
+		subject: subject,
+	}
+	artifactType := p.artifactType()
+	if opts.ArtifactType != "" {
+		artifactType = opts.ArtifactType
 	}
+	if p.ArtifactConfig != nil {
+		m.config = *p.ArtifactConfig
+	}
+	if opts.ConfigIsScratch {
+		m.config = p.emptyConfig(artifactType)
+		m.emptyConfig = true
+	}
+	if opts.LayersAreScratch {
+		for i := range m.layers {
+			m.layers[i] = scratchContent
+		}
+	}
+	if opts.IncludesArtifactType {
+		m.artifactType = artifactType
+	}
+	if opts.MissingBlob {
+		m.missingLayers = append(m.missingLayers, p.missingLayer())
+	}
+	return p.pushManifest(ctx, repo, tag, m)
+}
 
-	manifestBytes, err := json.Marshal(ociManifest)
+// manifestContent describes the content of a manifest pushed by pushManifest.
+type manifestContent struct {
+	config ContentGenerator
+	layers []ContentGenerator
+	// foreignLayers are referenced after the generated layers and never uploaded.
+	foreignLayers []ociimagespec.Descriptor
+	// missingLayers are referenced after the foreign layers and never uploaded, so the
+	// registry should reject the manifest.
+	missingLayers []ociimagespec.Descriptor
+	artifactType  string
+	subject       *ociimagespec.Descriptor
+	annotations   map[string]string
+	// emptyConfig indicates that the config is the empty "{}" content, whatever its media type.
+	emptyConfig bool
+}
+
+// pushManifest generates and uploads the config and layers, then pushes the manifest referencing them,
+// or the other way around if ManifestFirst is set. The manifest is pushed by digest, unless a tag is given.
+func (p Proxy) pushManifest(ctx context.Context, repo, tag string, m manifestContent) (ociimagespec.Descriptor, error) {
+	pusher, err := p.pusher(ctx, repo, tag)
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	manifestDesc, manifestBytes, blobs, err := p.prepareManifest(m)
 	if err != nil {
 		return ociimagespec.Descriptor{}, err
 	}
 
-	// Upload manifest
-	manifestDesc := ociimagespec.Descriptor{
-		MediaType: ociimagespec.MediaTypeImageManifest,
-		Digest:    digest.FromBytes(manifestBytes),
-		Size:      int64(len(manifestBytes)),
+	if p.ManifestFirst {
+		err = p.uploadManifestFirst(ctx, pusher, repo, tag, manifestDesc, manifestBytes, blobs)
+	} else if err = p.uploadBlobs(ctx, pusher, repo, blobs); err == nil {
+		err = p.uploadManifest(ctx, pusher, repo, tag, manifestDesc, manifestBytes)
 	}
-	err = uploadBytes(ctx, pusher, manifestDesc, manifestBytes)
 	if err != nil {
 		return ociimagespec.Descriptor{}, err
 	}
+	p.pushed.add(repo, tag, manifestDesc, manifestBytes)
+	if m.subject != nil {
+		if err := p.updateReferrersTag(ctx, repo, m.subject.Digest, manifestDesc, manifestBytes); err != nil {
+			return ociimagespec.Descriptor{}, fmt.Errorf("update referrers tag of %s: %w", m.subject.Digest, err)
+		}
+	}
 	return manifestDesc, nil
 }
 
-// Pushes a simple OCI Image Artifact
-func (p Proxy) pushOCIArtifact(ctx context.Context, subject *ociimagespec.Descriptor, repo, tag string, opts artifactConstructOptions) (ociimagespec.Descriptor, error) {
-	configDescriptor := ociimagespec.ScratchDescriptor
-	configBytes := ociimagespec.ScratchDescriptor.Data
-	var err error
-
-	if !opts.configIsScratch {
-		configBytes, err = json.Marshal(ociConfig)
-		if err != nil {
-			return ociimagespec.Descriptor{}, err
-		}
-		configDescriptor = ociimagespec.Descriptor{
-			MediaType: imagegenConfigMediaType,
-			Digest:    digest.FromBytes(configBytes),
-			Size:      int64(len(configBytes)),
-		}
+// uploadManifestFirst pushes the manifest before the blobs it references. A manifest the
+// registry rejects is pushed again once the blobs are uploaded, and one it accepts must be
+// served once they are.
+func (p Proxy) uploadManifestFirst(ctx context.Context, pusher remotes.Pusher, repo, tag string, desc ociimagespec.Descriptor, data []byte, blobs []Blob) error {
+	err := p.uploadManifest(ctx, pusher, repo, tag, desc, data)
+	if err != nil && pushOutcomeUnknown(ctx, err) {
+		return err
+	}
+	accepted := err == nil
+	if accepted {
+		p.Logger.Info().Msgf("Registry accepted manifest %s before its %d blobs were uploaded", desc.Digest, len(blobs))
+	} else {
+		p.Logger.Info().Msgf("Registry rejected manifest %s pushed before its %d blobs were uploaded: %v", desc.Digest, len(blobs), err)
 	}
 
-	ref := fmt.Sprintf("%s/%s:%s", p.Options.LoginServer, repo, tag)
-	pusher, err := p.resolver.Pusher(ctx, ref)
-	// Upload config blob
+	if err := p.uploadBlobs(ctx, pusher, repo, blobs); err != nil {
+		return err
+	}
+	if !accepted {
+		return p.uploadManifest(ctx, pusher, repo, tag, desc, data)
+	}
+	got, err := p.ResolveDescriptor(ctx, repo, desc.Digest.String())
 	if err != nil {
-		return ociimagespec.Descriptor{}, err
+		return fmt.Errorf("manifest %s accepted before its blobs is not served once they are uploaded: %w", desc.Digest, err)
+	}
+	p.Logger.Info().Msgf("Registry serves manifest %s accepted before its blobs once they are uploaded", got.Digest)
+	return nil
+}
+
+// pusher returns a pusher for the repository, pushing manifests by digest unless a tag is given.
+func (p Proxy) pusher(ctx context.Context, repo, tag string) (remotes.Pusher, error) {
+	ref := fmt.Sprintf("%s/%s", p.Options.LoginServer, repo)
+	if tag != "" {
+		ref = fmt.Sprintf("%s:%s", ref, tag)
 	}
-	err = uploadBytes(ctx, pusher, configDescriptor, configBytes)
+	// the upload tracker of a resolver keys uploads by digest only, a tracker shared by pushers would
+	// skip a blob already pushed to another repository, or a manifest already pushed to another tag
+	opts := p.resolverOptions
+	opts.Tracker = docker.NewInMemoryTracker()
+	return docker.NewResolver(opts).Pusher(ctx, ref)
+}
+
+// buildManifest generates and uploads the config and layers, then returns the descriptor
+// and content of the manifest referencing them without pushing it.
+func (p Proxy) buildManifest(ctx context.Context, pusher remotes.Pusher, repo string, m manifestContent) (ociimagespec.Descriptor, []byte, error) {
+	manifestDesc, manifestBytes, blobs, err := p.prepareManifest(m)
 	if err != nil {
-		return ociimagespec.Descriptor{}, err
+		return ociimagespec.Descriptor{}, nil, err
+	}
+	if err := p.uploadBlobs(ctx, pusher, repo, blobs); err != nil {
+		return ociimagespec.Descriptor{}, nil, err
 	}
+	return manifestDesc, manifestBytes, nil
+}
 
-	var layerDescs []ociimagespec.Descriptor
-	for i := 0; i < opts.layercount; i++ {
-		if opts.layersAreScratch {
-			// Avoid reuploading the scratch layer if its already been pushed
-			if !opts.configIsScratch && i == 0 {
-				err = uploadBytes(ctx, pusher, ociimagespec.ScratchDescriptor, ociimagespec.ScratchDescriptor.Data)
-				if err != nil {
-					return ociimagespec.Descriptor{}, err
-				}
-			}
-			layerDescs = append(layerDescs, ociimagespec.ScratchDescriptor)
-		} else {
-			layerBytes := []byte(fmt.Sprintf("TestLayer %s %d-at-time %s", tag, i, time.Now()))
-			layerDesc := ociimagespec.Descriptor{
-				MediaType: ociimagespec.MediaTypeImageLayer,
-				Digest:    digest.FromBytes(layerBytes),
-				Size:      int64(len(layerBytes)),
+// prepareManifest generates the config and layers and returns the descriptor and content of the
+// manifest referencing them, along with the blobs to upload, without any upload.
+func (p Proxy) prepareManifest(m manifestContent) (ociimagespec.Descriptor, []byte, []Blob, error) {
+	p.checkMediaType("artifact", m.artifactType)
+	if m.subject != nil {
+		if refs := p.referenceAnnotations(m.subject.Digest.String()); refs != nil {
+			// explicit annotations take precedence over the reference annotations
+			for k, v := range m.annotations {
+				refs[k] = v
 			}
-			err := uploadBytes(ctx, pusher, layerDesc, layerBytes)
-			if err != nil {
-				return ociimagespec.Descriptor{}, err
+			m.annotations = refs
+		}
+	}
+
+	manifestBytes, manifestDesc, blobs, err := m.build(p.buildOptions())
+	if err != nil {
+		return ociimagespec.Descriptor{}, nil, nil, err
+	}
+	if err := p.validateSchema(ociimagespec.MediaTypeImageManifest, manifestBytes); err != nil {
+		return ociimagespec.Descriptor{}, nil, nil, err
+	}
+	// the config is built last
+	config := blobs[len(blobs)-1].Descriptor
+	for i, blob := range blobs {
+		desc := blob.Descriptor
+		if isEmptyMediaType(desc.MediaType) || (m.emptyConfig && i == len(blobs)-1) {
+			if err := verifyEmptyDescriptor(desc); err != nil {
+				return ociimagespec.Descriptor{}, nil, nil, err
 			}
-			layerDescs = append(layerDescs, layerDesc)
 		}
 	}
+	if err := p.dumpContent(config, blobs[len(blobs)-1].Data); err != nil {
+		return ociimagespec.Descriptor{}, nil, nil, err
+	}
+	return manifestDesc, manifestBytes, blobs, nil
+}
 
-	ociManifest := ociimagespec.Manifest{
-		Versioned: specs.Versioned{SchemaVersion: 2},
-		MediaType: ociimagespec.MediaTypeImageManifest,
-		Config:    configDescriptor,
-		Layers:    layerDescs,
-		Subject:   subject,
+// uploadBlobs uploads the blobs of a manifest as uploadBlob does.
+func (p Proxy) uploadBlobs(ctx context.Context, pusher remotes.Pusher, repo string, blobs []Blob) error {
+	for _, blob := range blobs {
+		p.checkMediaType("blob", blob.Descriptor.MediaType)
+		if err := p.uploadBlob(ctx, pusher, repo, blob); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if opts.includesArtifactType {
-		ociManifest.ArtifactType = imagegenArtifactType
+// buildOptions returns the options of the manifests built by the proxy.
+func (p Proxy) buildOptions() BuildOptions {
+	return BuildOptions{
+		InlineConfig:    p.InlineConfig,
+		InlineLayers:    p.InlineSmallLayers,
+		InlineThreshold: p.InlineThreshold,
+		NormalizeJSON:   p.NormalizeJSON,
 	}
+}
 
-	manifestBytes, err := json.Marshal(ociManifest)
+// pushContent generates a blob and uploads it to the repository as uploadBlob does.
+func (p Proxy) pushContent(ctx context.Context, pusher remotes.Pusher, repo string, g ContentGenerator, inline bool) (ociimagespec.Descriptor, error) {
+	blob, err := generateBlob(g, inline, p.InlineThreshold)
 	if err != nil {
 		return ociimagespec.Descriptor{}, err
 	}
+	p.checkMediaType("blob", blob.Descriptor.MediaType)
+	if err := p.uploadBlob(ctx, pusher, repo, blob); err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	return blob.Descriptor, nil
+}
 
-	// Upload manifest
-	manifestDesc := ociimagespec.Descriptor{
-		MediaType: ociimagespec.MediaTypeImageManifest,
-		Digest:    digest.FromBytes(manifestBytes),
-		Size:      int64(len(manifestBytes)),
+// uploadBlob uploads a generated blob to the repository, unless its content is inlined in the
+// descriptor and inlined uploads are skipped, or it was already uploaded to the repository by
+// this proxy. The scratch and empty blobs are always uploaded, so every combination of scratch
+// configs and layers uploads it exactly once per repository.
+func (p Proxy) uploadBlob(ctx context.Context, pusher remotes.Pusher, repo string, blob Blob) error {
+	desc := blob.Descriptor
+	if desc.Data != nil && !isScratchBlob(desc) && p.SkipInlinedUpload {
+		return nil
 	}
-	err = uploadBytes(ctx, pusher, manifestDesc, manifestBytes)
-	if err != nil {
-		return ociimagespec.Descriptor{}, err
+	if p.uploaded.contains(repo, desc.Digest) {
+		return nil
 	}
-	return manifestDesc, nil
+	if err := p.uploadBytes(ctx, pusher, repo, "", desc, blob.Data); err != nil {
+		return err
+	}
+	p.uploaded.add(repo, desc.Digest)
+	return nil
+}
+
+// missingLayer returns the descriptor of a unique layer that is never uploaded.
+func (p Proxy) missingLayer() ociimagespec.Descriptor {
+	data := []byte(fmt.Sprintf("MissingLayer %s", p.newUUID()))
+	return ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+}
+
+// artifactCases returns the configured artifact cases, or the default cases if none are configured.
+func (p Proxy) artifactCases() []ArtifactConstructOptions {
+	if len(p.ArtifactCases) == 0 {
+		return DefaultArtifactCases
+	}
+	return p.ArtifactCases
 }
 
-func uploadBytes(ctx context.Context, pusher remotes.Pusher, desc ociimagespec.Descriptor, data []byte) error {
+// caseSelected indicates if the i-th artifact case should be run.
+func (p Proxy) caseSelected(i int) bool {
+	if len(p.SelectedCases) == 0 {
+		return true
+	}
+	for _, selected := range p.SelectedCases {
+		if selected == i {
+			return true
+		}
+	}
+	return false
+}
+
+// maxManifestSize returns the maximum size of the manifests read from the registry.
+func (p Proxy) maxManifestSize() int64 {
+	if p.MaxManifestSize > 0 {
+		return p.MaxManifestSize
+	}
+	return defaultMaxManifestSize
+}
+
+// indexManifestCount returns the number of manifests in a generated index.
+func (p Proxy) indexManifestCount() int {
+	if p.IndexManifestCount > 0 {
+		return p.IndexManifestCount
+	}
+	return defaultIndexManifestCount
+}
+
+// imageLayerCount returns the number of layers of the images of a generated index.
+func (p Proxy) imageLayerCount() int {
+	if p.ImageLayerCountSet {
+		return p.ImageLayerCount
+	}
+	return defaultImageLayerCount
+}
+
+// subjectLayerCount returns the number of layers of a generated subject image.
+func (p Proxy) subjectLayerCount() int {
+	if p.SubjectLayerCount > 0 {
+		return p.SubjectLayerCount
+	}
+	return defaultSubjectLayerCount
+}
+
+// configMediaType returns the media type of generated configs.
+func (p Proxy) configMediaType() string {
+	if p.ConfigMediaType != "" {
+		return p.ConfigMediaType
+	}
+	return imagegenConfigMediaType
+}
+
+// artifactType returns the artifact type of generated artifacts.
+func (p Proxy) artifactType() string {
+	if p.ArtifactType != "" {
+		return p.ArtifactType
+	}
+	return imagegenArtifactType
+}
+
+// newUUID returns a random UUID, drawn from the proxy's PRNG when seeded.
+func (p Proxy) newUUID() uuid.UUID {
+	if p.rand == nil {
+		return uuid.New()
+	}
+	return uuid.Must(uuid.NewRandomFromReader(p.rand))
+}
+
+// uploadBytes pushes the content of a descriptor to the repository, reporting the upload progress.
+// A push failing without an answer from the registry, such as when the upload timed out or the
+// connection broke, or with a status the retry policy retries, is pushed again from the start
+// with a new pusher for the tag, as allowed by the retry policy. The requests of the pusher skip
+// the retry transport, so a push is only ever retried here, as a whole. Content not matching the
+// descriptor fails once, before anything is pushed.
+func (p Proxy) uploadBytes(ctx context.Context, pusher remotes.Pusher, repo, tag string, desc ociimagespec.Descriptor, data []byte) error {
+	return p.retryPush(ctx, pusher, repo, tag, desc, data, nil)
+}
+
+// retryPush is uploadBytes, calling landed, if not nil, once a push fails without an answer from
+// the registry, and settling the push as successful without pushing again if it reports the
+// content landed anyway.
+func (p Proxy) retryPush(ctx context.Context, pusher remotes.Pusher, repo, tag string, desc ociimagespec.Descriptor, data []byte, landed func(context.Context) bool) error {
+	if err := verifyContent(data, desc); err != nil {
+		return fmt.Errorf("push %s: %w", desc.Digest, err)
+	}
+	startedAt := time.Now()
+	for retry := 0; ; retry++ {
+		err := p.pushBytes(ctx, pusher, desc, data)
+		if err == nil || !pushRetryable(ctx, err, p.Retry) {
+			return err
+		}
+		if landed != nil && pushOutcomeUnknown(ctx, err) && landed(ctx) {
+			p.Logger.Warn().Msgf("Push of %s failed: %v, but it landed", desc.Digest, err)
+			return nil
+		}
+		delay, ok := p.Retry.Next(retry, startedAt, 0)
+		if !ok {
+			return err
+		}
+		p.Logger.Warn().Msgf("Push of %s failed: %v, retrying in %v", desc.Digest, err, delay)
+		if err := rhttp.Sleep(ctx, delay); err != nil {
+			return err
+		}
+		if pusher, err = p.pusher(ctx, repo, tag); err != nil {
+			return err
+		}
+	}
+}
+
+// pushBytes pushes the content of a descriptor once, reporting the upload progress.
+// The upload is cancelled once it stalls for the stall timeout, if any, its requests are bounded
+// by the timeout transport.
+func (p Proxy) pushBytes(ctx context.Context, pusher remotes.Pusher, desc ociimagespec.Descriptor, data []byte) error {
+	ctx, committed := rhttp.WithCommitDigest(ctx)
 	cw, err := pusher.Push(ctx, desc)
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
 			logrus.Infof("content %s exists", desc.Digest.String())
 			return nil
 		}
-		return err
+		return pushError(err)
 	}
 	defer cw.Close()
 
-	err = content.Copy(ctx, cw, bytes.NewReader(data), desc.Size, desc.Digest)
+	reporter := p.Progress
+	if reporter == nil {
+		reporter = noProgress{}
+	}
+	r := &progressReader{
+		Reader:   io.NewReader(bytes.NewReader(data)),
+		data:     data,
+		ref:      desc.Digest.String(),
+		total:    desc.Size,
+		reporter: reporter,
+	}
+	ctx, stopWatch := watchStalls(ctx, r, desc.Digest, p.StallTimeout)
+	defer stopWatch()
+	// the pusher blocks writing content its failed request no longer reads, closing the writer
+	// once the context is done unblocks it
+	stop := context.AfterFunc(ctx, func() { cw.Close() })
+	defer stop()
+
+	err = content.Copy(ctx, cw, r, desc.Size, desc.Digest)
+	if got := committed.Digest(); got != "" {
+		matched := got == desc.Digest.String()
+		p.metrics.RecordCommitDigest(matched)
+		if !matched {
+			return fmt.Errorf("push %s failed, registry returned digest %s: %w", desc.Digest, got, ErrDigestMismatch)
+		}
+		p.Logger.Trace().Msgf("pushed %s, registry returned a matching digest", desc.Digest)
+	}
 	if err != nil {
-		return err
+		return stallCause(ctx, pushError(err))
 	}
 	return nil
 }
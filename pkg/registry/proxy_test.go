@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// failBlobPuts makes the registry respond to the first failures blob upload PUTs with the status.
+func failBlobPuts(m *memRegistry, failures int32, status int) {
+	var failed atomic.Int32
+	m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/blobs/uploads/") || failed.Add(1) > failures {
+			return false
+		}
+		io.Copy(io.Discard, r.Body)
+		memError(w, status, "UNAVAILABLE", "flaky blob store")
+		return true
+	}
+}
+
+func TestUploadBytesRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		failures   int32
+		maxRetries int
+		wantErr    error
+		wantPuts   int
+	}{
+		{name: "unavailable once", status: http.StatusServiceUnavailable, failures: 1, maxRetries: 2, wantPuts: 2},
+		{name: "internal error twice", status: http.StatusInternalServerError, failures: 2, maxRetries: 2, wantPuts: 3},
+		{name: "retries exhausted", status: http.StatusBadGateway, failures: 5, maxRetries: 2, wantErr: ErrUnexpectedStatus, wantPuts: 3},
+		{name: "retries disabled", status: http.StatusServiceUnavailable, failures: 1, wantErr: ErrUnexpectedStatus, wantPuts: 1},
+		{name: "client error", status: http.StatusBadRequest, failures: 1, maxRetries: 2, wantErr: ErrUnexpectedStatus, wantPuts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			failBlobPuts(m, tt.failures, tt.status)
+			p := newTestProxy(t, server, Options{Retry: rhttp.RetryPolicy{MaxRetries: tt.maxRetries}})
+
+			ctx := context.Background()
+			data := []byte("content of a blob pushed to a flaky registry")
+			desc := ociimagespec.Descriptor{
+				MediaType: ociimagespec.MediaTypeImageLayer,
+				Digest:    digest.FromBytes(data),
+				Size:      int64(len(data)),
+			}
+			pusher, err := p.pusher(ctx, "flaky", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.uploadBytes(ctx, pusher, "flaky", "", desc, data)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("uploadBytes() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := m.count(http.MethodPut, "/blobs/uploads/"); got != tt.wantPuts {
+				t.Errorf("blob PUTs = %d, want %d", got, tt.wantPuts)
+			}
+			if _, ok := m.blob("flaky", desc.Digest); ok != (tt.wantErr == nil) {
+				t.Errorf("blob stored = %v, want %v", ok, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestIndexLayerlessImageRejected(t *testing.T) {
+	const repo, tag = "layerless", "v1"
+	m, server := newMemRegistry(t)
+	m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") {
+			return false
+		}
+		var manifest ociimagespec.Manifest
+		data, err := io.ReadAll(r.Body)
+		if err != nil || json.Unmarshal(data, &manifest) != nil {
+			t.Errorf("manifest %s: %v", data, err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		// indexes have no config, artifacts have a layer
+		if manifest.Config.Digest == "" || len(manifest.Layers) > 0 {
+			return false
+		}
+		memError(w, http.StatusBadRequest, "MANIFEST_INVALID", "image without layers")
+		return true
+	}
+	p := newTestProxy(t, server, Options{
+		Repository:         repo,
+		Tag:                tag,
+		IndexManifestCount: 2,
+		IndexArtifactRatio: 0.5,
+		ImageLayerCount:    0,
+		ImageLayerCountSet: true,
+	})
+
+	result, err := p.GenerateOCIIndex(context.Background(), ociimagespec.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("GenerateOCIIndex() error = %v, want the rejected image recorded", err)
+	}
+	if result.Skipped != 1 || len(result.Children) != 2 {
+		t.Fatalf("%d children, %d skipped, want 2 children with 1 skipped", len(result.Children), result.Skipped)
+	}
+	var rejected int
+	for _, child := range result.Children {
+		if child.Error != "" {
+			rejected++
+			if !strings.Contains(child.Error, errLayerlessImageRejected.Error()) {
+				t.Errorf("child %s error = %q, want the rejection of the image without layers", child.Tag, child.Error)
+			}
+		}
+	}
+	if rejected != 1 {
+		t.Errorf("%d children rejected, want 1", rejected)
+	}
+	if _, ok := m.manifest(repo, tag); !ok {
+		t.Errorf("index not pushed to %s:%s", repo, tag)
+	}
+}
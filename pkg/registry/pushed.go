@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushedDescriptor describes a manifest pushed to the registry.
+type PushedDescriptor struct {
+	Repository string        `json:"repository"`
+	Reference  string        `json:"reference"`
+	MediaType  string        `json:"mediaType"`
+	Digest     digest.Digest `json:"digest"`
+	Size       int64         `json:"size"`
+
+	// Config, Layers and Manifests describe the content referenced by the manifest,
+	// the config and layers of an image or the manifests of an index.
+	Config    *ContentDescriptor  `json:"config,omitempty"`
+	Layers    []ContentDescriptor `json:"layers,omitempty"`
+	Manifests []ContentDescriptor `json:"manifests,omitempty"`
+}
+
+// ContentDescriptor describes content referenced by a pushed manifest.
+type ContentDescriptor struct {
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+}
+
+// contentDescriptors returns the content descriptors of the descriptors.
+func contentDescriptors(descs []ociimagespec.Descriptor) []ContentDescriptor {
+	var content []ContentDescriptor
+	for _, desc := range descs {
+		content = append(content, ContentDescriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size})
+	}
+	return content
+}
+
+// PushedDescriptors lists the manifests pushed during a run, in push order.
+type PushedDescriptors struct {
+	Descriptors []PushedDescriptor `json:"descriptors"`
+}
+
+// pushLog records pushed manifests. It is safe for concurrent use.
+type pushLog struct {
+	mu          sync.Mutex
+	descriptors []PushedDescriptor
+}
+
+// add records a manifest pushed to the repository with the content it references. The reference
+// is the tag, or the digest if the manifest was pushed by digest.
+func (l *pushLog) add(repo, tag string, desc ociimagespec.Descriptor, data []byte) {
+	reference := tag
+	if reference == "" {
+		reference = desc.Digest.String()
+	}
+	pushed := PushedDescriptor{
+		Repository: repo,
+		Reference:  reference,
+		MediaType:  desc.MediaType,
+		Digest:     desc.Digest,
+		Size:       desc.Size,
+	}
+	// the fields of images and indexes are read alike, unknown bodies reference nothing
+	var content struct {
+		Config    *ociimagespec.Descriptor  `json:"config"`
+		Layers    []ociimagespec.Descriptor `json:"layers"`
+		Manifests []ociimagespec.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &content); err == nil {
+		if c := content.Config; c != nil {
+			pushed.Config = &ContentDescriptor{MediaType: c.MediaType, Digest: c.Digest, Size: c.Size}
+		}
+		pushed.Layers = contentDescriptors(content.Layers)
+		pushed.Manifests = contentDescriptors(content.Manifests)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.descriptors = append(l.descriptors, pushed)
+}
+
+// Pushed returns the manifests pushed by the proxy so far.
+func (p Proxy) Pushed() PushedDescriptors {
+	p.pushed.mu.Lock()
+	defer p.pushed.mu.Unlock()
+	return PushedDescriptors{
+		Descriptors: append([]PushedDescriptor{}, p.pushed.descriptors...),
+	}
+}
+
+// blobSet tracks the blobs uploaded to each repository. It is safe for concurrent use.
+type blobSet struct {
+	mu    sync.Mutex
+	blobs map[string]map[digest.Digest]bool
+}
+
+// add marks the blob as uploaded to the repository.
+func (s *blobSet) add(repo string, dgst digest.Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = make(map[string]map[digest.Digest]bool)
+	}
+	if s.blobs[repo] == nil {
+		s.blobs[repo] = make(map[digest.Digest]bool)
+	}
+	s.blobs[repo][dgst] = true
+}
+
+// contains indicates if the blob was uploaded to the repository.
+func (s *blobSet) contains(repo string, dgst digest.Digest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[repo][dgst]
+}
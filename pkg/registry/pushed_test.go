@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestScratchBlobUploadedOncePerRepository(t *testing.T) {
+	scratch := ociimagespec.ScratchDescriptor.Digest
+	for _, configIsScratch := range []bool{false, true} {
+		for _, layersAreScratch := range []bool{false, true} {
+			for _, layerCount := range []int{0, 1, 3} {
+				opts := ArtifactConstructOptions{
+					ConfigIsScratch:  configIsScratch,
+					LayersAreScratch: layersAreScratch,
+					LayerCount:       layerCount,
+				}
+				t.Run(opts.Description(), func(t *testing.T) {
+					m, server := newMemRegistry(t)
+					p := newTestProxy(t, server, Options{})
+
+					// two artifacts in a repository and one in another
+					ctx := context.Background()
+					pushes := []struct{ repo, tag string }{{"scratch", "a"}, {"scratch", "b"}, {"scratch-other", "a"}}
+					for _, push := range pushes {
+						if _, err := p.pushOCIArtifact(ctx, nil, push.repo, push.tag, opts); err != nil {
+							t.Fatalf("push %s:%s: %v", push.repo, push.tag, err)
+						}
+					}
+
+					wantPuts := 0
+					if configIsScratch || (layersAreScratch && layerCount > 0) {
+						wantPuts = 1
+					}
+					for _, repo := range []string{"scratch", "scratch-other"} {
+						if puts := m.blobPuts(repo, scratch); puts != wantPuts {
+							t.Errorf("%s: scratch blob PUTs = %d, want %d", repo, puts, wantPuts)
+						}
+					}
+
+					// every pushed manifest references blobs of its repository only
+					for _, push := range pushes {
+						stored, ok := m.manifest(push.repo, push.tag)
+						if !ok {
+							t.Fatalf("%s:%s not pushed", push.repo, push.tag)
+						}
+						var manifest ociimagespec.Manifest
+						if err := json.Unmarshal(stored.Data, &manifest); err != nil {
+							t.Fatal(err)
+						}
+						for _, desc := range append([]ociimagespec.Descriptor{manifest.Config}, manifest.Layers...) {
+							if _, ok := m.blob(push.repo, desc.Digest); !ok {
+								t.Errorf("%s:%s references %s, never uploaded to %s", push.repo, push.tag, desc.Digest, push.repo)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package registry
+
+import "fmt"
+
+// ReferenceAnnotations is a convention of annotations naming the subject of an artifact,
+// used by clients discovering artifacts without the referrers API.
+type ReferenceAnnotations string
+
+// Reference annotation conventions.
+const (
+	// ReferenceAnnotationsOCI names the subject digest with the OCI ref name annotation.
+	ReferenceAnnotationsOCI ReferenceAnnotations = "oci"
+
+	// ReferenceAnnotationsDocker names the subject with the vnd.docker.reference annotations
+	// BuildKit sets on attestation manifests.
+	ReferenceAnnotationsDocker ReferenceAnnotations = "docker"
+)
+
+// Reference annotation keys.
+const (
+	annotationRefName               = "org.opencontainers.image.ref.name"
+	annotationDockerReferenceType   = "vnd.docker.reference.type"
+	annotationDockerReferenceDigest = "vnd.docker.reference.digest"
+	dockerReferenceTypeAttestation  = "attestation-manifest"
+)
+
+// ReferenceAnnotationsTypes are the supported reference annotation conventions.
+var ReferenceAnnotationsTypes = []ReferenceAnnotations{
+	ReferenceAnnotationsOCI,
+	ReferenceAnnotationsDocker,
+}
+
+// validate checks that the convention is supported.
+func (a ReferenceAnnotations) validate() error {
+	for _, supported := range ReferenceAnnotationsTypes {
+		if a == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported reference annotations %q, expected one of %v", a, ReferenceAnnotationsTypes)
+}
+
+// referenceAnnotations returns the annotations naming the subject digest following the
+// configured conventions, or nil if none are configured.
+func (p Proxy) referenceAnnotations(subject string) map[string]string {
+	if len(p.ReferenceAnnotations) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string)
+	for _, a := range p.ReferenceAnnotations {
+		switch a {
+		case ReferenceAnnotationsOCI:
+			annotations[annotationRefName] = subject
+		case ReferenceAnnotationsDocker:
+			annotations[annotationDockerReferenceType] = dockerReferenceTypeAttestation
+			annotations[annotationDockerReferenceDigest] = subject
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,521 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	orasartifact "github.com/oras-project/artifacts-spec/specs-go/v1"
+)
+
+// filterArtifactType is the name of the referrers artifactType filter.
+const filterArtifactType = "artifactType"
+
+// ReferrersMechanism is the mechanism used to discover referrers.
+type ReferrersMechanism string
+
+// Referrers discovery mechanisms.
+const (
+	// ReferrersAPI is the referrers API.
+	ReferrersAPI ReferrersMechanism = "api"
+
+	// ReferrersTagSchema is the referrers tag schema fallback.
+	ReferrersTagSchema ReferrersMechanism = "tag"
+)
+
+// ReferrersResult describes the referrers of a subject.
+type ReferrersResult struct {
+	// Referrers are the descriptors of the manifests referring to the subject.
+	Referrers []ociimagespec.Descriptor
+
+	// FiltersApplied indicates that the registry applied the artifactType filter itself.
+	FiltersApplied bool
+
+	// Mechanism is the mechanism that answered the query.
+	Mechanism ReferrersMechanism
+
+	// Pages is the number of pages the referrers were returned in.
+	Pages int
+}
+
+// GetReferrers lists the referrers of a subject using the ORAS referrers API.
+// Pages are followed through the Link header until all referrers are listed.
+func (p Proxy) GetReferrers(ctx context.Context, repo string, dgst digest.Digest) ([]orasartifact.Descriptor, error) {
+	var referrers []orasartifact.Descriptor
+	next := p.referrersURL(repo, dgst, "")
+	for next != "" {
+		tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+			method:      http.MethodGet,
+			url:         next,
+			op:          "get referrers",
+			expected:    []int{http.StatusOK},
+			maxBodySize: p.maxManifestSize(),
+		})
+		if err != nil {
+			return referrers, err
+		}
+
+		var page referrersResponse
+		if err := json.Unmarshal(tripInfo.Response.Body, &page); err != nil {
+			return referrers, err
+		}
+		referrers = append(referrers, page.Referrers...)
+
+		if next, err = nextReferrersPage(next, tripInfo.Response.HeaderLink); err != nil {
+			return referrers, err
+		}
+	}
+	return referrers, nil
+}
+
+// referrersURL returns the URL of the first page of the referrers of a subject, requesting
+// ReferrersPageSize referrers per page and filtered by artifactType if set.
+func (p Proxy) referrersURL(repo string, dgst digest.Digest, artifactType string) string {
+	query := url.Values{}
+	if artifactType != "" {
+		query.Set(filterArtifactType, artifactType)
+	}
+	if p.ReferrersPageSize > 0 {
+		query.Set("n", fmt.Sprint(p.ReferrersPageSize))
+	}
+	u := p.url(ocirouteReferrers, repo, dgst)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// nextReferrersPage returns the absolute URL of the next page of referrers referenced by a
+// Link header, relative links are resolved against the current page. A page linking to
+// itself is an error, since following it would never end.
+func nextReferrersPage(current, link string) (string, error) {
+	next, err := nextPage(current, link)
+	if err != nil {
+		return "", err
+	}
+	if next == current {
+		return "", fmt.Errorf("referrers page %s links to itself as the next page", current)
+	}
+	return next, nil
+}
+
+// GetReferrersOCI lists the referrers of a subject using the OCI distribution spec v1.1 referrers API.
+// If artifactType is set it is sent as a filter, and applied client side when the registry
+// does not report it in the OCI-Filters-Applied header.
+// Pages are followed through the Link header until all referrers are listed.
+// If the registry does not support the referrers API, the referrers tag schema is used instead.
+func (p Proxy) GetReferrersOCI(ctx context.Context, repo string, dgst digest.Digest, artifactType string) (ReferrersResult, error) {
+	result := ReferrersResult{Mechanism: ReferrersAPI}
+
+	next := p.referrersURL(repo, dgst, artifactType)
+	for next != "" {
+		// only the first page tells whether the registry supports the referrers API
+		expected := []int{http.StatusOK}
+		if result.Pages == 0 {
+			expected = append(expected, http.StatusNotFound)
+		}
+		tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+			method:      http.MethodGet,
+			url:         next,
+			accept:      ociimagespec.MediaTypeImageIndex,
+			op:          "get referrers",
+			expected:    expected,
+			maxBodySize: p.maxManifestSize(),
+		})
+		if err != nil {
+			return result, err
+		}
+		if tripInfo.Response.Code == http.StatusNotFound {
+			p.Logger.Debug().Msgf("referrers API not found, falling back to the referrers tag schema")
+			return p.getReferrersByTag(ctx, repo, dgst, artifactType)
+		}
+
+		var index ociimagespec.Index
+		if err := json.Unmarshal(tripInfo.Response.Body, &index); err != nil {
+			return result, err
+		}
+		result.Referrers = append(result.Referrers, index.Manifests...)
+		result.Pages++
+
+		// the filters applied to the first page apply to the whole result
+		if artifactType != "" && result.Pages == 1 {
+			for _, filter := range strings.Split(tripInfo.Response.HeaderOCIFilters, ",") {
+				if strings.TrimSpace(filter) == filterArtifactType {
+					result.FiltersApplied = true
+				}
+			}
+		}
+
+		if next, err = nextReferrersPage(next, tripInfo.Response.HeaderLink); err != nil {
+			return result, err
+		}
+	}
+
+	if artifactType != "" && !result.FiltersApplied {
+		p.Logger.Debug().Msgf("registry did not apply the %s filter, filtering client side", filterArtifactType)
+		result.Referrers = filterReferrers(result.Referrers, artifactType)
+	}
+	return result, nil
+}
+
+// getReferrersByTag lists the referrers of a subject from the index stored under its referrers tag.
+// A missing referrers tag means that the subject has no referrers.
+func (p Proxy) getReferrersByTag(ctx context.Context, repo string, dgst digest.Digest, artifactType string) (ReferrersResult, error) {
+	result := ReferrersResult{Mechanism: ReferrersTagSchema}
+
+	index, exists, err := p.ReferrersTagIndex(ctx, repo, dgst)
+	if err != nil || !exists {
+		return result, err
+	}
+	result.Referrers = index.Manifests
+	result.Pages = 1
+	if artifactType != "" {
+		result.Referrers = filterReferrers(result.Referrers, artifactType)
+	}
+	return result, nil
+}
+
+// ReferrersTagIndex returns the index stored under the referrers tag of a subject digest,
+// and whether it exists.
+func (p Proxy) ReferrersTagIndex(ctx context.Context, repo string, dgst digest.Digest) (ociimagespec.Index, bool, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(routeManifests, repo, ReferrersTag(dgst)),
+		accept:      ociimagespec.MediaTypeImageIndex,
+		op:          "get referrers tag",
+		expected:    []int{http.StatusOK, http.StatusNotFound},
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil {
+		return ociimagespec.Index{}, false, err
+	}
+	if tripInfo.Response.Code == http.StatusNotFound {
+		return ociimagespec.Index{}, false, nil
+	}
+
+	var index ociimagespec.Index
+	if err := json.Unmarshal(tripInfo.Response.Body, &index); err != nil {
+		return ociimagespec.Index{}, false, err
+	}
+	return index, true, nil
+}
+
+// updateReferrersTag adds the descriptor of a manifest pushed with a subject to the index under
+// the referrers tag of the subject if the registry does not support the referrers API, so the
+// manifest is listed as a referrer through the referrers tag schema. The index is created if the
+// subject has no referrers yet.
+func (p Proxy) updateReferrersTag(ctx context.Context, repo string, subject digest.Digest, desc ociimagespec.Descriptor, data []byte) error {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(ocirouteReferrers, repo, subject),
+		accept:      ociimagespec.MediaTypeImageIndex,
+		op:          "get referrers",
+		expected:    []int{http.StatusOK, http.StatusNotFound},
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil || tripInfo.Response.Code == http.StatusOK {
+		return err
+	}
+
+	index, exists, err := p.ReferrersTagIndex(ctx, repo, subject)
+	if err != nil {
+		return err
+	}
+	for _, referrer := range index.Manifests {
+		if referrer.Digest == desc.Digest {
+			return nil
+		}
+	}
+	referrer, err := referrerDescriptor(desc, data)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		index = ociimagespec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	}
+	index.MediaType = ociimagespec.MediaTypeImageIndex
+	index.Manifests = append(index.Manifests, referrer)
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexDesc := ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(indexBytes),
+		Size:      int64(len(indexBytes)),
+	}
+	tag := ReferrersTag(subject)
+	if _, err := p.putManifest(ctx, repo, tag, indexDesc, indexBytes); err != nil {
+		return err
+	}
+	p.pushed.add(repo, tag, indexDesc, indexBytes)
+	p.Logger.Debug().Msgf("Referrers API not found, listed %s in referrers tag %s with %d referrers", desc.Digest, tag, len(index.Manifests))
+	return nil
+}
+
+// referrerDescriptor returns the descriptor listing a manifest as a referrer, with its artifact
+// type, or the media type of its config if it has none, and its annotations.
+func referrerDescriptor(desc ociimagespec.Descriptor, data []byte) (ociimagespec.Descriptor, error) {
+	var manifest struct {
+		ArtifactType string                   `json:"artifactType"`
+		Config       *ociimagespec.Descriptor `json:"config"`
+		Annotations  map[string]string        `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	referrer := ociimagespec.Descriptor{
+		MediaType:    desc.MediaType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+		ArtifactType: manifest.ArtifactType,
+		Annotations:  manifest.Annotations,
+	}
+	if referrer.ArtifactType == "" && manifest.Config != nil {
+		referrer.ArtifactType = manifest.Config.MediaType
+	}
+	return referrer, nil
+}
+
+// ReferrersTag returns the referrers tag schema tag of a subject digest, <alg>-<ref>.
+// The algorithm is truncated to 32 and the encoded digest to 64 characters, and any
+// character not allowed in tags is replaced with a dash.
+func ReferrersTag(dgst digest.Digest) string {
+	alg := truncate(dgst.Algorithm().String(), 32)
+	ref := truncate(dgst.Encoded(), 64)
+	return invalidTagCharRegex.ReplaceAllString(alg+"-"+ref, "-")
+}
+
+// invalidTagCharRegex matches the characters not allowed in tags.
+var invalidTagCharRegex = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// truncate returns at most the first n characters of s.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// filterReferrers returns the referrers with the given artifact type.
+func filterReferrers(referrers []ociimagespec.Descriptor, artifactType string) []ociimagespec.Descriptor {
+	var filtered []ociimagespec.Descriptor
+	for _, r := range referrers {
+		if r.ArtifactType == artifactType {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// GenerateReferrers pushes a subject image and count artifacts referring to it, then lists the
+// referrers of the subject to exercise the pagination of the referrers API.
+func (p Proxy) GenerateReferrers(ctx context.Context, repo string, count int) (_ ReferrersResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.referrers", repo)
+	defer func() { endSpan(span, err) }()
+	subject, err := p.SubjectDescriptor(ctx, repo, "")
+	if err != nil {
+		return ReferrersResult{}, err
+	}
+
+	if err := p.pushReferrers(ctx, repo, subject, 0, count); err != nil {
+		return ReferrersResult{}, err
+	}
+
+	result, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+	if err != nil {
+		return result, err
+	}
+	p.Logger.Info().Msgf("Pushed %d referrers for %s@%s, listed %d referrers in %d pages (mechanism: %s)",
+		count, repo, subject.Digest, len(result.Referrers), result.Pages, result.Mechanism)
+	return result, nil
+}
+
+// pushReferrers pushes the referrers numbered from start to end, excluded, to the subject.
+func (p Proxy) pushReferrers(ctx context.Context, repo string, subject ociimagespec.Descriptor, start, end int) error {
+	opts := ArtifactConstructOptions{
+		HasSubject:           true,
+		SubjectInRegistry:    true,
+		IncludesArtifactType: true,
+		LayerCount:           1,
+	}
+	for i := start; i < end; i++ {
+		// the layer content embeds the tag, so every referrer has a distinct digest
+		tag := fmt.Sprintf("%s-referrer-%d", tagPrefix, i)
+		if _, err := p.pushOCIArtifact(ctx, &subject, repo, tag, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReferrersLatency is the latency of a full listing of the referrers of a subject.
+type ReferrersLatency struct {
+	// Referrers is the number of referrers pushed to the subject before the listing.
+	Referrers int `json:"referrers"`
+
+	// Listed is the number of referrers listed.
+	Listed int `json:"listed"`
+
+	// Pages is the number of pages the referrers were listed in.
+	Pages int `json:"pages"`
+
+	// Latency is the time taken to list all the pages.
+	Latency time.Duration `json:"latency"`
+
+	// Mechanism is the mechanism that answered the listing.
+	Mechanism ReferrersMechanism `json:"mechanism"`
+}
+
+// GenerateReferrersProfile pushes a subject image, then pushes referrers to it in steps until
+// it has each of the given counts of referrers, in increasing order, and times a full paginated
+// listing of its referrers after every step to profile how the referrers API scales.
+func (p Proxy) GenerateReferrersProfile(ctx context.Context, repo string, counts []int) (_ []ReferrersLatency, err error) {
+	for i, count := range counts {
+		if count < 0 || (i > 0 && count <= counts[i-1]) {
+			return nil, fmt.Errorf("invalid referrer counts %v, expected increasing counts", counts)
+		}
+	}
+	ctx, span := p.startSpan(ctx, "generate.referrers_profile", repo)
+	defer func() { endSpan(span, err) }()
+	subject, err := p.SubjectDescriptor(ctx, repo, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var profile []ReferrersLatency
+	pushed := 0
+	for _, count := range counts {
+		if err := p.pushReferrers(ctx, repo, subject, pushed, count); err != nil {
+			return profile, err
+		}
+		pushed = count
+
+		start := time.Now()
+		result, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+		if err != nil {
+			return profile, err
+		}
+		latency := ReferrersLatency{
+			Referrers: count,
+			Listed:    len(result.Referrers),
+			Pages:     result.Pages,
+			Latency:   time.Since(start),
+			Mechanism: result.Mechanism,
+		}
+		profile = append(profile, latency)
+		p.Logger.Info().Msgf("Listed %d of %d referrers of %s@%s in %d pages in %v",
+			latency.Listed, count, repo, subject.Digest, latency.Pages, latency.Latency)
+	}
+	return profile, nil
+}
+
+// ArtifactTypeCount is a number of referrers with an artifact type.
+type ArtifactTypeCount struct {
+	ArtifactType string
+	Count        int
+}
+
+// ArtifactTypeReferrers describes the referrers of an artifact type pushed to a subject and
+// listed back with the artifactType filter.
+type ArtifactTypeReferrers struct {
+	// ArtifactType is the artifact type of the referrers and the filter of the query.
+	ArtifactType string
+
+	// Pushed is the number of referrers pushed with the artifact type.
+	Pushed int
+
+	// Listed is the number of referrers listed with the filter.
+	Listed int
+
+	// FiltersApplied indicates that the registry applied the filter itself.
+	FiltersApplied bool
+
+	// Mechanism is the mechanism that answered the query.
+	Mechanism ReferrersMechanism
+}
+
+// ReferrerMatrixResult describes the referrers of every artifact type of a referrer matrix.
+type ReferrerMatrixResult struct {
+	// Subject is the digest of the subject the referrers refer to.
+	Subject digest.Digest
+
+	// Types are the referrers of every artifact type, in the requested order.
+	Types []ArtifactTypeReferrers
+
+	// Listed is the number of referrers listed without a filter.
+	Listed int
+}
+
+// GenerateReferrerMatrix pushes a subject image and the requested number of referrers of every
+// artifact type, then lists the referrers of the subject filtered by each artifact type and fails
+// with ErrExpectationViolated if the counts listed do not match the counts pushed.
+func (p Proxy) GenerateReferrerMatrix(ctx context.Context, repo string, counts []ArtifactTypeCount) (_ ReferrerMatrixResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.referrer_matrix", repo)
+	defer func() { endSpan(span, err) }()
+	subject, err := p.SubjectDescriptor(ctx, repo, "")
+	if err != nil {
+		return ReferrerMatrixResult{}, err
+	}
+	result := ReferrerMatrixResult{Subject: subject.Digest}
+
+	total := 0
+	for i, c := range counts {
+		opts := ArtifactConstructOptions{
+			HasSubject:           true,
+			SubjectInRegistry:    true,
+			IncludesArtifactType: true,
+			ArtifactType:         c.ArtifactType,
+			LayerCount:           1,
+		}
+		for j := 0; j < c.Count; j++ {
+			// the layer content embeds the tag, so every referrer has a distinct digest
+			tag := fmt.Sprintf("%s-referrer-%d-%d", tagPrefix, i, j)
+			if _, err := p.pushOCIArtifact(ctx, &subject, repo, tag, opts); err != nil {
+				return result, err
+			}
+		}
+		total += c.Count
+	}
+
+	var violations []string
+	for _, c := range counts {
+		listed, err := p.GetReferrersOCI(ctx, repo, subject.Digest, c.ArtifactType)
+		if err != nil {
+			return result, err
+		}
+		result.Types = append(result.Types, ArtifactTypeReferrers{
+			ArtifactType:   c.ArtifactType,
+			Pushed:         c.Count,
+			Listed:         len(listed.Referrers),
+			FiltersApplied: listed.FiltersApplied,
+			Mechanism:      listed.Mechanism,
+		})
+		if len(listed.Referrers) != c.Count {
+			violations = append(violations, fmt.Sprintf("%s: pushed %d, listed %d", c.ArtifactType, c.Count, len(listed.Referrers)))
+		}
+	}
+	all, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+	if err != nil {
+		return result, err
+	}
+	result.Listed = len(all.Referrers)
+	if result.Listed != total {
+		violations = append(violations, fmt.Sprintf("all artifact types: pushed %d, listed %d", total, result.Listed))
+	}
+
+	p.Logger.Info().Msgf("Pushed %d referrers of %d artifact types for %s@%s", total, len(counts), repo, subject.Digest)
+	if len(violations) > 0 {
+		return result, fmt.Errorf("referrers listed do not match the referrers pushed, %s: %w", strings.Join(violations, "; "), ErrExpectationViolated)
+	}
+	return result, nil
+}
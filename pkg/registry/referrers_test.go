@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReferrersTagUpdated(t *testing.T) {
+	tests := []struct {
+		name          string
+		referrersAPI  bool
+		wantMechanism ReferrersMechanism
+	}{
+		{name: "without referrers API", wantMechanism: ReferrersTagSchema},
+		{name: "with referrers API", referrersAPI: true, wantMechanism: ReferrersAPI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			if tt.referrersAPI {
+				// the registry supports the referrers API, but lists no referrers
+				m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+					if !strings.Contains(r.URL.Path, "/referrers/") {
+						return false
+					}
+					w.Header().Set("Content-Type", ociimagespec.MediaTypeImageIndex)
+					json.NewEncoder(w).Encode(ociimagespec.Index{MediaType: ociimagespec.MediaTypeImageIndex})
+					return true
+				}
+			}
+			p := newTestProxy(t, server, Options{})
+			ctx := context.Background()
+			repo := "subjects"
+
+			subject, err := p.SubjectDescriptor(ctx, repo, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.pushReferrers(ctx, repo, subject, 0, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, exists := m.manifest(repo, ReferrersTag(subject.Digest))
+			if exists != !tt.referrersAPI {
+				t.Fatalf("referrers tag exists = %v, want %v", exists, !tt.referrersAPI)
+			}
+			if tt.referrersAPI {
+				return
+			}
+			if stored.MediaType != ociimagespec.MediaTypeImageIndex {
+				t.Errorf("referrers tag media type = %q, want %q", stored.MediaType, ociimagespec.MediaTypeImageIndex)
+			}
+			var index ociimagespec.Index
+			if err := json.Unmarshal(stored.Data, &index); err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Manifests) != 2 {
+				t.Fatalf("referrers tag lists %d referrers, want 2", len(index.Manifests))
+			}
+			for _, referrer := range index.Manifests {
+				if referrer.ArtifactType != p.artifactType() {
+					t.Errorf("referrer %s has artifact type %q, want %q", referrer.Digest, referrer.ArtifactType, p.artifactType())
+				}
+				if _, ok := m.manifest(repo, referrer.Digest.String()); !ok {
+					t.Errorf("referrer %s listed but not pushed", referrer.Digest)
+				}
+			}
+
+			result, err := p.GetReferrersOCI(ctx, repo, subject.Digest, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Mechanism != tt.wantMechanism || len(result.Referrers) != 2 {
+				t.Errorf("listed %d referrers through %q, want 2 through %q", len(result.Referrers), result.Mechanism, tt.wantMechanism)
+			}
+		})
+	}
+}
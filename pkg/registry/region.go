@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// RegionCompareResult describes a blob pushed through the login server and pulled back
+// through the data endpoint.
+type RegionCompareResult struct {
+	// Digest is the digest of the pushed blob.
+	Digest digest.Digest
+
+	// PushElapsed is the time taken to push the blob through the login server.
+	PushElapsed time.Duration
+
+	// PullElapsed is the time taken to pull the blob, including the redirect to the data endpoint.
+	PullElapsed time.Duration
+
+	// PulledFrom is the host the blob content was served from.
+	PulledFrom string
+
+	// DigestMatches indicates that the pulled content matches the pushed digest.
+	DigestMatches bool
+}
+
+// GenerateRegionCompare pushes a blob through the login server, then pulls it back through the
+// data endpoint the registry redirects to, to validate the data plane serves the pushed content.
+func (p Proxy) GenerateRegionCompare(ctx context.Context, repo string) (_ RegionCompareResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.region_compare", repo)
+	defer func() { endSpan(span, err) }()
+	if p.DataEndpoint == "" {
+		return RegionCompareResult{}, errors.New("data endpoint required")
+	}
+
+	pusher, err := p.pusher(ctx, repo, "")
+	if err != nil {
+		return RegionCompareResult{}, err
+	}
+	startedAt := time.Now()
+	desc, err := p.pushContent(ctx, pusher, repo, p.layerGenerators(fmt.Sprintf("%s-region", tagPrefix), 1)[0], false)
+	if err != nil {
+		return RegionCompareResult{}, err
+	}
+	result := RegionCompareResult{
+		Digest:      desc.Digest,
+		PushElapsed: time.Since(startedAt),
+	}
+
+	// the data endpoint is enforced on the redirect, so a pull served elsewhere fails
+	startedAt = time.Now()
+	tripInfo, err := p.PullBlob(ctx, repo, desc.Digest)
+	result.PullElapsed = time.Since(startedAt)
+	if err != nil && !errors.Is(err, ErrDigestMismatch) {
+		return result, err
+	}
+	result.DigestMatches = err == nil
+	dataEndpoint := false
+	if u := tripInfo.Request.URL; u != nil {
+		result.PulledFrom = u.Host
+		dataEndpoint = u.Host == p.DataEndpoint || u.Hostname() == p.DataEndpoint
+	}
+
+	p.Logger.Info().Msgf("Pushed blob %s to %s in %v, pulled it from %s in %v, digest matches: %v",
+		desc.Digest, p.LoginServer, result.PushElapsed, result.PulledFrom, result.PullElapsed, result.DigestMatches)
+	if !dataEndpoint {
+		p.Logger.Warn().Msgf("Blob %s was served by %s instead of the data endpoint %s", desc.Digest, result.PulledFrom, p.DataEndpoint)
+	}
+	return result, nil
+}
+
+// DiscoverDataEndpoint pushes a probe blob through the login server and pulls it back to learn
+// the data endpoint from the host, and port if any, the registry redirects the download to. An
+// empty endpoint is returned if the registry serves the blob itself.
+func (p Proxy) DiscoverDataEndpoint(ctx context.Context, repo string) (_ string, err error) {
+	ctx, span := p.startSpan(ctx, "generate.discover_data_endpoint", repo)
+	defer func() { endSpan(span, err) }()
+
+	pusher, err := p.pusher(ctx, repo, "")
+	if err != nil {
+		return "", err
+	}
+	desc, err := p.pushContent(ctx, pusher, repo, p.layerGenerators(fmt.Sprintf("%s-discover", tagPrefix), 1)[0], false)
+	if err != nil {
+		return "", err
+	}
+	// redirects are followed, so the final request went to the redirect location
+	tripInfo, err := p.PullBlob(ctx, repo, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	u := tripInfo.Request.URL
+	if u == nil || u.Host == p.LoginServer || u.Hostname() == p.LoginServer {
+		return "", nil
+	}
+	p.Logger.Info().Msgf("Blob %s was redirected from %s to %s", desc.Digest, p.LoginServer, u.Host)
+	return u.Host, nil
+}
+
+// EndpointLatency describes repeated downloads of a blob from one endpoint.
+type EndpointLatency struct {
+	// Host is the host the blob was downloaded from.
+	Host string
+
+	// Elapsed are the durations of the requests, in the order they completed.
+	Elapsed []time.Duration
+}
+
+// Percentile returns the duration the given percentage of the requests did not exceed,
+// using the nearest rank.
+func (l EndpointLatency) Percentile(percent float64) time.Duration {
+	if len(l.Elapsed) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), l.Elapsed...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(percent / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// EndpointComparison describes the latency of downloading the same blob from the login server
+// and from the data endpoint it redirects to.
+type EndpointComparison struct {
+	// Digest is the digest of the downloaded blob.
+	Digest digest.Digest
+
+	// LoginServer describes the requests to the login server, answered with redirects.
+	LoginServer EndpointLatency
+
+	// DataEndpoint describes the downloads from the locations the login server redirected to.
+	DataEndpoint EndpointLatency
+}
+
+// GenerateEndpointComparison pushes a blob through the login server, then requests it count
+// times from the login server without following the redirect, and downloads it from every
+// redirect location, to compare the latency of both endpoints. Up to concurrency requests
+// run at a time. The elapsed time of every request is the one of its round trip, waiting for
+// the rate limiter excluded.
+func (p Proxy) GenerateEndpointComparison(ctx context.Context, repo string, count, concurrency int) (_ EndpointComparison, err error) {
+	ctx, span := p.startSpan(ctx, "generate.endpoint_comparison", repo)
+	defer func() { endSpan(span, err) }()
+	if count <= 0 {
+		return EndpointComparison{}, fmt.Errorf("invalid request count %d", count)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	pusher, err := p.pusher(ctx, repo, "")
+	if err != nil {
+		return EndpointComparison{}, err
+	}
+	desc, err := p.pushContent(ctx, pusher, repo, p.layerGenerators(fmt.Sprintf("%s-endpoints", tagPrefix), 1)[0], false)
+	if err != nil {
+		return EndpointComparison{}, err
+	}
+	result := EndpointComparison{Digest: desc.Digest}
+
+	logins := make([]rhttp.RoundTripInfo, count)
+	datas := make([]rhttp.RoundTripInfo, count)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i := 0; i < count && gctx.Err() == nil; i++ {
+		i := i
+		g.Go(func() (err error) {
+			logins[i], datas[i], err = p.compareEndpoints(gctx, repo, desc.Digest)
+			return err
+		})
+	}
+	err = g.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err != nil {
+		return result, err
+	}
+	for i := range logins {
+		result.LoginServer.Host = logins[i].Request.URL.Host
+		result.LoginServer.Elapsed = append(result.LoginServer.Elapsed, elapsed(logins[i]))
+		result.DataEndpoint.Host = datas[i].Request.URL.Host
+		result.DataEndpoint.Elapsed = append(result.DataEndpoint.Elapsed, elapsed(datas[i]))
+	}
+
+	p.Logger.Info().Msgf("Requested blob %s %d times from %s and %s", desc.Digest, count, result.LoginServer.Host, result.DataEndpoint.Host)
+	return result, nil
+}
+
+// compareEndpoints requests the blob from the login server without following the redirect,
+// then downloads it from the redirect location and verifies its digest, and that it matches
+// the HEAD response if HeadBeforeGet is set.
+func (p Proxy) compareEndpoints(ctx context.Context, repo string, dgst digest.Digest) (login, data rhttp.RoundTripInfo, err error) {
+	var head ociimagespec.Descriptor
+	if p.HeadBeforeGet {
+		if head, err = p.HeadBlob(ctx, repo, dgst); err != nil {
+			return login, data, err
+		}
+	}
+	req := registryRequest{
+		method:     http.MethodGet,
+		url:        p.url(routeBlobs, repo, dgst),
+		op:         fmt.Sprintf("get blob %s from the login server", dgst),
+		noRedirect: true,
+	}
+	if login, err = p.transport.roundTrip(ctx, req); err != nil {
+		return login, data, err
+	}
+	if !isRedirect(login.Response.Code) {
+		if err := checkStatus(req.op, login, http.StatusOK); err != nil {
+			return login, data, err
+		}
+		return login, data, fmt.Errorf("blob %s was served by %s instead of redirected to a data endpoint", dgst, p.LoginServer)
+	}
+	// the redirect location is pre-signed, it is requested without authorization
+	if data, err = p.transport.followRedirect(ctx, req, login); err != nil {
+		return login, data, err
+	}
+	if err := checkStatus(fmt.Sprintf("pull blob %s from the data endpoint", dgst), data, http.StatusOK); err != nil {
+		return login, data, err
+	}
+	if p.HeadBeforeGet {
+		if err := verifyHead(dgst, head, data.Response); err != nil {
+			return login, data, err
+		}
+	}
+	return login, data, p.verifyPulledBlob(dgst, data.Response)
+}
+
+// elapsed returns the elapsed time of the round trip.
+func elapsed(tripInfo rhttp.RoundTripInfo) time.Duration {
+	d, _ := time.ParseDuration(tripInfo.Elapsed)
+	return d
+}
@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverDataEndpointKeepsPort(t *testing.T) {
+	m, server := newMemRegistry(t)
+	// the data endpoint serves the blobs of the registry on a port of its own
+	data := httptest.NewServer(m)
+	t.Cleanup(data.Close)
+	m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Host == strings.TrimPrefix(data.URL, "http://") || r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/sha256:") {
+			return false
+		}
+		http.Redirect(w, r, data.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		return true
+	}
+	p := newTestProxy(t, server, Options{})
+
+	endpoint, err := p.DiscoverDataEndpoint(context.Background(), "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.TrimPrefix(data.URL, "http://"); endpoint != want {
+		t.Errorf("DiscoverDataEndpoint() = %q, want %q", endpoint, want)
+	}
+}
@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RepushResult describes how the registry handled the same manifest pushed twice.
+type RepushResult struct {
+	// Digest is the digest of the pushed manifest.
+	Digest digest.Digest
+
+	// FirstStatus and SecondStatus are the status codes of the two pushes.
+	FirstStatus  int
+	SecondStatus int
+
+	// SecondDigest is the digest the registry reported for the second push, if any.
+	SecondDigest digest.Digest
+
+	// ExistedBeforeRepush indicates that the tag resolved to the manifest before the second push,
+	// so the second push could not create or move the tag.
+	ExistedBeforeRepush bool
+
+	// DigestsMatch indicates that the registry reported the expected digest for both pushes.
+	DigestsMatch bool
+}
+
+// NoOp indicates that the registry accepted the second push as content it already stores: it
+// answered 200 or 201 with the digest of the manifest, for a tag already resolving to it.
+func (r RepushResult) NoOp() bool {
+	accepted := r.SecondStatus == http.StatusOK || r.SecondStatus == http.StatusCreated
+	return accepted && r.SecondDigest == r.Digest && r.ExistedBeforeRepush
+}
+
+// GenerateRepush pushes an image manifest, then pushes the exact same bytes again to check
+// that the registry treats the second push as a no-op on content it already stores.
+func (p Proxy) GenerateRepush(ctx context.Context, repo string) (_ RepushResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.repush", repo)
+	defer func() { endSpan(span, err) }()
+	tag := fmt.Sprintf("%s-repush", tagPrefix)
+	pusher, err := p.pusher(ctx, repo, tag)
+	if err != nil {
+		return RepushResult{}, err
+	}
+	desc, data, err := p.buildManifest(ctx, pusher, repo, manifestContent{
+		config: p.configGenerator(),
+		layers: p.imageLayerGenerators(tag, p.subjectLayerCount()),
+	})
+	if err != nil {
+		return RepushResult{}, err
+	}
+	result := RepushResult{Digest: desc.Digest}
+
+	first, err := p.putManifest(ctx, repo, tag, desc, data)
+	if err != nil {
+		return result, err
+	}
+	p.pushed.add(repo, tag, desc, data)
+	result.FirstStatus = first.Response.Code
+
+	resolved, err := p.ResolveDescriptor(ctx, repo, tag)
+	if err != nil {
+		return result, err
+	}
+	result.ExistedBeforeRepush = resolved.Digest == desc.Digest
+
+	second, err := p.putManifest(ctx, repo, tag, desc, data)
+	if err != nil {
+		return result, err
+	}
+	result.SecondStatus = second.Response.Code
+	result.SecondDigest = digest.Digest(second.Response.HeaderContentDigest)
+	result.DigestsMatch = first.Response.HeaderContentDigest == desc.Digest.String() &&
+		result.SecondDigest == desc.Digest
+
+	p.Logger.Info().Msgf("Pushed %s:%s twice, status codes %d then %d, existed before repush: %v, digests match: %v, no-op: %v",
+		repo, tag, result.FirstStatus, result.SecondStatus, result.ExistedBeforeRepush, result.DigestsMatch, result.NoOp())
+	return result, nil
+}
+
+// putManifest pushes the manifest content as is to the tag, bypassing any client side existence check.
+// The content is dumped first, if dumping is enabled, so the content of rejected pushes is kept.
+func (p Proxy) putManifest(ctx context.Context, repo, tag string, desc ociimagespec.Descriptor, data []byte) (rhttp.RoundTripInfo, error) {
+	if err := p.dumpContent(desc, data); err != nil {
+		return rhttp.RoundTripInfo{}, err
+	}
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodPut,
+		url:         p.url(routeManifests, repo, tag),
+		body:        data,
+		contentType: desc.MediaType,
+		op:          "put manifest",
+		expected:    []int{http.StatusCreated, http.StatusOK},
+	})
+	return tripInfo, err
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRepushNoOp(t *testing.T) {
+	const otherDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name     string
+		status   int
+		digest   string // the digest reported for the second push, the pushed one if "pushed"
+		wantNoOp bool
+	}{
+		{name: "created again", status: http.StatusCreated, digest: "pushed", wantNoOp: true},
+		{name: "already stored", status: http.StatusOK, digest: "pushed", wantNoOp: true},
+		{name: "digest missing", status: http.StatusCreated},
+		{name: "other digest", status: http.StatusCreated, digest: otherDigest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			puts := 0
+			m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") {
+					return false
+				}
+				if puts++; puts == 1 {
+					return false
+				}
+				data, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				switch tt.digest {
+				case "pushed":
+					w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+				case "":
+				default:
+					w.Header().Set("Docker-Content-Digest", tt.digest)
+				}
+				w.WriteHeader(tt.status)
+				return true
+			}
+			p := newTestProxy(t, server, Options{})
+
+			result, err := p.GenerateRepush(context.Background(), "repush")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.SecondStatus != tt.status {
+				t.Errorf("SecondStatus = %d, want %d", result.SecondStatus, tt.status)
+			}
+			if !result.ExistedBeforeRepush {
+				t.Error("ExistedBeforeRepush = false, want the tag to resolve to the first push")
+			}
+			if got := result.NoOp(); got != tt.wantNoOp {
+				t.Errorf("NoOp() = %v, want %v", got, tt.wantNoOp)
+			}
+		})
+	}
+}
+
+func TestPutManifestDumped(t *testing.T) {
+	m, server := newMemRegistry(t)
+	// the registry rejects the manifest, which must be dumped all the same
+	m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") {
+			return false
+		}
+		memError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest invalid")
+		return true
+	}
+	dir := t.TempDir()
+	p := newTestProxy(t, server, Options{DumpManifestsDir: dir})
+	data, desc, _, err := BuildOCIArtifact(imagegenArtifactType, nil, nil, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.putManifest(context.Background(), "dumped", "v1", desc, data); err == nil {
+		t.Fatal("putManifest() succeeded, want the rejection")
+	}
+	dumped, err := os.ReadFile(filepath.Join(dir, "sha256-"+desc.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dumped, data) {
+		t.Errorf("dumped %s, want the pushed manifest %s", dumped, data)
+	}
+}
@@ -0,0 +1,88 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SBOM artifact types.
+const (
+	SBOMArtifactTypeSPDX      = "application/spdx+json"
+	SBOMArtifactTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// GenerateSBOMArtifact pushes a synthetic SBOM describing the subject to the repository.
+// The artifact type selects the SBOM format, SPDX or CycloneDX.
+func (p Proxy) GenerateSBOMArtifact(ctx context.Context, repo string, subject ociimagespec.Descriptor, artifactType string) (_ ociimagespec.Descriptor, err error) {
+	ctx, span := p.startSpan(ctx, "generate.sbom", repo)
+	defer func() { endSpan(span, err) }()
+	var document any
+	switch artifactType {
+	case SBOMArtifactTypeSPDX:
+		document = spdxDocument(repo, subject)
+	case SBOMArtifactTypeCycloneDX:
+		document = cycloneDXDocument(repo, subject)
+	default:
+		return ociimagespec.Descriptor{}, fmt.Errorf("unsupported SBOM artifact type %s", artifactType)
+	}
+	desc, err := p.pushArtifact(ctx, repo, "", artifactType, &subject,
+		[]ContentGenerator{JSONContent{MediaType: artifactType, Value: document}}, nil)
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	p.Logger.Info().Msgf("Pushed %s SBOM %s for %s@%s", artifactType, desc.Digest, repo, subject.Digest)
+	return desc, nil
+}
+
+// spdxDocument returns a minimal SPDX 2.3 document describing the subject.
+func spdxDocument(repo string, subject ociimagespec.Descriptor) map[string]any {
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              repo,
+		"documentNamespace": fmt.Sprintf("https://imagegentest/spdx/%s/%s", repo, subject.Digest.Encoded()),
+		"creationInfo": map[string]any{
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: image-gen-test"},
+		},
+		"packages": []map[string]any{
+			{
+				"SPDXID":           "SPDXRef-Package-testlayer",
+				"name":             "testlayer",
+				"versionInfo":      "1.0.0",
+				"downloadLocation": "NOASSERTION",
+				"checksums": []map[string]string{
+					{"algorithm": "SHA256", "checksumValue": subject.Digest.Encoded()},
+				},
+			},
+		},
+	}
+}
+
+// cycloneDXDocument returns a minimal CycloneDX 1.4 document describing the subject.
+func cycloneDXDocument(repo string, subject ociimagespec.Descriptor) map[string]any {
+	return map[string]any{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.4",
+		"version":     1,
+		"metadata": map[string]any{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"component": map[string]any{
+				"type":    "container",
+				"name":    repo,
+				"version": subject.Digest.String(),
+			},
+		},
+		"components": []map[string]any{
+			{
+				"type":    "library",
+				"name":    "testlayer",
+				"version": "1.0.0",
+			},
+		},
+	}
+}
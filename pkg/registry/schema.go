@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/opencontainers/image-spec/schema"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// validateSchema checks a marshaled manifest or index against the OCI image-spec JSON schema,
+// if schema validation is enabled. Other media types are not checked.
+func (p Proxy) validateSchema(mediaType string, data []byte) error {
+	if !p.ValidateSchema {
+		return nil
+	}
+
+	var validator schema.Validator
+	switch mediaType {
+	case ociimagespec.MediaTypeImageManifest:
+		validator = schema.ValidatorMediaTypeManifest
+	case ociimagespec.MediaTypeImageIndex:
+		validator = schema.ValidatorMediaTypeImageIndex
+	default:
+		return nil
+	}
+	if err := validator.Validate(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrSchemaInvalid, mediaType, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Notary v2 signature constants.
+const (
+	notarySignatureArtifactType = "application/vnd.cncf.notary.signature"
+	notaryJWSMediaType          = "application/jose+json"
+	notaryThumbprintAnnotation  = "io.cncf.notary.x509chain.thumbprint#S256"
+	notaryPayloadMediaType      = "application/vnd.cncf.notary.payload.v1+json"
+)
+
+// GenerateSignatureArtifact pushes a notation style signature for the subject to the repository.
+// The signature is a synthetic JWS envelope that looks like, but is not, a valid notation signature.
+func (p Proxy) GenerateSignatureArtifact(ctx context.Context, repo string, subject ociimagespec.Descriptor) (_ ociimagespec.Descriptor, err error) {
+	ctx, span := p.startSpan(ctx, "generate.signature", repo)
+	defer func() { endSpan(span, err) }()
+	envelope, thumbprint, err := signatureEnvelope(subject)
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+
+	annotations := map[string]string{
+		notaryThumbprintAnnotation: fmt.Sprintf("[%q]", thumbprint),
+	}
+	desc, err := p.pushArtifact(ctx, repo, "", notarySignatureArtifactType, &subject,
+		[]ContentGenerator{StaticContent{MediaType: notaryJWSMediaType, Data: envelope}}, annotations)
+	if err != nil {
+		return ociimagespec.Descriptor{}, err
+	}
+	p.Logger.Info().Msgf("Pushed signature %s for %s@%s", desc.Digest, repo, subject.Digest)
+	return desc, nil
+}
+
+// signatureEnvelope returns a synthetic JWS envelope signing the subject and the thumbprint
+// of its synthetic certificate.
+func signatureEnvelope(subject ociimagespec.Descriptor) ([]byte, string, error) {
+	payload, err := json.Marshal(struct {
+		TargetArtifact ociimagespec.Descriptor `json:"targetArtifact"`
+	}{subject})
+	if err != nil {
+		return nil, "", err
+	}
+	protected, err := json.Marshal(map[string]any{
+		"alg":  "PS256",
+		"cty":  notaryPayloadMediaType,
+		"crit": []string{"io.cncf.notary.signingScheme"},
+
+		"io.cncf.notary.signingScheme": "notary.x509",
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	certificate := sha256.Sum256(append([]byte("certificate"), subject.Digest...))
+	signature := sha256.Sum256(append(protected, payload...))
+	envelope, err := json.Marshal(map[string]any{
+		"payload":   base64.RawURLEncoding.EncodeToString(payload),
+		"protected": base64.RawURLEncoding.EncodeToString(protected),
+		"header": map[string]any{
+			"x5c": []string{base64.StdEncoding.EncodeToString(certificate[:])},
+		},
+		"signature": base64.RawURLEncoding.EncodeToString(signature[:]),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	thumbprint := sha256.Sum256(certificate[:])
+	return envelope, fmt.Sprintf("%x", thumbprint), nil
+}
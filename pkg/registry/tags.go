@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// Tag routes
+const (
+	routeTags = "/v2/%s/tags/list" // add repo name
+)
+
+// tagsResponse describes the tag list API response.
+type tagsResponse struct {
+	// Tags is a page of the tags of the repository.
+	Tags []string `json:"tags"`
+}
+
+// ListTags lists all tags of the repository, following the Link header across pages.
+func (p Proxy) ListTags(ctx context.Context, repo string) ([]string, error) {
+	next := p.url(routeTags, repo)
+
+	var tags []string
+	for next != "" {
+		tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+			method:   http.MethodGet,
+			url:      next,
+			op:       fmt.Sprintf("list tags of %s", repo),
+			expected: []int{http.StatusOK},
+		})
+		if err != nil {
+			return tags, err
+		}
+
+		var page tagsResponse
+		if err := json.Unmarshal(tripInfo.Response.Body, &page); err != nil {
+			return tags, err
+		}
+		tags = append(tags, page.Tags...)
+
+		next, err = nextPage(next, tripInfo.Response.HeaderLink)
+		if err != nil {
+			return tags, err
+		}
+	}
+	return tags, nil
+}
+
+// tagManifest tags a pushed manifest with every tag by putting it again, without uploading any blob.
+// The tags put are then verified to be listed and to resolve to the manifest digest, tags skipped
+// because they exist and IfNotExists is set are left as is.
+func (p Proxy) tagManifest(ctx context.Context, repo string, desc ociimagespec.Descriptor, tags []string) error {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:      http.MethodGet,
+		url:         p.url(routeManifests, repo, desc.Digest),
+		accept:      desc.MediaType,
+		op:          fmt.Sprintf("get manifest %s", desc.Digest),
+		expected:    []int{http.StatusOK},
+		maxBodySize: p.maxManifestSize(),
+	})
+	if err != nil {
+		return err
+	}
+	if tripInfo.Response.SHA256Sum != desc.Digest {
+		return fmt.Errorf("get manifest %s failed, got digest %s: %w", desc.Digest, tripInfo.Response.SHA256Sum, ErrDigestMismatch)
+	}
+	data := tripInfo.Response.Body
+
+	var tagged []string
+	for _, tag := range tags {
+		skip, overwrite, err := p.checkTag(ctx, repo, tag)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		if _, err := p.putManifest(ctx, repo, tag, desc, data); err != nil {
+			return err
+		}
+		p.pushed.add(repo, tag, desc, data)
+		p.logPushed(repo, tag, overwrite)
+		tagged = append(tagged, tag)
+	}
+	return p.verifyTags(ctx, repo, desc.Digest, tagged)
+}
+
+// verifyTags checks that every tag is listed in the repository and resolves to the digest.
+func (p Proxy) verifyTags(ctx context.Context, repo string, dgst digest.Digest, tags []string) error {
+	listed, err := p.ListTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool, len(listed))
+	for _, tag := range listed {
+		set[tag] = true
+	}
+
+	for _, tag := range tags {
+		if !set[tag] {
+			return fmt.Errorf("tag %s of %s is not listed: %w", tag, repo, ErrNotFound)
+		}
+		desc, err := p.HeadManifest(ctx, repo, tag)
+		if err != nil {
+			return err
+		}
+		if desc.Digest != dgst {
+			return fmt.Errorf("tag %s of %s resolves to %s instead of %s: %w", tag, repo, desc.Digest, dgst, ErrDigestMismatch)
+		}
+	}
+	p.Logger.Info().Msgf("Verified %d tags of %s resolve to %s", len(tags), repo, dgst)
+	return nil
+}
+
+// TagsResult describes the tags pushed to a repository by GenerateTags and listed back.
+type TagsResult struct {
+	// Pushed is the number of tags pushed.
+	Pushed int `json:"pushed"`
+
+	// Elapsed is the time taken to push the tags.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Listed is the number of tags listed in the repository once pushed.
+	Listed int `json:"listed"`
+
+	// ListElapsed is the time taken to list all the pages of tags.
+	ListElapsed time.Duration `json:"listElapsed"`
+}
+
+// Throughput returns the number of tags pushed per second.
+func (r TagsResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Pushed) / r.Elapsed.Seconds()
+}
+
+// GenerateTags pushes count tiny artifacts tagged tag-0 to tag-<count-1> to the repository,
+// concurrency of them at a time, then lists the tags of the repository and checks that all of
+// them are listed. The artifacts share their scratch config and layer, which are uploaded once,
+// and only differ by an annotation, so only manifests multiply.
+func (p Proxy) GenerateTags(ctx context.Context, repo string, count, concurrency int) (_ TagsResult, err error) {
+	ctx, span := p.startSpan(ctx, "generate.tags", repo)
+	defer func() { endSpan(span, err) }()
+	if count <= 0 {
+		return TagsResult{}, fmt.Errorf("invalid tag count %d", count)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	push := func(ctx context.Context, i int) error {
+		tag := fmt.Sprintf("tag-%d", i)
+		artifactType := p.artifactType()
+		_, err := p.pushManifest(ctx, repo, tag, manifestContent{
+			config:       p.emptyConfig(artifactType),
+			layers:       []ContentGenerator{scratchContent},
+			artifactType: artifactType,
+			annotations:  map[string]string{ociimagespec.AnnotationRefName: tag},
+			emptyConfig:  true,
+		})
+		return err
+	}
+
+	var result TagsResult
+	start := time.Now()
+	// the first artifact is pushed alone, so the shared blobs are uploaded once
+	if err := push(ctx, 0); err != nil {
+		return result, err
+	}
+	result.Pushed++
+
+	var pushed atomic.Int64
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i := 1; i < count && gctx.Err() == nil; i++ {
+		i := i
+		g.Go(func() error {
+			if err := push(gctx, i); err != nil {
+				return err
+			}
+			pushed.Add(1)
+			return nil
+		})
+	}
+	err = g.Wait()
+	result.Pushed += int(pushed.Load())
+	result.Elapsed = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err != nil {
+		return result, err
+	}
+	p.Logger.Info().Msgf("Pushed %d tags to %s in %v (%.1f tags/s)", result.Pushed, repo, result.Elapsed, result.Throughput())
+
+	start = time.Now()
+	listed, err := p.ListTags(ctx, repo)
+	if err != nil {
+		return result, err
+	}
+	result.ListElapsed = time.Since(start)
+	result.Listed = len(listed)
+
+	set := make(map[string]bool, len(listed))
+	for _, tag := range listed {
+		set[tag] = true
+	}
+	for i := 0; i < count; i++ {
+		if tag := fmt.Sprintf("tag-%d", i); !set[tag] {
+			return result, fmt.Errorf("tag %s of %s is not listed: %w", tag, repo, ErrNotFound)
+		}
+	}
+	p.Logger.Info().Msgf("Listed %d tags of %s in %v", result.Listed, repo, result.ListElapsed)
+	return result, nil
+}
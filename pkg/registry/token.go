@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// tokenClaims are the claims of a JWT access token describing its lifetime and scope.
+type tokenClaims struct {
+	ExpiresAt int64         `json:"exp"`
+	IssuedAt  int64         `json:"iat"`
+	Access    []tokenAccess `json:"access"`
+}
+
+// tokenAccess is an access claim, the actions granted on a resource.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// decodeTokenClaims decodes the claims of the payload of a JWT access token, and returns false if
+// the token is opaque. The signature is neither decoded nor verified.
+func decodeTokenClaims(token string) (tokenClaims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenClaims{}, false
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, false
+	}
+	return claims, true
+}
+
+// grants indicates if the claims grant every action of a scope, such as repository:name:pull,push.
+// A wildcard action grants every action.
+func (c tokenClaims) grants(scope string) bool {
+	typ, rest, _ := strings.Cut(scope, ":")
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return false
+	}
+	name, actions := rest[:i], strings.Split(rest[i+1:], ",")
+
+	granted := make(map[string]bool)
+	for _, a := range c.Access {
+		if a.Type == typ && a.Name == name {
+			for _, action := range a.Actions {
+				granted[action] = true
+			}
+		}
+	}
+	for _, action := range actions {
+		if !granted[action] && !granted["*"] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTokenClaims logs the lifetime and access claims of a JWT access token at trace level, and
+// warns if it is expired or does not grant the requested scopes. Opaque tokens are skipped.
+func (t transport) checkTokenClaims(token string, scopes []string) {
+	claims, ok := decodeTokenClaims(token)
+	if !ok {
+		t.logger.Trace().Msgf("token is not a JWT, skipping claims")
+		return
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	access := make([]string, len(claims.Access))
+	for i, a := range claims.Access {
+		access[i] = a.Type + ":" + a.Name + ":" + strings.Join(a.Actions, ",")
+	}
+	t.logger.Trace().Msgf("token issued at %v, expires at %v, access: %s",
+		time.Unix(claims.IssuedAt, 0).UTC(), expiresAt.UTC(), strings.Join(access, " "))
+
+	if claims.ExpiresAt != 0 && time.Now().After(expiresAt) {
+		t.logger.Warn().Msgf("token expired at %v", expiresAt.UTC())
+	}
+	if len(claims.Access) == 0 {
+		// not a distribution token, its scope is unknown
+		return
+	}
+	for _, scope := range scopes {
+		if !claims.grants(scope) {
+			t.logger.Warn().Msgf("token access claims do not grant the requested scope %s", scope)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// attributeRepository is the span attribute holding the repository of a generation.
+const attributeRepository = attribute.Key("registry.repository")
+
+// startSpan starts the span of a generation in the repository, to be ended by endSpan.
+// The span parents the spans of the requests made with the returned context.
+func (p Proxy) startSpan(ctx context.Context, name, repo string) (context.Context, trace.Span) {
+	if p.Tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return p.Tracer.Start(ctx, name, trace.WithAttributes(attributeRepository.String(repo)))
+}
+
+// endSpan records the error of the generation, if any, and ends its span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,16 +1,19 @@
 package registry
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 
 	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
-	"github.com/estebanreyl/image-gen-test/pkg/io"
 	"github.com/rs/zerolog"
 )
 
@@ -30,17 +33,46 @@ const (
 	claimRealm   = "realm"
 	claimService = "service"
 	claimScope   = "scope"
-)
+	claimError   = "error"
 
-var authHeaderRegex = regexp.MustCompile(`(realm|service|scope)="([^"]*)`)
+	// errorInsufficientScope is the challenge error of a token not covering the request.
+	errorInsufficientScope = "insufficient_scope"
+)
 
 // registryRequest describes content of a registry request.
 type registryRequest struct {
-	method      string
-	url         string
-	body        io.Reader
+	method string
+	url    string
+
+	// body is the content sent, it is sent again when the request is retried with a new token.
+	body        []byte
 	contentType string
 	accept      string
+	byteRange   *rhttp.ByteRange
+
+	// uploadRange is the range of the blob sent by a chunk upload request.
+	uploadRange *rhttp.ByteRange
+
+	// op describes the request in errors, such as "get manifest".
+	op string
+
+	// expected are the status codes the request succeeds with, the round trip fails with a
+	// StatusError on any other code. Any code is accepted if empty.
+	expected []int
+
+	// maxBodySize bounds the size of the response body, unbounded if not positive.
+	maxBodySize int64
+
+	// noRedirect returns redirects as is instead of following them.
+	noRedirect bool
+}
+
+// operation returns the description of the request in errors.
+func (r registryRequest) operation() string {
+	if r.op != "" {
+		return r.op
+	}
+	return fmt.Sprintf("%s %s", r.method, r.url)
 }
 
 // transport can be used to make HTTP requests with authentication.
@@ -51,6 +83,23 @@ type transport struct {
 	username string
 	password string
 	logger   zerolog.Logger
+
+	// dataEndpoint is the host redirects are expected to point to, any host is accepted if empty.
+	dataEndpoint string
+
+	// dataEndpointURL, if set, rewrites redirect locations to use the scheme of the data endpoint.
+	dataEndpointURL func(*url.URL) *url.URL
+
+	// refreshToken, if set, provides the refresh token exchanged for bearer tokens.
+	refreshToken func(context.Context) (string, error)
+
+	// scopes accumulates the scopes of the bearer challenges of every repository, so the token of
+	// a repository covers every request made to it.
+	scopes *scopeSet
+
+	// token caches the last bearer token of every repository, a token is refreshed when the
+	// registry rejects it.
+	token *tokenCache
 }
 
 // newTransport returns a new transport.
@@ -76,6 +125,8 @@ func newTransport(tripper rhttp.RoundTripper, username, password string, at auth
 	t.authType = at
 	t.logger = logger
 	t.tripper = tripper
+	t.scopes = &scopeSet{}
+	t.token = &tokenCache{}
 
 	return t, nil
 }
@@ -95,10 +146,40 @@ func newBearerAuthTransport(tripper rhttp.RoundTripper, username, password strin
 	return newTransport(tripper, username, password, bearerAuth, logger)
 }
 
+// newRefreshTokenTransport returns a new transport that uses bearer auth with tokens
+// obtained by exchanging a refresh token.
+func newRefreshTokenTransport(tripper rhttp.RoundTripper, refreshToken func(context.Context) (string, error), logger zerolog.Logger) (transport, error) {
+	if refreshToken == nil {
+		return transport{}, errors.New("refresh token required")
+	}
+	t, err := newNoAuthTransport(tripper, logger)
+	if err != nil {
+		return t, err
+	}
+	t.authType = bearerAuth
+	t.refreshToken = refreshToken
+	return t, nil
+}
+
 // roundTrip makes an HTTP request and returns the response body.
-// It supports basic and bearer authorization.
-func (t transport) roundTrip(regReq registryRequest) (tripInfo rhttp.RoundTripInfo, err error) {
-	req, err := http.NewRequest(regReq.method, regReq.url, regReq.body)
+// It supports basic and bearer authorization. Bearer tokens are cached per repository across
+// requests and refreshed once when the registry rejects them.
+// Redirects of GET and HEAD requests, such as blob downloads redirected to the data endpoint, are followed.
+// The final response is checked against the status codes the request expects, if any.
+func (t transport) roundTrip(ctx context.Context, regReq registryRequest) (tripInfo rhttp.RoundTripInfo, err error) {
+	defer func() {
+		if err == nil && len(regReq.expected) > 0 {
+			err = checkStatus(regReq.operation(), tripInfo, regReq.expected...)
+		}
+	}()
+	if regReq.maxBodySize > 0 {
+		ctx = rhttp.WithMaxBodySize(ctx, regReq.maxBodySize)
+	}
+	var body io.Reader
+	if regReq.body != nil {
+		body = bytes.NewReader(regReq.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, regReq.method, regReq.url, body)
 	if err != nil {
 		return tripInfo, err
 	}
@@ -108,34 +189,30 @@ func (t transport) roundTrip(regReq registryRequest) (tripInfo rhttp.RoundTripIn
 	if regReq.accept != "" {
 		req.Header.Set(rhttp.HeaderAccept, regReq.accept)
 	}
+	if regReq.byteRange != nil {
+		req.Header.Set(rhttp.HeaderRange, regReq.byteRange.String())
+	}
+	if regReq.uploadRange != nil {
+		// chunks are not sent with chunked encoding, the body length must match the range
+		req.ContentLength = regReq.uploadRange.Len()
+		req.Header.Set(rhttp.HeaderContentRange, regReq.uploadRange.UploadString())
+	}
 
+	repo := requestRepository(req.URL)
+	var token string
 	switch t.authType {
 	case bearerAuth:
-		tokenReq, err := http.NewRequest(regReq.method, regReq.url, nil)
-		if err != nil {
-			return tripInfo, err
-		}
-		tripInfo, err = t.tripper.RoundTrip(tokenReq)
-		if err != nil {
-			return tripInfo, err
-		}
-		if tripInfo.Response.Code != http.StatusUnauthorized {
-			return tripInfo, errors.New("failed to get challenge")
-		}
-		scheme, params := parseAuthHeader(tripInfo.Response.HeaderChallenge)
-		if scheme == schemeBearer {
-			token, err := t.getToken(params)
+		token = t.token.get(repo)
+		if token == "" {
+			tripInfo, token, err = t.authorize(ctx, repo, regReq.method, regReq.url)
 			if err != nil {
 				return tripInfo, err
 			}
-
-			req.Header.Set(rhttp.HeaderAuthorization, "Bearer "+token)
-		} else {
-			return tripInfo, errors.New("server does not support bearer authentication")
 		}
+		req.Header.Set(rhttp.HeaderAuthorization, "Bearer "+token)
 	case basicAuth:
 		if t.username == "" {
-			return tripInfo, errors.New("username not provided")
+			return tripInfo, fmt.Errorf("username not provided: %w", ErrUnauthorized)
 		}
 		req.SetBasicAuth(t.username, t.password)
 	}
@@ -145,16 +222,135 @@ func (t transport) roundTrip(regReq registryRequest) (tripInfo rhttp.RoundTripIn
 		return tripInfo, err
 	}
 
+	// The token expired or does not cover the request, refresh it once from the new challenge.
+	// Stricter registries answer 403 with the scope they require instead of 401.
+	refresh := tripInfo.Response.Code == http.StatusUnauthorized && tripInfo.Response.HeaderChallenge != ""
+	if scope := insufficientScope(tripInfo.Response); t.authType == bearerAuth && scope != "" {
+		t.logger.Trace().Msgf("%s %s requires the scope %s, requesting a new token", regReq.method, regReq.url, scope)
+		refresh = true
+	}
+	if t.authType == bearerAuth && refresh {
+		t.token.invalidate(repo, token)
+		token, err = t.tokenFromChallenge(ctx, repo, tripInfo.Response.HeaderChallenge)
+		if err != nil {
+			return tripInfo, err
+		}
+		req = req.Clone(ctx)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return tripInfo, err
+			}
+		}
+		req.Header.Set(rhttp.HeaderAuthorization, "Bearer "+token)
+		tripInfo, err = t.tripper.RoundTrip(req)
+		if err != nil {
+			return tripInfo, err
+		}
+	}
+
+	if !regReq.noRedirect && isRedirect(tripInfo.Response.Code) && (regReq.method == http.MethodGet || regReq.method == http.MethodHead) {
+		return t.followRedirect(ctx, regReq, tripInfo)
+	}
+
 	return tripInfo, nil
 }
 
+// followRedirect re-issues the request at the location the registry redirected to.
+// The Authorization header is not forwarded since the location is expected to be
+// pre-signed. If a data endpoint is configured, the location host must match it.
+func (t transport) followRedirect(ctx context.Context, regReq registryRequest, redirect rhttp.RoundTripInfo) (rhttp.RoundTripInfo, error) {
+	location := redirect.Response.HeaderLocation
+	if location == nil {
+		return redirect, fmt.Errorf("redirect %v without location", redirect.Response.Code)
+	}
+	if t.dataEndpoint != "" && location.Host != t.dataEndpoint && location.Hostname() != t.dataEndpoint {
+		return redirect, fmt.Errorf("redirected to %s, expected data endpoint %s", location.Hostname(), t.dataEndpoint)
+	}
+	if t.dataEndpointURL != nil {
+		location = t.dataEndpointURL(location)
+	}
+	t.logger.Debug().Msgf("following redirect to %s", location.Host)
+
+	req, err := http.NewRequestWithContext(ctx, regReq.method, location.String(), nil)
+	if err != nil {
+		return redirect, err
+	}
+	if regReq.accept != "" {
+		req.Header.Set(rhttp.HeaderAccept, regReq.accept)
+	}
+	if regReq.byteRange != nil {
+		req.Header.Set(rhttp.HeaderRange, regReq.byteRange.String())
+	}
+	return t.tripper.RoundTrip(req)
+}
+
+// isRedirect indicates if the status code is an HTTP redirect.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// authorize runs the bearer challenge flow for a request to the repository and returns the
+// challenge round trip along with the obtained token.
+func (t transport) authorize(ctx context.Context, repo, method, url string) (rhttp.RoundTripInfo, string, error) {
+	challengeReq, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return rhttp.RoundTripInfo{}, "", err
+	}
+	tripInfo, err := t.tripper.RoundTrip(challengeReq)
+	if err != nil {
+		return tripInfo, "", err
+	}
+	if tripInfo.Response.Code != http.StatusUnauthorized {
+		return tripInfo, "", fmt.Errorf("failed to get challenge, got: %v: %w", tripInfo.Response.Code, ErrChallengeFailed)
+	}
+	token, err := t.tokenFromChallenge(ctx, repo, tripInfo.Response.HeaderChallenge)
+	return tripInfo, token, err
+}
+
+// tokenFromChallenge obtains a bearer token for the repository answering the challenge and
+// caches it. The token covers the scopes of every challenge of the repository so far.
+func (t transport) tokenFromChallenge(ctx context.Context, repo, challenge string) (string, error) {
+	scheme, params := parseAuthHeader(challenge)
+	if scheme != schemeBearer {
+		return "", fmt.Errorf("server does not support bearer authentication: %w", ErrChallengeFailed)
+	}
+	scopes := t.scopes.add(repo, params[claimScope])
+	t.logger.Trace().Msgf("requesting a token from %s for the scopes %s", params[claimRealm], strings.Join(scopes, " "))
+	token, err := t.getToken(ctx, params, scopes)
+	if err != nil {
+		return "", err
+	}
+	t.token.set(repo, token)
+	return token, nil
+}
+
+// repositoryRoute matches the path of a request made to a repository, capturing the repository.
+var repositoryRoute = regexp.MustCompile(`^/v2/(.+?)/(?:manifests|blobs|tags|referrers)/`)
+
+// requestRepository returns the repository a request is made to, or an empty string for requests
+// made to no repository, such as catalog listings.
+func requestRepository(u *url.URL) string {
+	if match := repositoryRoute.FindStringSubmatch(u.Path); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
 // getToken attempts to get an auth token based on the given params.
 // The params specify:
 // - realm: the HTTP endpoint of the token server
 // - service: the service to obtain the token for, such as myregistry.azurecr.io
 // - scope: the authorization scope the token grants
-func (t transport) getToken(params map[string]string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, params[claimRealm], nil)
+func (t transport) getToken(ctx context.Context, params map[string]string, scopes []string) (string, error) {
+	if t.refreshToken != nil {
+		return t.exchangeRefreshToken(ctx, params, scopes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params[claimRealm], nil)
 	if err != nil {
 		return "", err
 	}
@@ -166,8 +362,8 @@ func (t transport) getToken(params map[string]string) (string, error) {
 	if service, ok := params[claimService]; ok {
 		query.Set(claimService, service)
 	}
-	if scope, ok := params[claimScope]; ok {
-		query.Set(claimScope, scope)
+	for _, scope := range scopes {
+		query.Add(claimScope, scope)
 	}
 	req.URL.RawQuery = query.Encode()
 
@@ -175,33 +371,214 @@ func (t transport) getToken(params map[string]string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if tripInfo.Response.Code != http.StatusOK {
-		return "", fmt.Errorf("get access token failed, expected: 200, got: %v", tripInfo.Response.Code)
+	if err := checkStatus("get access token", tripInfo, http.StatusOK); err != nil {
+		return "", err
 	}
 
-	var result struct {
-		AccessToken string `json:"access_token"`
-	}
+	var result tokenResponse
 	if err := json.Unmarshal(tripInfo.Response.Body, &result); err != nil {
 		return "", err
 	}
+	t.checkScopes(scopes, result.Scope)
+	t.checkTokenClaims(result.AccessToken, scopes)
 	return result.AccessToken, nil
 }
 
+// insufficientScope returns the scope a 403 response requires, if its bearer challenge reports
+// that the token has an insufficient scope.
+func insufficientScope(resp rhttp.Response) string {
+	if resp.Code != http.StatusForbidden || resp.HeaderChallenge == "" {
+		return ""
+	}
+	scheme, params := parseAuthHeader(resp.HeaderChallenge)
+	if scheme != schemeBearer || params[claimError] != errorInsufficientScope {
+		return ""
+	}
+	return params[claimScope]
+}
+
 // parseAuthHeader parses the Www-Authenticate header and retrieves auth metadata
-// that can be used to obtain auth tokens.
+// that can be used to obtain auth tokens. Every comma separated key=value parameter is
+// returned with a lower case key, values are either tokens or quoted strings in which
+// backslash escapes the next character.
 func parseAuthHeader(header string) (string, map[string]string) {
-	parts := strings.SplitN(header, " ", 2)
-	scheme := strings.ToLower(parts[0])
-	if len(parts) < 2 {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	scheme = strings.ToLower(scheme)
+	if strings.TrimSpace(rest) == "" {
 		return scheme, nil
 	}
 
 	params := make(map[string]string)
-	result := authHeaderRegex.FindAllStringSubmatch(parts[1], -1)
-	for _, match := range result {
-		params[strings.ToLower(match[1])] = match[2]
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		value, rest = parseAuthParamValue(strings.TrimLeft(value, " \t"))
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			params[key] = value
+		}
 	}
 
 	return scheme, params
 }
+
+// parseAuthParamValue parses the auth parameter value at the start of s and returns it
+// along with the remainder of s.
+func parseAuthParamValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		value, rest, _ := strings.Cut(s, ",")
+		return strings.TrimSpace(value), rest
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+			}
+		case '"':
+			return value.String(), s[i+1:]
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	// unterminated quoted string
+	return value.String(), ""
+}
+
+// exchangeRefreshToken obtains an access token by posting a refresh token to the realm.
+func (t transport) exchangeRefreshToken(ctx context.Context, params map[string]string, scopes []string) (string, error) {
+	refreshToken, err := t.refreshToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	if service, ok := params[claimService]; ok {
+		form.Set(claimService, service)
+	}
+	for _, scope := range scopes {
+		form.Add(claimScope, scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, params[claimRealm], strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(rhttp.HeaderContentType, "application/x-www-form-urlencoded")
+
+	tripInfo, err := t.tripper.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	if err := checkStatus("exchange refresh token", tripInfo, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	var result tokenResponse
+	if err := json.Unmarshal(tripInfo.Response.Body, &result); err != nil {
+		return "", err
+	}
+	t.checkScopes(scopes, result.Scope)
+	t.checkTokenClaims(result.AccessToken, scopes)
+	return result.AccessToken, nil
+}
+
+// tokenResponse is the response of a token request.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+
+	// Scope lists the granted scopes separated by spaces, if the registry reports them.
+	Scope string `json:"scope"`
+}
+
+// checkScopes warns about requested scopes missing from the granted scopes.
+// Nothing is checked if the registry did not report the granted scopes.
+func (t transport) checkScopes(requested []string, granted string) {
+	if granted == "" {
+		return
+	}
+	grantedScopes := strings.Fields(granted)
+	for _, scope := range requested {
+		found := false
+		for _, g := range grantedScopes {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.logger.Warn().Msgf("token does not cover the requested scope %s, granted: %s", scope, granted)
+		}
+	}
+}
+
+// scopeSet holds the ordered set of token scopes of every repository, so the scopes of a token
+// are bounded by the requests made to its repository. It is safe for concurrent use.
+type scopeSet struct {
+	mu     sync.Mutex
+	scopes map[string][]string
+	seen   map[string]map[string]struct{}
+}
+
+// add adds the space separated scopes to the set of the repository, and returns the scopes of
+// the repository in the order they were added.
+func (s *scopeSet) add(repo, scopes string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.scopes = map[string][]string{}
+		s.seen = map[string]map[string]struct{}{}
+	}
+	seen := s.seen[repo]
+	if seen == nil {
+		seen = map[string]struct{}{}
+		s.seen[repo] = seen
+	}
+	for _, scope := range strings.Fields(scopes) {
+		if _, ok := seen[scope]; !ok {
+			seen[scope] = struct{}{}
+			s.scopes[repo] = append(s.scopes[repo], scope)
+		}
+	}
+	return append([]string(nil), s.scopes[repo]...)
+}
+
+// tokenCache holds the bearer token of every repository. It is safe for concurrent use.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// get returns the cached token of the repository, or an empty string if none is cached.
+func (c *tokenCache) get(repo string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[repo]
+}
+
+// set caches the token of the repository.
+func (c *tokenCache) set(repo, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[repo] = token
+}
+
+// invalidate drops the token of the repository if it is still cached, keeping any token
+// refreshed since.
+func (c *tokenCache) invalidate(repo, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens[repo] == token {
+		delete(c.tokens, repo)
+	}
+}
@@ -0,0 +1,523 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+func TestParseAuthHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantScheme string
+		wantParams map[string]string
+	}{
+		{
+			name:       "bearer challenge",
+			header:     `Bearer realm="https://example.azurecr.io/oauth2/token",service="example.azurecr.io"`,
+			wantScheme: "bearer",
+			wantParams: map[string]string{"realm": "https://example.azurecr.io/oauth2/token", "service": "example.azurecr.io"},
+		},
+		{
+			name:       "insufficient scope",
+			header:     `Bearer realm="https://auth.example.com/token",service="registry",scope="repository:foo:pull,push",error="insufficient_scope"`,
+			wantScheme: "bearer",
+			wantParams: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry",
+				"scope":   "repository:foo:pull,push",
+				"error":   "insufficient_scope",
+			},
+		},
+		{
+			name:       "space separated scopes",
+			header:     `Bearer realm="https://auth.example.com/token",scope="repository:foo:pull repository:bar:pull,push"`,
+			wantScheme: "bearer",
+			wantParams: map[string]string{
+				"realm": "https://auth.example.com/token",
+				"scope": "repository:foo:pull repository:bar:pull,push",
+			},
+		},
+		{
+			name:       "escaped quotes",
+			header:     `Bearer realm="https://auth.example.com/token",error_description="scope \"repository:foo:push\" denied, see \\docs"`,
+			wantScheme: "bearer",
+			wantParams: map[string]string{
+				"realm":             "https://auth.example.com/token",
+				"error_description": `scope "repository:foo:push" denied, see \docs`,
+			},
+		},
+		{
+			name:       "surrounding whitespace",
+			header:     "  Bearer   realm = \"https://auth.example.com/token\" ,\tService=registry , scope=\"repository:foo:pull\"  ",
+			wantScheme: "bearer",
+			wantParams: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry",
+				"scope":   "repository:foo:pull",
+			},
+		},
+		{
+			name:       "unquoted values",
+			header:     `Basic realm=registry, charset=UTF-8`,
+			wantScheme: "basic",
+			wantParams: map[string]string{"realm": "registry", "charset": "UTF-8"},
+		},
+		{
+			name:       "no params",
+			header:     "Basic",
+			wantScheme: "basic",
+		},
+		{
+			name:       "unterminated quoted value",
+			header:     `Bearer realm="https://auth.example.com/token`,
+			wantScheme: "bearer",
+			wantParams: map[string]string{"realm": "https://auth.example.com/token"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, params := parseAuthHeader(tt.header)
+			if scheme != tt.wantScheme {
+				t.Errorf("scheme = %q, want %q", scheme, tt.wantScheme)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params = %q, want %q", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+const (
+	replayManifestURL = "https://registry.example.io/v2/repo/manifests/v1"
+	replayOtherURL    = "https://registry.example.io/v2/other/manifests/v1"
+	replayRealm       = "https://registry.example.io/oauth2/token"
+)
+
+// replayTrip returns a recorded round trip answering the request with the status, the challenge
+// if any, and the body.
+func replayTrip(t *testing.T, method, rawURL string, code int, challenge, body string) rhttp.RoundTripInfo {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rhttp.RoundTripInfo{
+		Request: rhttp.Request{Method: method, URL: u},
+		Response: rhttp.Response{
+			Code:            code,
+			HeaderChallenge: challenge,
+			Body:            json.RawMessage(body),
+		},
+	}
+}
+
+// replayChallenge returns the bearer challenge of the registry for the scopes.
+func replayChallenge(scope, errorCode string) string {
+	challenge := fmt.Sprintf(`Bearer realm=%q,service="registry.example.io",scope=%q`, replayRealm, scope)
+	if errorCode != "" {
+		challenge += fmt.Sprintf(`,error=%q`, errorCode)
+	}
+	return challenge
+}
+
+// replayTokenURL returns the URL of the token request for the scopes.
+func replayTokenURL(scopes ...string) string {
+	return replayRealm + "?" + url.Values{"scope": scopes, "service": {"registry.example.io"}}.Encode()
+}
+
+// authCapture records the Authorization header of every request sent through it.
+type authCapture struct {
+	base rhttp.RoundTripper
+	sent []string
+}
+
+func (c *authCapture) RoundTrip(req *http.Request) (rhttp.RoundTripInfo, error) {
+	c.sent = append(c.sent, req.Header.Get(rhttp.HeaderAuthorization))
+	return c.base.RoundTrip(req)
+}
+
+func TestTransportBearerReplay(t *testing.T) {
+	pull := "repository:repo:pull"
+	push := "repository:repo:pull,push"
+	other := "repository:other:pull"
+	tests := []struct {
+		name     string
+		trips    func(t *testing.T) []rhttp.RoundTripInfo
+		requests []registryRequest
+		wantErr  error
+		wantCode int
+
+		// wantAuth is the Authorization header of the last request sent.
+		wantAuth string
+	}{
+		{
+			name: "challenge then token",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}},
+			wantCode: http.StatusOK,
+			wantAuth: "Bearer token-1",
+		},
+		{
+			name: "cached token reused",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}, {method: http.MethodGet, url: replayManifestURL}},
+			wantCode: http.StatusOK,
+			wantAuth: "Bearer token-1",
+		},
+		{
+			name: "push with body",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodPut, replayManifestURL, http.StatusUnauthorized, replayChallenge(push, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(push), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodPut, replayManifestURL, http.StatusCreated, "", ""),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodPut, url: replayManifestURL, body: []byte(`{}`), expected: []int{http.StatusCreated}}},
+			wantCode: http.StatusCreated,
+			wantAuth: "Bearer token-1",
+		},
+		{
+			name: "expired token refreshed",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, "invalid_token"), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-2"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}, {method: http.MethodGet, url: replayManifestURL}},
+			wantCode: http.StatusOK,
+			wantAuth: "Bearer token-2",
+		},
+		{
+			name: "insufficient scope",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusForbidden, replayChallenge(other, "insufficient_scope"), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull, other), http.StatusOK, "", `{"access_token":"token-2"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}},
+			wantCode: http.StatusOK,
+			wantAuth: "Bearer token-2",
+		},
+		{
+			name: "token per repository",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusOK, "", `{"access_token":"token-1"}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+					replayTrip(t, http.MethodGet, replayOtherURL, http.StatusUnauthorized, replayChallenge(other, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(other), http.StatusOK, "", `{"access_token":"token-2"}`),
+					replayTrip(t, http.MethodGet, replayOtherURL, http.StatusOK, "", `{}`),
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{
+				{method: http.MethodGet, url: replayManifestURL},
+				{method: http.MethodGet, url: replayOtherURL},
+				{method: http.MethodGet, url: replayManifestURL},
+			},
+			wantCode: http.StatusOK,
+			wantAuth: "Bearer token-1",
+		},
+		{
+			name: "token request rejected",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, replayChallenge(pull, ""), ""),
+					replayTrip(t, http.MethodGet, replayTokenURL(pull), http.StatusUnauthorized, "", `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}},
+			wantErr:  ErrUnauthorized,
+		},
+		{
+			name: "no challenge",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusOK, "", `{}`),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}},
+			wantErr:  ErrChallengeFailed,
+		},
+		{
+			name: "basic challenge",
+			trips: func(t *testing.T) []rhttp.RoundTripInfo {
+				return []rhttp.RoundTripInfo{
+					replayTrip(t, http.MethodGet, replayManifestURL, http.StatusUnauthorized, `Basic realm="registry.example.io"`, ""),
+				}
+			},
+			requests: []registryRequest{{method: http.MethodGet, url: replayManifestURL}},
+			wantErr:  ErrChallengeFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the trips go through a recording file, as a recording of a live registry would
+			recorder := &rhttp.Recorder{}
+			for _, trip := range tt.trips(t) {
+				recorder.Record(trip)
+			}
+			path := filepath.Join(t.TempDir(), "recording.json")
+			if err := recorder.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			trips, err := rhttp.LoadRecording(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replay := rhttp.NewReplayRoundTripper(trips)
+			capture := &authCapture{base: replay}
+			tr, err := newBearerAuthTransport(capture, "user", "password", zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tripInfo rhttp.RoundTripInfo
+			for _, req := range tt.requests {
+				if tripInfo, err = tr.roundTrip(context.Background(), req); err != nil {
+					break
+				}
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if tripInfo.Response.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", tripInfo.Response.Code, tt.wantCode)
+			}
+			if n := replay.Remaining(); n != 0 {
+				t.Errorf("%d recorded trips not replayed", n)
+			}
+			if tt.wantAuth != "" {
+				if last := capture.sent[len(capture.sent)-1]; last != tt.wantAuth {
+					t.Errorf("last Authorization = %q, want %q", last, tt.wantAuth)
+				}
+			}
+			// token requests carry the credentials, registry requests the token
+			for i, auth := range capture.sent {
+				if strings.HasPrefix(trips[i].URL.String(), replayRealm) != strings.HasPrefix(auth, "Basic ") {
+					t.Errorf("request %d to %s sent Authorization %q", i, trips[i].URL, auth)
+				}
+			}
+		})
+	}
+}
+
+// expiringTokens makes a memRegistry require bearer tokens issued by its /token endpoint, every
+// token expiring once it authorized a number of requests.
+type expiringTokens struct {
+	mu      sync.Mutex
+	realm   string
+	uses    int
+	current string
+	issued  int
+
+	// expireAfter is the number of requests a token authorizes, none if not positive.
+	expireAfter int
+}
+
+// requireTokens installs bearer authentication with tokens expiring after the number of requests.
+func requireTokens(m *memRegistry, server *httptest.Server, expireAfter int) *expiringTokens {
+	tokens := &expiringTokens{realm: server.URL + "/token", expireAfter: expireAfter}
+	m.hook = tokens.serve
+	return tokens
+}
+
+// serve issues tokens and rejects requests without a valid token, serving them instead.
+func (e *expiringTokens) serve(w http.ResponseWriter, r *http.Request) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r.URL.Path == "/token" {
+		e.issued++
+		e.current = fmt.Sprintf("token-%d", e.issued)
+		e.uses = 0
+		json.NewEncoder(w).Encode(map[string]string{"access_token": e.current})
+		return true
+	}
+	if e.current != "" && r.Header.Get("Authorization") == "Bearer "+e.current && e.uses < e.expireAfter {
+		e.uses++
+		return false
+	}
+	w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="memregistry",scope="repository:auth:pull,push"`, e.realm))
+	memError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return true
+}
+
+// tokensIssued returns the number of tokens issued.
+func (e *expiringTokens) tokensIssued() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.issued
+}
+
+func TestTokenExpiresMidRun(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	desc := ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	tests := []struct {
+		name        string
+		expireAfter int
+		wantErr     bool
+		push        func(ctx context.Context, p *Proxy) error
+
+		// wantManifests are the tags expected to hold the manifest.
+		wantManifests []string
+	}{
+		{
+			name:          "transport manifest puts",
+			expireAfter:   1,
+			wantManifests: []string{"v1", "v2", "v3"},
+			push: func(ctx context.Context, p *Proxy) error {
+				for _, tag := range []string{"v1", "v2", "v3"} {
+					if _, err := p.putManifest(ctx, "auth", tag, desc, manifest); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:        "pusher artifact push",
+			expireAfter: 2,
+			push: func(ctx context.Context, p *Proxy) error {
+				_, err := p.pushOCIArtifact(ctx, nil, "auth", "artifact", ArtifactConstructOptions{LayerCount: 3})
+				return err
+			},
+		},
+		{
+			name:    "transport token always rejected",
+			wantErr: true,
+			push: func(ctx context.Context, p *Proxy) error {
+				_, err := p.putManifest(ctx, "auth", "v1", desc, manifest)
+				return err
+			},
+		},
+		{
+			name:    "pusher token always rejected",
+			wantErr: true,
+			push: func(ctx context.Context, p *Proxy) error {
+				_, err := p.pushOCIArtifact(ctx, nil, "auth", "artifact", ArtifactConstructOptions{LayerCount: 3})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			tokens := requireTokens(m, server, tt.expireAfter)
+			p := newTestProxy(t, server, Options{Username: "user", Password: "password"})
+
+			err := tt.push(context.Background(), p)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("push succeeded with every token rejected")
+				}
+				// every request is retried once with a new token, the push does not loop
+				if issued := tokens.tokensIssued(); issued > 10 {
+					t.Errorf("tokens issued = %d, want the push to give up", issued)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issued := tokens.tokensIssued(); issued < 2 {
+				t.Errorf("tokens issued = %d, want the expired token refreshed", issued)
+			}
+			for _, tag := range tt.wantManifests {
+				if stored, ok := m.manifest("auth", tag); !ok || string(stored.Data) != string(manifest) {
+					t.Errorf("auth:%s = %s, want the body sent again with the new token", tag, stored.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestScopeSet(t *testing.T) {
+	var s scopeSet
+	steps := []struct {
+		repo   string
+		scopes string
+		want   []string
+	}{
+		{repo: "a", scopes: "repository:a:pull", want: []string{"repository:a:pull"}},
+		{repo: "a", scopes: "repository:a:pull repository:a:push", want: []string{"repository:a:pull", "repository:a:push"}},
+		{repo: "b", scopes: "repository:b:pull repository:a:pull", want: []string{"repository:b:pull", "repository:a:pull"}},
+		{repo: "a", scopes: "  repository:a:push  ", want: []string{"repository:a:pull", "repository:a:push"}},
+		{repo: "", scopes: "registry:catalog:*", want: []string{"registry:catalog:*"}},
+	}
+	for i, step := range steps {
+		if got := s.add(step.repo, step.scopes); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d: add(%q, %q) = %v, want %v", i, step.repo, step.scopes, got, step.want)
+		}
+	}
+}
+
+func TestRequestRepository(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://registry.example.io/v2/repo/manifests/v1", want: "repo"},
+		{url: "https://registry.example.io/v2/team/app/blobs/uploads/", want: "team/app"},
+		{url: "https://registry.example.io/v2/team/app/blobs/sha256:abc", want: "team/app"},
+		{url: "https://registry.example.io/v2/repo/tags/list", want: "repo"},
+		{url: "https://registry.example.io/v2/repo/referrers/sha256:abc", want: "repo"},
+		{url: "https://registry.example.io/v2/_catalog", want: ""},
+		{url: "https://registry.example.io/v2/", want: ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requestRepository(u); got != tt.want {
+			t.Errorf("requestRepository(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
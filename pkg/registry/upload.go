@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Upload routes
+const (
+	routeBlobUploads = "/v2/%s/blobs/uploads/" // add repo name
+)
+
+// attributeResumeSkipped is the span attribute holding the number of bytes of a chunked upload
+// not sent again thanks to resumption.
+const attributeResumeSkipped = attribute.Key("upload.resume.skipped_bytes")
+
+// uploadChunked uploads a blob in chunks of the given size: an upload session is started with
+// a POST, every chunk is sent with a PATCH to the location returned by the previous request and
+// the upload is committed with a PUT of the digest.
+// A failed chunk is resumed up to the number of retries of the retry policy: the session is
+// queried for the bytes the registry received and the upload continues from there.
+func (p Proxy) uploadChunked(ctx context.Context, repo string, desc ociimagespec.Descriptor, data []byte, chunkSize int64) (err error) {
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	ctx, span := p.startSpan(ctx, "upload.chunked", repo)
+	defer func() { endSpan(span, err) }()
+
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodPost,
+		url:      p.url(routeBlobUploads, repo),
+		op:       fmt.Sprintf("start upload of %s", desc.Digest),
+		expected: []int{http.StatusAccepted},
+	})
+	if err != nil {
+		return err
+	}
+	location, err := uploadLocation(tripInfo)
+	if err != nil {
+		return err
+	}
+
+	var resumes int
+	var skipped int64
+	for start := int64(0); start < desc.Size; {
+		end := start + chunkSize - 1
+		if end >= desc.Size {
+			end = desc.Size - 1
+		}
+		tripInfo, err = p.transport.roundTrip(ctx, registryRequest{
+			method:      http.MethodPatch,
+			url:         location.String(),
+			body:        data[start : end+1],
+			contentType: "application/octet-stream",
+			uploadRange: &rhttp.ByteRange{Start: start, End: end},
+			op:          fmt.Sprintf("upload %s range %d-%d", desc.Digest, start, end),
+			expected:    []int{http.StatusAccepted},
+		})
+		if err == nil {
+			if location, err = uploadLocation(tripInfo); err != nil {
+				return err
+			}
+			start = end + 1
+			continue
+		}
+		if ctx.Err() != nil || resumes >= p.Retry.MaxRetries {
+			return err
+		}
+
+		delay := p.Retry.Delay(resumes)
+		resumes++
+		p.Logger.Warn().Msgf("Upload of %s range %d-%d failed: %v, resuming in %v", desc.Digest, start, end, err, delay)
+		if err := rhttp.Sleep(ctx, delay); err != nil {
+			return err
+		}
+		var offset int64
+		if location, offset, err = p.uploadStatus(ctx, location); err != nil {
+			return err
+		}
+		if offset > end+1 {
+			return fmt.Errorf("upload of %s resumed at offset %d past the %d bytes sent", desc.Digest, offset, end+1)
+		}
+		skipped += offset
+		span.SetAttributes(attributeResumeSkipped.Int64(skipped))
+		p.Logger.Info().Msgf("Resuming upload of %s at offset %d, %d bytes skipped by resumption", desc.Digest, offset, skipped)
+		start = offset
+	}
+
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+	tripInfo, err = p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodPut,
+		url:      location.String(),
+		op:       fmt.Sprintf("commit upload of %s", desc.Digest),
+		expected: []int{http.StatusCreated},
+	})
+	if err != nil {
+		return err
+	}
+	if got := tripInfo.Response.HeaderContentDigest; got != "" && got != desc.Digest.String() {
+		return fmt.Errorf("push %s failed, registry returned digest %s: %w", desc.Digest, got, ErrDigestMismatch)
+	}
+	return nil
+}
+
+// uploadStatus queries an upload session for the number of bytes the registry received.
+// It returns the location to continue the upload at, the given one if the registry returned none.
+func (p Proxy) uploadStatus(ctx context.Context, location *url.URL) (*url.URL, int64, error) {
+	tripInfo, err := p.transport.roundTrip(ctx, registryRequest{
+		method:   http.MethodGet,
+		url:      location.String(),
+		op:       "get upload status",
+		expected: []int{http.StatusNoContent},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	var offset int64
+	if tripInfo.Response.HeaderRange != "" {
+		if offset, err = rhttp.ParseUploadRange(tripInfo.Response.HeaderRange); err != nil {
+			return nil, 0, err
+		}
+	}
+	if tripInfo.Response.HeaderLocation != nil {
+		location, _ = uploadLocation(tripInfo)
+	}
+	return location, offset, nil
+}
+
+// uploadLocation returns a copy of the upload location returned by an upload request.
+func uploadLocation(tripInfo rhttp.RoundTripInfo) (*url.URL, error) {
+	if tripInfo.Response.HeaderLocation == nil {
+		return nil, fmt.Errorf("upload response %v without location", tripInfo.Response.Code)
+	}
+	location := *tripInfo.Response.HeaderLocation
+	return &location, nil
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	rhttp "github.com/estebanreyl/image-gen-test/pkg/http"
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUploadChunkedResume(t *testing.T) {
+	const chunkSize = 100
+	data := bytes.Repeat([]byte("0123456789"), 30)
+	desc := ociimagespec.Descriptor{
+		MediaType: ociimagespec.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	tests := []struct {
+		name      string
+		failPatch int32 // the PATCH failing, counted from one
+		received  int   // the bytes of the failing chunk the registry keeps
+		wantPatch int
+	}{
+		// the session is empty when the first chunk fails and is reported as 0-0
+		{name: "first chunk fails", failPatch: 1, wantPatch: 4},
+		{name: "first chunk partly received", failPatch: 1, received: 40, wantPatch: 4},
+		{name: "mid-upload chunk fails", failPatch: 2, wantPatch: 4},
+		{name: "mid-upload chunk partly received", failPatch: 2, received: 60, wantPatch: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const repo = "resumed"
+			m, server := newMemRegistry(t)
+			var patches atomic.Int32
+			m.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				match := memRouteUploads.FindStringSubmatch(r.URL.Path)
+				if r.Method != http.MethodPatch || match == nil || patches.Add(1) != tt.failPatch {
+					return false
+				}
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				m.mu.Lock()
+				m.uploads[match[2]] = append(m.uploads[match[2]], body[:tt.received]...)
+				m.mu.Unlock()
+				memError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "blob upload invalid")
+				return true
+			}
+			p := newTestProxy(t, server, Options{Retry: rhttp.RetryPolicy{MaxRetries: 1}})
+
+			if err := p.uploadChunked(context.Background(), repo, desc, data, chunkSize); err != nil {
+				t.Fatalf("uploadChunked() error = %v", err)
+			}
+			if got, ok := m.blob(repo, desc.Digest); !ok || !bytes.Equal(got, data) {
+				t.Errorf("blob %s not stored with the uploaded content", desc.Digest)
+			}
+			if got := m.count(http.MethodPatch, "/blobs/uploads/"); got != tt.wantPatch {
+				t.Errorf("PATCH requests = %d, want %d", got, tt.wantPatch)
+			}
+		})
+	}
+}
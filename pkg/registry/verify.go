@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"fmt"
+	stdio "io"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readVerified reads the content fully and checks that its size and SHA-256 digest match the
+// descriptor, so content not matching its descriptor fails locally before anything is pushed.
+// The digest is not checked if empty or of another algorithm.
+func readVerified(r stdio.Reader, desc ociimagespec.Descriptor) ([]byte, error) {
+	data, err := stdio.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyContent(data, desc); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// verifyContent checks that the size and SHA-256 digest of the content match the descriptor,
+// without copying it. The digest is not checked if empty or of another algorithm.
+func verifyContent(data []byte, desc ociimagespec.Descriptor) error {
+	if int64(len(data)) != desc.Size {
+		return fmt.Errorf("content of %s is %d bytes, descriptor size is %d: %w", desc.Digest, len(data), desc.Size, ErrSizeMismatch)
+	}
+	if desc.Digest != "" && desc.Digest.Algorithm() == digest.SHA256 {
+		if got := digest.FromBytes(data); got != desc.Digest {
+			return fmt.Errorf("content digest is %s, descriptor digest is %s: %w", got, desc.Digest, ErrDigestMismatch)
+		}
+	}
+	return nil
+}
+
+// verifyEmptyDescriptor checks that a descriptor claiming to describe the empty "{}" content,
+// such as the config of an artifact without one, matches the canonical empty descriptor: its
+// digest and size must be those of the data it embeds, if any, and of the empty descriptor.
+// It catches descriptors whose data was changed without recomputing their digest and size.
+func verifyEmptyDescriptor(desc ociimagespec.Descriptor) error {
+	if desc.Data != nil {
+		if got := desc.Digest.Algorithm().FromBytes(desc.Data); got != desc.Digest {
+			return fmt.Errorf("empty descriptor %s embeds data of digest %s: %w", desc.Digest, got, ErrDigestMismatch)
+		}
+		if int64(len(desc.Data)) != desc.Size {
+			return fmt.Errorf("empty descriptor %s embeds %d bytes, its size is %d: %w", desc.Digest, len(desc.Data), desc.Size, ErrSizeMismatch)
+		}
+	}
+	empty := ociimagespec.ScratchDescriptor
+	if desc.Digest != empty.Digest {
+		return fmt.Errorf("empty descriptor of media type %s has digest %s instead of %s: %w", desc.MediaType, desc.Digest, empty.Digest, ErrDigestMismatch)
+	}
+	if desc.Size != empty.Size {
+		return fmt.Errorf("empty descriptor of media type %s has size %d instead of %d: %w", desc.MediaType, desc.Size, empty.Size, ErrSizeMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ociimagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReadVerified(t *testing.T) {
+	data := []byte("content verified before it is pushed")
+	tests := []struct {
+		name    string
+		desc    ociimagespec.Descriptor
+		wantErr error
+	}{
+		{
+			name: "matching",
+			desc: ociimagespec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))},
+		},
+		{
+			name:    "size too small",
+			desc:    ociimagespec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data)) - 1},
+			wantErr: ErrSizeMismatch,
+		},
+		{
+			name:    "size too large",
+			desc:    ociimagespec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data)) + 1},
+			wantErr: ErrSizeMismatch,
+		},
+		{
+			name:    "wrong digest",
+			desc:    ociimagespec.Descriptor{Digest: digest.FromString("other content"), Size: int64(len(data))},
+			wantErr: ErrDigestMismatch,
+		},
+		{
+			name: "no digest",
+			desc: ociimagespec.Descriptor{Size: int64(len(data))},
+		},
+		{
+			name: "digest of another algorithm",
+			desc: ociimagespec.Descriptor{Digest: digest.SHA512.FromString("other content"), Size: int64(len(data))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readVerified(bytes.NewReader(data), tt.desc)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("readVerified() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Errorf("readVerified() = %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+func TestUploadBytesVerifiesContent(t *testing.T) {
+	data := []byte("content pushed with a deliberately wrong size")
+	tests := []struct {
+		name    string
+		desc    ociimagespec.Descriptor
+		wantErr error
+	}{
+		{
+			name:    "wrong size",
+			desc:    ociimagespec.Descriptor{MediaType: ociimagespec.MediaTypeImageLayer, Digest: digest.FromBytes(data), Size: 3},
+			wantErr: ErrSizeMismatch,
+		},
+		{
+			name:    "wrong digest",
+			desc:    ociimagespec.Descriptor{MediaType: ociimagespec.MediaTypeImageLayer, Digest: digest.FromString("other content"), Size: int64(len(data))},
+			wantErr: ErrDigestMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, server := newMemRegistry(t)
+			p := newTestProxy(t, server, Options{})
+
+			ctx := context.Background()
+			pusher, err := p.pusher(ctx, "verified", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.uploadBytes(ctx, pusher, "verified", "", tt.desc, data); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("uploadBytes() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := m.count(http.MethodPost, "/blobs/uploads/") + m.count(http.MethodPut, "/blobs/uploads/"); got != 0 {
+				t.Errorf("%d upload requests sent, want none", got)
+			}
+		})
+	}
+}